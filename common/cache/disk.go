@@ -0,0 +1,324 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache is the disk tier. Each entry is two files named for the hash of its key: the image itself, as a plain PNG;
+// and a small JSON file holding the rest of the entry. A file's modification time is updated whenever it is read, so
+// that the oldest files are also the least recently used.
+//
+// The entries, their sizes, and the order they were last used in are read from the directory once, on first use, and
+// then kept up to date in memory; so the directory is only written to by this mapbot while it runs.
+type diskCache struct {
+	dir    string
+	max    int64
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // nil until read from the directory
+	order   *list.List               // most recently used first
+	size    int64
+	hits    uint64
+	misses  uint64
+}
+
+func newDisk(dir string, max int64, maxAge time.Duration) *diskCache {
+	return &diskCache{dir: dir, max: max, maxAge: maxAge, order: list.New()}
+}
+
+type diskMeta struct {
+	Version int     `json:"version"`
+	Scale   float64 `json:"scale"`
+}
+
+// cacheFileRe matches the names of files the cache owns; with no extension, they are from the old, single-file format.
+var cacheFileRe = regexp.MustCompile(`^([0-9a-f]{64})(\.png|\.json)?$`)
+
+// Get reads an entry. The lock is only held to look the entry up, not while it's read and decoded.
+func (d *diskCache) Get(key string) (*CacheEntry, bool) {
+	dir, key := d.dir, hash(key)
+
+	d.mu.Lock()
+	e, ok := d.index()[key]
+	if !ok {
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+	d.order.MoveToFront(e)
+	d.mu.Unlock()
+
+	ret, err := d.read(dir, key)
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("reading cached file %s: %s", key, err)
+		}
+		d.mu.Lock()
+		// Whatever's left of it is of no use.
+		if d.entries[key] == e {
+			d.remove(e)
+		}
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	d.hits++
+	e.Value.(*diskEntry).mtime = now
+	d.mu.Unlock()
+
+	for _, ext := range []string{".png", ".json"} {
+		os.Chtimes(filepath.Join(dir, key+ext), now, now)
+	}
+	return ret, true
+}
+
+func (d *diskCache) read(dir, key string) (*CacheEntry, error) {
+	metaData, err := os.ReadFile(filepath.Join(dir, key+".json"))
+	if err != nil {
+		return nil, err
+	}
+	meta := diskMeta{}
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %s", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, key+".png"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decoding png: %s", err)
+	}
+
+	if meta.Scale <= 0 {
+		meta.Scale = 1
+	}
+	return &CacheEntry{Version: meta.Version, Image: img, Scale: meta.Scale}, nil
+}
+
+// Put writes the entry to disk, without holding the lock; and then, if the cache has grown larger than its maximum
+// size or its least recently used entry is older than its maximum age, prunes it. The new entry itself is always kept.
+func (d *diskCache) Put(key string, entry *CacheEntry) {
+	dir, key := d.dir, hash(key)
+
+	size, err := d.write(dir, key, entry)
+	if err != nil {
+		log.Errorf("writing cached file %s: %s", key, err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	index := d.index()
+	if e, ok := index[key]; ok {
+		d.remove(e)
+	}
+	index[key] = d.order.PushFront(&diskEntry{
+		key:   key,
+		files: []string{filepath.Join(dir, key+".png"), filepath.Join(dir, key+".json")},
+		size:  size,
+		mtime: time.Now(),
+	})
+	d.size += size
+
+	if err := d.prune(key); err != nil {
+		log.Errorf("pruning cache: %s", err)
+	}
+}
+
+// write writes the entry's files, returning their total size.
+func (d *diskCache) write(dir, key string, entry *CacheEntry) (int64, error) {
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return 0, err
+	}
+
+	meta, err := json.Marshal(diskMeta{Version: entry.Version, Scale: entry.Scale})
+	if err != nil {
+		return 0, err
+	}
+
+	// The PNG goes first, so that a reader never finds metadata without its image.
+	pngSize, err := writeFile(dir, key+".png", func(f *os.File) error { return png.Encode(f, entry.Image) })
+	if err != nil {
+		return 0, err
+	}
+	metaSize, err := writeFile(dir, key+".json", func(f *os.File) error {
+		_, err := f.Write(meta)
+		return err
+	})
+	return pngSize + metaSize, err
+}
+
+// writeFile writes a file via a temporary file, so that a reader never sees it partially written, and returns its size.
+func writeFile(dir, name string, write func(*os.File) error) (int64, error) {
+	f, err := os.CreateTemp(dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return 0, err
+	}
+	err = write(f)
+	size := int64(0)
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return size, err
+}
+
+type diskEntry struct {
+	key   string
+	files []string
+	size  int64
+	mtime time.Time
+}
+
+// list returns the entries in the cache, oldest first. Files in the old format are returned as entries of their own,
+// with a zero modification time.
+func (d *diskCache) list(dir string) ([]*diskEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	byKey := map[string]*diskEntry{}
+	for _, f := range files {
+		m := cacheFileRe.FindStringSubmatch(f.Name())
+		if m == nil || f.IsDir() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		key := m[1]
+		if m[2] == "" {
+			key = f.Name() + "-legacy"
+		}
+		e, ok := byKey[key]
+		if !ok {
+			e = &diskEntry{key: key}
+			byKey[key] = e
+		}
+		e.files = append(e.files, filepath.Join(dir, f.Name()))
+		e.size += info.Size()
+		if m[2] == ".png" {
+			e.mtime = info.ModTime()
+		}
+	}
+
+	ret := make([]*diskEntry, 0, len(byKey))
+	for _, e := range byKey {
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].mtime.Before(ret[j].mtime) })
+	return ret, nil
+}
+
+// index returns the entries in the cache, reading them from the directory if they haven't been yet. The lock must be
+// held.
+func (d *diskCache) index() map[string]*list.Element {
+	if d.entries != nil {
+		return d.entries
+	}
+	d.entries = map[string]*list.Element{}
+	entries, err := d.list(d.dir)
+	if err != nil {
+		log.Errorf("listing cache: %s", err)
+	}
+	for _, e := range entries {
+		d.entries[e.key] = d.order.PushFront(e)
+		d.size += e.size
+	}
+	return d.entries
+}
+
+func (d *diskCache) remove(e *list.Element) {
+	item := d.order.Remove(e).(*diskEntry)
+	delete(d.entries, item.key)
+	d.size -= item.size
+}
+
+// prune removes the least recently used entries, other than `keep`, until the cache is no larger than its maximum size
+// and none are older than its maximum age. The lock must be held.
+func (d *diskCache) prune(keep string) error {
+	cutoff := time.Now().Add(-d.maxAge)
+	for e := d.order.Back(); e != nil; e = d.order.Back() {
+		item := e.Value.(*diskEntry)
+		if item.key == keep || d.size <= d.max && item.mtime.After(cutoff) {
+			break
+		}
+		for _, f := range item.files {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		d.remove(e)
+		log.Debugf("evicted cached files %s", strings.Join(item.files, ", "))
+	}
+	return nil
+}
+
+func (d *diskCache) Stats(s *Stats) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s.Stored = "disk"
+	s.StoredHits = d.hits
+	s.Misses = d.misses
+	s.StoredEntries = len(d.index())
+	s.StoredBytes = d.size
+}
+
+func (d *diskCache) Purge() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hits = 0
+	d.misses = 0
+	// The directory is read again on next use, for whatever couldn't be removed.
+	d.entries = nil
+	d.order.Init()
+	d.size = 0
+
+	entries, err := d.list(d.dir)
+	if err != nil {
+		return 0, err
+	}
+	freed := int64(0)
+	for _, e := range entries {
+		for _, f := range e.files {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return freed, err
+			}
+		}
+		freed += e.size
+	}
+	return freed, nil
+}
@@ -1,141 +1,170 @@
+// Package cache holds rendered maps and downloaded backgrounds, so they need not be produced again. Entries are kept
+// decoded in a size-bounded in-memory LRU, in front of a shared backend selected with -cache-backend: a directory of
+// PNGs bounded by total size and by age, or a Redis-compatible server that several mapbots can share.
+//
+// Images passed to Put and returned by Get are shared, and must not be modified.
 package cache
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	mbLog "github.com/pdbogen/mapbot/common/log"
 	"image"
-	"image/png"
-	"io/ioutil"
-	"os"
-	"strconv"
 	"sync"
+	"time"
 )
 
-var cacheMu = sync.Mutex{}
-
 type CacheEntry struct {
 	Version int
 	Image   image.Image
-}
 
-func (c *CacheEntry) MarshalJSON() ([]byte, error) {
-	m := make(map[string]interface{})
-	m["version"] = strconv.Itoa(c.Version)
-	buf := &bytes.Buffer{}
-	png.Encode(buf, c.Image)
-	m["png"] = base64.StdEncoding.EncodeToString(buf.Bytes())
-	return json.Marshal(m)
+	// Scale records the output pixels per reference pixel the image was drawn at; see tabula.Render.
+	Scale float64
 }
 
-func (c *CacheEntry) UnmarshalJSON(data []byte) error {
-	m := make(map[string]interface{})
-	if err := json.Unmarshal(data, &m); err != nil {
-		return err
-	}
-	v, ok := m["version"]
-	if !ok {
-		return errors.New("missing `version`")
-	}
-	vStr, ok := v.(string)
-	if !ok {
-		return fmt.Errorf("`version` was %T, not string", v)
-	}
-	vInt, err := strconv.Atoi(vStr)
-	if err != nil {
-		return fmt.Errorf("`version` was %q, not parseable int: %s", vStr, err)
-	}
-	c.Version = vInt
+var log = mbLog.Log
 
-	pngData, ok := m["png"]
-	if !ok {
-		return errors.New("missing `png`")
-	}
-	pngb64, ok := pngData.(string)
-	if !ok {
-		return fmt.Errorf("`png` was %T, not string", pngData)
-	}
+var BackendName = flag.String("cache-backend", "fs", "where to cache rendered maps: fs, memory, or redis")
+var CacheDir = flag.String("cache-dir", "/tmp/mapbot", "directory to store cached map files (fs)")
+var MemorySize = flag.Int("cache-memory", 256, "size, in megabytes, of the in-memory cache of decoded images")
+var DiskSize = flag.Int("cache-disk", 2048, "size, in megabytes, beyond which the least recently used cached files are removed (fs)")
+var MaxAge = flag.Duration("cache-max-age", 30*24*time.Hour, "cached maps unused for longer than this are removed (fs, redis)")
+var RedisUrl = flag.String("cache-redis", "redis://localhost:6379/0", "URL of the Redis-compatible server to cache in (redis)")
 
-	pngBytes, err := base64.StdEncoding.DecodeString(pngb64)
-	if err != nil {
-		return fmt.Errorf("decoding `png` from base64: %s", err)
-	}
+// Backend is a place to keep cache entries.
+type Backend interface {
+	Get(key string) (*CacheEntry, bool)
+	Put(key string, entry *CacheEntry)
 
-	pngBuf := bytes.NewBuffer(pngBytes)
-	img, err := png.Decode(pngBuf)
-	if err != nil {
-		return fmt.Errorf("`png` couldn't decode as png: %s", err)
-	}
-	c.Image = img
-	return nil
+	// Stats fills in the parts of `s` that describe this backend.
+	Stats(s *Stats)
+
+	// Purge removes every entry, returning the number of bytes freed, if known.
+	Purge() (int64, error)
 }
 
-var log = mbLog.Log
+// Stats describes the contents and effectiveness of the cache since startup (or the last Purge).
+type Stats struct {
+	MemoryEntries int
+	MemoryBytes   int64
+	MemoryHits    uint64
 
-var CacheDir = flag.String("cache-dir", "/tmp/mapbot", "directory to store cached map files")
+	// Stored describes the backend behind the in-memory cache, if any.
+	Stored        string
+	StoredEntries int
+	StoredBytes   int64
+	StoredHits    uint64
 
-func Get(key string) (ret *CacheEntry, ok bool) {
-	cacheMu.Lock()
-	defer cacheMu.Unlock()
-	keyHash := sha256.Sum256([]byte(key))
-	key = hex.EncodeToString(keyHash[:])
+	Misses uint64
+}
 
-	f, err := os.Open(*CacheDir + "/" + key)
+// Instance is the backend used by Get and Put. If it is not set, Get and Put will Open one on first use.
+var Instance Backend
+var instanceMu sync.Mutex
+
+// Open returns the backend selected by the -cache-* flags.
+func Open() (Backend, error) {
+	memory := newLru(int64(*MemorySize) << 20)
+	switch *BackendName {
+	case "memory":
+		return memory, nil
+	case "fs":
+		return &tiered{front: memory, back: newDisk(*CacheDir, int64(*DiskSize)<<20, *MaxAge)}, nil
+	case "redis":
+		r, err := newRedis(*RedisUrl, *MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		return &tiered{front: memory, back: r}, nil
+	}
+	return nil, fmt.Errorf("unknown cache backend %q; try fs, memory, or redis", *BackendName)
+}
 
-	var data []byte
+func instance() Backend {
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+	if Instance == nil {
+		var err error
+		if Instance, err = Open(); err != nil {
+			log.Errorf("opening cache: %s; caching in memory only", err)
+			Instance = newLru(int64(*MemorySize) << 20)
+		}
+	}
+	return Instance
+}
 
-	if err == nil {
-		defer f.Close()
+func hash(key string) string {
+	keyHash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(keyHash[:])
+}
 
-		data, err = ioutil.ReadAll(f)
-	}
+func Get(key string) (*CacheEntry, bool) {
+	return instance().Get(key)
+}
 
-	if err == nil {
-		ret = new(CacheEntry)
-		err = json.Unmarshal(data, ret)
-	}
+func Put(key string, entry *CacheEntry) {
+	instance().Put(key, entry)
+}
 
-	if err == nil {
-		return ret, true
+// Flush waits for entries still being written to the backend behind the in-memory cache.
+func Flush() {
+	if t, ok := instance().(*tiered); ok {
+		t.writes.Wait()
 	}
+}
 
-	// err wasn't nil
-	if !os.IsNotExist(err) {
-		log.Errorf("error opening cached file %s: %s", key, err)
-	} else {
-		log.Debugf("cache miss %s", key)
-	}
-	return nil, false
+// GetStats returns the current cache statistics.
+func GetStats() Stats {
+	s := Stats{}
+	instance().Stats(&s)
+	return s
 }
 
-func Put(key string, entry *CacheEntry) {
-	cacheMu.Lock()
-	defer cacheMu.Unlock()
+// Purge empties the cache, returning the number of bytes freed from its backend.
+func Purge() (int64, error) {
+	return instance().Purge()
+}
 
-	keyHash := sha256.Sum256([]byte(key))
-	key = hex.EncodeToString(keyHash[:])
+// tiered keeps entries in a fast front backend, falling back to (and filling from) a slower back backend.
+type tiered struct {
+	front *lru
+	back  Backend
 
-	_, err := os.Stat(*CacheDir)
-	if os.IsNotExist(err) {
-		err = os.Mkdir(*CacheDir, os.FileMode(0755))
-	}
+	// writes tracks entries still being written to the back backend. Encoding an entry takes longer than the render
+	// that produced it, so it's done in the background; the entry can be had from the front backend meanwhile.
+	writes sync.WaitGroup
+}
 
-	var f *os.File
-	if err == nil {
-		f, err = os.OpenFile(*CacheDir+"/"+key, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0644))
-	}
-	if err == nil {
-		defer f.Close()
-		enc := json.NewEncoder(f)
-		err = enc.Encode(entry)
+func (t *tiered) Get(key string) (*CacheEntry, bool) {
+	if ret, ok := t.front.Get(key); ok {
+		return ret, true
 	}
-	if err != nil {
-		log.Errorf("writing cached file %s: %s", key, err)
+	ret, ok := t.back.Get(key)
+	if ok {
+		t.front.Put(key, ret)
 	}
+	return ret, ok
+}
+
+func (t *tiered) Put(key string, entry *CacheEntry) {
+	t.front.Put(key, entry)
+	t.writes.Add(1)
+	go func() {
+		defer t.writes.Done()
+		t.back.Put(key, entry)
+	}()
+}
+
+func (t *tiered) Stats(s *Stats) {
+	t.front.Stats(s)
+	t.back.Stats(s)
+}
+
+// Purge waits for writes to the back backend first, lest an entry be written after it's been purged.
+func (t *tiered) Purge() (int64, error) {
+	t.writes.Wait()
+	t.front.Purge()
+	return t.back.Purge()
 }
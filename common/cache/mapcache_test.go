@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func entry(version, side int) *CacheEntry {
+	return &CacheEntry{Version: version, Image: image.NewNRGBA(image.Rect(0, 0, side, side)), Scale: 1.5}
+}
+
+func TestLru(t *testing.T) {
+	// Each entry is 10x10x4 = 400 bytes, so three fit.
+	l := newLru(1200)
+	for i, key := range []string{"a", "b", "c"} {
+		l.Put(key, entry(i, 10))
+	}
+	l.Get("a")
+	l.Put("d", entry(3, 10))
+
+	if _, ok := l.Get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := l.Get(key); !ok {
+			t.Errorf("expected %q to remain", key)
+		}
+	}
+
+	l.Put("huge", entry(4, 100))
+	if _, ok := l.Get("huge"); ok || len(l.entries) != 3 || l.size != 1200 {
+		t.Errorf("an entry larger than the cache should not displace others; have %d entries, %d bytes", len(l.entries), l.size)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	d := newDisk(dir, 1<<20, time.Hour)
+
+	d.Put("one", entry(7, 10))
+	got, ok := d.Get("one")
+	if !ok {
+		t.Fatal("expected entry to be read back")
+	}
+	if got.Version != 7 || got.Scale != 1.5 || got.Image.Bounds().Dx() != 10 {
+		t.Errorf("entry did not survive: %+v", got)
+	}
+	if _, ok := d.Get("two"); ok {
+		t.Error("expected miss for absent entry")
+	}
+
+	// An old-format file, an expired entry, and a file that isn't ours; found when the directory is read again, as on
+	// restart.
+	legacy := filepath.Join(dir, hash("legacy"))
+	os.WriteFile(legacy, []byte("{}"), 0644)
+	d.Put("old", entry(1, 10))
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, hash("old")+".png"), old, old)
+	other := filepath.Join(dir, "precious.txt")
+	os.WriteFile(other, []byte("keep me"), 0644)
+
+	d = newDisk(dir, 1<<20, time.Hour)
+	s := Stats{}
+	d.Stats(&s)
+	if s.StoredEntries != 3 {
+		t.Errorf("expected three entries read from the directory, got %+v", s)
+	}
+
+	d.Put("three", entry(3, 10))
+	for _, f := range []string{legacy, filepath.Join(dir, hash("old")+".png")} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be pruned", filepath.Base(f))
+		}
+	}
+
+	// A cap smaller than two entries leaves only the newest.
+	d.max = 1
+	d.Put("four", entry(4, 10))
+	if _, ok := d.Get("one"); ok {
+		t.Error("expected oldest entry to be pruned for size")
+	}
+	if _, ok := d.Get("four"); !ok {
+		t.Error("expected newest entry to remain")
+	}
+
+	// Entries missing from the directory are dropped.
+	os.Remove(filepath.Join(dir, hash("four")+".png"))
+	if _, ok := d.Get("four"); ok {
+		t.Error("expected entry with its image removed to miss")
+	}
+
+	s = Stats{}
+	d.Stats(&s)
+	if s.StoredEntries != 0 || s.StoredBytes != 0 || s.StoredHits != 1 || s.Misses != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	if freed, err := d.Purge(); err != nil || freed == 0 {
+		t.Errorf("expected purge to free space, got %d, %v", freed, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("purge removed a file it doesn't own: %s", err)
+	}
+}
+
+func TestTiered(t *testing.T) {
+	back := newLru(1 << 20)
+	c := &tiered{front: newLru(1 << 20), back: back}
+
+	c.Put("a", entry(1, 10))
+	c.writes.Wait()
+	if _, ok := back.Get("a"); !ok {
+		t.Fatal("expected entry to be written to back tier")
+	}
+	c.front.Purge()
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected entry from back tier")
+	}
+	if _, ok := c.front.Get("a"); !ok {
+		t.Error("expected front tier to be filled from back tier")
+	}
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// lru is the in-memory backend: decoded images, bounded by their approximate total size in bytes.
+type lru struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int64
+	max     int64
+	hits    uint64
+	misses  uint64
+}
+
+type lruItem struct {
+	key   string
+	entry *CacheEntry
+	size  int64
+}
+
+func newLru(max int64) *lru {
+	return &lru{entries: map[string]*list.Element{}, order: list.New(), max: max}
+}
+
+func (l *lru) Get(key string) (*CacheEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		l.misses++
+		return nil, false
+	}
+	l.hits++
+	l.order.MoveToFront(e)
+	return e.Value.(*lruItem).entry, true
+}
+
+// Put adds the entry to the front of the LRU, and then evicts from the back until the LRU is no larger than its
+// maximum. Entries larger than the maximum by themselves are not kept at all.
+func (l *lru) Put(key string, entry *CacheEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[key]; ok {
+		l.remove(e)
+	}
+
+	size := imageSize(entry.Image)
+	if size > l.max {
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruItem{key, entry, size})
+	l.size += size
+
+	for l.size > l.max {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *lru) remove(e *list.Element) {
+	item := l.order.Remove(e).(*lruItem)
+	delete(l.entries, item.key)
+	l.size -= item.size
+}
+
+func (l *lru) Purge() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = map[string]*list.Element{}
+	l.order.Init()
+	l.size = 0
+	l.hits = 0
+	l.misses = 0
+	return 0, nil
+}
+
+// Stats fills in the memory statistics; and the misses, though a backend behind this one will replace them with its
+// own.
+func (l *lru) Stats(s *Stats) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.MemoryEntries = len(l.entries)
+	s.MemoryBytes = l.size
+	s.MemoryHits = l.hits
+	s.Misses = l.misses
+}
+
+// imageSize estimates the memory used by the pixels of an image.
+func imageSize(i image.Image) int64 {
+	switch img := i.(type) {
+	case nil:
+		return 0
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.Paletted:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	}
+	return int64(i.Bounds().Dx()) * int64(i.Bounds().Dy()) * 4
+}
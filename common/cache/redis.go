@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisPrefix is prepended to the hash of each key, so that the cache can share a server with other data.
+const redisPrefix = "mapbot:cache:"
+
+// redisMaxIdle is how many connections are kept open between calls.
+const redisMaxIdle = 4
+
+// redisCache keeps entries on a Redis-compatible server, as hashes holding the version, scale, and PNG-encoded image.
+// Entries expire after going unused for `maxAge`; the server's own maxmemory policy should be used to bound its size.
+type redisCache struct {
+	addr, password string
+	db             int
+	maxAge         time.Duration
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	hits   uint64
+	misses uint64
+}
+
+// redisConn is one connection to the server; each is used by a single call at a time.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// newRedis parses a URL like redis://:password@host:port/db; connections are made on first use.
+func newRedis(rawUrl string, maxAge time.Duration) (*redisCache, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis URL: %s", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("redis URL should start with redis://, not %s://", u.Scheme)
+	}
+
+	ret := &redisCache{addr: u.Host, maxAge: maxAge}
+	if u.Port() == "" {
+		ret.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		ret.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if ret.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("redis database should be a number, not %q", path)
+		}
+	}
+	return ret, nil
+}
+
+func (r *redisCache) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	if r.password != "" {
+		if _, err := c.call("AUTH", r.password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authenticating: %s", err)
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.call("SELECT", strconv.Itoa(r.db)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("selecting database %d: %s", r.db, err)
+		}
+	}
+	return c, nil
+}
+
+// with calls `f` with an idle connection, or a new one if none is idle. A connection that fails is dropped and `f`
+// is retried once on a fresh one, since the server may simply have closed an idle connection; error replies from the
+// server are returned as they are.
+func (r *redisCache) with(f func(c *redisConn) error) error {
+	r.mu.Lock()
+	var c *redisConn
+	if n := len(r.idle); n > 0 {
+		c, r.idle = r.idle[n-1], r.idle[:n-1]
+	}
+	r.mu.Unlock()
+
+	var err error
+	for try := 0; try < 2; try++ {
+		if c == nil {
+			if c, err = r.dial(); err != nil {
+				continue
+			}
+		}
+		err = f(c)
+		if _, ok := err.(redisError); err == nil || ok {
+			r.release(c)
+			return err
+		}
+		c.Close()
+		c = nil
+	}
+	return err
+}
+
+func (r *redisCache) release(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) < redisMaxIdle {
+		r.idle = append(r.idle, c)
+		return
+	}
+	c.Close()
+}
+
+// pipeline sends every command before reading any reply, and returns the replies in order.
+func (c *redisConn) pipeline(cmds ...[]string) ([]interface{}, error) {
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	buf := &bytes.Buffer{}
+	for _, args := range cmds {
+		buf.Write(encodeCommand(args...))
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	ret := make([]interface{}, len(cmds))
+	for i := range ret {
+		var err error
+		if ret[i], err = readReply(c.r); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// call sends one command and returns its reply, with error replies returned as errors.
+func (c *redisConn) call(args ...string) (interface{}, error) {
+	replies, err := c.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(redisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+func encodeCommand(args ...string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return buf.Bytes()
+}
+
+// readReply reads one RESP reply; a string for simple strings, a redisError for errors, an int64 for integers, a
+// []byte for bulk strings, and a []interface{} for arrays. Null bulk strings and arrays are returned as nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		ret := make([]interface{}, n)
+		for i := range ret {
+			if ret[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
+
+func (r *redisCache) Get(key string) (*CacheEntry, bool) {
+	ret, err := r.get(redisPrefix + hash(key))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil || ret == nil {
+		if err != nil {
+			log.Errorf("reading cached entry %s from redis: %s", key, err)
+		}
+		r.misses++
+		return nil, false
+	}
+	r.hits++
+	return ret, true
+}
+
+// get fetches an entry and refreshes its expiry; the image is decoded after the connection is given back.
+func (r *redisCache) get(key string) (*CacheEntry, error) {
+	var fields []interface{}
+	err := r.with(func(c *redisConn) error {
+		reply, err := c.call("HMGET", key, "version", "scale", "png")
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if fields, ok = reply.([]interface{}); !ok || len(fields) != 3 {
+			return fmt.Errorf("unexpected reply %v", reply)
+		}
+		if fields[0] == nil || fields[2] == nil {
+			return nil
+		}
+		if _, err := c.call("EXPIRE", key, r.ttl()); err != nil {
+			log.Warningf("refreshing expiry of %s: %s", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	version, _ := fields[0].([]byte)
+	scale, _ := fields[1].([]byte)
+	pngData, _ := fields[2].([]byte)
+	if version == nil || pngData == nil {
+		return nil, nil
+	}
+
+	ret := &CacheEntry{Scale: 1}
+	if ret.Version, err = strconv.Atoi(string(version)); err != nil {
+		return nil, fmt.Errorf("version %q is not a number", version)
+	}
+	if s, err := strconv.ParseFloat(string(scale), 64); err == nil && s > 0 {
+		ret.Scale = s
+	}
+	if ret.Image, err = png.Decode(bytes.NewReader(pngData)); err != nil {
+		return nil, fmt.Errorf("decoding png: %s", err)
+	}
+	return ret, nil
+}
+
+func (r *redisCache) ttl() string {
+	return strconv.Itoa(int(r.maxAge / time.Second))
+}
+
+func (r *redisCache) Put(key string, entry *CacheEntry) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, entry.Image); err != nil {
+		log.Errorf("encoding cached entry %s: %s", key, err)
+		return
+	}
+
+	key = redisPrefix + hash(key)
+	err := r.with(func(c *redisConn) error {
+		_, err := c.call("HSET", key,
+			"version", strconv.Itoa(entry.Version),
+			"scale", strconv.FormatFloat(entry.Scale, 'g', -1, 64),
+			"png", buf.String(),
+		)
+		if err == nil {
+			_, err = c.call("EXPIRE", key, r.ttl())
+		}
+		return err
+	})
+	if err != nil {
+		log.Errorf("writing cached entry %s to redis: %s", key, err)
+	}
+}
+
+// each calls `f` with every cache key on the server, a SCAN batch at a time, along with the size of each key's image.
+// The sizes of a batch are asked for in a single pipeline rather than a round trip per key.
+func (c *redisConn) each(f func(keys []string, sizes []int64)) error {
+	cursor := "0"
+	for {
+		reply, err := c.call("SCAN", cursor, "MATCH", redisPrefix+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		next, _ := parts[0].([]byte)
+		found, _ := parts[1].([]interface{})
+
+		keys := []string{}
+		cmds := [][]string{}
+		for _, k := range found {
+			if key, ok := k.([]byte); ok {
+				keys = append(keys, string(key))
+				cmds = append(cmds, []string{"HSTRLEN", string(key), "png"})
+			}
+		}
+		if len(keys) > 0 {
+			replies, err := c.pipeline(cmds...)
+			if err != nil {
+				return err
+			}
+			sizes := make([]int64, len(keys))
+			for i, reply := range replies {
+				if sizes[i], ok = reply.(int64); !ok {
+					return errors.New("HSTRLEN did not return an integer")
+				}
+			}
+			f(keys, sizes)
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (r *redisCache) Stats(s *Stats) {
+	r.mu.Lock()
+	s.Stored = "redis"
+	s.StoredHits = r.hits
+	s.Misses = r.misses
+	r.mu.Unlock()
+
+	err := r.with(func(c *redisConn) error {
+		s.StoredEntries, s.StoredBytes = 0, 0
+		return c.each(func(keys []string, sizes []int64) {
+			s.StoredEntries += len(keys)
+			for _, n := range sizes {
+				s.StoredBytes += n
+			}
+		})
+	})
+	if err != nil {
+		log.Errorf("listing cache: %s", err)
+	}
+}
+
+func (r *redisCache) Purge() (int64, error) {
+	r.mu.Lock()
+	r.hits = 0
+	r.misses = 0
+	r.mu.Unlock()
+
+	freed := int64(0)
+	err := r.with(func(c *redisConn) error {
+		// Keys are collected first, since deleting during a SCAN may cause keys to be skipped.
+		keys := []string{}
+		freed = 0
+		err := c.each(func(batch []string, sizes []int64) {
+			keys = append(keys, batch...)
+			for _, n := range sizes {
+				freed += n
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > 100 {
+				n = 100
+			}
+			if _, err := c.call(append([]string{"DEL"}, keys[:n]...)...); err != nil {
+				return err
+			}
+			keys = keys[n:]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return freed, nil
+}
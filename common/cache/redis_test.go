@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis understands just enough of the Redis protocol to exercise redisCache.
+type fakeRedis struct {
+	mu       sync.Mutex
+	password string
+	hashes   map[string]map[string]string
+	expiry   map[string]string
+}
+
+func (f *fakeRedis) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		parts := req.([]interface{})
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			args[i] = string(p.([]byte))
+		}
+
+		f.mu.Lock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "HSET":
+			h := map[string]string{}
+			for i := 2; i < len(args); i += 2 {
+				h[args[i]] = args[i+1]
+			}
+			f.hashes[args[1]] = h
+			reply = fmt.Sprintf(":%d\r\n", len(h))
+		case cmd == "HMGET":
+			reply = fmt.Sprintf("*%d\r\n", len(args)-2)
+			for _, field := range args[2:] {
+				if v, ok := f.hashes[args[1]][field]; ok {
+					reply += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+				} else {
+					reply += "$-1\r\n"
+				}
+			}
+		case cmd == "HSTRLEN":
+			reply = fmt.Sprintf(":%d\r\n", len(f.hashes[args[1]][args[2]]))
+		case cmd == "EXPIRE":
+			f.expiry[args[1]] = args[2]
+			reply = ":1\r\n"
+		case cmd == "SCAN":
+			keys := []string{}
+			for k := range f.hashes {
+				if strings.HasPrefix(k, strings.TrimSuffix(args[3], "*")) {
+					keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(k), k))
+				}
+			}
+			reply = fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+		case cmd == "DEL":
+			for _, k := range args[1:] {
+				delete(f.hashes, k)
+			}
+			reply = fmt.Sprintf(":%d\r\n", len(args)-1)
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+func TestRedis(t *testing.T) {
+	f := &fakeRedis{password: "sekrit", hashes: map[string]map[string]string{}, expiry: map[string]string{}}
+	f.hashes["someone:else"] = map[string]string{"x": "y"}
+	addr := f.serve(t)
+
+	if r, err := newRedis("redis://:wrong@"+addr, time.Hour); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else {
+		r.Put("a", entry(1, 10))
+		if _, ok := r.Get("a"); ok {
+			t.Error("expected wrong password to fail")
+		}
+	}
+
+	r, err := newRedis("redis://:sekrit@"+addr, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r.Put("a", entry(3, 10))
+	got, ok := r.Get("a")
+	if !ok {
+		t.Fatal("expected entry to be read back")
+	}
+	if got.Version != 3 || got.Scale != 1.5 || got.Image.Bounds().Dx() != 10 {
+		t.Errorf("entry did not survive: %+v", got)
+	}
+	f.mu.Lock()
+	if f.expiry[redisPrefix+hash("a")] != "3600" {
+		t.Errorf("expected an hour's expiry, got %q", f.expiry[redisPrefix+hash("a")])
+	}
+	f.mu.Unlock()
+	if _, ok := r.Get("b"); ok {
+		t.Error("expected miss for absent entry")
+	}
+
+	s := Stats{}
+	r.Stats(&s)
+	if s.StoredEntries != 1 || s.StoredBytes == 0 || s.StoredHits != 1 || s.Misses != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// A dropped connection is re-established.
+	for _, c := range r.idle {
+		c.Close()
+	}
+	if _, ok := r.Get("a"); !ok {
+		t.Error("expected reconnect after dropped connection")
+	}
+
+	if freed, err := r.Purge(); err != nil || freed == 0 {
+		t.Errorf("expected purge to free space, got %d, %v", freed, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.hashes) != 1 || f.hashes["someone:else"] == nil {
+		t.Errorf("purge should remove only cache keys; left %v", f.hashes)
+	}
+}
+
+func TestRedisConcurrent(t *testing.T) {
+	f := &fakeRedis{hashes: map[string]map[string]string{}, expiry: map[string]string{}}
+	r, err := newRedis("redis://"+f.serve(t), time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r.Put("a", entry(1, 10))
+
+	// A call that holds its connection does not hold up others.
+	held, done := make(chan bool), make(chan bool)
+	go r.with(func(c *redisConn) error {
+		held <- true
+		<-done
+		return nil
+	})
+	<-held
+	if _, ok := r.Get("a"); !ok {
+		t.Error("expected entry while another call is in progress")
+	}
+	close(done)
+}
+
+func TestNewRedis(t *testing.T) {
+	r, err := newRedis("redis://cache.example/2", time.Hour)
+	if err != nil || r.addr != "cache.example:6379" || r.db != 2 || r.password != "" {
+		t.Errorf("unexpected %+v, %v", r, err)
+	}
+	for _, bad := range []string{"http://cache.example", "redis://cache.example/two"} {
+		if _, err := newRedis(bad, time.Hour); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -1,13 +1,9 @@
 package conv
 
 import (
-	"errors"
-	"fmt"
 	mbLog "github.com/pdbogen/mapbot/common/log"
 	"image"
 	"regexp"
-	"strconv"
-	"strings"
 )
 
 var log = mbLog.Log
@@ -16,21 +12,9 @@ var xCoordRe = regexp.MustCompile(`^-?[a-z]+$`)
 var yCoordRe = regexp.MustCompile(`^-?[0-9]+$`)
 var coordRe = regexp.MustCompile(`^(-?[a-z]+)(-?[0-9]+)(n|ne|e|se|s|sw|w|nw)?$`)
 
+// RCToPoint parses a square's name, perhaps with a direction, in the default notation.
 func RCToPoint(rc string, directionAllowed bool) (point image.Point, direction string, err error) {
-	rc = strings.ToLower(rc)
-	if matches := coordRe.FindStringSubmatch(rc); matches != nil && len(matches) >= 3 {
-		if !directionAllowed && len(matches) > 3 && matches[3] != "" {
-			return image.Point{}, "", errors.New("direction not allowed in this context")
-		}
-
-		point, err = CoordsToPoint(matches[1], matches[2])
-		if len(matches) > 3 {
-			direction = matches[3]
-		}
-		return
-	} else {
-		return image.Point{}, "", errors.New("not an RC coordinate")
-	}
+	return Notation{}.Parse(rc, directionAllowed)
 }
 
 func ToLetter(n int) string {
@@ -39,52 +23,20 @@ func ToLetter(n int) string {
 	}
 
 	if n < 26 {
-		return string(n + int('A'))
+		return string(rune(n + int('A')))
 	}
 
 	return ToLetter(n/26) + ToLetter(n%26)
 }
 
+// PointToCoords names the square at `pt` in the default notation.
 func PointToCoords(pt image.Point) string {
-
-	if pt.Y >= 0 {
-		pt.Y++
-	}
-	return ToLetter(pt.X) + strconv.Itoa(pt.Y)
+	return Notation{}.Format(pt)
 }
 
+// CoordsToPoint parses a square's name given as a column letter and row number, in the default notation.
 func CoordsToPoint(x, y string) (image.Point, error) {
-	x = strings.ToLower(x)
-	if !xCoordRe.MatchString(x) {
-		return image.Point{}, errors.New("X coordinate must be a column letter")
-	}
-
-	y = strings.ToLower(y)
-	if !yCoordRe.MatchString(y) {
-		return image.Point{}, errors.New("Y coordinate must be a number")
-	}
-
-	accumX := 0
-	sign := 1
-	if x[0] == '-' {
-		sign = -1
-		x = x[1:]
-	}
-
-	for i := 0; i < len(x); i++ {
-		accumX = accumX*26 + int(x[i]) - int('a')
-	}
-
-	accumX = accumX * sign
-
-	accumY, err := strconv.Atoi(y)
-	if err != nil {
-		return image.Point{}, fmt.Errorf("invalid Y coordinate: %s", err)
-	}
-	if accumY < 0 {
-		accumY += 1
-	}
-	return image.Point{accumX, accumY - 1}, nil
+	return Notation{}.ParsePair(x, y)
 }
 
 // Distance calculates the "pathfinder-style" distance between two points;
@@ -148,3 +100,34 @@ func DistanceCorners(a image.Point, cornerA string, b image.Point, cornerB strin
 
 	return straights*5 + diags/2*15 + diags%2*5
 }
+
+// PathDistance returns the distance along a path through the squares `pts`, in order. Diagonals are counted along the
+// whole path, so that two diagonal steps cost 15 feet even when they're in different legs.
+func PathDistance(pts ...image.Point) int {
+	straights, diags := 0, 0
+	for i := 1; i < len(pts); i++ {
+		d := pts[i].Sub(pts[i-1])
+		if d.X < 0 {
+			d.X = -d.X
+		}
+		if d.Y < 0 {
+			d.Y = -d.Y
+		}
+		if d.X < d.Y {
+			d.X, d.Y = d.Y, d.X
+		}
+		straights += d.X - d.Y
+		diags += d.Y
+	}
+	return straights*5 + diags/2*15 + diags%2*5
+}
+
+// Distance3D returns the distance between two points `flat` feet apart on the map and `rise` feet apart in height,
+// treating the distance on the map as a straight line and stepping diagonally up or down it the way Distance steps
+// diagonally across the map.
+func Distance3D(flat, rise int) int {
+	if rise < 0 {
+		rise = -rise
+	}
+	return Distance(image.Point{}, image.Pt((flat+4)/5, (rise+4)/5))
+}
@@ -152,3 +152,43 @@ func TestToLetter(t *testing.T) {
 		}
 	}
 }
+
+func TestDistance3D(t *testing.T) {
+	type test struct {
+		flat, rise, out int
+	}
+	tests := []test{
+		{0, 0, 0},
+		{30, 0, 30},
+		{0, -20, 20},
+		{5, 5, 5},
+		{10, 10, 15},
+		{30, 10, 35},
+		{0, 3, 5},
+	}
+	for i, test := range tests {
+		if res := Distance3D(test.flat, test.rise); res != test.out {
+			t.Errorf("test %d: expected Distance3D(%d,%d) to be %d, but it was %d", i, test.flat, test.rise, test.out, res)
+		}
+	}
+}
+
+func TestPathDistance(t *testing.T) {
+	type test struct {
+		pts []image.Point
+		out int
+	}
+	tests := []test{
+		{nil, 0},
+		{[]image.Point{{2, 2}}, 0},
+		{[]image.Point{{0, 0}, {0, 3}, {2, 3}}, 25},
+		// Two diagonal legs of one square each are 15ft together, not 10ft.
+		{[]image.Point{{0, 0}, {1, 1}, {2, 2}}, 15},
+		{[]image.Point{{0, 0}, {3, 1}, {3, 0}}, 20},
+	}
+	for i, test := range tests {
+		if res := PathDistance(test.pts...); res != test.out {
+			t.Errorf("test %d: expected PathDistance(%v) to be %d, but it was %d", i, test.pts, test.out, res)
+		}
+	}
+}
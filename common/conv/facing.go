@@ -0,0 +1,77 @@
+package conv
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Facing is the direction a token faces, in whole degrees clockwise from north (up).
+type Facing int
+
+// Compass names the eight directions a facing can be given as, starting from north and going clockwise.
+var Compass = []string{"n", "ne", "e", "se", "s", "sw", "w", "nw"}
+
+var compassWords = map[string]string{
+	"north": "n", "northeast": "ne", "east": "e", "southeast": "se",
+	"south": "s", "southwest": "sw", "west": "w", "northwest": "nw",
+}
+
+// NewFacing returns `degrees` as a Facing, turned into [0,360).
+func NewFacing(degrees int) Facing {
+	degrees %= 360
+	if degrees < 0 {
+		degrees += 360
+	}
+	return Facing(degrees)
+}
+
+// ParseFacing parses a compass direction, like `ne` or `northeast`, or a number of degrees clockwise from north, like
+// `120`.
+func ParseFacing(s string) (Facing, error) {
+	s = strings.ToLower(s)
+	if word, ok := compassWords[s]; ok {
+		s = word
+	}
+	for i, dir := range Compass {
+		if s == dir {
+			return Facing(i * 45), nil
+		}
+	}
+
+	deg, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(s, "°"), "deg"))
+	if err != nil {
+		return 0, fmt.Errorf("`%s` isn't a direction; try one of %s, or a number of degrees clockwise from north",
+			s, strings.Join(Compass, ", "))
+	}
+	return NewFacing(deg), nil
+}
+
+// FacingBetween returns the direction from square `from` to square `to`; it's false if they're the same square.
+func FacingBetween(from, to image.Point) (Facing, bool) {
+	d := to.Sub(from)
+	if d == image.ZP {
+		return 0, false
+	}
+	deg := math.Atan2(float64(d.X), float64(-d.Y)) * 180 / math.Pi
+	return NewFacing(int(math.Round(deg))), true
+}
+
+// Compass returns the compass direction nearest the facing.
+func (f Facing) Compass() string {
+	return Compass[(int(NewFacing(int(f)))*2+45)/90%8]
+}
+
+// Radians returns the facing in radians clockwise from north.
+func (f Facing) Radians() float64 {
+	return float64(f) * math.Pi / 180
+}
+
+func (f Facing) String() string {
+	if f%45 == 0 {
+		return f.Compass()
+	}
+	return fmt.Sprintf("%d°", int(f))
+}
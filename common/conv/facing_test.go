@@ -0,0 +1,61 @@
+package conv
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseFacing(t *testing.T) {
+	tests := map[string]Facing{"n": 0, "NE": 45, "southwest": 225, "nw": 315, "90": 90, "-90": 270, "450": 90, "30°": 30}
+	for in, exp := range tests {
+		out, err := ParseFacing(in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", in, err)
+			continue
+		}
+		if out != exp {
+			t.Errorf("%q: expected %d, got %d", in, exp, out)
+		}
+	}
+	if _, err := ParseFacing("up"); err == nil {
+		t.Errorf("expected `up` to be an error")
+	}
+}
+
+func TestFacingBetween(t *testing.T) {
+	tests := []struct {
+		to     image.Point
+		facing Facing
+	}{
+		{image.Pt(0, -3), 0},
+		{image.Pt(2, -2), 45},
+		{image.Pt(4, 0), 90},
+		{image.Pt(0, 1), 180},
+		{image.Pt(-1, 0), 270},
+		{image.Pt(1, -3), 18},
+	}
+	for _, test := range tests {
+		f, ok := FacingBetween(image.Pt(0, 0), test.to)
+		if !ok || f != test.facing {
+			t.Errorf("to %v: expected %d, got %d (%t)", test.to, test.facing, f, ok)
+		}
+	}
+	if _, ok := FacingBetween(image.Pt(1, 1), image.Pt(1, 1)); ok {
+		t.Errorf("expected no facing between a square and itself")
+	}
+}
+
+func TestFacingCompass(t *testing.T) {
+	tests := map[Facing]string{0: "n", 22: "n", 23: "ne", 100: "e", 200: "s", 350: "n"}
+	for f, exp := range tests {
+		if out := f.Compass(); out != exp {
+			t.Errorf("%d: expected %s, got %s", f, exp, out)
+		}
+	}
+	if s := Facing(135).String(); s != "se" {
+		t.Errorf("expected 135 to be se, got %s", s)
+	}
+	if s := Facing(100).String(); s != "100°" {
+		t.Errorf("expected 100 to be 100°, got %s", s)
+	}
+}
@@ -0,0 +1,245 @@
+package conv
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Style is the way squares are named.
+type Style string
+
+const (
+	// Letters name columns with letters and rows with numbers, like C4; this is the default.
+	Letters Style = "letters"
+	// Numeric names columns and rows with numbers, column first, like 3,4.
+	Numeric Style = "numeric"
+	// RowLetters name rows with letters and columns with numbers, row first, like D3.
+	RowLetters Style = "rowletters"
+)
+
+var Styles = []Style{Letters, Numeric, RowLetters}
+
+func ParseStyle(s string) (Style, error) {
+	for _, style := range Styles {
+		if Style(strings.ToLower(s)) == style {
+			return style, nil
+		}
+	}
+	names := []string{}
+	for _, style := range Styles {
+		names = append(names, string(style))
+	}
+	return "", fmt.Errorf("unknown coordinate style %q; try %s", s, strings.Join(names, ", "))
+}
+
+// Notation is the way a context names squares. The zero value is the letters-and-numbers notation, where the
+// top-left square is A1.
+type Notation struct {
+	Style Style
+
+	// Origin is added to a square's position before it's named, so that the labels can match a map's own numbering.
+	Origin image.Point
+
+	// Zero is set when numbers count through zero. Otherwise, as by default, the first number is 1, and the one before
+	// it is -1.
+	Zero bool
+}
+
+func (n Notation) style() Style {
+	if n.Style == "" {
+		return Letters
+	}
+	return n.Style
+}
+
+// number returns how the numbered axes call position `v`.
+func (n Notation) number(v int) string {
+	if v < 0 || n.Zero {
+		return strconv.Itoa(v)
+	}
+	return strconv.Itoa(v + 1)
+}
+
+// Column returns the name of column `x`.
+func (n Notation) Column(x int) string {
+	x += n.Origin.X
+	if n.style() == Letters {
+		return ToLetter(x)
+	}
+	return n.number(x)
+}
+
+// Row returns the name of row `y`.
+func (n Notation) Row(y int) string {
+	y += n.Origin.Y
+	if n.style() == RowLetters {
+		return ToLetter(y)
+	}
+	return n.number(y)
+}
+
+// Format returns the name of the square at `pt`.
+func (n Notation) Format(pt image.Point) string {
+	switch n.style() {
+	case Numeric:
+		return n.Column(pt.X) + "," + n.Row(pt.Y)
+	case RowLetters:
+		return n.Row(pt.Y) + n.Column(pt.X)
+	}
+	return n.Column(pt.X) + n.Row(pt.Y)
+}
+
+var numericCoordRe = regexp.MustCompile(`^(-?[0-9]+),(-?[0-9]+)(n|ne|e|se|s|sw|w|nw)?$`)
+
+// Parse parses the name of a square, like `c4`, perhaps followed by a direction naming one of its sides or corners,
+// like `c4ne`, as `Format` would write it.
+func (n Notation) Parse(rc string, directionAllowed bool) (point image.Point, direction string, err error) {
+	rc = strings.ToLower(rc)
+	re := coordRe
+	if n.style() == Numeric {
+		re = numericCoordRe
+	}
+
+	matches := re.FindStringSubmatch(rc)
+	if matches == nil {
+		return image.Point{}, "", errors.New("not an RC coordinate")
+	}
+	if !directionAllowed && matches[3] != "" {
+		return image.Point{}, "", errors.New("direction not allowed in this context")
+	}
+	point, err = n.ParsePair(matches[1], matches[2])
+	return point, matches[3], err
+}
+
+// ParsePair parses a square's name given as two words, like `c 4`, or `3, 4`.
+func (n Notation) ParsePair(a, b string) (image.Point, error) {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	var x, y int
+	var err error
+	switch n.style() {
+	case Numeric:
+		if x, err = n.parseNumber(strings.TrimSuffix(a, ","), "X"); err != nil {
+			return image.Point{}, err
+		}
+		y, err = n.parseNumber(b, "Y")
+	case RowLetters:
+		if y, err = parseLetters(a, "Y coordinate must be a row letter"); err != nil {
+			return image.Point{}, err
+		}
+		x, err = n.parseNumber(b, "X")
+	default:
+		if x, err = parseLetters(a, "X coordinate must be a column letter"); err != nil {
+			return image.Point{}, err
+		}
+		y, err = n.parseNumber(b, "Y")
+	}
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(x, y).Sub(n.Origin), nil
+}
+
+// SplitArgs splits the comma-separated arguments of a shape, like `circle(3,4,15)`, keeping together the two halves of
+// numeric coordinates.
+func (n Notation) SplitArgs(s string) []string {
+	args := strings.Split(s, ",")
+	if n.style() != Numeric {
+		return args
+	}
+	ret := []string{}
+	for i := 0; i < len(args); i++ {
+		if i+1 < len(args) && yCoordRe.MatchString(args[i]) {
+			if _, _, err := n.Parse(args[i]+","+args[i+1], true); err == nil {
+				ret = append(ret, args[i]+","+args[i+1])
+				i++
+				continue
+			}
+		}
+		ret = append(ret, args[i])
+	}
+	return ret
+}
+
+func parseLetters(s string, msg string) (int, error) {
+	if !xCoordRe.MatchString(s) {
+		return 0, errors.New(msg)
+	}
+
+	accum := 0
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+		s = s[1:]
+	}
+
+	for i := 0; i < len(s); i++ {
+		accum = accum*26 + int(s[i]) - int('a')
+	}
+	return accum * sign, nil
+}
+
+func (n Notation) parseNumber(s string, axis string) (int, error) {
+	if !yCoordRe.MatchString(s) {
+		return 0, fmt.Errorf("%s coordinate must be a number", axis)
+	}
+
+	accum, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s coordinate: %s", axis, err)
+	}
+	if n.Zero {
+		return accum, nil
+	}
+	if accum < 0 {
+		accum += 1
+	}
+	return accum - 1, nil
+}
+
+// Placement is where a map's coordinate labels are drawn.
+type Placement string
+
+const (
+	// Inside draws labels in the top row and left column of the squares shown; this is the default.
+	Inside Placement = "inside"
+	// Edges draws labels in a margin around all four edges of the squares shown, so that they cover nothing.
+	Edges Placement = "edges"
+	// Hidden draws no labels.
+	Hidden Placement = "none"
+)
+
+var Placements = []Placement{Inside, Edges, Hidden}
+
+func ParsePlacement(s string) (Placement, error) {
+	for _, p := range Placements {
+		if Placement(strings.ToLower(s)) == p {
+			return p, nil
+		}
+	}
+	names := []string{}
+	for _, p := range Placements {
+		names = append(names, string(p))
+	}
+	return "", fmt.Errorf("unknown label placement %q; try %s", s, strings.Join(names, ", "))
+}
+
+// Options are a context's choices of how squares are named, and how their names are drawn on its maps.
+type Options struct {
+	Notation
+	Labels Placement
+
+	// Font is the name of the font labels are drawn in; if empty, the renderer's default.
+	Font string
+}
+
+// Placement returns where labels are drawn; the zero value is Inside.
+func (o Options) Placement() Placement {
+	if o.Labels == "" {
+		return Inside
+	}
+	return o.Labels
+}
@@ -0,0 +1,81 @@
+package conv
+
+import (
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNotation(t *testing.T) {
+	type test struct {
+		n    Notation
+		pt   image.Point
+		name string
+	}
+	tests := []test{
+		{Notation{}, image.Pt(2, 3), "C4"},
+		{Notation{}, image.Pt(-1, -1), "-B-1"},
+		{Notation{Style: Numeric}, image.Pt(2, 3), "3,4"},
+		{Notation{Style: Numeric}, image.Pt(-3, 0), "-3,1"},
+		{Notation{Style: RowLetters}, image.Pt(2, 3), "D3"},
+		{Notation{Style: RowLetters}, image.Pt(27, 26), "BA28"},
+		{Notation{Origin: image.Pt(2, 9), Zero: true}, image.Pt(0, 0), "C9"},
+		{Notation{Style: Numeric, Zero: true}, image.Pt(0, 0), "0,0"},
+		{Notation{Style: Numeric, Zero: true}, image.Pt(-1, 1), "-1,1"},
+		{Notation{Style: Numeric, Origin: image.Pt(10, -2), Zero: true}, image.Pt(1, 3), "11,1"},
+	}
+
+	for _, test := range tests {
+		if name := test.n.Format(test.pt); name != test.name {
+			t.Errorf("%+v: expected %v to be named %q, not %q", test.n, test.pt, test.name, name)
+		}
+		pt, dir, err := test.n.Parse(strings.ToLower(test.name)+"ne", true)
+		if err != nil {
+			t.Errorf("%+v: parsing %q: %s", test.n, test.name+"ne", err)
+			continue
+		}
+		if pt != test.pt || dir != "ne" {
+			t.Errorf("%+v: expected %q to be %v ne, not %v %s", test.n, test.name+"ne", test.pt, pt, dir)
+		}
+	}
+}
+
+func TestNotationParse(t *testing.T) {
+	numeric := Notation{Style: Numeric}
+	if pt, err := numeric.ParsePair("3,", "4"); err != nil || pt != image.Pt(2, 3) {
+		t.Errorf("expected `3, 4` to be (2,3), not %v (err %v)", pt, err)
+	}
+	for _, bad := range []string{"c4", "3;4", "3,4x"} {
+		if _, _, err := numeric.Parse(bad, true); err == nil {
+			t.Errorf("expected %q not to parse as numeric", bad)
+		}
+	}
+	if _, _, err := numeric.Parse("3,4n", false); err == nil {
+		t.Errorf("expected direction to be refused")
+	}
+
+	rows := Notation{Style: RowLetters}
+	if pt, err := rows.ParsePair("d", "3"); err != nil || pt != image.Pt(2, 3) {
+		t.Errorf("expected `d 3` to be (2,3), not %v (err %v)", pt, err)
+	}
+	if _, err := rows.ParsePair("3", "d"); err == nil {
+		t.Errorf("expected `3 d` not to parse as rowletters")
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := map[string][]string{
+		"3,4,15":      {"3,4", "15"},
+		"3,4ne,ne,20": {"3,4ne", "ne", "20"},
+		"1,1,3,3":     {"1,1", "3,3"},
+	}
+	for in, want := range tests {
+		if got := (Notation{Style: Numeric}).SplitArgs(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to split into %q, not %q", in, want, got)
+		}
+	}
+	if got := (Notation{}).SplitArgs("c4,15"); !reflect.DeepEqual(got, []string{"c4", "15"}) {
+		t.Errorf("expected c4,15 to split in two, not %q", got)
+	}
+}
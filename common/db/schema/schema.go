@@ -267,6 +267,177 @@ var schema = []Migration{
 			`ALTER TABLE users          ALTER COLUMN id      TYPE VARCHAR(9);`,
 		},
 	},
+	{
+		Id: 25,
+		Up: map[string]string{"any": `CREATE TABLE tabula_walls (` +
+			`tabula_id BIGSERIAL REFERENCES tabulas (id) ON DELETE CASCADE,` +
+			`idx       INT NOT NULL,` +
+			`x1        REAL NOT NULL,` +
+			`y1        REAL NOT NULL,` +
+			`x2        REAL NOT NULL,` +
+			`y2        REAL NOT NULL,` +
+			`door      BOOLEAN NOT NULL DEFAULT FALSE,` +
+			`open      BOOLEAN NOT NULL DEFAULT FALSE,` +
+			`PRIMARY KEY (tabula_id, idx)` +
+			`)`},
+		Down: map[string]string{"any": `DROP TABLE tabula_walls`},
+	},
+	{
+		Id: 26,
+		Up: map[string]string{"any": `CREATE TABLE tabula_lights (` +
+			`tabula_id BIGSERIAL REFERENCES tabulas (id) ON DELETE CASCADE,` +
+			`idx       INT NOT NULL,` +
+			`x         REAL NOT NULL,` +
+			`y         REAL NOT NULL,` +
+			`radius    INT NOT NULL,` +
+			`r         SMALLINT NOT NULL,` +
+			`g         SMALLINT NOT NULL,` +
+			`b         SMALLINT NOT NULL,` +
+			`PRIMARY KEY (tabula_id, idx)` +
+			`)`},
+		Down: map[string]string{"any": `DROP TABLE tabula_lights`},
+	},
+	{
+		Id: 27,
+		Up: map[string]string{
+			"postgresql": `ALTER TABLE contexts ALTER COLUMN active_tabula DROP NOT NULL;` +
+				`ALTER TABLE contexts ALTER COLUMN active_tabula DROP DEFAULT;` +
+				`ALTER TABLE contexts ADD COLUMN output_format VARCHAR(8) NOT NULL DEFAULT '';` +
+				`ALTER TABLE contexts ADD COLUMN output_quality SMALLINT NOT NULL DEFAULT 0;` +
+				`ALTER TABLE contexts ADD COLUMN output_budget INTEGER NOT NULL DEFAULT 0;`,
+			"any": `ALTER TABLE contexts ADD COLUMN output_format VARCHAR(8) NOT NULL DEFAULT '';` +
+				`ALTER TABLE contexts ADD COLUMN output_quality SMALLINT NOT NULL DEFAULT 0;` +
+				`ALTER TABLE contexts ADD COLUMN output_budget INTEGER NOT NULL DEFAULT 0;`,
+		},
+		Down: map[string]string{
+			// Contexts with no active map couldn't be stored before this migration, and have no map to point at.
+			"postgresql": `DELETE FROM contexts WHERE active_tabula IS NULL;` +
+				`ALTER TABLE contexts ALTER COLUMN active_tabula SET DEFAULT nextval('contexts_active_tabula_seq'::regclass);` +
+				`ALTER TABLE contexts ALTER COLUMN active_tabula SET NOT NULL;` +
+				`ALTER TABLE contexts DROP COLUMN output_format;` +
+				`ALTER TABLE contexts DROP COLUMN output_quality;` +
+				`ALTER TABLE contexts DROP COLUMN output_budget;`,
+			"any": `ALTER TABLE contexts DROP COLUMN output_format;` +
+				`ALTER TABLE contexts DROP COLUMN output_quality;` +
+				`ALTER TABLE contexts DROP COLUMN output_budget;`,
+		},
+	},
+	{
+		Id: 28,
+		Up: map[string]string{"any": `CREATE TABLE context_history (` +
+			`context_id VARCHAR(128) NOT NULL,` +
+			`tabula_id  BIGINT REFERENCES tabulas (id) ON DELETE CASCADE,` +
+			`seq        INT NOT NULL,` +
+			`frame      TEXT NOT NULL,` +
+			`PRIMARY KEY (context_id, tabula_id, seq)` +
+			`)`},
+		Down: map[string]string{"any": `DROP TABLE context_history`},
+	},
+	{
+		Id: 29,
+		Up: map[string]string{"any": `ALTER TABLE tabulas ADD COLUMN grid_style VARCHAR(8) NOT NULL DEFAULT '';` +
+			`ALTER TABLE tabulas ADD COLUMN grid_width SMALLINT NOT NULL DEFAULT 0;` +
+			`ALTER TABLE tabulas ADD COLUMN grid_opacity SMALLINT NOT NULL DEFAULT 0;`,
+		},
+		Down: map[string]string{"any": `ALTER TABLE tabulas DROP COLUMN grid_style;` +
+			`ALTER TABLE tabulas DROP COLUMN grid_width;` +
+			`ALTER TABLE tabulas DROP COLUMN grid_opacity;`,
+		},
+	},
+	{
+		Id: 30,
+		Up: map[string]string{"any": `ALTER TABLE contexts ADD COLUMN coord_style VARCHAR(16) NOT NULL DEFAULT '';` +
+			`ALTER TABLE contexts ADD COLUMN coord_origin_x INTEGER NOT NULL DEFAULT 0;` +
+			`ALTER TABLE contexts ADD COLUMN coord_origin_y INTEGER NOT NULL DEFAULT 0;` +
+			`ALTER TABLE contexts ADD COLUMN coord_zero BOOLEAN NOT NULL DEFAULT FALSE;` +
+			`ALTER TABLE contexts ADD COLUMN coord_labels VARCHAR(8) NOT NULL DEFAULT '';` +
+			`ALTER TABLE contexts ADD COLUMN coord_font VARCHAR(16) NOT NULL DEFAULT '';`,
+		},
+		Down: map[string]string{"any": `ALTER TABLE contexts DROP COLUMN coord_style;` +
+			`ALTER TABLE contexts DROP COLUMN coord_origin_x;` +
+			`ALTER TABLE contexts DROP COLUMN coord_origin_y;` +
+			`ALTER TABLE contexts DROP COLUMN coord_zero;` +
+			`ALTER TABLE contexts DROP COLUMN coord_labels;` +
+			`ALTER TABLE contexts DROP COLUMN coord_font;`,
+		},
+	},
+	{
+		Id: 31,
+		Up: map[string]string{"any": `ALTER TABLE tabula_tokens ADD COLUMN owner VARCHAR(64) NOT NULL DEFAULT '';` +
+			`CREATE TABLE token_art (` +
+			`scope VARCHAR(8) NOT NULL,` +
+			`owner VARCHAR(64) NOT NULL,` +
+			`name  VARCHAR(128) NOT NULL,` +
+			`data  BYTEA NOT NULL,` +
+			`round BOOLEAN NOT NULL DEFAULT TRUE,` +
+			`r SMALLINT NOT NULL DEFAULT 0,` +
+			`g SMALLINT NOT NULL DEFAULT 0,` +
+			`b SMALLINT NOT NULL DEFAULT 0,` +
+			`a SMALLINT NOT NULL DEFAULT 0,` +
+			`no_border BOOLEAN NOT NULL DEFAULT FALSE,` +
+			`PRIMARY KEY (scope, owner, name)` +
+			`)`,
+		},
+		Down: map[string]string{"any": `DROP TABLE token_art;` +
+			`ALTER TABLE tabula_tokens DROP COLUMN owner;`,
+		},
+	},
+	{
+		Id:   32,
+		Up:   map[string]string{"any": `ALTER TABLE tabula_tokens ADD COLUMN facing SMALLINT NOT NULL DEFAULT -1`},
+		Down: map[string]string{"any": `ALTER TABLE tabula_tokens DROP COLUMN facing`},
+	},
+	{
+		Id:   33,
+		Up:   map[string]string{"any": `ALTER TABLE tabula_tokens ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE`},
+		Down: map[string]string{"any": `ALTER TABLE tabula_tokens DROP COLUMN hidden`},
+	},
+	{
+		Id:   34,
+		Up:   map[string]string{"any": `ALTER TABLE tabula_tokens ADD COLUMN elevation INTEGER NOT NULL DEFAULT 0`},
+		Down: map[string]string{"any": `ALTER TABLE tabula_tokens DROP COLUMN elevation`},
+	},
+	{
+		Id: 35,
+		Up: map[string]string{"any": `CREATE TABLE token_groups (` +
+			`context_id VARCHAR(128) NOT NULL,` +
+			`name       VARCHAR(128) NOT NULL,` +
+			`seq        INT NOT NULL,` +
+			`token      VARCHAR(128) NOT NULL,` +
+			`PRIMARY KEY (context_id, name, seq)` +
+			`)`},
+		Down: map[string]string{"any": `DROP TABLE token_groups`},
+	},
+	{
+		Id: 36,
+		Up: map[string]string{"any": `ALTER TABLE tabula_tokens ADD COLUMN speed INTEGER NOT NULL DEFAULT 0;` +
+			`ALTER TABLE tabula_tokens ADD COLUMN moved INTEGER NOT NULL DEFAULT 0;`,
+		},
+		Down: map[string]string{"any": `ALTER TABLE tabula_tokens DROP COLUMN speed;` +
+			`ALTER TABLE tabula_tokens DROP COLUMN moved;`,
+		},
+	},
+	{
+		Id: 37,
+		Up: map[string]string{"any": `CREATE TABLE context_terrain (` +
+			`context_id VARCHAR(128) NOT NULL,` +
+			`tabula_id  BIGINT REFERENCES tabulas (id) ON DELETE CASCADE,` +
+			`square_x   INTEGER NOT NULL,` +
+			`square_y   INTEGER NOT NULL,` +
+			`kind       VARCHAR(16) NOT NULL,` +
+			`PRIMARY KEY (context_id, tabula_id, square_x, square_y)` +
+			`)`},
+		Down: map[string]string{"any": `DROP TABLE context_terrain`},
+	},
+	{
+		Id: 38,
+		Up: map[string]string{"any": `ALTER TABLE tabula_tokens ADD COLUMN reach INTEGER NOT NULL DEFAULT 0;` +
+			`ALTER TABLE tabula_tokens ADD COLUMN faction VARCHAR(8) NOT NULL DEFAULT '';`,
+		},
+		Down: map[string]string{"any": `ALTER TABLE tabula_tokens DROP COLUMN reach;` +
+			`ALTER TABLE tabula_tokens DROP COLUMN faction;`,
+		},
+	},
 }
 
 func Reset(db anydb.AnyDb) error {
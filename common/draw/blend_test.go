@@ -3,6 +3,7 @@ package draw
 import (
 	"image"
 	"image/color"
+	"image/draw"
 	"testing"
 )
 
@@ -43,3 +44,37 @@ func TestBlendAt(t *testing.T) {
 		t.Fatalf("blended-at a was %d, not %d", a, 255<<8|255)
 	}
 }
+
+func TestBlendRect(t *testing.T) {
+	fast := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	slow := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for _, img := range []draw.Image{fast, slow} {
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				img.Set(x, y, &color.NRGBA{uint8(x * 60), uint8(y * 60), 200, uint8(100 + x*y*10)})
+			}
+		}
+		BlendRect(img, image.Rect(1, -1, 5, 3), &color.NRGBA{0, 255, 0, 128})
+	}
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			f := color.NRGBAModel.Convert(fast.At(x, y)).(color.NRGBA)
+			s := color.NRGBAModel.Convert(slow.At(x, y)).(color.NRGBA)
+			if diff(f.R, s.R) > 2 || diff(f.G, s.G) > 2 || diff(f.B, s.B) > 2 || f.A != s.A {
+				t.Errorf("at (%d,%d), RGBA blend gave %v but generic blend gave %v", x, y, f, s)
+			}
+		}
+	}
+
+	if c := fast.RGBAAt(0, 0); c.G != 0 {
+		t.Errorf("pixel outside the rectangle was altered: %v", c)
+	}
+}
+
+func diff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -31,7 +31,7 @@ func Pad(in draw.Image, bounds image.Rectangle) draw.Image {
 		dstR.Max.Y = bounds.Dy()
 	}
 
-	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
-	draw.Draw(out, dstR, in, srcPt, draw.Over)
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, dstR, in, srcPt, draw.Src)
 	return out
 }
@@ -0,0 +1,131 @@
+package draw
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// quantizeSamples is roughly how many pixels Quantize looks at, across all of its images.
+const quantizeSamples = 1 << 18
+
+// Quantize chooses a palette of at most `n` colors for `imgs` by median cut: starting from a box holding every sampled
+// color, it repeatedly splits a box at the median of its widest channel, and then takes the average of each box. The
+// box split is the one with the most pixels times that channel's range, so colors are spent where the images have
+// both many pixels and much variety, and a single flat color is never split at all.
+func Quantize(imgs []image.Image, n int) color.Palette {
+	total := 0
+	for _, img := range imgs {
+		total += img.Bounds().Dx() * img.Bounds().Dy()
+	}
+	stride := total/quantizeSamples + 1
+
+	pixels := []color.RGBA{}
+	i := 0
+	for _, img := range imgs {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if i++; i%stride != 0 {
+					continue
+				}
+				r, g, b, _ := img.At(x, y).RGBA()
+				pixels = append(pixels, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255})
+			}
+		}
+	}
+	if len(pixels) == 0 {
+		return color.Palette{color.Black}
+	}
+
+	boxes := []colorBox{newColorBox(pixels)}
+	for len(boxes) < n {
+		best := -1
+		for i, box := range boxes {
+			if box.span > 0 && (best < 0 || box.score() > boxes[best].score()) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		a, b := boxes[best].split()
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	ret := color.Palette{}
+	for _, box := range boxes {
+		ret = append(ret, box.average())
+	}
+	return ret
+}
+
+type colorBox struct {
+	pixels []color.RGBA
+	// channel is the channel (0 for red, 1 green, 2 blue) with the widest range, and span is that range.
+	channel int
+	span    int
+}
+
+func channel(c color.RGBA, ch int) uint8 {
+	switch ch {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	}
+	return c.B
+}
+
+func newColorBox(pixels []color.RGBA) colorBox {
+	ret := colorBox{pixels: pixels}
+	for ch := 0; ch < 3; ch++ {
+		min, max := uint8(255), uint8(0)
+		for _, p := range pixels {
+			v := channel(p, ch)
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if span := int(max) - int(min); span > ret.span || ch == 0 {
+			ret.channel, ret.span = ch, span
+		}
+	}
+	return ret
+}
+
+func (b colorBox) score() int {
+	return len(b.pixels) * b.span
+}
+
+func (b colorBox) split() (colorBox, colorBox) {
+	sort.Slice(b.pixels, func(i, j int) bool {
+		return channel(b.pixels[i], b.channel) < channel(b.pixels[j], b.channel)
+	})
+	// Split at the boundary between values nearest the median, so that no value ends up in both halves.
+	same := func(i int) bool { return channel(b.pixels[i-1], b.channel) == channel(b.pixels[i], b.channel) }
+	mid := len(b.pixels) / 2
+	for mid > 1 && same(mid) {
+		mid--
+	}
+	if same(mid) {
+		for mid = len(b.pixels) / 2; mid < len(b.pixels)-1 && same(mid); mid++ {
+		}
+	}
+	return newColorBox(b.pixels[:mid]), newColorBox(b.pixels[mid:])
+}
+
+func (b colorBox) average() color.Color {
+	var r, g, bl int
+	for _, p := range b.pixels {
+		r += int(p.R)
+		g += int(p.G)
+		bl += int(p.B)
+	}
+	n := len(b.pixels)
+	return color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 255}
+}
@@ -0,0 +1,55 @@
+package draw
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestQuantize(t *testing.T) {
+	// A few flat colors should come back exactly.
+	flat := image.NewRGBA(image.Rect(0, 0, 30, 30))
+	want := []color.RGBA{{255, 0, 0, 255}, {0, 128, 0, 255}, {10, 20, 30, 255}}
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 30; x++ {
+			flat.SetRGBA(x, y, want[x/10])
+		}
+	}
+	p := Quantize([]image.Image{flat}, 256)
+	if len(p) != len(want) {
+		t.Fatalf("expected %d colors, got %d: %v", len(want), len(p), p)
+	}
+	for _, c := range want {
+		if got := p.Convert(c); got != c {
+			t.Errorf("%v quantized to %v", c, got)
+		}
+	}
+
+	// A gradient should use the whole palette, and stay close to the original.
+	grad := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			grad.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	p = Quantize([]image.Image{grad, flat}, 64)
+	if len(p) != 64 {
+		t.Fatalf("expected 64 colors, got %d", len(p))
+	}
+	for y := 0; y < 256; y += 17 {
+		for x := 0; x < 256; x += 17 {
+			c := grad.RGBAAt(x, y)
+			got := p.Convert(c).(color.RGBA)
+			if d := abs(int(got.R)-int(c.R)) + abs(int(got.G)-int(c.G)) + abs(int(got.B)-int(c.B)); d > 48 {
+				t.Fatalf("%v quantized to %v, too far away", c, got)
+			}
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,246 @@
+// Package output encodes rendered maps for upload: as PNG, JPEG, or WebP, and optionally within a size budget, for
+// which it picks the encoding and scale.
+package output
+
+import (
+	"bytes"
+	"fmt"
+	mbLog "github.com/pdbogen/mapbot/common/log"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var log = mbLog.Log
+
+type Format string
+
+const (
+	PNG  Format = "png"
+	JPEG Format = "jpeg"
+	WebP Format = "webp"
+)
+
+// DefaultQuality is the JPEG quality used when none is chosen.
+const DefaultQuality = 85
+
+// minQuality is the lowest JPEG quality that Encode will fall back to in order to meet a budget.
+const minQuality = 50
+
+// minSide is the smallest that Encode will shrink an image to in order to meet a budget.
+const minSide = 256
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case PNG, JPEG, WebP:
+		return f, nil
+	case "jpg":
+		return JPEG, nil
+	}
+	return "", fmt.Errorf("unknown format %q; try png, jpeg, or webp", s)
+}
+
+func (f Format) Extension() string {
+	if f == JPEG {
+		return ".jpg"
+	}
+	return "." + string(f)
+}
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Options describe how a context wants its maps encoded. The zero value is a PNG of any size.
+type Options struct {
+	Format Format
+
+	// Quality is the JPEG quality, 1-100; if zero, DefaultQuality.
+	Quality int
+
+	// Budget is the largest an encoded map may be, in bytes; if zero, there is no limit.
+	Budget int
+}
+
+func (o Options) format() Format {
+	if o.Format == "" {
+		return PNG
+	}
+	return o.Format
+}
+
+func (o Options) quality() int {
+	if o.Quality <= 0 || o.Quality > 100 {
+		return DefaultQuality
+	}
+	return o.Quality
+}
+
+func (o Options) String() string {
+	ret := string(o.format())
+	if o.format() == JPEG {
+		ret += fmt.Sprintf(" at quality %d", o.quality())
+	}
+	if o.Budget > 0 {
+		ret += ", at most " + FormatSize(o.Budget)
+	}
+	return ret
+}
+
+// Encoded is an encoded image.
+type Encoded struct {
+	Data   []byte
+	Format Format
+
+	// Scale is the size of the encoded image relative to the original.
+	Scale float64
+}
+
+// Encode encodes `img` as `o` describes. If the result is over budget, JPEG is tried at decreasing qualities, and
+// then the image is shrunk until some encoding fits. If nothing fits, the smallest encoding found is returned.
+func Encode(img image.Image, o Options) (*Encoded, error) {
+	var best *Encoded
+	scale := 1.0
+	scaled := img
+	for {
+		for _, c := range candidates(o) {
+			data, err := encode(scaled, c.Format, c.Quality)
+			if err != nil {
+				return nil, err
+			}
+			enc := &Encoded{Data: data, Format: c.Format, Scale: scale}
+			if o.Budget <= 0 || len(data) <= o.Budget {
+				return enc, nil
+			}
+			if best == nil || len(data) < len(best.Data) {
+				best = enc
+			}
+		}
+
+		// Image size goes roughly with pixel count, so aim for the budget with a little room to spare.
+		b := scaled.Bounds()
+		shrink := math.Sqrt(float64(o.Budget)/float64(len(best.Data))) * 0.95
+		shrink = math.Max(0.5, math.Min(0.9, shrink))
+		w, h := int(float64(b.Dx())*shrink), int(float64(b.Dy())*shrink)
+		if w < minSide && h < minSide {
+			log.Warningf("could not fit %dx%d image into %s; smallest was %s", img.Bounds().Dx(), img.Bounds().Dy(),
+				FormatSize(o.Budget), FormatSize(len(best.Data)))
+			return best, nil
+		}
+		scale *= float64(w) / float64(b.Dx())
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), scaled, b, xdraw.Src, nil)
+		scaled = dst
+	}
+}
+
+// candidates lists the encodings to try at each scale, in order of preference: the one asked for, and then, if there's
+// a budget, JPEG at successively lower qualities.
+func candidates(o Options) []Options {
+	ret := []Options{{Format: o.format(), Quality: o.quality()}}
+	if o.Budget <= 0 {
+		return ret
+	}
+	q := DefaultQuality
+	if o.format() == JPEG {
+		q = o.quality() - 10
+	}
+	for ; q >= minQuality; q -= 10 {
+		ret = append(ret, Options{Format: JPEG, Quality: q})
+	}
+	return ret
+}
+
+func encode(img image.Image, f Format, quality int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	switch f {
+	case PNG:
+		err = encodePNG(buf, img)
+	case JPEG:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	case WebP:
+		err = encodeWebP(buf, img)
+	default:
+		err = fmt.Errorf("unknown format %q", f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s: %s", f, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodePNG encodes with the best compression, and, if the image has few enough colors, with a palette.
+func encodePNG(buf *bytes.Buffer, img image.Image) error {
+	enc := &png.Encoder{CompressionLevel: png.BestCompression}
+	if p := paletted(img); p != nil {
+		img = p
+	}
+	return enc.Encode(buf, img)
+}
+
+// paletted returns a copy of `img` using a palette, if it has no more than 256 colors; otherwise, nil.
+func paletted(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	index := map[color.NRGBA]uint8{}
+	palette := color.Palette{}
+	ret := image.NewPaletted(b, nil)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			i, ok := index[c]
+			if !ok {
+				if len(palette) == 256 {
+					return nil
+				}
+				i = uint8(len(palette))
+				index[c] = i
+				palette = append(palette, c)
+			}
+			ret.Pix[ret.PixOffset(x, y)] = i
+		}
+	}
+	ret.Palette = palette
+	return ret
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int
+}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1}}
+
+// ParseSize parses a size like 500KB, 1.5MB, or 2000000; `off`, `none`, and 0 are all zero.
+func ParseSize(s string) (int, error) {
+	orig := s
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "off" || s == "none" {
+		return 0, nil
+	}
+	mult := 1
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size; try something like 500KB or 2MB", orig)
+	}
+	return int(n * float64(mult)), nil
+}
+
+func FormatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + "MB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + "KB"
+	}
+	return strconv.Itoa(n) + "B"
+}
@@ -0,0 +1,210 @@
+package output
+
+import (
+	"bytes"
+	"golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// testImages returns images that exercise the encoders: noise, flat areas, repeats, transparency, and odd sizes.
+func testImages() map[string]image.Image {
+	rng := rand.New(rand.NewSource(1))
+	ret := map[string]image.Image{}
+
+	noise := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	rng.Read(noise.Pix)
+	ret["noise"] = noise
+
+	flat := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for i := range flat.Pix {
+		flat.Pix[i] = 0x80
+	}
+	ret["flat"] = flat
+
+	grid := image.NewRGBA(image.Rect(0, 0, 257, 129))
+	for y := 0; y < 129; y++ {
+		for x := 0; x < 257; x++ {
+			c := color.RGBA{uint8(x), uint8(y * 2), uint8(x ^ y), 255}
+			if x%16 == 0 || y%16 == 0 {
+				c = color.RGBA{0, 0, 0, 255}
+			}
+			grid.SetRGBA(x, y, c)
+		}
+	}
+	ret["grid"] = grid
+
+	alpha := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			alpha.SetNRGBA(x, y, color.NRGBA{uint8(x * 6), 200, uint8(y * 6), uint8(x * y)})
+		}
+	}
+	ret["alpha"] = alpha
+
+	ret["pixel"] = image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	ret["offset"] = grid.SubImage(image.Rect(10, 20, 100, 90))
+	return ret
+}
+
+func sameImage(t *testing.T, name string, want, got image.Image) {
+	if want.Bounds().Size() != got.Bounds().Size() {
+		t.Fatalf("%s: decoded size %v, not %v", name, got.Bounds().Size(), want.Bounds().Size())
+	}
+	wb, gb := want.Bounds(), got.Bounds()
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			w := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y)).(color.NRGBA)
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y)).(color.NRGBA)
+			if w.A == 0 && g.A == 0 {
+				continue
+			}
+			if w != g {
+				t.Fatalf("%s: pixel (%d,%d) was %v, not %v", name, x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestWebP(t *testing.T) {
+	for name, img := range testImages() {
+		enc, err := Encode(img, Options{Format: WebP})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		got, err := webp.Decode(bytes.NewReader(enc.Data))
+		if err != nil {
+			t.Fatalf("%s: decoding: %s", name, err)
+		}
+		sameImage(t, name, img, got)
+	}
+}
+
+func TestWebPCompresses(t *testing.T) {
+	img := testImages()["grid"]
+	enc, err := Encode(img, Options{Format: WebP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw := 4 * img.Bounds().Dx() * img.Bounds().Dy(); len(enc.Data) > raw/4 {
+		t.Fatalf("webp was %d bytes, more than a quarter of the %d raw bytes", len(enc.Data), raw)
+	}
+}
+
+func TestPNG(t *testing.T) {
+	for name, img := range testImages() {
+		enc, err := Encode(img, Options{})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if enc.Format != PNG {
+			t.Fatalf("%s: default format was %s, not png", name, enc.Format)
+		}
+		got, err := png.Decode(bytes.NewReader(enc.Data))
+		if err != nil {
+			t.Fatalf("%s: decoding: %s", name, err)
+		}
+		sameImage(t, name, img, got)
+	}
+
+	// Few colors should produce a paletted image.
+	enc, _ := Encode(testImages()["flat"], Options{Format: PNG})
+	got, _ := png.Decode(bytes.NewReader(enc.Data))
+	if _, ok := got.(*image.Paletted); !ok {
+		t.Fatalf("single-color png decoded as %T, not paletted", got)
+	}
+}
+
+func TestJPEGQuality(t *testing.T) {
+	img := testImages()["noise"]
+	low, err := Encode(img, Options{Format: JPEG, Quality: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := Encode(img, Options{Format: JPEG, Quality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(low.Data) >= len(high.Data) {
+		t.Fatalf("quality 20 was %d bytes, not smaller than quality 95's %d", len(low.Data), len(high.Data))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(low.Data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	img := image.NewNRGBA(image.Rect(0, 0, 1000, 800))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+
+	unlimited, err := Encode(img, Options{Format: PNG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlimited.Scale != 1 || unlimited.Format != PNG {
+		t.Fatalf("without a budget, got %s at %f", unlimited.Format, unlimited.Scale)
+	}
+
+	for _, budget := range []int{1 << 20, 200 << 10} {
+		enc, err := Encode(img, Options{Format: PNG, Budget: budget})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(enc.Data) > budget {
+			t.Fatalf("budget %d: encoded to %d bytes", budget, len(enc.Data))
+		}
+		if enc.Format != JPEG {
+			t.Fatalf("budget %d: expected to fall back to jpeg, got %s", budget, enc.Format)
+		}
+		got, err := jpeg.Decode(bytes.NewReader(enc.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := int(1000 * enc.Scale); got.Bounds().Dx() != w {
+			t.Fatalf("budget %d: scale %f, but width %d", budget, enc.Scale, got.Bounds().Dx())
+		}
+	}
+
+	// A budget that can't be met still produces something.
+	enc, err := Encode(img, Options{Format: WebP, Budget: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc.Scale >= 1 {
+		t.Fatalf("impossible budget wasn't met by shrinking; scale %f", enc.Scale)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int{
+		"off":    0,
+		"0":      0,
+		"1000":   1000,
+		"500KB":  500 << 10,
+		"1.5mb":  3 << 19,
+		"2M":     2 << 20,
+		" 10 k ": 10 << 10,
+	}
+	for in, want := range cases {
+		got, err := ParseSize(in)
+		if err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+		if got != want {
+			t.Fatalf("%q parsed as %d, not %d", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "big", "-1MB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Fatalf("%q parsed without error", in)
+		}
+	}
+}
@@ -0,0 +1,737 @@
+package output
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// The standard library and x/image can only decode WebP, so this is a small encoder for the lossless (VP8L) format. It
+// uses the subtract-green transform, a color cache, and greedy LZ77 backward references with a single set of prefix
+// codes for the whole image; simple next to libwebp, but enough to do much better than PNG on rendered maps.
+
+const (
+	webpMaxSide = 1 << 14
+
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	colorCacheBits       = 10
+	colorCacheMultiplier = 0x1e35a7bd
+
+	minMatch = 3
+	maxMatch = 4096
+
+	// maxDistance is the furthest back a reference can reach, given 40 distance codes and the 120 codes for nearby
+	// pixels.
+	maxDistance = 1<<20 - 120
+
+	// hashBits sizes the table used to find earlier runs of pixels matching the current ones.
+	hashBits = 16
+
+	// predictorBits is the log-2 size of the tiles that each choose their own predictor.
+	predictorBits = 4
+
+	maxCodeLength       = 15
+	maxCodeLengthLength = 7
+)
+
+// codeLengthCodeOrder is the order in which the lengths of the code length code are written.
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeWebP writes `img` to `w` as a lossless WebP.
+func encodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > webpMaxSide || height > webpMaxSide {
+		return fmt.Errorf("webp images must be between 1x1 and %dx%d, not %dx%d", webpMaxSide, webpMaxSide, width, height)
+	}
+
+	argb, hasAlpha := argbPixels(img)
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if hasAlpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// Two transforms: subtract green, and then the predictor, whose modes are themselves a small image.
+	subtractGreen(argb)
+	bw.write(1, 1)
+	bw.write(2, 2)
+
+	modes, tilesPerRow := predict(argb, width, height)
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(predictorBits-2, 3)
+	writeImage(bw, modes, tilesPerRow, false)
+
+	bw.write(0, 1)
+	writeImage(bw, argb, width, true)
+	data := bw.bytes()
+
+	// The RIFF container; chunks are padded to an even length.
+	pad := len(data) & 1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+len(data)+pad))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if pad != 0 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// writeImage writes an entropy-coded image: the main image if `topLevel`, and otherwise a transform's sub-image.
+func writeImage(bw *bitWriter, argb []uint32, width int, topLevel bool) {
+	symbols := tokenize(argb, width)
+
+	bw.write(1, 1)
+	bw.write(colorCacheBits, 4)
+
+	// No meta prefix codes; every pixel uses the same codes.
+	if topLevel {
+		bw.write(0, 1)
+	}
+
+	var histograms [5][]int
+	histograms[0] = make([]int, nLiteralCodes+nLengthCodes+1<<colorCacheBits)
+	for i := 1; i < 4; i++ {
+		histograms[i] = make([]int, 256)
+	}
+	histograms[4] = make([]int, nDistanceCodes)
+	for _, s := range symbols {
+		s.count(&histograms)
+	}
+
+	var codes [5]*prefixCode
+	for i, h := range histograms {
+		codes[i] = newPrefixCode(h, maxCodeLength)
+		codes[i].writeTo(bw)
+	}
+	for _, s := range symbols {
+		s.writeTo(bw, &codes)
+	}
+}
+
+// argbPixels returns the non-premultiplied pixels of `img` as 0xAARRGGBB, and whether any of them is not opaque.
+func argbPixels(img image.Image) ([]uint32, bool) {
+	b := img.Bounds()
+	ret := make([]uint32, 0, b.Dx()*b.Dy())
+	hasAlpha := false
+
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				nrgba.Set(x, y, color.NRGBAModel.Convert(img.At(x, y)))
+			}
+		}
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := nrgba.Pix[nrgba.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			p := row[4*x : 4*x+4]
+			if p[3] != 0xff {
+				hasAlpha = true
+			}
+			ret = append(ret, uint32(p[3])<<24|uint32(p[0])<<16|uint32(p[1])<<8|uint32(p[2]))
+		}
+	}
+	return ret, hasAlpha
+}
+
+// subtractGreen applies the subtract-green transform, which removes much of the correlation between channels.
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// predict applies the predictor transform in place, choosing for each tile the mode that leaves the smallest residuals;
+// it returns the modes, as an image `tilesPerRow` wide with the mode in the green channel.
+func predict(argb []uint32, width, height int) ([]uint32, int) {
+	tileSize := 1 << predictorBits
+	tilesPerRow := (width + tileSize - 1) / tileSize
+	tilesPerCol := (height + tileSize - 1) / tileSize
+	modes := make([]uint32, tilesPerRow*tilesPerCol)
+
+	// The residuals are computed from the original pixels, which is also what the decoder will have reconstructed when
+	// it needs them; so the modes are all chosen first, a row of tiles at a time in parallel, and the residuals written
+	// afterward.
+	rows := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ty := range rows {
+				for tx := 0; tx < tilesPerRow; tx++ {
+					modes[ty*tilesPerRow+tx] = 0xff000000 | uint32(bestMode(argb, width, height, tx, ty))<<8
+				}
+			}
+		}()
+	}
+	for ty := 0; ty < tilesPerCol; ty++ {
+		rows <- ty
+	}
+	close(rows)
+	wg.Wait()
+
+	residuals := make([]uint32, len(argb))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mode := int(modes[(y>>predictorBits)*tilesPerRow+(x>>predictorBits)]>>8) & 0xf
+			residuals[y*width+x] = subPixels(argb[y*width+x], predictPixel(argb, width, x, y, mode))
+		}
+	}
+	copy(argb, residuals)
+	return modes, tilesPerRow
+}
+
+// bestMode returns the predictor mode that leaves the smallest residuals in the tile at (tx, ty).
+func bestMode(argb []uint32, width, height, tx, ty int) int {
+	tileSize := 1 << predictorBits
+	best, bestCost := 0, -1
+	for mode := 0; mode < 14; mode++ {
+		cost := 0
+		for y := ty * tileSize; y < height && y < (ty+1)*tileSize; y++ {
+			for x := tx * tileSize; x < width && x < (tx+1)*tileSize; x++ {
+				cost += residualCost(subPixels(argb[y*width+x], predictPixel(argb, width, x, y, mode)))
+			}
+		}
+		if bestCost < 0 || cost < bestCost {
+			best, bestCost = mode, cost
+		}
+	}
+	return best
+}
+
+// residualCost estimates how expensive a residual will be to store: the sum of the magnitudes of its channels.
+func residualCost(r uint32) int {
+	cost := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		c := int(int8(r >> shift))
+		if c < 0 {
+			c = -c
+		}
+		cost += c
+	}
+	return cost
+}
+
+// predictPixel predicts the pixel at (x, y) from its neighbors using `mode`; the first row and column have fixed modes.
+func predictPixel(argb []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+
+	// On the last column, the pixel "above and to the right" is the first on the current row.
+	l, t, tr, tl := argb[i-1], argb[i-width], argb[i-width+1], argb[i-width-1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		if channelDistance(tl, t) < channelDistance(tl, l) {
+			return l
+		}
+		return t
+	case 12:
+		return channelwise(l, t, tl, func(a, b, c int) int { return a + b - c })
+	case 13:
+		return channelwise(average2(l, t), tl, 0, func(a, b, _ int) int { return a + (a-b)/2 })
+	}
+	return 0
+}
+
+func average2(a, b uint32) uint32 {
+	return channelwise(a, b, 0, func(a, b, _ int) int { return (a + b) / 2 })
+}
+
+// channelwise applies `f` to each channel of the pixels, clamping the results to 0-255.
+func channelwise(a, b, c uint32, f func(a, b, c int) int) uint32 {
+	ret := uint32(0)
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := f(int(a>>shift&0xff), int(b>>shift&0xff), int(c>>shift&0xff))
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		ret |= uint32(v) << shift
+	}
+	return ret
+}
+
+func channelDistance(a, b uint32) int {
+	d := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		c := int(a>>shift&0xff) - int(b>>shift&0xff)
+		if c < 0 {
+			c = -c
+		}
+		d += c
+	}
+	return d
+}
+
+// subPixels subtracts each channel of `b` from `a`, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	ret := uint32(0)
+	for shift := uint(0); shift < 32; shift += 8 {
+		ret |= (a>>shift - b>>shift) & 0xff << shift
+	}
+	return ret
+}
+
+// symbol is one step of the compressed image: a literal pixel, a color cache hit, or a backward reference.
+type symbol struct {
+	kind  byte
+	argb  uint32
+	index int
+	// length and distance code of a backward reference.
+	length, distance int
+}
+
+const (
+	literal = iota
+	cached
+	backref
+)
+
+func (s symbol) count(h *[5][]int) {
+	switch s.kind {
+	case literal:
+		h[0][(s.argb>>8)&0xff]++
+		h[1][(s.argb>>16)&0xff]++
+		h[2][s.argb&0xff]++
+		h[3][s.argb>>24]++
+	case cached:
+		h[0][nLiteralCodes+nLengthCodes+s.index]++
+	case backref:
+		lc, _, _ := prefixEncode(s.length)
+		dc, _, _ := prefixEncode(s.distance)
+		h[0][nLiteralCodes+lc]++
+		h[4][dc]++
+	}
+}
+
+func (s symbol) writeTo(bw *bitWriter, codes *[5]*prefixCode) {
+	switch s.kind {
+	case literal:
+		codes[0].writeSymbol(bw, int((s.argb>>8)&0xff))
+		codes[1].writeSymbol(bw, int((s.argb>>16)&0xff))
+		codes[2].writeSymbol(bw, int(s.argb&0xff))
+		codes[3].writeSymbol(bw, int(s.argb>>24))
+	case cached:
+		codes[0].writeSymbol(bw, nLiteralCodes+nLengthCodes+s.index)
+	case backref:
+		lc, lBits, lExtra := prefixEncode(s.length)
+		codes[0].writeSymbol(bw, nLiteralCodes+lc)
+		bw.write(lExtra, lBits)
+		dc, dBits, dExtra := prefixEncode(s.distance)
+		codes[4].writeSymbol(bw, dc)
+		bw.write(dExtra, dBits)
+	}
+}
+
+// prefixEncode splits a length or distance code (at least 1) into its prefix symbol and extra bits.
+func prefixEncode(v int) (code int, nBits uint, extra uint32) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	high := uint(0)
+	for (v >> (high + 1)) != 0 {
+		high++
+	}
+	second := (v >> (high - 1)) & 1
+	nBits = high - 1
+	return int(2*high) + second, nBits, uint32(v) & (1<<nBits - 1)
+}
+
+// distanceCode returns the code for a backward reference `dist` pixels back; the pixels directly above and directly
+// to the left have short codes of their own.
+func distanceCode(dist, width int) int {
+	switch dist {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return dist + 120
+}
+
+// tokenize turns the pixels into symbols, greedily taking the longest of the backward references it finds to the
+// previous pixel, the pixel above, and the last position with the same two pixels.
+func tokenize(argb []uint32, width int) []symbol {
+	var cache [1 << colorCacheBits]uint32
+	var cacheValid [1 << colorCacheBits]bool
+	addToCache := func(p uint32) {
+		i := (p * colorCacheMultiplier) >> (32 - colorCacheBits)
+		cache[i] = p
+		cacheValid[i] = true
+	}
+
+	hashes := make([]int32, 1<<hashBits)
+	for i := range hashes {
+		hashes[i] = -1
+	}
+	hashAt := func(i int) uint32 {
+		return ((argb[i] * 0x9e3779b1) ^ (argb[i+1] * colorCacheMultiplier)) >> (32 - hashBits)
+	}
+	matchLength := func(i, dist int) int {
+		n := 0
+		for i+n < len(argb) && n < maxMatch && argb[i+n] == argb[i+n-dist] {
+			n++
+		}
+		return n
+	}
+
+	ret := make([]symbol, 0, len(argb)/4)
+	for i := 0; i < len(argb); {
+		bestLen, bestDist := 0, 0
+		try := func(dist int) {
+			if dist < 1 || dist > i || dist > maxDistance {
+				return
+			}
+			if n := matchLength(i, dist); n > bestLen {
+				bestLen, bestDist = n, dist
+			}
+		}
+		try(1)
+		try(width)
+		var h uint32
+		if i+1 < len(argb) {
+			h = hashAt(i)
+			if prev := hashes[h]; prev >= 0 {
+				try(i - int(prev))
+			}
+		}
+
+		if bestLen >= minMatch {
+			ret = append(ret, symbol{kind: backref, length: bestLen, distance: distanceCode(bestDist, width)})
+			for j := i; j < i+bestLen; j++ {
+				addToCache(argb[j])
+				if j+1 < len(argb) {
+					hashes[hashAt(j)] = int32(j)
+				}
+			}
+			i += bestLen
+			continue
+		}
+
+		p := argb[i]
+		ci := (p * colorCacheMultiplier) >> (32 - colorCacheBits)
+		if cacheValid[ci] && cache[ci] == p {
+			ret = append(ret, symbol{kind: cached, index: int(ci)})
+		} else {
+			ret = append(ret, symbol{kind: literal, argb: p})
+		}
+		addToCache(p)
+		if i+1 < len(argb) {
+			hashes[h] = int32(i)
+		}
+		i++
+	}
+	return ret
+}
+
+// prefixCode is a canonical prefix (Huffman) code for one alphabet.
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+
+	// used holds the symbols with non-zero counts, in order. A code for zero or one symbol takes no bits to write.
+	used []int
+}
+
+// newPrefixCode builds a code for symbols with the given counts, with no code longer than `limit` bits.
+func newPrefixCode(counts []int, limit int) *prefixCode {
+	ret := &prefixCode{lengths: make([]int, len(counts)), codes: make([]uint32, len(counts))}
+	for s, c := range counts {
+		if c > 0 {
+			ret.used = append(ret.used, s)
+		}
+	}
+	if len(ret.used) < 2 {
+		for _, s := range ret.used {
+			ret.lengths[s] = 1
+		}
+		return ret
+	}
+
+	// Flattening the counts shortens the longest codes, and eventually makes every code the same length.
+	adjusted := append([]int{}, counts...)
+	for !huffmanLengths(adjusted, ret.lengths, limit) {
+		for s, c := range adjusted {
+			if c > 0 {
+				adjusted[s] = c/2 + 1
+			}
+		}
+	}
+	ret.assignCodes()
+	return ret
+}
+
+// huffmanLengths fills in the Huffman code lengths for `counts`, returning false if any would be longer than `limit`.
+func huffmanLengths(counts []int, lengths []int, limit int) bool {
+	h := &nodeHeap{}
+	for s, c := range counts {
+		if c > 0 {
+			*h = append(*h, &heapNode{count: c, symbol: s})
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 1 {
+		a := heap.Pop(h).(*heapNode)
+		b := heap.Pop(h).(*heapNode)
+		heap.Push(h, &heapNode{count: a.count + b.count, symbol: -1, left: a, right: b})
+	}
+
+	ok := true
+	var walk func(n *heapNode, depth int)
+	walk = func(n *heapNode, depth int) {
+		if n.left == nil {
+			lengths[n.symbol] = depth
+			if depth > limit {
+				ok = false
+			}
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk((*h)[0], 0)
+	return ok
+}
+
+type heapNode struct {
+	count       int
+	symbol      int
+	left, right *heapNode
+}
+
+// nodeHeap orders nodes by count, breaking ties by symbol so that codes are deterministic.
+type nodeHeap []*heapNode
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h nodeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x interface{}) { *h = append(*h, x.(*heapNode)) }
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// assignCodes computes the canonical codes for the lengths, bit-reversed since the stream is written least
+// significant bit first.
+func (p *prefixCode) assignCodes() {
+	var count [maxCodeLength + 2]uint32
+	for _, l := range p.lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [maxCodeLength + 2]uint32
+	code := uint32(0)
+	for l := 1; l < len(next); l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range p.lengths {
+		if l > 0 {
+			p.codes[s] = reverse(next[l], uint(l))
+			next[l]++
+		}
+	}
+}
+
+func reverse(v uint32, n uint) uint32 {
+	ret := uint32(0)
+	for i := uint(0); i < n; i++ {
+		ret = ret<<1 | (v>>i)&1
+	}
+	return ret
+}
+
+func (p *prefixCode) writeSymbol(bw *bitWriter, s int) {
+	if len(p.used) < 2 {
+		return
+	}
+	bw.write(p.codes[s], uint(p.lengths[s]))
+}
+
+// writeTo writes the code itself: as a "simple" code if it has at most two symbols that fit in a byte, and otherwise
+// as its code lengths, which are themselves compressed with a prefix code.
+func (p *prefixCode) writeTo(bw *bitWriter) {
+	if len(p.used) <= 2 && (len(p.used) == 0 || p.used[len(p.used)-1] < 256) {
+		symbols := append([]int{}, p.used...)
+		if len(symbols) == 0 {
+			symbols = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(symbols[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			bw.write(uint32(symbols[1]), 8)
+		}
+		return
+	}
+
+	// The lengths become a series of literal lengths (0-15), repeats of the previous non-zero length (16), and runs
+	// of zeroes (17 and 18).
+	type token struct {
+		code  int
+		extra uint32
+	}
+	tokens := []token{}
+	prev := 8
+	for i := 0; i < len(p.lengths); {
+		l := p.lengths[i]
+		run := 1
+		for i+run < len(p.lengths) && p.lengths[i+run] == l {
+			run++
+		}
+		switch {
+		case l == 0 && run >= 11:
+			run = min(run, 138)
+			tokens = append(tokens, token{18, uint32(run - 11)})
+		case l == 0 && run >= 3:
+			run = min(run, 10)
+			tokens = append(tokens, token{17, uint32(run - 3)})
+		case l != 0 && l == prev && run >= 3:
+			run = min(run, 6)
+			tokens = append(tokens, token{16, uint32(run - 3)})
+		default:
+			run = 1
+			tokens = append(tokens, token{l, 0})
+			if l != 0 {
+				prev = l
+			}
+		}
+		i += run
+	}
+
+	counts := make([]int, 19)
+	for _, t := range tokens {
+		counts[t.code]++
+	}
+	lengthCode := newPrefixCode(counts, maxCodeLengthLength)
+
+	nCodes := 4
+	for i, s := range codeLengthCodeOrder {
+		if lengthCode.lengths[s] != 0 && i+1 > nCodes {
+			nCodes = i + 1
+		}
+	}
+	bw.write(0, 1)
+	bw.write(uint32(nCodes-4), 4)
+	for _, s := range codeLengthCodeOrder[:nCodes] {
+		bw.write(uint32(lengthCode.lengths[s]), 3)
+	}
+
+	// The lengths of every symbol in the alphabet follow.
+	bw.write(0, 1)
+	extraBits := map[int]uint{16: 2, 17: 3, 18: 7}
+	for _, t := range tokens {
+		lengthCode.writeSymbol(bw, t.code)
+		if n, ok := extraBits[t.code]; ok {
+			bw.write(t.extra, n)
+		}
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// bitWriter packs values least significant bit first.
+type bitWriter struct {
+	buf   bytes.Buffer
+	bits  uint64
+	nBits uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	b.bits |= uint64(v) << b.nBits
+	b.nBits += n
+	for b.nBits >= 8 {
+		b.buf.WriteByte(byte(b.bits))
+		b.bits >>= 8
+		b.nBits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nBits > 0 {
+		b.buf.WriteByte(byte(b.bits))
+		b.bits, b.nBits = 0, 0
+	}
+	return b.buf.Bytes()
+}
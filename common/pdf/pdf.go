@@ -0,0 +1,208 @@
+// Package pdf writes simple PDF documents: pages of JPEG images, lines, rectangles, and Helvetica text. Coordinates are
+// in points, 72 to the inch, measured from the top left of the page.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strings"
+)
+
+// PointsPerInch is the size of the unit that pages are measured in.
+const PointsPerInch = 72
+
+// Document is a PDF under construction.
+type Document struct {
+	pages []*Page
+}
+
+// Page is one page of a Document; its methods append drawing operations to it.
+type Page struct {
+	Width, Height float64
+	content       bytes.Buffer
+	images        [][]byte
+	imageSizes    []image.Point
+}
+
+func New() *Document {
+	return &Document{}
+}
+
+// AddPage adds a page of the given size, in points.
+func (d *Document) AddPage(width, height float64) *Page {
+	p := &Page{Width: width, Height: height}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+func (d *Document) Pages() int {
+	return len(d.pages)
+}
+
+// y converts a distance from the top of the page to PDF's distance from the bottom.
+func (p *Page) y(y float64) float64 {
+	return p.Height - y
+}
+
+// Image draws `img` into the rectangle with its top left at (x,y), encoded as a JPEG of the given quality.
+func (p *Page) Image(img image.Image, x, y, width, height float64, quality int) error {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("encoding image: %s", err)
+	}
+	p.images = append(p.images, buf.Bytes())
+	p.imageSizes = append(p.imageSizes, img.Bounds().Size())
+	fmt.Fprintf(&p.content, "q %s 0 0 %s %s %s cm /Im%d Do Q\n",
+		num(width), num(height), num(x), num(p.y(y+height)), len(p.images)-1)
+	return nil
+}
+
+// Line strokes a line from (x1,y1) to (x2,y2) in the given gray level (0 is black, 1 white). If `dash` is non-zero,
+// the line is dashed in segments that long.
+func (p *Page) Line(x1, y1, x2, y2, width, gray, dash float64) {
+	fmt.Fprintf(&p.content, "q %s w %s G ", num(width), num(gray))
+	if dash > 0 {
+		fmt.Fprintf(&p.content, "[%s] 0 d ", num(dash))
+	}
+	fmt.Fprintf(&p.content, "%s %s m %s %s l S Q\n", num(x1), num(p.y(y1)), num(x2), num(p.y(y2)))
+}
+
+// Rect strokes a rectangle with its top left at (x,y).
+func (p *Page) Rect(x, y, width, height, lineWidth, gray float64) {
+	fmt.Fprintf(&p.content, "q %s w %s G %s %s %s %s re S Q\n",
+		num(lineWidth), num(gray), num(x), num(p.y(y+height)), num(width), num(height))
+}
+
+// Text draws `s` in black Helvetica, with its baseline starting at (x,y).
+func (p *Page) Text(x, y, size float64, s string) {
+	fmt.Fprintf(&p.content, "BT /F1 %s Tf %s %s Td (%s) Tj ET\n", num(size), num(x), num(p.y(y)), escape(s))
+}
+
+// TextCentered draws `s` centered horizontally on x, and vertically on y.
+func (p *Page) TextCentered(x, y, size float64, s string) {
+	p.Text(x-TextWidth(s, size)/2, y+size*0.35, size, s)
+}
+
+// TextWidth approximates the width, in points, of `s` set in Helvetica at `size`.
+func TextWidth(s string, size float64) float64 {
+	w := 0.0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			w += 0.556
+		case r >= 'A' && r <= 'Z':
+			w += 0.667
+		case r == ' ' || r == '.' || r == ',':
+			w += 0.278
+		case r == '-' || r == '(' || r == ')':
+			w += 0.333
+		default:
+			w += 0.5
+		}
+	}
+	return w * size
+}
+
+// escape escapes a string for use as a PDF literal; characters Helvetica can't show become '?'.
+func escape(s string) string {
+	b := &strings.Builder{}
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// num formats a number compactly, as PDF readers expect: no exponent, and no more precision than is useful.
+func num(f float64) string {
+	s := fmt.Sprintf("%.3f", f)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// Bytes returns the finished document.
+func (d *Document) Bytes() ([]byte, error) {
+	w := &writer{}
+	w.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 and 2 are the catalog and the page tree, and 3 is the font; pages follow.
+	catalog, pages, font := w.reserve(), w.reserve(), w.reserve()
+	w.object(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	w.object(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+
+	kids := []string{}
+	for _, p := range d.pages {
+		page, content := w.reserve(), w.reserve()
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+
+		xobjects := []string{}
+		for i, data := range p.images {
+			im := w.reserve()
+			size := p.imageSizes[i]
+			w.stream(im, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB "+
+				"/BitsPerComponent 8 /Filter /DCTDecode", size.X, size.Y), data)
+			xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", i, im))
+		}
+
+		compressed := &bytes.Buffer{}
+		zw := zlib.NewWriter(compressed)
+		if _, err := zw.Write(p.content.Bytes()); err != nil {
+			return nil, fmt.Errorf("compressing page content: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("compressing page content: %s", err)
+		}
+		w.stream(content, "/Filter /FlateDecode", compressed.Bytes())
+
+		w.object(page, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Contents %d 0 R "+
+			"/Resources << /Font << /F1 %d 0 R >> /XObject << %s >> >> >>",
+			pages, num(p.Width), num(p.Height), content, font, strings.Join(xobjects, " ")))
+	}
+	w.object(pages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+
+	xref := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.offsets)+1)
+	for _, off := range w.offsets {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.offsets)+1, catalog, xref)
+	return w.buf.Bytes(), nil
+}
+
+// writer numbers objects and records where each one starts, for the cross-reference table. Objects may be written in
+// any order once reserved.
+type writer struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+func (w *writer) reserve() int {
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets)
+}
+
+func (w *writer) object(n int, body string) {
+	w.offsets[n-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n%s\nendobj\n", n, body)
+}
+
+func (w *writer) stream(n int, dict string, data []byte) {
+	w.offsets[n-1] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", n, dict, len(data))
+	w.buf.Write(data)
+	w.buf.WriteString("\nendstream\nendobj\n")
+}
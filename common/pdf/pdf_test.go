@@ -0,0 +1,72 @@
+package pdf
+
+import (
+	"bytes"
+	"image"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestDocument(t *testing.T) {
+	d := New()
+	for i := 0; i < 3; i++ {
+		p := d.AddPage(612, 792)
+		if err := p.Image(image.NewRGBA(image.Rect(0, 0, 30, 20)), 36, 36, 300, 200, 90); err != nil {
+			t.Fatal(err)
+		}
+		p.Line(0, 0, 612, 792, 1, 0, 3)
+		p.Rect(36, 36, 300, 200, 0.5, 0.5)
+		p.TextCentered(100, 20, 10, "A (1)")
+	}
+	data, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("missing header or trailer")
+	}
+	if n := bytes.Count(data, []byte("/Type /Page ")); n != 3 {
+		t.Fatalf("expected 3 pages, found %d", n)
+	}
+	if !bytes.Contains(data, []byte("/Count 3")) {
+		t.Fatalf("page tree doesn't count 3 pages")
+	}
+
+	// Every entry in the cross-reference table should point at the object it names.
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(data[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d doesn't point at xref table", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	if len(entries) == 0 {
+		t.Fatal("empty xref table")
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		want := strconv.Itoa(i+1) + " 0 obj\n"
+		if !bytes.HasPrefix(data[off:], []byte(want)) {
+			t.Fatalf("xref entry %d points at %q, not %q", i+1, data[off:off+len(want)], want)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	cases := map[string]string{
+		"A1":        "A1",
+		"(a)":       `\(a\)`,
+		`back\`:     `back\\`,
+		"snow ☃":    "snow ?",
+		"tab\there": "tab?here",
+	}
+	for in, want := range cases {
+		if got := escape(in); got != want {
+			t.Errorf("escape(%q) = %q, not %q", in, got, want)
+		}
+	}
+}
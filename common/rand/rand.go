@@ -24,3 +24,13 @@ func RandHex(n int) string {
 	}
 	return string(buf)
 }
+
+// Seed returns a fresh random seed, for callers that want reproducible output but were not given a seed.
+func Seed() int64 {
+	return random.Int63()
+}
+
+// Seeded returns a new generator driven by the given seed. The same seed always produces the same sequence.
+func Seeded(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
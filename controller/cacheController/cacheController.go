@@ -0,0 +1,103 @@
+// Package cacheController provides administrative commands for inspecting and emptying the render cache.
+package cacheController
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/cache"
+	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/controller/cmdproc"
+	"github.com/pdbogen/mapbot/hub"
+	"strings"
+)
+
+var log = mbLog.Log
+
+var admins = flag.String("admins", "", "comma-separated list of user IDs permitted to use administrative commands, like `cache`")
+
+func Register(h *hub.Hub) {
+	h.Subscribe("user:cache", route)
+}
+
+var processor *cmdproc.CommandProcessor
+
+func init() {
+	processor = &cmdproc.CommandProcessor{
+		Command: "cache",
+		Commands: map[string]cmdproc.Subcommand{
+			"stats": {"", "show the size and hit rate of the render cache", cmdStats},
+			"purge": {"", "empty the render cache", cmdPurge},
+		},
+		Comment: "These commands are only available to mapbot administrators.",
+	}
+}
+
+// IsAdmin reports whether the user who sent `c` is listed in the -admins flag.
+func IsAdmin(c *hub.Command) bool {
+	if c.User == nil {
+		return false
+	}
+	for _, id := range strings.Split(*admins, ",") {
+		if id = strings.TrimSpace(id); id != "" && id == string(c.User.Id) {
+			return true
+		}
+	}
+	return false
+}
+
+func route(h *hub.Hub, c *hub.Command) {
+	if !IsAdmin(c) {
+		h.Error(c, "sorry, only mapbot administrators can manage the cache")
+		return
+	}
+	processor.Route(h, c)
+}
+
+func cmdStats(h *hub.Hub, c *hub.Command) {
+	s := cache.GetStats()
+	lookups := s.MemoryHits + s.StoredHits + s.Misses
+	rate := 0.0
+	if lookups > 0 {
+		rate = float64(s.MemoryHits+s.StoredHits) / float64(lookups) * 100
+	}
+
+	msg := fmt.Sprintf("Memory: %d entries, %s of %d MB\n", s.MemoryEntries, bytes(s.MemoryBytes), *cache.MemorySize)
+	switch s.Stored {
+	case "":
+		msg += fmt.Sprintf("Lookups: %d (%d hits, %d misses; %.1f%% hit rate)", lookups, s.MemoryHits, s.Misses, rate)
+		h.Reply(c, msg)
+		return
+	case "disk":
+		msg += fmt.Sprintf("Disk: %d entries, %s of %d MB, evicted after %s unused\n",
+			s.StoredEntries, bytes(s.StoredBytes), *cache.DiskSize, *cache.MaxAge)
+	default:
+		msg += fmt.Sprintf("%s: %d entries, %s, expiring after %s unused\n",
+			s.Stored, s.StoredEntries, bytes(s.StoredBytes), *cache.MaxAge)
+	}
+	msg += fmt.Sprintf("Lookups: %d (%d from memory, %d from %s, %d misses; %.1f%% hit rate)",
+		lookups, s.MemoryHits, s.StoredHits, s.Stored, s.Misses, rate)
+	h.Reply(c, msg)
+}
+
+func cmdPurge(h *hub.Hub, c *hub.Command) {
+	freed, err := cache.Purge()
+	if err != nil {
+		log.Errorf("purging cache: %s", err)
+		h.Error(c, fmt.Sprintf("error purging cache after freeing %s: %s", bytes(freed), err))
+		return
+	}
+	log.Infof("user %s purged the cache, freeing %s", c.User.Id, bytes(freed))
+	h.Reply(c, fmt.Sprintf("Cache purged; freed %s.", bytes(freed)))
+}
+
+func bytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
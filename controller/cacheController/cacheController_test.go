@@ -0,0 +1,22 @@
+package cacheController
+
+import (
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/types"
+	"github.com/pdbogen/mapbot/model/user"
+	"testing"
+)
+
+func TestIsAdmin(t *testing.T) {
+	*admins = "U1, U2"
+	tests := map[string]bool{"U1": true, "U2": true, "U3": false, "": false}
+	for id, expected := range tests {
+		c := &hub.Command{User: &user.User{Id: types.UserId(id)}}
+		if IsAdmin(c) != expected {
+			t.Errorf("expected IsAdmin(%q) to be %v", id, expected)
+		}
+	}
+	if IsAdmin(&hub.Command{}) {
+		t.Error("expected command with no user not to be from an admin")
+	}
+}
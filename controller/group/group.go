@@ -0,0 +1,378 @@
+package group
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/colors"
+	"github.com/pdbogen/mapbot/common/db"
+	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/controller/cmdproc"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/group"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image"
+	"image/color"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var log = mbLog.Log
+
+func Register(h *hub.Hub) {
+	h.Subscribe("user:group", processor.Route)
+}
+
+var processor *cmdproc.CommandProcessor
+
+func init() {
+	processor = &cmdproc.CommandProcessor{
+		Command: "group",
+		Commands: map[string]cmdproc.Subcommand{
+			"add":    {"<group> <name> [<name2> ... <nameN>]", "adds tokens to a group, making it if need be; the first token added leads the group.", cmdAdd},
+			"remove": {"<group> [<name> ... <nameN>]", "takes tokens out of a group, or with no tokens forgets the group; the tokens stay on the map.", cmdRemove},
+			"list":   {"", "lists the groups in this channel.", cmdList},
+			"move":   {"<group> <point>", "moves every token in the group at once, keeping the formation: the leader goes to <point>, and everyone else keeps their place around it.", cmdMove},
+			"color":  {"<group> <color>", "sets the color of every token in the group; see `token color`.", cmdColor},
+			"light":  {"<group> <dim> [<normal> [<bright>]]", "sets the light every token in the group carries; see `token light`.", cmdLight},
+			"hide":   {"<group>", "hides every token in the group; see `token hide`.", cmdHide},
+			"reveal": {"<group>", "shows every token in the group again.", cmdHide},
+		},
+		Comment: "Groups belong to the channel, and are kept from map to map; tokens of a group that aren't on the active map are left alone.",
+	}
+}
+
+func argsFromCommand(h *hub.Hub, c *hub.Command) ([]string, bool) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+	}
+	return args, ok
+}
+
+func loadGroups(h *hub.Hub, c *hub.Command) (group.Groups, bool) {
+	groups, err := group.Load(db.Instance, c.Context.Id())
+	if err != nil {
+		h.Error(c, "an error occured loading the groups for this channel")
+		log.Errorf("error loading groups for %s: %s", c.Context.Id(), err)
+		return nil, false
+	}
+	return groups, true
+}
+
+func saveGroups(h *hub.Hub, c *hub.Command, groups group.Groups) bool {
+	if err := groups.Save(db.Instance, c.Context.Id()); err != nil {
+		h.Error(c, "an error occured saving the groups for this channel")
+		log.Errorf("error saving groups for %s: %s", c.Context.Id(), err)
+		return false
+	}
+	return true
+}
+
+// loadMembers returns the active map and the tokens of group `name` that are on it, in the group's order.
+func loadMembers(h *hub.Hub, c *hub.Command, name string) (*tabula.Tabula, []string, bool) {
+	groups, ok := loadGroups(h, c)
+	if !ok {
+		return nil, nil, false
+	}
+	members, ok := groups[group.Key(name)]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no group `%s`; try `group list`.", name))
+		return nil, nil, false
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return nil, nil, false
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return nil, nil, false
+	}
+
+	present := []string{}
+	for _, m := range members {
+		if _, ok := tab.Tokens[c.Context.Id()][m]; ok {
+			present = append(present, m)
+		}
+	}
+	if len(present) == 0 {
+		h.Error(c, fmt.Sprintf("None of group `%s` is on the map!", name))
+		return nil, nil, false
+	}
+	return tab, present, true
+}
+
+// update applies `change` to each of `members` of the map, then saves and shows it.
+func update(h *hub.Hub, c *hub.Command, tab *tabula.Tabula, members []string, change func(tabula.Token) tabula.Token) {
+	for _, m := range members {
+		tab.Tokens[c.Context.Id()][m] = change(tab.Tokens[c.Context.Id()][m])
+	}
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+	}
+
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+	h.PublishUpdate(c.Context)
+}
+
+func cmdAdd(h *hub.Hub, c *hub.Command) {
+	args, ok := argsFromCommand(h, c)
+	if !ok {
+		return
+	}
+	if len(args) < 2 {
+		h.Error(c, "usage: group add "+processor.Commands["add"].Args)
+		return
+	}
+
+	groups, ok := loadGroups(h, c)
+	if !ok {
+		return
+	}
+	groups.Add(args[0], args[1:]...)
+	if !saveGroups(h, c, groups) {
+		return
+	}
+	h.Reply(c, fmt.Sprintf("group `%s`: %s", group.Key(args[0]), strings.Join(groups[group.Key(args[0])], " ")))
+}
+
+func cmdRemove(h *hub.Hub, c *hub.Command) {
+	args, ok := argsFromCommand(h, c)
+	if !ok {
+		return
+	}
+	if len(args) < 1 {
+		h.Error(c, "usage: group remove "+processor.Commands["remove"].Args)
+		return
+	}
+
+	groups, ok := loadGroups(h, c)
+	if !ok {
+		return
+	}
+	if _, ok := groups[group.Key(args[0])]; !ok {
+		h.Error(c, fmt.Sprintf("There's no group `%s`; try `group list`.", args[0]))
+		return
+	}
+	groups.Remove(args[0], args[1:]...)
+	if !saveGroups(h, c, groups) {
+		return
+	}
+
+	if members, ok := groups[group.Key(args[0])]; ok {
+		h.Reply(c, fmt.Sprintf("group `%s`: %s", group.Key(args[0]), strings.Join(members, " ")))
+	} else {
+		h.Reply(c, fmt.Sprintf("group `%s` is no more", group.Key(args[0])))
+	}
+}
+
+func cmdList(h *hub.Hub, c *hub.Command) {
+	groups, ok := loadGroups(h, c)
+	if !ok {
+		return
+	}
+	if len(groups) == 0 {
+		h.Reply(c, "There are no groups in this channel; make one with `group add`.")
+		return
+	}
+
+	lines := []string{}
+	for _, name := range groups.Names() {
+		lines = append(lines, fmt.Sprintf("`%s`: %s", name, strings.Join(groups[name], " ")))
+	}
+	h.Reply(c, strings.Join(lines, "\n"))
+}
+
+func cmdMove(h *hub.Hub, c *hub.Command) {
+	args, ok := argsFromCommand(h, c)
+	if !ok {
+		return
+	}
+
+	notation := c.Context.GetCoordinates().Notation
+	var to image.Point
+	var err error
+	switch len(args) {
+	case 2:
+		to, _, err = notation.Parse(args[1], false)
+	case 3:
+		to, err = notation.ParsePair(args[1], args[2])
+	default:
+		h.Error(c, "usage: group move "+processor.Commands["move"].Args)
+		return
+	}
+	if err != nil {
+		h.Error(c, fmt.Sprintf("`%s` is not a coordinate: %s", strings.Join(args[1:], " "), err))
+		return
+	}
+
+	tab, members, ok := loadMembers(h, c, args[0])
+	if !ok {
+		return
+	}
+
+	at := map[string]image.Point{}
+	for _, m := range members {
+		at[m] = tab.Tokens[c.Context.Id()][m].Coordinate
+	}
+	dest := group.Formation(members, at, to)
+
+	// Each member finds its own way around walls and blocked ground, and pays for what it crosses, as a token sent
+	// `to` a square by itself would.
+	ground := c.Context.GetTerrain(*tab.Id)
+	paths := map[string][]image.Point{}
+	feet := map[string]int{}
+	for _, m := range members {
+		tok := tab.Tokens[c.Context.Id()][m]
+		path, cost, ok := ground.Path(at[m], dest[m], tok.Size, tab.Walls)
+		if !ok {
+			if tab.Shows(tok) {
+				h.Error(c, fmt.Sprintf("there's no way for %s to get to %s", m, notation.Format(dest[m])))
+			} else {
+				h.Error(c, fmt.Sprintf("there's no way for all of %s to get to %s", group.Key(args[0]), notation.Format(to)))
+			}
+			return
+		}
+		paths[m], feet[m] = path, cost
+	}
+
+	// The group goes only as far as its slowest member can; see `token speed`.
+	if !c.User.Owns(*tab.Id) {
+		for _, m := range members {
+			if tok := tab.Tokens[c.Context.Id()][m]; tok.Speed > 0 && tab.Shows(tok) && feet[m] > tok.Remaining() {
+				h.Error(c, fmt.Sprintf("%s can only move %dft more this turn, not %dft. `token turn` starts a new turn.", m, tok.Remaining(), feet[m]))
+				return
+			}
+		}
+	}
+
+	lines := []mark.Line{}
+	notes := []string{}
+	// shown is how far the members seen to move went, if they all went as far.
+	shown := -1
+	for _, m := range members {
+		tok := tab.Tokens[c.Context.Id()][m]
+		moved := tok
+		for _, pt := range paths[m] {
+			if tab.Shows(tok) {
+				lines = append(lines, moved.MoveLines(pt, color.RGBA{R: 255, G: 0, B: 0, A: 255})...)
+			}
+			moved = moved.MovedTo(pt)
+		}
+		if tok.Speed > 0 && tab.Shows(tok) {
+			moved = moved.WithMoved(tok.Moved + feet[m])
+		}
+		tab.Tokens[c.Context.Id()][m] = moved
+		if !tab.Shows(tok) {
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("%s moved %dft", m, feet[m]))
+		if len(notes) == 1 {
+			shown = feet[m]
+		} else if feet[m] != shown {
+			shown = -1
+		}
+	}
+
+	// Unless the ground made some go further than others, there's just the one distance to tell.
+	note := strings.Join(notes, "; ")
+	if shown >= 0 {
+		note = fmt.Sprintf("%s moved %dft", group.Key(args[0]), shown)
+	}
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+	}
+
+	c.Context.SetLastToken(c.User.Id, members[0])
+	if err := c.Context.Save(); err != nil {
+		h.Error(c, "an error occured saving the context")
+		log.Errorf("error saving context: %s", err)
+	}
+
+	h.Publish(c.
+		WithType(hub.CommandType(c.From)).
+		WithPayload(tab.WithLines(lines).WithNote(note)),
+	)
+	h.PublishUpdate(c.Context)
+}
+
+func cmdColor(h *hub.Hub, c *hub.Command) {
+	args, ok := argsFromCommand(h, c)
+	if !ok {
+		return
+	}
+	if len(args) != 2 {
+		h.Error(c, "usage: group color "+processor.Commands["color"].Args)
+		return
+	}
+
+	newColor, err := colors.ToColor(args[1])
+	if err != nil {
+		h.Error(c, err.Error())
+		return
+	}
+
+	tab, members, ok := loadMembers(h, c, args[0])
+	if !ok {
+		return
+	}
+	update(h, c, tab, members, func(tok tabula.Token) tabula.Token { return tok.WithColor(newColor) })
+}
+
+func cmdLight(h *hub.Hub, c *hub.Command) {
+	args, ok := argsFromCommand(h, c)
+	if !ok {
+		return
+	}
+	if len(args) < 2 || len(args) > 4 {
+		h.Error(c, "usage: group light "+processor.Commands["light"].Args)
+		return
+	}
+
+	levels := [3]int{}
+	for i, a := range args[1:] {
+		feet, err := strconv.Atoi(a)
+		if err != nil {
+			h.Error(c, fmt.Sprintf("`%s` is not a number of feet: %s", a, err))
+			return
+		}
+		levels[i] = feet
+	}
+
+	tab, members, ok := loadMembers(h, c, args[0])
+	if !ok {
+		return
+	}
+	update(h, c, tab, members, func(tok tabula.Token) tabula.Token {
+		return tok.WithLight(levels[0], levels[1], levels[2])
+	})
+}
+
+// cmdHide hides, or for `group reveal` shows again, the tokens of a group.
+func cmdHide(h *hub.Hub, c *hub.Command) {
+	args, ok := argsFromCommand(h, c)
+	if !ok {
+		return
+	}
+	if len(args) != 1 {
+		h.Error(c, "usage: group hide "+processor.Commands["hide"].Args)
+		return
+	}
+	hide := strings.HasSuffix(string(c.Type.Canonical()), ":hide")
+
+	tab, members, ok := loadMembers(h, c, args[0])
+	if !ok {
+		return
+	}
+	update(h, c, tab, members, func(tok tabula.Token) tabula.Token { return tok.WithHidden(hide) })
+}
@@ -0,0 +1,117 @@
+package mapController
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image"
+	"strings"
+)
+
+// coordsArgs returns the usage of `map coords`.
+func coordsArgs() string {
+	styles := []string{}
+	for _, s := range conv.Styles {
+		styles = append(styles, string(s))
+	}
+	placements := []string{}
+	for _, p := range conv.Placements {
+		placements = append(placements, string(p))
+	}
+	return fmt.Sprintf("[%s] [origin <square>] [labels {%s}] [font {%s}] [default]", strings.Join(styles, "|"),
+		strings.Join(placements, "|"), strings.Join(tabula.FontNames(), "|"))
+}
+
+func cmdCoords(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "usage: map coords "+processor.Commands["coords"].Args)
+		return
+	}
+
+	if len(args) == 0 {
+		h.Reply(c, describeCoordinates(c.Context.GetCoordinates()))
+		return
+	}
+
+	o, err := parseCoordinates(c.Context.GetCoordinates(), args)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("%s; usage: map coords %s", err, processor.Commands["coords"].Args))
+		return
+	}
+
+	c.Context.SetCoordinates(o)
+	if err := c.Context.Save(); err != nil {
+		h.Error(c, fmt.Sprintf("Something went wrong while saving your change: %s", err))
+		return
+	}
+	h.Reply(c, describeCoordinates(o))
+	if c.Context.GetActiveTabulaId() != nil {
+		cmdShow(h, c.WithPayload([]string{}))
+		h.PublishUpdate(c.Context)
+	}
+}
+
+// parseCoordinates applies coords arguments like `numeric origin 0,0 labels edges` to `o`. The origin is the name of
+// the top-left square, in the notation chosen by the arguments.
+func parseCoordinates(o conv.Options, args []string) (conv.Options, error) {
+	origin := ""
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		if arg == "default" {
+			o = conv.Options{}
+			continue
+		}
+
+		if arg == "origin" || arg == "labels" || arg == "font" {
+			if i+1 >= len(args) {
+				return o, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+		}
+
+		var err error
+		switch arg {
+		case "origin":
+			origin = args[i]
+		case "labels":
+			o.Labels, err = conv.ParsePlacement(args[i])
+		case "font":
+			o.Font, err = tabula.ParseFont(args[i])
+		default:
+			o.Style, err = conv.ParseStyle(arg)
+		}
+		if err != nil {
+			return o, err
+		}
+	}
+
+	// With an origin, numbers count straight on from it, through zero if need be, as a printed map's would.
+	if origin != "" {
+		pt, _, err := conv.Notation{Style: o.Style, Zero: true}.Parse(origin, false)
+		if err != nil {
+			return o, fmt.Errorf("origin %q: %s", origin, err)
+		}
+		o.Origin = pt
+		o.Zero = true
+	}
+	return o, nil
+}
+
+// describeCoordinates returns a sentence describing `o`.
+func describeCoordinates(o conv.Options) string {
+	labels := "drawn inside the top row and left column of the map"
+	switch o.Placement() {
+	case conv.Edges:
+		labels = "drawn in a margin around the map"
+	case conv.Hidden:
+		labels = "hidden"
+	}
+	font := o.Font
+	if font == "" {
+		font = tabula.DefaultFont
+	}
+	return fmt.Sprintf("squares in this channel are named like %s, and the top-left square is %s; labels are %s, in %s",
+		conv.Notation{Style: o.Style}.Format(image.Pt(2, 3)), o.Format(image.Pt(0, 0)), labels, font)
+}
@@ -0,0 +1,34 @@
+package mapController
+
+import (
+	"github.com/pdbogen/mapbot/common/conv"
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestParseCoordinates(t *testing.T) {
+	start := conv.Options{Labels: conv.Edges}
+	cases := map[string]conv.Options{
+		"numeric":                       {Notation: conv.Notation{Style: conv.Numeric}, Labels: conv.Edges},
+		"labels none font mono":         {Labels: conv.Hidden, Font: "mono"},
+		"origin c5":                     {Notation: conv.Notation{Origin: image.Pt(2, 5), Zero: true}, Labels: conv.Edges},
+		"origin 0,0 NUMERIC":            {Notation: conv.Notation{Style: conv.Numeric, Zero: true}, Labels: conv.Edges},
+		"default rowletters origin a10": {Notation: conv.Notation{Style: conv.RowLetters, Origin: image.Pt(10, 0), Zero: true}},
+	}
+	for in, want := range cases {
+		got, err := parseCoordinates(start, strings.Fields(in))
+		if err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+		if got != want {
+			t.Fatalf("%q: got %+v, not %+v", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"hex", "origin", "labels sideways", "font comic", "numeric origin c5"} {
+		if _, err := parseCoordinates(start, strings.Fields(in)); err == nil {
+			t.Fatalf("%q parsed without error", in)
+		}
+	}
+}
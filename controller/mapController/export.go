@@ -0,0 +1,67 @@
+package mapController
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/attachment"
+	"github.com/pdbogen/mapbot/model/bundle"
+	"github.com/pdbogen/mapbot/model/foundry"
+	"github.com/pdbogen/mapbot/model/tabula"
+)
+
+func cmdExport(h *hub.Hub, c *hub.Command) {
+	if c.User == nil {
+		log.Errorf("received command with nil user")
+		return
+	}
+
+	args, ok := c.Payload.([]string)
+	if !ok || len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[0] != "foundry" && args[0] != "svg") {
+		h.Error(c, "usage: map export "+processor.Commands["export"].Args)
+		return
+	}
+
+	name := tabula.TabulaName(args[len(args)-1])
+	t, ok := c.User.TabulaByName(name)
+	if !ok {
+		h.Error(c, notFound(name))
+		return
+	}
+
+	var data []byte
+	var err error
+	var filename, title string
+	// The full bundle holds every channel's tokens, hidden ones too, so it goes only to the map's owner.
+	private := false
+	switch {
+	case len(args) == 2 && args[0] == "svg":
+		data, err = t.SVG(c.Context, "")
+		filename = string(t.Name) + ".svg"
+		title = fmt.Sprintf("map %q as an SVG, with the tokens and marks in this channel", t.Name)
+	case len(args) == 2:
+		data, err = foundry.Export(db.Instance, t, c.Context)
+		filename = string(t.Name) + ".foundry.zip"
+		title = fmt.Sprintf("map %q as a Foundry VTT scene; unzip into your Foundry Data directory, then import %s/scene.json", t.Name, foundry.Dir(t))
+	default:
+		data, err = bundle.Export(db.Instance, t)
+		filename = string(t.Name) + bundle.Extension
+		title = fmt.Sprintf("map %q", t.Name)
+		private = true
+	}
+	if err != nil {
+		h.Error(c, fmt.Sprintf("could not export map %q: %s", t.Name, err))
+		log.Errorf("exporting map %d: %s", t.Id, err)
+		return
+	}
+
+	var payload interface{} = attachment.New(filename, title, data)
+	if private {
+		payload = &hub.Private{Payload: payload}
+	}
+	h.Publish(&hub.Command{
+		Type:    hub.CommandType(c.From),
+		Payload: payload,
+		User:    c.User,
+	})
+}
@@ -0,0 +1,70 @@
+package mapController
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/output"
+	"github.com/pdbogen/mapbot/hub"
+	"strconv"
+	"strings"
+)
+
+func cmdFormat(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "usage: map format "+processor.Commands["format"].Args)
+		return
+	}
+
+	if len(args) == 0 {
+		h.Reply(c, "maps in this channel are sent as "+c.Context.GetOutput().String())
+		return
+	}
+
+	o, err := parseOutput(c.Context.GetOutput(), args)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("%s; usage: map format %s", err, processor.Commands["format"].Args))
+		return
+	}
+
+	c.Context.SetOutput(o)
+	if err := c.Context.Save(); err != nil {
+		h.Error(c, fmt.Sprintf("Something went wrong while saving your change: %s", err))
+		return
+	}
+	h.Reply(c, "maps in this channel will be sent as "+o.String())
+}
+
+// parseOutput applies format arguments like `jpeg 80 budget 2MB` to `o`.
+func parseOutput(o output.Options, args []string) (output.Options, error) {
+	for i := 0; i < len(args); i++ {
+		if strings.ToLower(args[i]) == "budget" {
+			if i+1 >= len(args) {
+				return o, fmt.Errorf("budget needs a size, like 2MB, or `off`")
+			}
+			n, err := output.ParseSize(args[i+1])
+			if err != nil {
+				return o, err
+			}
+			o.Budget = n
+			i++
+			continue
+		}
+
+		f, err := output.ParseFormat(args[i])
+		if err != nil {
+			return o, err
+		}
+		o.Format = f
+		if f != output.JPEG || i+1 >= len(args) {
+			continue
+		}
+		if q, err := strconv.Atoi(args[i+1]); err == nil {
+			if q < 1 || q > 100 {
+				return o, fmt.Errorf("quality should be between 1 and 100, not %d", q)
+			}
+			o.Quality = q
+			i++
+		}
+	}
+	return o, nil
+}
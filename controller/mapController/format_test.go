@@ -0,0 +1,34 @@
+package mapController
+
+import (
+	"github.com/pdbogen/mapbot/common/output"
+	"strings"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	start := output.Options{Format: output.JPEG, Quality: 70, Budget: 1 << 20}
+	cases := map[string]output.Options{
+		"png":                  {Format: output.PNG, Quality: 70, Budget: 1 << 20},
+		"jpg 90":               {Format: output.JPEG, Quality: 90, Budget: 1 << 20},
+		"webp budget off":      {Format: output.WebP, Quality: 70},
+		"budget 500KB":         {Format: output.JPEG, Quality: 70, Budget: 500 << 10},
+		"jpeg budget 2MB":      {Format: output.JPEG, Quality: 70, Budget: 2 << 20},
+		"JPEG 40 budget 100kb": {Format: output.JPEG, Quality: 40, Budget: 100 << 10},
+	}
+	for in, want := range cases {
+		got, err := parseOutput(start, strings.Fields(in))
+		if err != nil {
+			t.Fatalf("%q: %s", in, err)
+		}
+		if got != want {
+			t.Fatalf("%q: got %+v, not %+v", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"gif", "jpeg 101", "budget", "budget lots", "png 80"} {
+		if _, err := parseOutput(start, strings.Fields(in)); err == nil {
+			t.Fatalf("%q parsed without error", in)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mapController
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/rand"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/mapgen"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image/png"
+	"math"
+	"strconv"
+)
+
+const defaultGenerateSize = 30
+
+// generatedSide is the length, in pixels, of the longest side of the background in the space DPI is measured in; we
+// pick the DPI in those terms so that the grid lands exactly on the generated squares.
+const generatedSide = tabula.ReferenceSize
+
+func cmdGenerate(h *hub.Hub, c *hub.Command) {
+	if c.User == nil {
+		log.Errorf("received command with nil user")
+		return
+	}
+
+	args, ok := c.Payload.([]string)
+	if !ok || len(args) < 2 || len(args) > 4 {
+		h.Error(c, "usage: map generate "+processor.Commands["generate"].Args)
+		return
+	}
+
+	name := tabula.TabulaName(args[0])
+	if _, ok := c.User.TabulaByName(name); ok {
+		h.Error(c, fmt.Sprintf("name `%s` is already in use", name))
+		return
+	}
+
+	seed := rand.Seed()
+	if len(args) >= 3 {
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			h.Error(c, fmt.Sprintf("seed %q was not an integer: %s", args[2], err))
+			return
+		}
+		seed = n
+	}
+
+	size := defaultGenerateSize
+	if len(args) == 4 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil {
+			h.Error(c, fmt.Sprintf("size %q was not an integer: %s", args[3], err))
+			return
+		}
+		size = n
+	}
+
+	layout, err := mapgen.Generate(args[1], seed, size)
+	if err != nil {
+		h.Error(c, err.Error())
+		return
+	}
+
+	px := int(math.Ceil(float64(generatedSide) / float64(size)))
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, layout.Image(px)); err != nil {
+		h.Error(c, "encountered some problems drawing this map; sorry!")
+		log.Errorf("encoding generated map: %v", err)
+		return
+	}
+
+	t, err := tabula.New(string(name), fmt.Sprintf("generated:%s:%d:%d", layout.Kind, seed, size))
+	if err != nil {
+		h.Error(c, fmt.Sprintf("error creating map: %s", err))
+		return
+	}
+	t.Dpi = float32(generatedSide) / float32(size)
+	t.WithWalls(layout.Walls())
+
+	if err := addTabula(c, t, buf.Bytes()); err != nil {
+		h.Error(c, "encountered some problems adding this map; sorry!")
+		log.Errorf("saving generated map: %v", err)
+		return
+	}
+
+	h.Reply(c, fmt.Sprintf("map %q generated: %s, %dx%d squares, seed `%d`, %d walls", name, layout.Kind, size, size, seed, len(t.Walls)))
+	h.Publish(&hub.Command{
+		Type:    hub.CommandType(c.From),
+		Payload: t,
+		User:    c.User,
+	})
+}
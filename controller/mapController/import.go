@@ -0,0 +1,146 @@
+package mapController
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/bundle"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/uvtt"
+	"io"
+	"net/http"
+	"time"
+)
+
+func cmdImport(h *hub.Hub, c *hub.Command) {
+	if c.User == nil {
+		log.Errorf("received command with nil user")
+		return
+	}
+
+	args, ok := c.Payload.([]string)
+	if !ok || len(args) < 1 || len(args) > 2 || (len(args) == 1 && len(c.Data) == 0) {
+		h.Error(c, "usage: map import "+processor.Commands["import"].Args)
+		return
+	}
+
+	name := uniqueName(c.User, args[0])
+	if _, ok := c.User.TabulaByName(tabula.TabulaName(name)); ok {
+		h.Error(c, fmt.Sprintf("name `%s` is already in use", name))
+		return
+	}
+
+	var url string
+	if len(args) == 2 {
+		url = args[1]
+	}
+
+	data := c.Data
+	c.Data = nil
+	if len(data) == 0 {
+		var err error
+		data, err = fetch(url)
+		if err != nil {
+			h.Error(c, fmt.Sprintf("could not retrieve %s: %s", url, err))
+			return
+		}
+	}
+
+	if bundle.Sniff(data) {
+		importBundle(h, c, name, data)
+		return
+	}
+
+	if !uvtt.Sniff(data) {
+		h.Error(c, "that doesn't look like a mapbot export or a universal VTT (.dd2vtt, .df2vtt, .uvtt) file; use `map add` for plain images")
+		return
+	}
+
+	f, err := uvtt.Parse(data)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("could not import map: %s", err))
+		return
+	}
+
+	t, img, err := f.Tabula(name, url)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("could not import map: %s", err))
+		return
+	}
+
+	if err := addTabula(c, t, img); err != nil {
+		h.Error(c, "encountered some problems adding this map; sorry!")
+		log.Errorf("saving imported map: %v", err)
+		return
+	}
+
+	h.Reply(c, fmt.Sprintf("map %q imported at %.2f DPI, with %d walls and doors and %d lights", name, t.Dpi, len(t.Walls), len(t.Lights)))
+	h.Publish(&hub.Command{
+		Type:    hub.CommandType(c.From),
+		Payload: t,
+		User:    c.User,
+	})
+}
+
+func importBundle(h *hub.Hub, c *hub.Command, name string, data []byte) {
+	b, err := bundle.Import(data, name)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("could not import map: %s", err))
+		return
+	}
+
+	var skipped int
+	err = addTabula(c, b.Tabula, b.Background, func(dialect string, tx *sql.Tx) (err error) {
+		skipped, err = b.SaveMarksTx(dialect, tx)
+		return err
+	})
+	if err != nil {
+		h.Error(c, "encountered some problems adding this map; sorry!")
+		log.Errorf("saving imported bundle: %v", err)
+		return
+	}
+
+	tokens := 0
+	for _, ctxTokens := range b.Tabula.Tokens {
+		tokens += len(ctxTokens)
+	}
+	msg := fmt.Sprintf("map %q imported, with %d masks and %d tokens", name, len(b.Tabula.Masks), tokens)
+	if skipped > 0 {
+		msg += fmt.Sprintf("; %d marks were skipped because their channels are unknown here", skipped)
+	}
+	h.Reply(c, msg)
+	h.Publish(&hub.Command{
+		Type:    hub.CommandType(c.From),
+		Payload: b.Tabula,
+		User:    c.User,
+	})
+}
+
+// maxImportBytes is the largest file `map import` will fetch.
+const maxImportBytes = 256 << 20
+
+func fetch(url string) ([]byte, error) {
+	c := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	res, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded %s", res.Status)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, io.LimitReader(res.Body, maxImportBytes+1)); err != nil {
+		return nil, fmt.Errorf("error reading from HTTP response: %s", err)
+	}
+	if buf.Len() > maxImportBytes {
+		return nil, fmt.Errorf("file is larger than the %d MB I'll import", maxImportBytes>>20)
+	}
+	return buf.Bytes(), nil
+}
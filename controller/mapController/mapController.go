@@ -1,15 +1,19 @@
 package mapController
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/pdbogen/mapbot/common/colors"
-	"github.com/pdbogen/mapbot/common/conv"
 	"github.com/pdbogen/mapbot/common/db"
 	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/common/output"
 	"github.com/pdbogen/mapbot/controller/cmdproc"
 	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/history"
+	"github.com/pdbogen/mapbot/model/mapgen"
 	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/user"
 	"image"
 	"image/color"
 	"regexp"
@@ -21,6 +25,7 @@ var log = mbLog.Log
 
 func Register(h *hub.Hub) {
 	h.Subscribe("user:map", processor.Route)
+	h.Subscribe("internal:update:*", recordHistory)
 }
 
 var processor *cmdproc.CommandProcessor
@@ -32,8 +37,8 @@ func init() {
 			"add":       cmdproc.Subcommand{"<name> <url>", "add a map to your collection", cmdAdd},
 			"remove":    cmdproc.Subcommand{"<name>", "remove a map from your collection", cmdRemove},
 			"delete":    cmdproc.Subcommand{"<name>", "remove a map from your collection", cmdRemove},
-			"show":      cmdproc.Subcommand{"[<name>]", "show a the named map; or the active map in this context, if any", cmdShow},
-			"set":       cmdproc.Subcommand{"[<name>] {offsetX|offsetY|dpi|gridColor} <value>[ <key2> <value2> ...]", "set a property of an existing map; offsetX, offsetY, and dpi accepts numbers; color accepts some common color names or a six-digit hex code. If no map is specified, selected map is used.", cmdSet},
+			"show":      cmdproc.Subcommand{"[<name>|gm]", "show a the named map; or the active map in this context, if any. `gm` sends the owner of the active map a view with hidden tokens (see `token hide`) in a direct message", cmdShow},
+			"set":       cmdproc.Subcommand{"[<name>] {offsetX|offsetY|dpi|gridColor|gridStyle|gridWidth|gridOpacity} <value>[ <key2> <value2> ...]", "set a property of an existing map; offsetX, offsetY, and dpi accepts numbers; color accepts some common color names or a six-digit hex code. gridStyle is solid, dashed, dotted, or none (coordinates and tokens still line up with a hidden grid); gridWidth is in pixels, and gridOpacity a percentage. If no map is specified, selected map is used.", cmdSet},
 			"list":      cmdproc.Subcommand{"", "list your maps", cmdList},
 			"select":    cmdproc.Subcommand{"<name>", "selects the map active in this channel. active tokens will be cleared.", cmdSelect},
 			"dpi":       cmdproc.Subcommand{"<name> <dpi>", "shorthand for set, to set the map DPI", cmdDpi},
@@ -44,6 +49,13 @@ func init() {
 			"check":     cmdproc.Subcommand{"", "alias for non-map command `check`; see `check help` for more", cmdMark},
 			"autozoom":  cmdproc.Subcommand{"", "sets the zoom so that all current tokens are visible, with a small margin", cmdAutoZoom},
 			"rename":    {"<name> <new-name>", "shorthand for set, to set the map name", cmdRename},
+			"import":    {"<name> [<url>]", "import a map exported by `map export`, or a universal VTT (.dd2vtt, .df2vtt, .uvtt) map with its grid, walls, doors, and lights already set up. You can also just upload the file to mapbot in a DM.", cmdImport},
+			"export":    {"[foundry|svg] <name>", "export one of your maps, with its background, grid, masks, tokens, and marks, as a single file that `map import` understands. With `foundry`, instead export it as a Foundry VTT scene, with the tokens and marks in this channel; with `svg`, as an SVG image whose grid, tokens, marks, and lines stay sharp at any size.", cmdExport},
+			"coords":    {coordsArgs(), "choose how squares are named in this channel: letters for columns and numbers for rows, like C4 (the default); numeric, like 3,4; or rowletters, letters for rows and numbers for columns, like D3. Mark, token, and zoom commands then expect that notation. `origin` names the top-left square, so the labels can match a map's own numbering; `labels` moves the labels into a margin around the map's edges, or hides them; and `font` picks their font. `default` goes back to the defaults. With no arguments, shows the current choice.", cmdCoords},
+			"format":    {"[png|webp|jpeg [<quality>]] [budget {<size>|off}]", "choose how maps in this channel are sent: png (the default), webp (lossless, and usually smaller), or jpeg (smallest, but slightly blurry; quality 1-100, default " + strconv.Itoa(output.DefaultQuality) + "). With a budget, like 2MB, maps that would be larger are sent as jpeg or shrunk until they fit. With no arguments, shows the current choice.", cmdFormat},
+			"print":     {"<name> [paper={" + strings.Join(tabula.PaperNames(), "|") + "}]", "send one of your maps as a PDF for printing, with the tokens and marks in this channel. Each square is one inch, so the map is spread across several pages, which overlap by one square so they can be lined up and taped together. Paper defaults to letter.", cmdPrint},
+			"replay":    {"[<rounds>|clear]", "send an animated GIF replaying the last <rounds> changes to tokens and marks on the active map in this channel (by default, up to " + strconv.Itoa(history.MaxReplayFrames) + "), with a trail behind each token that moved. `clear` forgets the history, so the next replay starts from now.", cmdReplay},
+			"generate":  {"<name> {" + strings.Join(mapgen.Kinds(), "|") + "} [<seed>] [<size>]", "procedurally generate a new map, <size> squares on a side (default 30). The same seed always produces the same map; if no seed is given, a random one is chosen and reported.", cmdGenerate},
 		},
 	}
 }
@@ -96,15 +108,15 @@ func cmdAutoZoom(h *hub.Hub, c *hub.Command) {
 		return
 	}
 
-	ctxId := c.Context.Id()
-	if tab.Tokens == nil || tab.Tokens[ctxId] == nil || len(tab.Tokens[ctxId]) == 0 {
+	tokens := tab.ShownTokens(c.Context)
+	if len(tokens) == 0 {
 		h.Reply(c, "There are no tokens on the active map.")
 		return
 	}
 
 	first := true
 	min_x, min_y, max_x, max_y := 0, 0, 0, 0
-	for _, token := range tab.Tokens[ctxId] {
+	for _, token := range tokens {
 		if first {
 			min_x = token.Coordinate.X
 			max_x = token.Coordinate.X
@@ -128,9 +140,10 @@ func cmdAutoZoom(h *hub.Hub, c *hub.Command) {
 		}
 	}
 
+	notation := c.Context.GetCoordinates().Notation
 	cmdZoom(h, c.WithPayload([]string{
-		conv.PointToCoords(image.Pt(min_x-1, min_y-1)),
-		conv.PointToCoords(image.Pt(max_x+1, max_y+1)),
+		notation.Format(image.Pt(min_x-1, min_y-1)),
+		notation.Format(image.Pt(max_x+1, max_y+1)),
 	}))
 }
 
@@ -144,13 +157,14 @@ func cmdZoom(h *hub.Hub, c *hub.Command) {
 	var minCoord, maxCoord image.Point
 	var err error
 	var state int
+	notation := c.Context.GetCoordinates().Notation
 loop:
 	for i := 0; i < len(args); i++ {
 		var c image.Point
 		a := args[i]
-		c, _, err = conv.RCToPoint(a, false)
+		c, _, err = notation.Parse(a, false)
 		if err != nil && i+1 < len(args) {
-			c, err = conv.CoordsToPoint(a, args[i+1])
+			c, err = notation.ParsePair(a, args[i+1])
 			i++
 		}
 		if err != nil {
@@ -332,6 +346,27 @@ func cmdSet(h *hub.Hub, c *hub.Command) {
 				h.Error(c, "color should be a common color name; or an HTML-style RGB code, i.e., (red) #FF0000, (green) #00FF00, (blue) #0000FF")
 				return
 			}
+		case "gridstyle":
+			style, err := tabula.ParseGridStyle(args[i+1])
+			if err != nil {
+				h.Error(c, err.Error())
+				return
+			}
+			t.GridStyle = style
+		case "gridwidth":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 || n > tabula.MaxGridWidth {
+				h.Error(c, fmt.Sprintf("grid width should be a number of pixels from 1 to %d, not %q", tabula.MaxGridWidth, args[i+1]))
+				return
+			}
+			t.GridWidth = n
+		case "gridopacity":
+			n, err := strconv.Atoi(strings.TrimSuffix(args[i+1], "%"))
+			if err != nil || n < 1 || n > 100 {
+				h.Error(c, fmt.Sprintf("grid opacity should be a percentage from 1 to 100, not %q; to hide the grid, use `gridstyle none`", args[i+1]))
+				return
+			}
+			t.GridOpacity = n
 		case "offsetx":
 			n, err := strconv.Atoi(args[i+1])
 			if err != nil {
@@ -427,6 +462,10 @@ func cmdShow(h *hub.Hub, c *hub.Command) {
 				return
 			}
 		case 1:
+			if strings.ToLower(args[0]) == "gm" {
+				cmdShowGM(h, c)
+				return
+			}
 			var ok bool
 			t, ok = c.User.TabulaByName(tabula.TabulaName(args[0]))
 			if !ok {
@@ -445,6 +484,27 @@ func cmdShow(h *hub.Hub, c *hub.Command) {
 	}
 }
 
+// cmdShowGM sends the owner of the active map, privately, a view of it that includes the channel's hidden tokens.
+func cmdShowGM(h *hub.Hub, c *hub.Command) {
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+	if !c.User.Owns(*tabId) {
+		h.Error(c, "only the owner of the active map can see its GM view")
+		return
+	}
+
+	t, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "error loading active map")
+		log.Errorf("error loading active map %d: %s", *tabId, err)
+		return
+	}
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(&hub.Private{Payload: t.GMView()}))
+}
+
 func cmdRemove(h *hub.Hub, c *hub.Command) {
 	if c.User == nil {
 		log.Errorf("received command with nil user")
@@ -491,24 +551,7 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 
 	log.Debugf("got cmdAdd %v w/ %d bytes data", args, len(c.Data))
 
-	// If name is blank or prefixed with `@`, automatically pick a unique name
-	if len(args[0]) == 0 || args[0][0] == '@' {
-		if len(args[0]) > 0 {
-			args[0] = args[0][1:]
-		}
-
-		i := 1
-		name := args[0]
-		for {
-			_, ok := c.User.TabulaByName(tabula.TabulaName(name))
-			if !ok {
-				break
-			}
-			i++
-			name = fmt.Sprintf("%s-%d", args[0], i)
-		}
-		args[0] = name
-	}
+	args[0] = uniqueName(c.User, args[0])
 
 	t, ok := c.User.TabulaByName(tabula.TabulaName(args[0]))
 	if ok {
@@ -539,6 +582,43 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 		return
 	}
 
+	err = addTabula(c, t, c.Data)
+	c.Data = nil
+
+	if err != nil {
+		h.Error(c, "encountered some problems adding this map; sorry!")
+		log.Errorf("saving map: %v", err)
+	} else {
+		h.Publish(&hub.Command{
+			Type:    hub.CommandType(c.From),
+			Payload: fmt.Sprintf("map %q saved", args[0]),
+			User:    c.User,
+		})
+	}
+}
+
+// uniqueName returns `name` unchanged, unless it is blank or prefixed with `@`; in which case a name based on it that
+// the user is not yet using is chosen automatically.
+func uniqueName(u *user.User, name string) string {
+	if len(name) > 0 && name[0] != '@' {
+		return name
+	}
+	name = strings.TrimPrefix(name, "@")
+
+	i := 1
+	candidate := name
+	for {
+		if _, ok := u.TabulaByName(tabula.TabulaName(candidate)); !ok {
+			return candidate
+		}
+		i++
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// addTabula saves a new tabula, assigns it to the command's user, and stores `data` (if any) as its background image,
+// all in a single transaction. Any `extra` functions are run last, in the same transaction.
+func addTabula(c *hub.Command, t *tabula.Tabula, data []byte, extra ...func(dialect string, tx *sql.Tx) error) error {
 	tx, err := db.Instance.Begin()
 	if err == nil {
 		err = t.SaveTx(db.Instance.Dialect(), tx)
@@ -547,13 +627,18 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 		err = c.User.AssignTx(db.Instance.Dialect(), tx, t)
 	}
 
-	if err == nil && len(c.Data) > 0 {
+	if err == nil && len(data) > 0 {
 		_, err = tx.Exec(
 			`INSERT INTO tabula_data (tabula_id, data) VALUES ($1,$2)`,
-			int64(*t.Id), c.Data,
+			int64(*t.Id), data,
 		)
-		log.Debugf("saved %d bytes of map data", len(c.Data))
-		c.Data = nil
+		log.Debugf("saved %d bytes of map data", len(data))
+	}
+
+	for _, f := range extra {
+		if err == nil {
+			err = f(db.Instance.Dialect(), tx)
+		}
 	}
 
 	if err == nil {
@@ -566,16 +651,7 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 		}
 	}
 
-	if err != nil {
-		h.Error(c, "encountered some problems adding this map; sorry!")
-		log.Errorf("saving map: %v", err)
-	} else {
-		h.Publish(&hub.Command{
-			Type:    hub.CommandType(c.From),
-			Payload: fmt.Sprintf("map %q saved", args[0]),
-			User:    c.User,
-		})
-	}
+	return err
 }
 
 func notFound(n tabula.TabulaName) string {
@@ -0,0 +1,62 @@
+package mapController
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/attachment"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"strings"
+)
+
+func cmdPrint(h *hub.Hub, c *hub.Command) {
+	if c.User == nil {
+		log.Errorf("received command with nil user")
+		return
+	}
+
+	args, ok := c.Payload.([]string)
+	if !ok || len(args) < 1 || len(args) > 2 {
+		h.Error(c, "usage: map print "+processor.Commands["print"].Args)
+		return
+	}
+
+	paper := tabula.Papers["letter"]
+	if len(args) == 2 {
+		p, err := parsePaper(args[1])
+		if err != nil {
+			h.Error(c, fmt.Sprintf("%s; usage: map print %s", err, processor.Commands["print"].Args))
+			return
+		}
+		paper = p
+	}
+
+	name := tabula.TabulaName(args[0])
+	t, ok := c.User.TabulaByName(name)
+	if !ok {
+		h.Error(c, notFound(name))
+		return
+	}
+
+	data, err := t.Print(c.Context, paper)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("could not print map %q: %s", t.Name, err))
+		log.Errorf("printing map %d: %s", t.Id, err)
+		return
+	}
+
+	h.Publish(&hub.Command{
+		Type: hub.CommandType(c.From),
+		Payload: attachment.New(string(t.Name)+".pdf",
+			fmt.Sprintf("map %q on %s paper; print at actual size (100%%), and each square will be one inch", t.Name, paper.Name), data),
+		User: c.User,
+	})
+}
+
+// parsePaper parses an argument like `paper=a4`; the `paper=` is optional.
+func parsePaper(arg string) (tabula.Paper, error) {
+	name := strings.TrimPrefix(strings.ToLower(arg), "paper=")
+	if p, ok := tabula.Papers[name]; ok {
+		return p, nil
+	}
+	return tabula.Paper{}, fmt.Errorf("unknown paper %q; try %s", name, strings.Join(tabula.PaperNames(), " or "))
+}
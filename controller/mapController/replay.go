@@ -0,0 +1,103 @@
+package mapController
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/attachment"
+	"github.com/pdbogen/mapbot/model/history"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"strconv"
+)
+
+// recordHistory records a frame of the active map's tokens and marks whenever a context's map is updated. Only the
+// tokens the channel is shown are recorded, so replays are as the channel saw the map.
+func recordHistory(h *hub.Hub, c *hub.Command) {
+	if c.Context == nil {
+		return
+	}
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		log.Errorf("loading tabula %d to record history: %s", *tabId, err)
+		return
+	}
+
+	frame := history.NewFrame(tab.ShownTokens(c.Context), c.Context.GetMarks(*tabId))
+	if err := history.Record(db.Instance, c.Context.Id(), *tabId, frame); err != nil {
+		log.Errorf("recording history: %s", err)
+	}
+}
+
+func cmdReplay(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok || len(args) > 1 {
+		h.Error(c, "usage: map replay "+processor.Commands["replay"].Args)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	if len(args) == 1 && args[0] == "clear" {
+		if err := history.Clear(db.Instance, c.Context.Id(), *tabId); err != nil {
+			h.Error(c, "an error occurred clearing this channel's history")
+			log.Errorf("clearing history: %s", err)
+			return
+		}
+		h.Reply(c, "Forgot this channel's history on the active map; the next replay starts from here.")
+		return
+	}
+
+	rounds := history.MaxReplayFrames
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			h.Error(c, fmt.Sprintf("%q is not a number of rounds; usage: map replay %s", args[0], processor.Commands["replay"].Args))
+			return
+		}
+		if n < rounds {
+			rounds = n
+		}
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	// A replay of N rounds shows the N changes leading up to now, so it starts one frame earlier.
+	frames, err := history.Load(db.Instance, c.Context.Id(), *tabId, rounds+1)
+	if err != nil {
+		h.Error(c, "an error occurred loading this channel's history")
+		log.Errorf("loading history: %s", err)
+		return
+	}
+	if len(frames) < 2 {
+		h.Error(c, "Nothing has moved on the active map yet, so there's nothing to replay.")
+		return
+	}
+
+	h.Reply(c, fmt.Sprintf("Rendering %d frames; this may take a moment...", len(frames)))
+	data, err := history.Replay(tab, c.Context, frames)
+	if err != nil {
+		h.Error(c, fmt.Sprintf("could not render the replay: %s", err))
+		log.Errorf("rendering replay of tabula %d: %s", *tabId, err)
+		return
+	}
+
+	h.Publish(&hub.Command{
+		Type:    hub.CommandType(c.From),
+		Payload: attachment.New(string(tab.Name)+"-replay.gif", fmt.Sprintf("replay of the last %d changes on map %q", len(frames)-1, tab.Name), data),
+		User:    c.User,
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/pdbogen/mapbot/hub"
 	"github.com/pdbogen/mapbot/model/mark"
 	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/terrain"
 	"image"
 	"math"
 	"strconv"
@@ -24,14 +25,15 @@ func Register(h *hub.Hub) {
 }
 
 const syntax = "<place> [<place2> ... <placeN>] <color>\n" +
-	"specify one or more places followed by a color. There are a few ways to specify a place:\n" +
+	"specify one or more places followed by a color. Squares are named in this channel's notation (see `map coords`); the examples use the default. There are a few ways to specify a place:\n" +
 	"    a square -- given by a coordinate, with or without a space; i.e., `a1` or `a 1`\n" +
 	"    a side   -- given by a coordinate (no space) and a cardinal direction (n, s, e, w); example: `a1n` or `a1s`\n" +
 	"    a corner -- given by a coordinate (no space) and an intercardinal direction (ne, se, sw, nw); example: `a1ne`\n" +
 	"    a square -- use `square(top-left,bottom-right)` where `top-left` and `bottom-right` are coordinates (without spaces); example: `square(a1,f6)`\n" +
 	"    a circle -- use `circle(center,radius)` where `center` is a square or corner and `radius` is a number of feet, assuming 5 feet per square; example: `circle(m10,15)` or `circle(m10ne,15)`\n" +
-	"    a cone   -- use `cone(origin-corner,direction,radius)` where `origin-corner` is a square with corner; `direction` is one of the allowable directions from that corner (e.g., ne corner can project a cone north, northeast, or east); and radius is the size of the cone. 15-foot cones are special-cased according to Pahfinder rules, but all other cones are computed as all squares such that 3/4 corners are within a 90-degree cone, and all corners are within the radius. Example: `cone(f6ne,ne,20)`\n" +
-	"    a line   -- (or lines) use `line(A,B)` where A and B are squares or corners. Specifying a square will draw lines to/from all corners of that square. Example: `line(a1se,f5)` will draw four lines, from a1se to all corners of f5."
+	"    a cone   -- use `cone(origin-corner,direction,radius)`, or `cone(token,[direction,]radius)` to start from a token's corner, facing the way it faces unless you give a direction; where `origin-corner` is a square with corner; `direction` is one of the allowable directions from that corner (e.g., ne corner can project a cone north, northeast, or east); and radius is the size of the cone. 15-foot cones are special-cased according to Pahfinder rules, but all other cones are computed as all squares such that 3/4 corners are within a 90-degree cone, and all corners are within the radius. Example: `cone(f6ne,ne,20)`\n" +
+	"    a line   -- (or lines) use `line(A,B)` where A and B are squares or corners. Specifying a square will draw lines to/from all corners of that square. Example: `line(a1se,f5)` will draw four lines, from a1se to all corners of f5.\n" +
+	"Instead of a color, `mark` can give places a terrain: `difficult` squares cost double to move into, `blocked` squares can't be entered, and `open` clears them; example: `mark square(c3,e5) difficult`. Paths found by `path` and `token move ... to` go around them. `mark clear terrain` clears all the terrain."
 
 func clearMarks(h *hub.Hub, c *hub.Command) {
 	tabId := c.Context.GetActiveTabulaId()
@@ -57,6 +59,30 @@ func clearMarks(h *hub.Hub, c *hub.Command) {
 	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
 }
 
+func clearTerrain(h *hub.Hub, c *hub.Command) {
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	c.Context.ClearTerrain(*tabId)
+
+	if err := c.Context.Save(); err != nil {
+		log.Errorf("saving terrain: %s", err)
+		h.Error(c, ":warning: A problem occurred while saving your terrain. This could indicate an bug.")
+	}
+
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+}
+
 func consumeUntilSuffix(args []string, i *int, suffix string) string {
 	ret := ""
 	for _, arg := range args {
@@ -70,13 +96,13 @@ func consumeUntilSuffix(args []string, i *int, suffix string) string {
 	return ret
 }
 
-var markFuncs = map[string]func([]string) ([]mark.Mark, error){
+var markFuncs = map[string]func(conv.Notation, []string) ([]mark.Mark, error){
 	"square": marksFromSquare,
 	"circle": mark.Circle,
 	"cone":   marksFromCone,
 }
 
-var lineFuncs = map[string]func([]string) ([]mark.Line, error){
+var lineFuncs = map[string]func(conv.Notation, []string) ([]mark.Line, error){
 	"line":  linesFromLine,
 	"lines": linesFromLine,
 }
@@ -102,6 +128,11 @@ func cmdMark(h *hub.Hub, c *hub.Command) {
 		return
 	}
 
+	if len(args) == 2 && strings.ToLower(args[0]) == "clear" && strings.ToLower(args[1]) == "terrain" {
+		clearTerrain(h, c)
+		return
+	}
+
 	tabId := c.Context.GetActiveTabulaId()
 	if tabId == nil {
 		h.Error(c, "no active map in this channel, use `map select <name>` first")
@@ -115,23 +146,25 @@ func cmdMark(h *hub.Hub, c *hub.Command) {
 		return
 	}
 
+	notation := c.Context.GetCoordinates().Notation
 	marks := []mark.Mark{}
 	coloredMarks := []mark.Mark{}
 	lines := []mark.Line{}
 	coloredLines := []mark.Line{}
+	ground := map[image.Point]terrain.Kind{}
 	for i := 0; i < len(args); i++ {
 		a := strings.ToLower(args[i])
 		// Option 1: RC-style coordinate (maybe with a direction)
 		// Option 2: Row letter; i+1 contains column
 		// Option 3: A shape (i.e., square(a,b))
 		// Option 4: color
-		if pt, dir, err := conv.RCToPoint(a, true); err == nil {
+		if pt, dir, err := notation.Parse(a, true); err == nil {
 			marks = append(marks, mark.Mark{Point: pt, Direction: dir})
 			continue
 		}
 
 		if i+1 < len(args) {
-			if pt, err := conv.CoordsToPoint(a, args[i+1]); err == nil {
+			if pt, err := notation.ParsePair(a, args[i+1]); err == nil {
 				marks = append(marks, mark.Mark{Point: pt})
 				i++
 				continue
@@ -140,8 +173,14 @@ func cmdMark(h *hub.Hub, c *hub.Command) {
 
 		if f, ok := markFuncs[strings.ToLower(strings.Split(a, "(")[0])]; ok {
 			term := consumeUntilSuffix(args[i:], &i, ")")
-			args := strings.Split(strings.TrimRight(strings.Split(term, "(")[1], ")"), ",")
-			m, err := f(args)
+			args := notation.SplitArgs(strings.TrimRight(strings.Split(term, "(")[1], ")"))
+			if strings.HasPrefix(a, "cone(") {
+				if args, err = tokenCone(notation, tab.ShownTokens(c.Context), args); err != nil {
+					h.Error(c, fmt.Sprintf(":warning: while parsing `%s`, %s", term, err))
+					return
+				}
+			}
+			m, err := f(notation, args)
 			if err != nil {
 				h.Error(c, fmt.Sprintf(":warning: while parsing `%s`, %s", term, err))
 				return
@@ -152,8 +191,8 @@ func cmdMark(h *hub.Hub, c *hub.Command) {
 
 		if f, ok := lineFuncs[strings.ToLower(strings.Split(a, "(")[0])]; ok {
 			term := consumeUntilSuffix(args[i:], &i, ")")
-			args := strings.Split(strings.TrimRight(strings.Split(term, "(")[1], ")"), ",")
-			l, err := f(args)
+			args := notation.SplitArgs(strings.TrimRight(strings.Split(term, "(")[1], ")"))
+			l, err := f(notation, args)
 			if err != nil {
 				h.Error(c, fmt.Sprintf(":warning: while parsing `%s`, %s", term, err))
 				return
@@ -162,6 +201,18 @@ func cmdMark(h *hub.Hub, c *hub.Command) {
 			continue
 		}
 
+		if kind, err := terrain.ParseKind(a); err == nil {
+			if cmdName != "mark" {
+				h.Error(c, fmt.Sprintf(":warning: `%s` is a terrain, which only `mark` can give squares.", a))
+				return
+			}
+			for _, m := range marks {
+				ground[m.Point] = kind
+			}
+			marks = []mark.Mark{}
+			continue
+		}
+
 		if color, err := colors.ToColor(a); err == nil {
 			// paint the squares the color
 			for _, m := range marks {
@@ -194,6 +245,9 @@ func cmdMark(h *hub.Hub, c *hub.Command) {
 		for _, m := range coloredMarks {
 			c.Context.Mark(*tabId, m)
 		}
+		for pt, kind := range ground {
+			c.Context.SetTerrain(*tabId, pt, kind)
+		}
 		log.Debugf("saving marks...")
 		if err := c.Context.Save(); err != nil {
 			log.Errorf("saving marks: %s", err)
@@ -297,18 +351,17 @@ func angle(a image.Point, cA string, b image.Point, cB string) float64 {
 	}
 }
 
-func linesFromLine(args []string) (out []mark.Line, err error) {
-	out = []mark.Line{}
+func linesFromLine(n conv.Notation, args []string) (out []mark.Line, err error) {
 	if len(args) != 2 {
 		return nil, fmt.Errorf("`line()` expects two comma-separated arguments: `from`, `to`")
 	}
 
-	a, ac, err := conv.RCToPoint(args[0], true)
+	a, ac, err := n.Parse(args[0], true)
 	if err != nil {
 		return nil, fmt.Errorf("looked like a line, but could not parse coordinate `%s`: %s", args[0], err)
 	}
 
-	b, bc, err := conv.RCToPoint(args[1], true)
+	b, bc, err := n.Parse(args[1], true)
 	if err != nil {
 		return nil, fmt.Errorf("looked like a line, but could not parse coordinate `%s`: %s", args[1], err)
 	}
@@ -321,31 +374,60 @@ func linesFromLine(args []string) (out []mark.Line, err error) {
 		return nil, fmt.Errorf("only corners or entire squares can be used to draw lines; you gave `%s`", args[1])
 	}
 
-	cornersA := []string{ac}
-	if len(ac) == 0 {
-		cornersA = []string{"ne", "se", "sw", "nw"}
-	}
+	return mark.CornerLines(a, ac, b, bc), nil
+}
+
+// coneCorners are the corners of a token that cones leave from, by their direction. Cones going straight out of a
+// side leave from the corner clockwise of its middle.
+var coneCorners = map[string]string{
+	"n": "ne", "ne": "ne", "e": "se", "se": "se", "s": "sw", "sw": "sw", "w": "nw", "nw": "nw",
+}
 
-	cornersB := []string{bc}
-	if len(bc) == 0 {
-		cornersB = []string{"ne", "se", "sw", "nw"}
+// tokenCone rewrites the arguments of a cone that starts from a token, like `:orc:,15` or `:orc:,ne,15`, into those of
+// one that starts from the corner of the token facing its direction, like `c3ne,ne,15`. Other arguments are returned
+// unchanged.
+func tokenCone(n conv.Notation, tokens map[string]tabula.Token, args []string) ([]string, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return args, nil
+	}
+	tok, ok := tokens[args[0]]
+	if !ok {
+		return args, nil
 	}
 
-	for _, cA := range cornersA {
-		for _, cB := range cornersB {
-			out = append(out, mark.Line{A: a, CA: cA, B: b, CB: cB})
-		}
+	var dir string
+	if len(args) == 3 {
+		dir = strings.ToLower(args[1])
+	} else if tok.HasFacing {
+		dir = tok.Facing.Compass()
+	} else {
+		return nil, fmt.Errorf("`%s` isn't facing anywhere; give the cone a direction, or use `token face`", args[0])
+	}
+	corner, ok := coneCorners[dir]
+	if !ok {
+		return nil, fmt.Errorf("`%s` is not a direction", dir)
 	}
 
-	return out, nil
+	far := tok.Size - 1
+	if far < 0 {
+		far = 0
+	}
+	pt := tok.Coordinate
+	if strings.Contains(corner, "e") {
+		pt.X += far
+	}
+	if strings.Contains(corner, "s") {
+		pt.Y += far
+	}
+	return []string{n.Format(pt) + corner, dir, args[len(args)-1]}, nil
 }
 
-func marksFromCone(args []string) (out []mark.Mark, err error) {
+func marksFromCone(n conv.Notation, args []string) (out []mark.Mark, err error) {
 	out = []mark.Mark{}
 	if len(args) != 3 {
 		return nil, fmt.Errorf("`cone()` expects three comma-separated arguments: `corner`, `direction`, `distance`")
 	}
-	origin, corner, err := conv.RCToPoint(args[0], true)
+	origin, corner, err := n.Parse(args[0], true)
 	if err != nil {
 		return nil, fmt.Errorf("looked like a cone, but could not parse coordinate `%s`: %s", args[0], err)
 	}
@@ -420,18 +502,18 @@ func marksFromCone(args []string) (out []mark.Mark, err error) {
 	return out, nil
 }
 
-func marksFromSquare(args []string) (out []mark.Mark, err error) {
+func marksFromSquare(n conv.Notation, args []string) (out []mark.Mark, err error) {
 	out = []mark.Mark{}
 	if len(args) != 2 {
 		return nil, fmt.Errorf("`square()` expects two comma-separated arguments")
 	}
 
-	min, _, err := conv.RCToPoint(args[0], false)
+	min, _, err := n.Parse(args[0], false)
 	if err != nil {
 		return nil, fmt.Errorf("looked like a square, but could not parse coordinate `%s`: %s", args[0], err)
 	}
 
-	max, _, err := conv.RCToPoint(args[1], false)
+	max, _, err := n.Parse(args[1], false)
 	if err != nil {
 		return nil, fmt.Errorf("looked like a square, but could not parse coordinate `%s`: %s", args[1], err)
 	}
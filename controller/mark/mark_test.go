@@ -2,6 +2,8 @@ package mark
 
 import (
 	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/model/tabula"
 	"image"
 	"math"
 	"strings"
@@ -27,7 +29,7 @@ func TestMarksFromCone(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		marks, err := marksFromCone(test.input)
+		marks, err := marksFromCone(conv.Notation{}, test.input)
 		if err != nil {
 			t.Fatalf("%q: expected non-nil error, got %s", test.input, err)
 		}
@@ -100,3 +102,34 @@ func TestConsumeUntilSuffix(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenCone(t *testing.T) {
+	tokens := map[string]tabula.Token{
+		"orc":   tabula.Token{Coordinate: image.Pt(2, 2), Size: 1}.WithFacing(90),
+		"ogre":  tabula.Token{Coordinate: image.Pt(5, 5), Size: 2}.WithFacing(135),
+		"lost":  {Coordinate: image.Pt(0, 0), Size: 1},
+		"giant": tabula.Token{Coordinate: image.Pt(8, 8), Size: 3}.WithFacing(0),
+	}
+	tests := []struct {
+		in, out string
+	}{
+		{"orc,15", "c3se,e,15"},
+		{"orc,nw,15", "c3nw,nw,15"},
+		{"ogre,20", "g7se,se,20"},
+		{"giant,n,15", "k9ne,n,15"},
+		{"c3ne,ne,15", "c3ne,ne,15"},
+	}
+	for _, test := range tests {
+		out, err := tokenCone(conv.Notation{}, tokens, strings.Split(test.in, ","))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.in, err)
+			continue
+		}
+		if !strings.EqualFold(strings.Join(out, ","), test.out) {
+			t.Errorf("%s: expected %s, got %s", test.in, test.out, strings.Join(out, ","))
+		}
+	}
+	if _, err := tokenCone(conv.Notation{}, tokens, []string{"lost", "15"}); err == nil {
+		t.Errorf("expected an error for a cone from a token facing nowhere")
+	}
+}
@@ -0,0 +1,161 @@
+package token
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/colors"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/art"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image/color"
+	"reflect"
+	"strings"
+)
+
+// artOptions are the arguments of `token art` after the token's name.
+type artOptions struct {
+	url      string
+	clear    bool
+	mine     bool
+	round    *bool
+	border   *color.NRGBA
+	noBorder bool
+}
+
+func parseArtOptions(args []string) (artOptions, error) {
+	ret := artOptions{}
+	for i := 0; i < len(args); i++ {
+		a := strings.ToLower(args[i])
+		switch {
+		case strings.HasPrefix(a, "http://") || strings.HasPrefix(a, "https://"):
+			ret.url = args[i]
+		case a == "clear":
+			ret.clear = true
+		case a == "mine":
+			ret.mine = true
+		case a == "round" || a == "square":
+			round := a == "round"
+			ret.round = &round
+		case a == "border":
+			if i+1 >= len(args) {
+				return ret, fmt.Errorf("border needs a color, or `none`")
+			}
+			i++
+			if strings.ToLower(args[i]) == "none" {
+				ret.noBorder = true
+				continue
+			}
+			c, err := colors.ToColor(args[i])
+			if err != nil {
+				return ret, err
+			}
+			border := color.NRGBAModel.Convert(c).(color.NRGBA)
+			ret.border = &border
+		default:
+			return ret, fmt.Errorf("I don't know what you mean by `%s`", args[i])
+		}
+	}
+	return ret, nil
+}
+
+func cmdArt(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+	usage := "usage: token art " + processor.Commands["art"].Args
+
+	if len(args) < 1 {
+		h.Error(c, usage)
+		return
+	}
+
+	name := args[0]
+	opts, err := parseArtOptions(args[1:])
+	if err != nil {
+		h.Error(c, fmt.Sprintf("%s; %s", err, usage))
+		return
+	}
+
+	scope, owner, whose := art.Channel, string(c.Context.Id()), "this channel"
+	if opts.mine {
+		scope, owner, whose = art.User, string(c.User.Id), "you"
+	}
+
+	if opts.clear {
+		if err := art.Delete(db.Instance, scope, owner, name); err != nil {
+			h.Error(c, "an error occurred forgetting the portrait")
+			log.Error(err)
+			return
+		}
+		h.Reply(c, fmt.Sprintf("%s no longer has a portrait for %s", whose, name))
+		showArt(h, c)
+		return
+	}
+
+	data := c.Data
+	c.Data = nil
+	if opts.url != "" {
+		if data, err = art.Fetch(opts.url); err != nil {
+			h.Error(c, fmt.Sprintf("I couldn't retrieve %s: %s", opts.url, err))
+			return
+		}
+	}
+
+	var a *art.Art
+	if data != nil {
+		if a, err = art.New(scope, owner, name, data); err != nil {
+			h.Error(c, err.Error())
+			return
+		}
+	} else {
+		if a, err = art.Load(db.Instance, scope, owner, name); err != nil {
+			h.Error(c, "an error occurred loading the portrait")
+			log.Error(err)
+			return
+		}
+		if a == nil {
+			h.Error(c, fmt.Sprintf("%s has no portrait for %s yet; give me a URL, or DM me an image with the comment `token art %s`. %s", whose, name, name, usage))
+			return
+		}
+	}
+
+	if opts.round != nil {
+		a.Round = *opts.round
+	}
+	if opts.border != nil {
+		a.Border, a.NoBorder = *opts.border, false
+	}
+	if opts.noBorder {
+		a.Border, a.NoBorder = color.NRGBA{}, true
+	}
+	if err := a.Save(db.Instance); err != nil {
+		h.Error(c, "an error occurred saving the portrait")
+		log.Error(err)
+		return
+	}
+
+	if opts.mine {
+		h.Reply(c, fmt.Sprintf("%s tokens you place will be drawn with your portrait, unless the channel has its own", name))
+	} else {
+		h.Reply(c, fmt.Sprintf("%s tokens in this channel will be drawn with this portrait", name))
+	}
+	showArt(h, c)
+}
+
+// showArt shows the active map, if there is one, so that a changed portrait can be seen.
+func showArt(h *hub.Hub, c *hub.Command) {
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		return
+	}
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+	h.PublishUpdate(c.Context)
+}
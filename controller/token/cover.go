@@ -0,0 +1,114 @@
+package token
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image/color"
+	"reflect"
+	"strings"
+)
+
+const coverUsage = "usage: cover [<attacker>] <target>\n" +
+	"works out the cover the target has from the attacker: lines are drawn from the attacker's best corner to each " +
+	"corner of the target, and each line crossing a wall or passing through another token's square is blocked. With " +
+	"none blocked, the target has no cover; fewer than half, partial cover; all of them, total cover; and otherwise, " +
+	"cover. The lines tested are shown, blocked ones in red. Without an attacker, from the last token you moved."
+
+// coverColors draw the lines tested for cover: clear, then blocked.
+var coverColors = [2]color.Color{
+	color.NRGBA{R: 0x30, G: 0xd0, B: 0x30, A: 0xff},
+	color.NRGBA{R: 0xe0, G: 0x20, B: 0x20, A: 0xff},
+}
+
+// coverPhrase describes cover `c` as a sentence would.
+func coverPhrase(c tabula.Cover) string {
+	switch c {
+	case tabula.NoCover:
+		return "no cover"
+	case tabula.FullCover:
+		return "cover"
+	}
+	return c.String() + " cover"
+}
+
+func cmdCover(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 0 || strings.ToLower(args[0]) == "help" {
+		h.Reply(c, coverUsage)
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You named one token, but I don't remember the last token you moved to attack with.")
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, coverUsage)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tokens := tab.ShownTokens(c.Context)
+	attacker, target := args[0], args[1]
+	for _, name := range args {
+		if _, ok := tokens[name]; !ok {
+			h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", name))
+			return
+		}
+	}
+	if attacker == target {
+		h.Error(c, fmt.Sprintf("%s can't take cover from itself.", attacker))
+		return
+	}
+
+	others := []tabula.Token{}
+	for name, tok := range tokens {
+		if name != attacker && name != target {
+			others = append(others, tok)
+		}
+	}
+
+	cover, tested := tabula.CoverFrom(tokens[attacker], tokens[target], others, tab.Walls)
+	lines := []mark.Line{}
+	blocked := 0
+	for _, l := range tested {
+		if l.Blocked {
+			blocked++
+			lines = append(lines, l.WithColor(coverColors[1]))
+		} else {
+			lines = append(lines, l.WithColor(coverColors[0]))
+		}
+	}
+
+	h.Publish(c.
+		WithType(hub.CommandType(c.From)).
+		WithPayload(tab.WithLines(lines).WithNote(fmt.Sprintf("%s has %s from %s (%d of %d lines blocked)",
+			target, coverPhrase(cover), attacker, blocked, len(tested)))),
+	)
+}
@@ -0,0 +1,110 @@
+package token
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+)
+
+const pathUsage = "usage: path <from> <to>\n" +
+	"shows the cheapest way from one place to another, going around walls and `blocked` squares, and paying double for " +
+	"`difficult` ones (see `mark help`). Each place is a square, or a token on the map; a path from a token is the way " +
+	"that token would go. `token move <name> to <point>` moves a token along it."
+
+// pathColor shades the squares of a path.
+var pathColor = color.NRGBA{R: 0xff, G: 0xd0, B: 0x20, A: 0x70}
+
+// parsePlaces returns the squares named in `args`, each a square's name in one or two words or the name of one of
+// `tokens`, and the size of the token at the first of them.
+func parsePlaces(n conv.Notation, args []string, tokens map[string]tabula.Token) ([]image.Point, int, error) {
+	places := []image.Point{}
+	size := 1
+	for i := 0; i < len(args); i++ {
+		if tok, ok := tokens[args[i]]; ok {
+			if len(places) == 0 {
+				size = sizeOf(tok)
+			}
+			places = append(places, tok.Coordinate)
+			continue
+		}
+		if i+1 < len(args) {
+			if pt, err := n.ParsePair(args[i], args[i+1]); err == nil {
+				places = append(places, pt)
+				i++
+				continue
+			}
+		}
+		pt, _, err := n.Parse(args[i], false)
+		if err != nil {
+			return nil, 0, fmt.Errorf("`%s` is neither a square nor a token on the map", args[i])
+		}
+		places = append(places, pt)
+	}
+	return places, size, nil
+}
+
+func cmdPath(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 0 || strings.ToLower(args[0]) == "help" {
+		h.Reply(c, pathUsage)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	notation := c.Context.GetCoordinates().Notation
+	places, size, err := parsePlaces(notation, args, tab.ShownTokens(c.Context))
+	if err != nil {
+		h.Error(c, err.Error())
+		return
+	}
+	if len(places) != 2 {
+		h.Error(c, pathUsage)
+		return
+	}
+
+	path, feet, ok := c.Context.GetTerrain(*tabId).Path(places[0], places[1], size, tab.Walls)
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no way from %s to %s.", notation.Format(places[0]), notation.Format(places[1])))
+		return
+	}
+
+	marks := []mark.Mark{}
+	for _, pt := range path {
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				marks = append(marks, mark.Mark{Point: pt.Add(image.Pt(x, y)), Color: pathColor})
+			}
+		}
+	}
+
+	h.Publish(c.
+		WithType(hub.CommandType(c.From)).
+		WithPayload(tab.WithMarks(marks).WithNote(fmt.Sprintf("%s to %s: %dft",
+			strings.ToUpper(notation.Format(places[0])), strings.ToUpper(notation.Format(places[1])), feet))),
+	)
+}
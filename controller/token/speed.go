@@ -0,0 +1,201 @@
+package token
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image/color"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSpeed is the fastest a token may move in a turn, in feet; far more than any creature needs, but little enough that
+// shading where it can reach stays quick.
+const maxSpeed = 500
+
+// reachableColor shades the squares a token can still reach this turn.
+var reachableColor = color.NRGBA{R: 0x30, G: 0x90, B: 0xff, A: 0x50}
+
+func cmdSpeed(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, fmt.Sprintf("`%s` looks like a speed, but I don't remember the last token you moved.", args[0]))
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, "usage: token speed "+processor.Commands["speed"].Args)
+		return
+	}
+
+	feet, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(args[1]), "ft"))
+	if err != nil || feet < 0 {
+		h.Error(c, fmt.Sprintf("`%s` is not a number of feet", args[1]))
+		return
+	}
+	if feet > maxSpeed {
+		h.Error(c, fmt.Sprintf("%dft is too fast; speeds go up to %dft", feet, maxSpeed))
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tok, ok := tab.Tokens[c.Context.Id()][args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+	tab.Tokens[c.Context.Id()][args[0]] = tok.WithSpeed(feet)
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+		return
+	}
+
+	if feet == 0 {
+		h.Reply(c, fmt.Sprintf("%s may move as far as it likes", args[0]))
+	} else {
+		h.Reply(c, fmt.Sprintf("%s moves %dft a turn; it has %dft left this turn", args[0], feet, tab.Tokens[c.Context.Id()][args[0]].Remaining()))
+	}
+}
+
+// cmdTurn starts a new turn for the named tokens, or with `all` for every token, so they may move their whole speed
+// again.
+func cmdTurn(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 0 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You didn't name a token, and I don't remember the last token you moved.")
+			return
+		}
+		args = []string{tok}
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	if len(args) == 1 && strings.ToLower(args[0]) == "all" {
+		args = []string{}
+		for name := range tab.Tokens[c.Context.Id()] {
+			args = append(args, name)
+		}
+		sort.Strings(args)
+	}
+
+	for _, name := range args {
+		tok, ok := tab.Tokens[c.Context.Id()][name]
+		if !ok {
+			h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", name))
+			return
+		}
+		tab.Tokens[c.Context.Id()][name] = tok.WithMoved(0)
+	}
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+		return
+	}
+
+	h.Reply(c, fmt.Sprintf("a new turn for %s", strings.Join(args, " ")))
+}
+
+// cmdReachable shades the squares the token can still reach this turn.
+func cmdReachable(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 0 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You didn't name a token, and I don't remember the last token you moved.")
+			return
+		}
+		args = []string{tok}
+	}
+
+	if len(args) != 1 {
+		h.Error(c, "usage: token reachable "+processor.Commands["reachable"].Args)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tok, ok := tab.ShownTokens(c.Context)[args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+	if tok.Speed == 0 {
+		h.Error(c, fmt.Sprintf("%s has no speed; give it one with `token speed %s <feet>`.", args[0], args[0]))
+		return
+	}
+
+	marks := []mark.Mark{}
+	for _, pt := range tok.Reachable(tok.Remaining(), c.Context.GetTerrain(*tabId), tab.Walls) {
+		marks = append(marks, mark.Mark{Point: pt, Color: reachableColor})
+	}
+
+	h.Publish(c.
+		WithType(hub.CommandType(c.From)).
+		WithPayload(tab.WithMarks(marks).WithNote(fmt.Sprintf("%s has %dft of its %dft left", args[0], tok.Remaining(), tok.Speed))),
+	)
+}
@@ -0,0 +1,308 @@
+package token
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const threatUsage = "usage: threat [<name>|<point>]\n" +
+	"lists the tokens threatening a token, or a square: enemies threaten allies and allies threaten enemies, and " +
+	"enemies threaten a neutral token or a square. Tokens threaten the squares within their reach, 5ft unless set with " +
+	"`token reach`; set whose side a token is on with `token faction`. Without a name, for the last token you moved."
+
+const flankUsage = "usage: flank [<attacker>] <target>\n" +
+	"tells whether an ally of the attacker threatens the target from the opposite side, so that the line between the " +
+	"two of them passes through opposite sides or corners of the target. Without an attacker, for the last token you " +
+	"moved."
+
+func cmdReach(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, fmt.Sprintf("`%s` looks like a reach, but I don't remember the last token you moved.", args[0]))
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, "usage: token reach "+processor.Commands["reach"].Args)
+		return
+	}
+
+	feet, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(args[1]), "ft"))
+	if err != nil || feet < 0 {
+		h.Error(c, fmt.Sprintf("`%s` is not a number of feet", args[1]))
+		return
+	}
+	if feet > tabula.MaxReach {
+		h.Error(c, fmt.Sprintf("%dft is too far; reaches go up to %dft", feet, tabula.MaxReach))
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tok, ok := tab.Tokens[c.Context.Id()][args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+	tab.Tokens[c.Context.Id()][args[0]] = tok.WithReach(feet)
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+		return
+	}
+
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+	h.PublishUpdate(c.Context)
+}
+
+func cmdFaction(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, fmt.Sprintf("`%s` looks like a faction, but I don't remember the last token you moved.", args[0]))
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, "usage: token faction "+processor.Commands["faction"].Args)
+		return
+	}
+
+	faction, err := tabula.ParseFaction(args[1])
+	if err != nil {
+		h.Error(c, err.Error())
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tok, ok := tab.Tokens[c.Context.Id()][args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+	tab.Tokens[c.Context.Id()][args[0]] = tok.WithFaction(faction)
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+		return
+	}
+
+	h.Reply(c, fmt.Sprintf("%s is %s", args[0], faction))
+}
+
+// threatening returns the names of `tokens`, other than `target` itself, that threaten `target`: those of the opposing
+// faction within their reach of it. A neutral target is threatened by enemies.
+func threatening(tokens map[string]tabula.Token, name string, target tabula.Token) []string {
+	against := target.Faction
+	if against == tabula.Neutral {
+		against = tabula.Ally
+	}
+	ret := []string{}
+	for n, tok := range tokens {
+		if n != name && tok.Faction.Opposes(against) && tok.Threatens(target) {
+			ret = append(ret, n)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func cmdThreat(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) > 0 && strings.ToLower(args[0]) == "help" {
+		h.Reply(c, threatUsage)
+		return
+	}
+
+	if len(args) == 0 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You didn't name a token, and I don't remember the last token you moved.")
+			return
+		}
+		args = []string{tok}
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tokens := tab.ShownTokens(c.Context)
+	name := args[0]
+	target, ok := tokens[name]
+	if !ok || len(args) > 1 {
+		notation := c.Context.GetCoordinates().Notation
+		places, _, err := parsePlaces(notation, args, nil)
+		if err != nil {
+			h.Error(c, err.Error())
+			return
+		}
+		if len(places) != 1 {
+			h.Error(c, threatUsage)
+			return
+		}
+		name = strings.ToUpper(notation.Format(places[0]))
+		target = tabula.Token{Coordinate: places[0], Size: 1}
+	}
+
+	names := threatening(tokens, name, target)
+	if len(names) == 0 {
+		h.Reply(c, fmt.Sprintf("Nothing threatens %s.", name))
+		return
+	}
+	for i, n := range names {
+		if reach := tokens[n].ReachOrDefault(); reach != tabula.DefaultReach {
+			names[i] = fmt.Sprintf("%s (%dft reach)", n, reach)
+		}
+	}
+	h.Reply(c, fmt.Sprintf("%s is threatened by %s", name, strings.Join(names, ", ")))
+}
+
+// flanking returns the names of `tokens` on the same side as `attacker` that flank `target` with it.
+func flanking(tokens map[string]tabula.Token, attacker, target string) []string {
+	a, t := tokens[attacker], tokens[target]
+	ret := []string{}
+	for n, tok := range tokens {
+		if n == attacker || n == target || tok.Faction != a.Faction {
+			continue
+		}
+		if a.Flanks(tok, t) {
+			ret = append(ret, n)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func cmdFlank(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 0 || strings.ToLower(args[0]) == "help" {
+		h.Reply(c, flankUsage)
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You named one token, but I don't remember the last token you moved to attack with.")
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, flankUsage)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tokens := tab.ShownTokens(c.Context)
+	attacker, target := args[0], args[1]
+	for _, name := range args {
+		if _, ok := tokens[name]; !ok {
+			h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", name))
+			return
+		}
+	}
+
+	a := tokens[attacker]
+	if a.Faction == tabula.Neutral {
+		h.Error(c, fmt.Sprintf("%s has no allies; give it a side with `token faction %s ally` or `enemy`.", attacker, attacker))
+		return
+	}
+	if !a.Threatens(tokens[target]) {
+		h.Reply(c, fmt.Sprintf("%s doesn't threaten %s: it reaches %dft, and %s is %dft away.",
+			attacker, target, a.ReachOrDefault(), target, a.DistanceTo(tokens[target])))
+		return
+	}
+
+	names := flanking(tokens, attacker, target)
+	if len(names) == 0 {
+		h.Reply(c, fmt.Sprintf("%s doesn't flank %s; no ally threatens it from the opposite side.", attacker, target))
+		return
+	}
+	h.Reply(c, fmt.Sprintf("%s flanks %s with %s", attacker, target, strings.Join(names, ", ")))
+}
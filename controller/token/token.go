@@ -13,8 +13,10 @@ import (
 	"github.com/pdbogen/mapbot/model/types"
 	"image"
 	"image/color"
+	"math"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -23,6 +25,10 @@ var log = mbLog.Log
 
 func Register(h *hub.Hub) {
 	h.Subscribe("user:token", processor.Route)
+	h.Subscribe("user:path", cmdPath)
+	h.Subscribe("user:threat", cmdThreat)
+	h.Subscribe("user:flank", cmdFlank)
+	h.Subscribe("user:cover", cmdCover)
 }
 
 var processor *cmdproc.CommandProcessor
@@ -31,16 +37,27 @@ func init() {
 	processor = &cmdproc.CommandProcessor{
 		Command: "token",
 		Commands: map[string]cmdproc.Subcommand{
-			"add":     cmdproc.Subcommand{"[<name>] <point> [[<name2>] <pt2> ... [<nameN>] <ptN>]", "add a token(s) (or change its location) to the currently selected map (see `map select`). Token names should be emoji! (Or very short words). Space between coordinate pairs is optional.", cmdAdd},
-			"move":    cmdproc.Subcommand{"[<name>] <point>", "synonym for add", cmdAdd},
-			"color":   cmdproc.Subcommand{"[<name>] <color>", "sets the color for the given token, which can be a common name; the world 'clear'; a 6-digit hex code specifying red, green, and blue (optionally with two more digits specifying Alpha); https://en.wikipedia.org/wiki/List_of_Crayola_crayon_colors has a great list of colors.", cmdColor},
-			"list":    cmdproc.Subcommand{"", "list tokens on the active map", cmdList},
-			"clear":   cmdproc.Subcommand{"", "clear tokens from the field", cmdClear},
-			"remove":  cmdproc.Subcommand{"[<name>]", "removes the named token from the active map.", cmdRemove},
-			"swap":    cmdproc.Subcommand{"[<old>] <new>", "replace an old token with a new token, retaining other settings (location/color).", cmdSwap},
-			"replace": cmdproc.Subcommand{"[<old>] <new>", "synonym for swap", cmdSwap},
-			"size":    cmdproc.Subcommand{"[<name>] <size>", "sets the named token to be <size> squares big; medium creatures at 1, large are 2, etc.", cmdSize},
-			"light":   cmdproc.Subcommand{"[<name>] <dim> [<normal> [<bright>]]", "sets 'light levels' to project as marks around the token; dim is orange, normal is yellow, and bright is bright yellow. values are in 'pathfinder feet'.", cmdLight},
+			"add":       cmdproc.Subcommand{"[<name>] <point> [[<name2>] <pt2> ... [<nameN>] <ptN>]", "add a token(s) (or change its location) to the currently selected map (see `map select`). Token names should be emoji! (Or very short words). Space between coordinate pairs is optional. Instead of a point, move relative to where the token is with a plus sign, a compass direction, and a number of squares, like `+n3`, or squares across and down, like `+2,-1`; `toward <name2> [<squares>]`; or `to <point>`, finding the way around walls and terrain (see `path`). Several moves make a path.", cmdAdd},
+			"move":      cmdproc.Subcommand{"[<name>] <point>", "synonym for add", cmdAdd},
+			"color":     cmdproc.Subcommand{"[<name>] <color>", "sets the color for the given token, which can be a common name; the world 'clear'; a 6-digit hex code specifying red, green, and blue (optionally with two more digits specifying Alpha); https://en.wikipedia.org/wiki/List_of_Crayola_crayon_colors has a great list of colors.", cmdColor},
+			"list":      cmdproc.Subcommand{"", "list tokens on the active map", cmdList},
+			"clear":     cmdproc.Subcommand{"", "clear tokens from the field", cmdClear},
+			"remove":    cmdproc.Subcommand{"[<name>]", "removes the named token from the active map.", cmdRemove},
+			"swap":      cmdproc.Subcommand{"[<old>] <new>", "replace an old token with a new token, retaining other settings (location/color).", cmdSwap},
+			"replace":   cmdproc.Subcommand{"[<old>] <new>", "synonym for swap", cmdSwap},
+			"size":      cmdproc.Subcommand{"[<name>] <size>", "sets the named token to be <size> squares big; medium creatures at 1, large are 2, etc.", cmdSize},
+			"face":      {"[<name>] <direction>|none", "turns the token to face a compass direction (n, ne, e, ...) or a number of degrees clockwise from north, shown as a wedge on its edge; tokens also turn to face the way they last moved. cones marked from a token, like `mark cone(:orc:,15)`, go the way it faces.", cmdFace},
+			"hide":      {"[<name>]", "hides the token from the maps shown in this channel, while keeping it on the map; the owner of the map can see it with `map show gm`.", cmdHide},
+			"reveal":    {"[<name>]", "shows a hidden token again.", cmdHide},
+			"elevation": {"[<name>] <feet>", "sets how many feet above the ground the token is flying, or below it if negative, shown as a badge; 0 lands it. tokens sharing a square at different heights are drawn stacked.", cmdElevation},
+			"distance":  {"[<name>] <name2>", "tells how far apart two tokens are, in feet, counting their difference in elevation; without a first name, from the last token you moved.", cmdDistance},
+			"speed":     {"[<name>] <feet>", "sets how many feet, up to 500, the token may move in a turn, counting diagonals for you; 0 stops counting. players can't move a token further than it has left, and the map's owner is warned.", cmdSpeed},
+			"turn":      {"[<name> ... <nameN>]|all", "starts a new turn for the tokens, so that they may move their whole speed again.", cmdTurn},
+			"reachable": {"[<name>]", "shades the squares the token can still reach this turn.", cmdReachable},
+			"reach":     {"[<name>] <feet>", "sets how many feet away, up to 100, the token threatens, and outlines the squares it threatens on the map; 0 goes back to the usual 5ft, unoutlined. see `threat` and `flank`.", cmdReach},
+			"faction":   {"[<name>] ally|enemy|neutral", "sets whose side the token is on; allies and enemies threaten one another. see `threat` and `flank`.", cmdFaction},
+			"art":       {"<name> [<url>] [mine] [round|square] [border {<color>|none}] | <name> clear [mine]", "draws tokens named <name> with a portrait: the image at <url>, or one DM'd to me with the comment `token art <name>`. Portraits belong to the channel, or with `mine` to you, for the tokens you place anywhere; a channel's own portrait wins. Portraits are round and ringed in the token's color unless you say otherwise; give no image to change just the shape or border.", cmdArt},
+			"light":     cmdproc.Subcommand{"[<name>] <dim> [<normal> [<bright>]]", "sets 'light levels' to project as marks around the token; dim is orange, normal is yellow, and bright is bright yellow. values are in 'pathfinder feet'.", cmdLight},
 		},
 		Comment: "For command where the token effected is enclosed in `[]`, it is optional, and if not provided, the last token you have added or moved is effected.",
 	}
@@ -127,6 +144,225 @@ func cmdLight(h *hub.Hub, c *hub.Command) {
 	h.PublishUpdate(c.Context)
 }
 
+func cmdFace(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, fmt.Sprintf("`%s` looks like a direction, but I don't remember the last token you moved.", args[0]))
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, "usage: token face "+processor.Commands["face"].Args)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tok, ok := tab.Tokens[c.Context.Id()][args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+
+	if strings.ToLower(args[1]) == "none" {
+		tok = tok.WithoutFacing()
+	} else {
+		facing, err := conv.ParseFacing(args[1])
+		if err != nil {
+			h.Error(c, err.Error())
+			return
+		}
+		tok = tok.WithFacing(facing)
+	}
+	tab.Tokens[c.Context.Id()][args[0]] = tok
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+	}
+
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+	h.PublishUpdate(c.Context)
+}
+
+// cmdHide hides, or for `token reveal` shows again, the named tokens.
+func cmdHide(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+	hide := strings.HasSuffix(string(c.Type.Canonical()), ":hide")
+
+	if len(args) == 0 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You didn't name a token, and I don't remember the last token you moved.")
+			return
+		}
+		args = []string{tok}
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	for _, name := range args {
+		tok, ok := tab.Tokens[c.Context.Id()][name]
+		if !ok {
+			h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", name))
+			return
+		}
+		tab.Tokens[c.Context.Id()][name] = tok.WithHidden(hide)
+	}
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+	}
+
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+	h.PublishUpdate(c.Context)
+}
+
+func cmdElevation(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, fmt.Sprintf("`%s` looks like a height, but I don't remember the last token you moved.", args[0]))
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, "usage: token elevation "+processor.Commands["elevation"].Args)
+		return
+	}
+
+	feet, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(args[1]), "ft"))
+	if err != nil {
+		h.Error(c, fmt.Sprintf("`%s` is not a number of feet: %s", args[1], err))
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tok, ok := tab.Tokens[c.Context.Id()][args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+	tab.Tokens[c.Context.Id()][args[0]] = tok.WithElevation(feet)
+
+	if err := tab.Save(db.Instance); err != nil {
+		h.Error(c, "an error occured saving the active map for this channel")
+		log.Errorf("error saving tabula %d: %s", tab.Id, err)
+	}
+
+	h.Publish(c.WithType(hub.CommandType(c.From)).WithPayload(tab))
+	h.PublishUpdate(c.Context)
+}
+
+func cmdDistance(h *hub.Hub, c *hub.Command) {
+	args, ok := c.Payload.([]string)
+	if !ok {
+		h.Error(c, "unexpected payload")
+		log.Errorf("expected []string payload, but received %s", reflect.TypeOf(c.Payload))
+		return
+	}
+
+	if len(args) == 1 {
+		tok := c.Context.GetLastToken(c.User.Id)
+		if tok == "" {
+			h.Error(c, "You named one token, but I don't remember the last token you moved to measure from.")
+			return
+		}
+		args = append([]string{tok}, args...)
+	}
+
+	if len(args) != 2 {
+		h.Error(c, "usage: token distance "+processor.Commands["distance"].Args)
+		return
+	}
+
+	tabId := c.Context.GetActiveTabulaId()
+	if tabId == nil {
+		h.Error(c, "no active map in this channel, use `map select <name>` first")
+		return
+	}
+
+	tab, err := tabula.Load(db.Instance, *tabId)
+	if err != nil {
+		h.Error(c, "an error occured loading the active map for this channel")
+		log.Errorf("error loading tabula %d: %s", *tabId, err)
+		return
+	}
+
+	tokens := tab.ShownTokens(c.Context)
+	from, ok := tokens[args[0]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[0]))
+		return
+	}
+	to, ok := tokens[args[1]]
+	if !ok {
+		h.Error(c, fmt.Sprintf("There's no token `%s` on the map!", args[1]))
+		return
+	}
+
+	h.Reply(c, fmt.Sprintf("%s is %dft from %s", args[0], from.DistanceTo(to), args[1]))
+}
+
 func cmdSize(h *hub.Hub, c *hub.Command) {
 	args, ok := c.Payload.([]string)
 	if !ok {
@@ -333,21 +569,21 @@ func cmdList(h *hub.Hub, c *hub.Command) {
 		return
 	}
 
-	ctxId := c.Context.Id()
-	if tab.Tokens == nil || tab.Tokens[ctxId] == nil || len(tab.Tokens[ctxId]) == 0 {
+	tokens := tab.ShownTokens(c.Context)
+	if len(tokens) == 0 {
 		h.Reply(c, "There are no tokens on the active map.")
 		return
 	}
 
-	rep := fmt.Sprintf("There are %d tokens on the active map:", len(tab.Tokens[ctxId]))
-	for name, token := range tab.Tokens[ctxId] {
+	rep := fmt.Sprintf("There are %d tokens on the active map:", len(tokens))
+	for name, token := range tokens {
 		bits := emojiToken.FindStringSubmatch(name)
 		if bits != nil {
 			name = name + " (`" + bits[1] + "`)"
 		}
 		rep += fmt.Sprintf("\n- %s at %s",
 			name,
-			strings.ToUpper(conv.PointToCoords(image.Pt(token.Coordinate.X, token.Coordinate.Y))),
+			strings.ToUpper(c.Context.GetCoordinates().Format(token.Coordinate)),
 		)
 
 		r, g, b, a := token.Color().RGBA()
@@ -368,6 +604,20 @@ func cmdList(h *hub.Hub, c *hub.Command) {
 		if len(lights) > 0 {
 			rep += fmt.Sprintf(", light (%s)", strings.Join(lights, ", "))
 		}
+		if token.Elevation > 0 {
+			rep += fmt.Sprintf(", %dft up", token.Elevation)
+		} else if token.Elevation < 0 {
+			rep += fmt.Sprintf(", %dft down", -token.Elevation)
+		}
+		if token.Speed > 0 {
+			rep += fmt.Sprintf(", speed %dft (%dft left)", token.Speed, token.Remaining())
+		}
+		if token.Reach > 0 {
+			rep += fmt.Sprintf(", reach %dft", token.Reach)
+		}
+		if token.Faction != tabula.Neutral {
+			rep += ", " + token.Faction.String()
+		}
 	}
 	h.Reply(c, rep)
 	return
@@ -454,23 +704,175 @@ func cmdClear(h *hub.Hub, c *hub.Command) {
 	h.PublishUpdate(c.Context)
 }
 
-func parseMovements(args []string, lastToken string) (map[string][]image.Point, error) {
+// compassSteps are the squares each compass direction steps by.
+var compassSteps = map[string]image.Point{
+	"n": {0, -1}, "ne": {1, -1}, "e": {1, 0}, "se": {1, 1},
+	"s": {0, 1}, "sw": {-1, 1}, "w": {-1, 0}, "nw": {-1, -1},
+}
+
+var compassStepRe = regexp.MustCompile(`^\+(n|ne|e|se|s|sw|w|nw)([0-9]+)$`)
+var offsetRe = regexp.MustCompile(`^([+-][0-9]+),([+-][0-9]+)$`)
+
+// relativeStep returns how far `a` moves a token, if it names a move relative to where the token is: a compass
+// direction and a number of squares after a plus sign, like `+n3`, or squares across and down, each with a sign, like
+// `+2,-1`. The sign keeps them from being read as squares; without it, `n3` is just the square N3.
+func relativeStep(n conv.Notation, a string) (image.Point, bool) {
+	if m := compassStepRe.FindStringSubmatch(strings.ToLower(a)); m != nil {
+		squares, err := strconv.Atoi(m[2])
+		if err != nil {
+			return image.Point{}, false
+		}
+		return compassSteps[m[1]].Mul(squares), true
+	}
+	if m := offsetRe.FindStringSubmatch(a); m != nil {
+		// A numeric notation may name the square -2,-1 just the same.
+		if _, _, err := n.Parse(a, false); err == nil {
+			return image.Point{}, false
+		}
+		x, errX := strconv.Atoi(m[1])
+		y, errY := strconv.Atoi(m[2])
+		if errX != nil || errY != nil {
+			return image.Point{}, false
+		}
+		return image.Pt(x, y), true
+	}
+	return image.Point{}, false
+}
+
+func sizeOf(tok tabula.Token) int {
+	if tok.Size < 1 {
+		return 1
+	}
+	return tok.Size
+}
+
+// toward returns where a token `size` squares big at `from` ends up after `squares` steps straight toward `target`,
+// stopping short if it comes up next to it; if `squares` is negative, it goes until it's next to it.
+func toward(from image.Point, size int, target tabula.Token, squares int) image.Point {
+	tsize := sizeOf(target)
+	goal := image.Rectangle{Min: target.Coordinate, Max: target.Coordinate.Add(image.Pt(tsize, tsize))}
+	if squares < 0 {
+		squares = math.MaxInt32
+	}
+
+	pos := from
+	for i := 0; i < squares; i++ {
+		// Aim between the middles of the two tokens, in half-squares so that the middles fall on whole numbers.
+		dx := float64(2*goal.Min.X + tsize - 2*pos.X - size)
+		dy := float64(2*goal.Min.Y + tsize - 2*pos.Y - size)
+		far := math.Max(math.Abs(dx), math.Abs(dy))
+		if far == 0 {
+			break
+		}
+		next := pos.Add(image.Pt(int(math.Round(dx/far)), int(math.Round(dy/far))))
+		if (image.Rectangle{Min: next, Max: next.Add(image.Pt(size, size))}).Overlaps(goal) {
+			break
+		}
+		pos = next
+	}
+	return pos
+}
+
+// router returns the squares a token `size` squares big steps through to get from `from` to `to`, not counting `from`;
+// or false, if it can't get there.
+type router func(from, to image.Point, size int) ([]image.Point, bool)
+
+// parseMovements returns the squares each token named in `args` moves through, in order. A token goes to squares
+// named outright, like `c4`; to those relative to where it is, as `relativeStep` reads them; `toward <name>
+// [<squares>]`, straight at another token; and `to <point>`, along the way `route` finds there. `tokens` are the
+// tokens already on the map, for moves relative to them, and `targets` those of them the channel can see, which are
+// the only ones a token may move toward.
+func parseMovements(n conv.Notation, args []string, lastToken string, tokens, targets map[string]tabula.Token, route router) (map[string][]image.Point, error) {
 	curToken := lastToken
-	tokens := map[string][]image.Point{}
+	moves := map[string][]image.Point{}
+
+	// at returns where a token is, having made the moves so far.
+	at := func(name string) (image.Point, bool) {
+		if pts := moves[name]; len(pts) > 0 {
+			return pts[len(pts)-1], true
+		}
+		tok, ok := tokens[name]
+		return tok.Coordinate, ok
+	}
+
 	for i := 0; i < len(args); i++ {
 		a := args[i]
 
 		if i+1 < len(args) {
-			if pt, err := conv.CoordsToPoint(a, args[i+1]); err == nil {
+			if pt, err := n.ParsePair(a, args[i+1]); err == nil {
 				if curToken == "" {
 					return nil, fmt.Errorf("I found a coordinate (`%s%s`), but you didn't give me a token, and I don't remember the last token you moved.", args[i], args[i+1])
 				}
-				tokens[curToken] = append(tokens[curToken], pt)
+				moves[curToken] = append(moves[curToken], pt)
 				i++
 				continue
 			}
 		}
 
+		if strings.ToLower(a) == "toward" || strings.ToLower(a) == "towards" {
+			if curToken == "" {
+				return nil, fmt.Errorf("you asked to move `%s`, but you didn't give me a token, and I don't remember the last token you moved.", a)
+			}
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("move %s `%s` what?", curToken, a)
+			}
+			target, ok := targets[args[i+1]]
+			if !ok {
+				return nil, fmt.Errorf("there's no token `%s` on the map to move %s toward", args[i+1], curToken)
+			}
+			if pt, ok := at(args[i+1]); ok {
+				target = target.WithCoords(pt)
+			}
+			from, ok := at(curToken)
+			if !ok {
+				return nil, fmt.Errorf("%s isn't on the map yet, so it can't move toward %s", curToken, args[i+1])
+			}
+			squares := -1
+			if i+2 < len(args) {
+				if s, err := strconv.Atoi(args[i+2]); err == nil && s >= 0 {
+					squares = s
+					i++
+				}
+			}
+			moves[curToken] = append(moves[curToken], toward(from, sizeOf(tokens[curToken]), target, squares))
+			i++
+			continue
+		}
+
+		if strings.ToLower(a) == "to" && curToken != "" {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("move %s `%s` where?", curToken, a)
+			}
+			dest, _, err := n.Parse(args[i+1], false)
+			if i+2 < len(args) {
+				if pt, pairErr := n.ParsePair(args[i+1], args[i+2]); pairErr == nil {
+					dest, err = pt, nil
+					i++
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("`%s` isn't a square for %s to go to", args[i+1], curToken)
+			}
+			i++
+
+			from, ok := at(curToken)
+			if !ok {
+				return nil, fmt.Errorf("%s isn't on the map yet, so it can't find its way to %s", curToken, n.Format(dest))
+			}
+			if route == nil {
+				return nil, fmt.Errorf("I can't find the way for %s here", curToken)
+			}
+			steps, ok := route(from, dest, sizeOf(tokens[curToken]))
+			if !ok {
+				return nil, fmt.Errorf("there's no way for %s to get to %s", curToken, n.Format(dest))
+			}
+			if len(steps) == 0 {
+				steps = []image.Point{from}
+			}
+			moves[curToken] = append(moves[curToken], steps...)
+			continue
+		}
+
 		// If it's not a two word coordinate and we don't have a token yet, this must be a token. But if it's the last or only token, it could instad be a
 		// coordinate.
 		if curToken == "" && i+1 < len(args) {
@@ -478,22 +880,34 @@ func parseMovements(args []string, lastToken string) (map[string][]image.Point,
 			continue
 		}
 
-		if pt, _, err := conv.RCToPoint(a, false); err == nil {
+		if d, ok := relativeStep(n, a); ok {
+			if curToken == "" {
+				return nil, fmt.Errorf("I found a move (`%s`), but you didn't give me a token, and I don't remember the last token you moved.", a)
+			}
+			from, ok := at(curToken)
+			if !ok {
+				return nil, fmt.Errorf("%s isn't on the map yet, so it can't move `%s` from where it is", curToken, a)
+			}
+			moves[curToken] = append(moves[curToken], from.Add(d))
+			continue
+		}
+
+		if pt, _, err := n.Parse(a, false); err == nil {
 			if curToken == "" {
 				return nil, fmt.Errorf("I found a coordinate (`%s`), but you didn't give me a token, and I don't remember the last token you moved.", a)
 			}
-			tokens[curToken] = append(tokens[curToken], pt)
+			moves[curToken] = append(moves[curToken], pt)
 			continue
 		}
 
 		curToken = a
 	}
 
-	if _, ok := tokens[curToken]; !ok {
+	if _, ok := moves[curToken]; !ok {
 		return nil, fmt.Errorf("you ended with a token %q, but did not specify any movements for it", curToken)
 	}
 
-	return tokens, nil
+	return moves, nil
 }
 
 func cmdAdd(h *hub.Hub, c *hub.Command) {
@@ -510,20 +924,15 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 	}
 
 	// We got two arguments, but they could be a space-separated coordinate pair
+	notation := c.Context.GetCoordinates().Notation
 	if len(args) == 2 {
-		if _, err := conv.CoordsToPoint(args[0], args[1]); err == nil {
-			args = []string{args[0] + args[1]}
+		if pt, err := notation.ParsePair(args[0], args[1]); err == nil {
+			args = []string{notation.Format(pt)}
 		}
 	}
 
 	curToken := c.Context.GetLastToken(c.User.Id)
 
-	tokens, err := parseMovements(args, curToken)
-	if err != nil {
-		h.Error(c, err.Error())
-		return
-	}
-
 	tabId := c.Context.GetActiveTabulaId()
 	if tabId == nil {
 		h.Error(c, "no active map in this channel, use `map select <name>` first")
@@ -537,8 +946,39 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 		return
 	}
 
+	ground := c.Context.GetTerrain(*tabId)
+	route := func(from, to image.Point, size int) ([]image.Point, bool) {
+		path, _, ok := ground.Path(from, to, size, tab.Walls)
+		return path, ok
+	}
+
+	tokens, err := parseMovements(notation, args, curToken, tab.Tokens[c.Context.Id()], tab.ShownTokens(c.Context), route)
+	if err != nil {
+		h.Error(c, err.Error())
+		return
+	}
+
+	// A token with a speed may only move as far as it has left this turn. The map's owner may move it further, but
+	// is warned.
+	over := []string{}
+	for name, coords := range tokens {
+		tok, ok := tab.Tokens[c.Context.Id()][name]
+		if !ok || tok.Speed == 0 || !tab.Shows(tok) {
+			continue
+		}
+		if cost := ground.Cost(append([]image.Point{tok.Coordinate}, coords...), tok.Size); cost > tok.Remaining() {
+			over = append(over, fmt.Sprintf("%s can only move %dft more this turn, not %dft", name, tok.Remaining(), cost))
+		}
+	}
+	sort.Strings(over)
+	if len(over) > 0 && !c.User.Owns(*tabId) {
+		h.Error(c, strings.Join(over, "; ")+". `token turn` starts a new turn.")
+		return
+	}
+
 	lines := []mark.Line{}
-	dist := map[string]int{}
+	// paths are the squares each token that was seen to move went through, where it started first.
+	paths := map[string][]image.Point{}
 
 	lastToken := ""
 	for name, coords := range tokens {
@@ -556,31 +996,42 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 					Coordinate: coord,
 					TokenColor: color.RGBA{0, 0, 0, 0},
 					Size:       1,
+					Owner:      c.User.Id,
 				}
 			} else {
 				orig := tok.Coordinate
-				tab.Tokens[c.Context.Id()][name] = tok.WithCoords(coord)
-				lines = append(lines,
-					mark.Line{A: orig, B: coord, CA: "nw", CB: "nw", Color: color.RGBA{R: 255, G: 0, B: 0, A: 255}},
-					mark.Line{
-						A:  orig.Add(image.Pt(tok.Size-1, 0)),
-						B:  coord.Add(image.Pt(tok.Size-1, 0)),
-						CA: "ne", CB: "ne", Color: color.RGBA{R: 255, G: 0, B: 0, A: 255}},
-					mark.Line{
-						A:  orig.Add(image.Pt(tok.Size-1, tok.Size-1)),
-						B:  coord.Add(image.Pt(tok.Size-1, tok.Size-1)),
-						CA: "se", CB: "se", Color: color.RGBA{R: 255, G: 0, B: 0, A: 255}},
-					mark.Line{
-						A:  orig.Add(image.Pt(0, tok.Size-1)),
-						B:  coord.Add(image.Pt(0, tok.Size-1)),
-						CA: "sw", CB: "sw", Color: color.RGBA{R: 255, G: 0, B: 0, A: 255}},
-				)
-				dist[name] = dist[name] + conv.Distance(orig, coord)
+				tab.Tokens[c.Context.Id()][name] = tok.MovedTo(coord)
+				if !tab.Shows(tok) {
+					continue
+				}
+				lines = append(lines, tok.MoveLines(coord, color.RGBA{R: 255, G: 0, B: 0, A: 255})...)
+				if len(paths[name]) == 0 {
+					paths[name] = []image.Point{orig}
+				}
+				paths[name] = append(paths[name], coord)
 			}
 		}
 		lastToken = name
 	}
 
+	notes := []string{}
+	for name, path := range paths {
+		tok := tab.Tokens[c.Context.Id()][name]
+		cost := ground.Cost(path, tok.Size)
+		note := fmt.Sprintf("%s moved %dft", name, cost)
+		if tok.Speed > 0 {
+			tok = tok.WithMoved(tok.Moved + cost)
+			tab.Tokens[c.Context.Id()][name] = tok
+			if tok.Moved > tok.Speed {
+				note += fmt.Sprintf(", %dft over its %dft speed!", tok.Moved-tok.Speed, tok.Speed)
+			} else {
+				note += fmt.Sprintf(", %dft left", tok.Remaining())
+			}
+		}
+		notes = append(notes, note)
+	}
+	sort.Strings(notes)
+
 	if err := tab.Save(db.Instance); err != nil {
 		h.Error(c, "an error occured saving the active map for this channel")
 		log.Errorf("error saving tabula %d: %s", tab.Id, err)
@@ -597,11 +1048,6 @@ func cmdAdd(h *hub.Hub, c *hub.Command) {
 		log.Errorf("error saving context: %s", err)
 	}
 
-	notes := []string{}
-	for name, d := range dist {
-		notes = append(notes, fmt.Sprintf("%s moved %dft", name, d))
-	}
-
 	h.Publish(c.
 		WithType(hub.CommandType(c.From)).
 		WithPayload(tab.WithLines(lines).WithNote(strings.Join(notes, "; "))),
@@ -1,13 +1,16 @@
 package token
 
 import (
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/model/tabula"
 	"image"
+	"reflect"
 	"strings"
 	"testing"
 )
 
 func TestParseMovements(t *testing.T) {
-	//func parseMovements(args []string, lastToken string) (map[string][]image.Point, error) {
+	//func parseMovements(n conv.Notation, args []string, lastToken string) (map[string][]image.Point, error) {
 	type test struct {
 		last string
 		in   string
@@ -26,7 +29,7 @@ func TestParseMovements(t *testing.T) {
 	}
 
 	for testN, test := range tests {
-		out, err := parseMovements(strings.Fields(test.in), test.last)
+		out, err := parseMovements(conv.Notation{}, strings.Fields(test.in), test.last, nil, nil, nil)
 		if (err != nil) != test.err {
 			if test.err {
 				t.Fatalf("test %d: expected non-nil err but was %v", testN, err)
@@ -51,3 +54,152 @@ func TestParseMovements(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMovementsNumeric(t *testing.T) {
+	n := conv.Notation{Style: conv.Numeric}
+	out, err := parseMovements(n, strings.Fields("goblin 3,4 5, 6 orc 1 1"), "", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []image.Point{{2, 3}, {4, 5}}; len(out["goblin"]) != 2 || out["goblin"][0] != exp[0] || out["goblin"][1] != exp[1] {
+		t.Fatalf("goblin should move to %v, not %v", exp, out["goblin"])
+	}
+	if exp := (image.Point{0, 0}); len(out["orc"]) != 1 || out["orc"][0] != exp {
+		t.Fatalf("orc should move to %v, not %v", exp, out["orc"])
+	}
+}
+
+func TestParseMovementsRelative(t *testing.T) {
+	tokens := map[string]tabula.Token{
+		":elf:":  {Coordinate: image.Pt(2, 2), Size: 1},
+		":orc:":  {Coordinate: image.Pt(8, 2), Size: 1},
+		":ogre:": {Coordinate: image.Pt(2, 9), Size: 2},
+	}
+	type test struct {
+		in  string
+		out map[string][]image.Point
+	}
+	tests := []test{
+		{":elf: +n2 +e3", map[string][]image.Point{":elf:": {{2, 0}, {5, 0}}}},
+		{":elf: +2,-1 +SW1", map[string][]image.Point{":elf:": {{4, 1}, {3, 2}}}},
+		{":elf: toward :orc: 2", map[string][]image.Point{":elf:": {{4, 2}}}},
+		{":elf: toward :orc:", map[string][]image.Point{":elf:": {{7, 2}}}},
+		{":elf: toward :ogre:", map[string][]image.Point{":elf:": {{2, 8}}}},
+		// Waypoints follow on from one another, mixing squares and relative moves.
+		{":elf: c10 +n1 toward :orc: 1", map[string][]image.Point{":elf:": {{2, 9}, {2, 8}, {3, 7}}}},
+	}
+	for i, test := range tests {
+		out, err := parseMovements(conv.Notation{}, strings.Fields(test.in), "", tokens, tokens, nil)
+		if err != nil {
+			t.Errorf("test %d (%s): %s", i, test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("test %d (%s): expected %v, got %v", i, test.in, test.out, out)
+		}
+	}
+
+	for _, in := range []string{":goblin: +n2", ":elf: toward :goblin:", "toward :orc:"} {
+		if _, err := parseMovements(conv.Notation{}, strings.Fields(in), "", tokens, tokens, nil); err == nil {
+			t.Errorf("expected an error for %q", in)
+		}
+	}
+
+	// A token the channel can't see can't be moved toward, and isn't told apart from one that isn't there.
+	shown := map[string]tabula.Token{":elf:": tokens[":elf:"], ":orc:": tokens[":orc:"]}
+	_, hidden := parseMovements(conv.Notation{}, strings.Fields(":elf: toward :ogre:"), "", tokens, shown, nil)
+	_, absent := parseMovements(conv.Notation{}, strings.Fields(":elf: toward :goblin:"), "", tokens, shown, nil)
+	if hidden == nil || strings.Replace(hidden.Error(), ":ogre:", ":goblin:", 1) != absent.Error() {
+		t.Errorf("expected a hidden target to look absent, got %v", hidden)
+	}
+}
+
+func TestParseMovementsAmbiguous(t *testing.T) {
+	tokens := map[string]tabula.Token{":elf:": {Coordinate: image.Pt(2, 2), Size: 1}}
+
+	// Without a sign, a compass direction and a number is a square, however it's written.
+	for _, in := range []string{":elf: s9", ":elf: S9", ":elf: s 9"} {
+		out, err := parseMovements(conv.Notation{}, strings.Fields(in), "", tokens, tokens, nil)
+		if err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if exp := []image.Point{{18, 8}}; !reflect.DeepEqual(out[":elf:"], exp) {
+			t.Errorf("%q: expected the square S9 at %v, got %v", in, exp, out[":elf:"])
+		}
+	}
+
+	// A token with no moves can still be added on a square that looks like a compass move.
+	out, err := parseMovements(conv.Notation{}, strings.Fields(":goblin: e4"), "", tokens, tokens, nil)
+	if err != nil || !reflect.DeepEqual(out[":goblin:"], []image.Point{{4, 3}}) {
+		t.Errorf("expected :goblin: to be added at E4, got %v, %v", out, err)
+	}
+}
+
+func TestParseMovementsRelativeNumeric(t *testing.T) {
+	n := conv.Notation{Style: conv.Numeric}
+	tokens := map[string]tabula.Token{":elf:": {Coordinate: image.Pt(2, 2)}}
+	out, err := parseMovements(n, strings.Fields(":elf: -2,-1 +1,+0"), "", tokens, tokens, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -2,-1 is a square in the numeric notation, so only +1,+0 is relative.
+	if exp := []image.Point{{-2, -1}, {-1, -1}}; !reflect.DeepEqual(out[":elf:"], exp) {
+		t.Errorf("expected %v, got %v", exp, out[":elf:"])
+	}
+}
+
+func TestParseMovementsTo(t *testing.T) {
+	tokens := map[string]tabula.Token{":elf:": {Coordinate: image.Pt(2, 2), Size: 1}}
+	// The way round goes south first, then east.
+	route := func(from, to image.Point, size int) ([]image.Point, bool) {
+		if to.X > 20 {
+			return nil, false
+		}
+		return []image.Point{{from.X, to.Y}, to}, true
+	}
+
+	out, err := parseMovements(conv.Notation{}, strings.Fields(":elf: to h 12 +n1"), "", tokens, tokens, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []image.Point{{2, 11}, {7, 11}, {7, 10}}; !reflect.DeepEqual(out[":elf:"], exp) {
+		t.Errorf("expected %v, got %v", exp, out[":elf:"])
+	}
+
+	for _, in := range []string{":elf: to z1", ":elf: to nowhere", ":goblin: to c3"} {
+		if _, err := parseMovements(conv.Notation{}, strings.Fields(in), "", tokens, tokens, route); err == nil {
+			t.Errorf("expected an error for %q", in)
+		}
+	}
+}
+
+func TestParseArtOptions(t *testing.T) {
+	opts, err := parseArtOptions(strings.Fields("https://example.com/wizard.png square mine border ff0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.url != "https://example.com/wizard.png" || !opts.mine || opts.clear {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if opts.round == nil || *opts.round {
+		t.Errorf("expected square, got %v", opts.round)
+	}
+	if opts.border == nil || opts.border.R != 0xff || opts.border.G != 0 || opts.border.A != 0xff {
+		t.Errorf("expected a red border, got %v", opts.border)
+	}
+
+	opts, err = parseArtOptions(strings.Fields("border none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.noBorder || opts.border != nil || opts.round != nil {
+		t.Errorf("expected only no border, got %+v", opts)
+	}
+
+	for _, bad := range []string{"border", "border chartreusish", "sparkly"} {
+		if _, err := parseArtOptions(strings.Fields(bad)); err == nil {
+			t.Errorf("expected %q to be an error", bad)
+		}
+	}
+}
@@ -73,8 +73,9 @@ func (h *Hub) SubscribeSole(c CommandType, s Subscriber) {
 	h.Subscribers[c] = []Subscriber{s}
 }
 
+// PublishUpdate announces that something visible on the map in `ctx` has changed.
 func (h *Hub) PublishUpdate(ctx context.Context) {
-	h.Publish(&Command{Type: CommandType("internal:update:" + ctx.Id())})
+	h.Publish(&Command{Type: CommandType("internal:update:" + ctx.Id()), Context: ctx})
 }
 
 // Publish searches publishers for a subscriber to the given command's type, and executes the subscriber in a goroutine.
@@ -154,6 +155,12 @@ type Command struct {
 	Data []byte
 }
 
+// Private is a payload that a UI should deliver only to the user who sent the command being replied to, such as by a
+// direct message, rather than to everyone who can see where the command came from.
+type Private struct {
+	Payload interface{}
+}
+
 // WithType returns a copy of the command with the type replaced by the given type. The payload is not deep-copied.
 func (c *Command) WithType(n CommandType) *Command {
 	return &Command{
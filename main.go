@@ -5,10 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/pdbogen/mapbot/common/blobserv"
-	_ "github.com/pdbogen/mapbot/common/cache"
+	"github.com/pdbogen/mapbot/common/cache"
 	"github.com/pdbogen/mapbot/common/db"
 	"github.com/pdbogen/mapbot/common/db/anydb"
 	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/controller/cacheController"
+	groupController "github.com/pdbogen/mapbot/controller/group"
 	helpController "github.com/pdbogen/mapbot/controller/help"
 	"github.com/pdbogen/mapbot/controller/mapController"
 	markCtrl "github.com/pdbogen/mapbot/controller/mark"
@@ -83,6 +85,10 @@ func main() {
 		log.Fatalf("unable to connect to database: %s", err)
 	}
 
+	if cache.Instance, err = cache.Open(); err != nil {
+		log.Fatalf("unable to open cache: %s", err)
+	}
+
 	proto := "http"
 	if *Tls || *AdvertiseTls {
 		proto = "https"
@@ -115,9 +121,11 @@ func main() {
 	}
 
 	mapController.Register(hub)
+	cacheController.Register(hub)
 	maskController.Register(hub)
 	helpController.Register(hub)
 	tokenController.Register(hub)
+	groupController.Register(hub)
 	workflowController.Register(hub)
 	markCtrl.Register(hub)
 	web.Register(hub, *Tls, *Domain)
@@ -0,0 +1,323 @@
+// Package art keeps the portraits that tokens can be drawn with in place of their names or emoji. A portrait belongs
+// to a channel, for the tokens of that channel, or to a user, for the tokens they place anywhere.
+package art
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/model/types"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var log = mbLog.Log
+
+// MaxBytes is the largest portrait that will be kept.
+const MaxBytes = 4 << 20
+
+// MaxSide is the widest or tallest portrait that will be kept, in pixels.
+const MaxSide = 4096
+
+type Scope string
+
+const (
+	Channel Scope = "channel"
+	User    Scope = "user"
+)
+
+// Art is a token's portrait.
+type Art struct {
+	Scope Scope
+	Owner string
+	Name  string
+	Data  []byte
+
+	// Round portraits are cropped to a circle; others fill the token's square.
+	Round bool
+
+	// Border is the color of the ring around a round portrait, or of the frame around a square one. If it's
+	// transparent, the token's own color is used, unless NoBorder is set.
+	Border   color.NRGBA
+	NoBorder bool
+
+	// Hash identifies Data, for Image's variants; it's set by New and Load.
+	Hash string
+}
+
+func hashOf(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// New returns a round portrait of `data`, after checking that it's an image mapbot can draw.
+func New(scope Scope, owner, name string, data []byte) (*Art, error) {
+	if len(data) > MaxBytes {
+		return nil, fmt.Errorf("portraits can be at most %d MB", MaxBytes>>20)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not an image I can read: %s", err)
+	}
+	if cfg.Width > MaxSide || cfg.Height > MaxSide {
+		return nil, fmt.Errorf("image is %dx%d, but portraits can be at most %dx%d", cfg.Width, cfg.Height, MaxSide, MaxSide)
+	}
+	return &Art{Scope: scope, Owner: owner, Name: name, Data: data, Round: true, Hash: hashOf(data)}, nil
+}
+
+// Fetch retrieves the image at `url`, for New.
+func Fetch(url string) ([]byte, error) {
+	c := http.Client{Timeout: 30 * time.Second}
+	res, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, MaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %s", url, err)
+	}
+	return data, nil
+}
+
+func (a *Art) Save(db anydb.AnyDb) error {
+	var query string
+	switch dia := db.Dialect(); dia {
+	case "postgresql":
+		query = "INSERT INTO token_art (scope, owner, name, data, round, r, g, b, a, no_border) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) " +
+			"ON CONFLICT (scope, owner, name) DO UPDATE SET data=$4, round=$5, r=$6, g=$7, b=$8, a=$9, no_border=$10"
+	case "sqlite3":
+		query = "REPLACE INTO token_art (scope, owner, name, data, round, r, g, b, a, no_border) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)"
+	default:
+		return fmt.Errorf("no Art.Save query for dialect %s", dia)
+	}
+	if _, err := db.Exec(query, string(a.Scope), a.Owner, a.Name, a.Data, a.Round,
+		a.Border.R, a.Border.G, a.Border.B, a.Border.A, a.NoBorder); err != nil {
+		return fmt.Errorf("saving portrait of %q for %s %s: %s", a.Name, a.Scope, a.Owner, err)
+	}
+	return nil
+}
+
+// Delete forgets the portrait of `name` kept by `owner`.
+func Delete(db anydb.AnyDb, scope Scope, owner, name string) error {
+	if _, err := db.Exec("DELETE FROM token_art WHERE scope=$1 AND owner=$2 AND name=$3", string(scope), owner, name); err != nil {
+		return fmt.Errorf("deleting portrait of %q for %s %s: %s", name, scope, owner, err)
+	}
+	return nil
+}
+
+// Load returns the portrait of `name` kept by `owner`, or nil if there isn't one.
+func Load(db anydb.AnyDb, scope Scope, owner, name string) (*Art, error) {
+	res, err := db.Query("SELECT data, round, r, g, b, a, no_border FROM token_art WHERE scope=$1 AND owner=$2 AND name=$3",
+		string(scope), owner, name)
+	if err != nil {
+		return nil, fmt.Errorf("querying portrait of %q for %s %s: %s", name, scope, owner, err)
+	}
+	defer res.Close()
+
+	if !res.Next() {
+		return nil, nil
+	}
+	ret := &Art{Scope: scope, Owner: owner, Name: name}
+	if err := res.Scan(&ret.Data, &ret.Round, &ret.Border.R, &ret.Border.G, &ret.Border.B, &ret.Border.A, &ret.NoBorder); err != nil {
+		return nil, fmt.Errorf("scanning portrait of %q for %s %s: %s", name, scope, owner, err)
+	}
+	ret.Hash = hashOf(ret.Data)
+	return ret, nil
+}
+
+// Loader loads portraits, remembering each it's loaded, or found missing. A render uses one of its own, so that tokens
+// sharing a portrait don't each load it.
+type Loader struct {
+	db     anydb.AnyDb
+	loaded map[loaderKey]*Art
+}
+
+type loaderKey struct {
+	scope       Scope
+	owner, name string
+}
+
+func NewLoader(db anydb.AnyDb) *Loader {
+	return &Loader{db: db, loaded: map[loaderKey]*Art{}}
+}
+
+// Load is Load, but only queries for each portrait once.
+func (l *Loader) Load(scope Scope, owner, name string) (*Art, error) {
+	key := loaderKey{scope, owner, name}
+	if a, ok := l.loaded[key]; ok {
+		return a, nil
+	}
+	a, err := Load(l.db, scope, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	l.loaded[key] = a
+	return a, nil
+}
+
+// Find returns the portrait of the token `name` as it's drawn in `ctxId`: the channel's own, if there is one, or else
+// that of `userId`, who placed the token. It returns nil if there's neither.
+func (l *Loader) Find(ctxId types.ContextId, userId types.UserId, name string) (*Art, error) {
+	a, err := l.Load(Channel, string(ctxId), name)
+	if a != nil || err != nil || userId == "" {
+		return a, err
+	}
+	return l.Load(User, string(userId), name)
+}
+
+// variant is a portrait decoded, cropped, and resized; `ready` is closed once it's been made.
+type variant struct {
+	ready chan struct{}
+	img   image.Image
+	err   error
+}
+
+// variants are kept by the hash of their portrait's data, and their size, shape, and border.
+var variants = map[string]*variant{}
+var variantsMu sync.Mutex
+
+// maxVariants is how many variants are kept before they're all forgotten.
+const maxVariants = 256
+
+// Image returns the portrait as it's drawn on a token `px` pixels across, bordered in `fallback` if the art doesn't
+// choose its own border color. Each variant is only made once; renders wanting one that's being made wait for it,
+// rather than making it again, but the lock is only held to look it up.
+func (a *Art) Image(px int, fallback color.Color) (image.Image, error) {
+	if px <= 0 {
+		return nil, errors.New("portraits must be at least one pixel across")
+	}
+	border := color.Color(a.Border)
+	if a.Border.A == 0 && !a.NoBorder {
+		border = fallback
+	}
+	var br, bg, bb, ba uint32
+	if border != nil {
+		br, bg, bb, ba = border.RGBA()
+	}
+	if a.Hash == "" {
+		a.Hash = hashOf(a.Data)
+	}
+	key := fmt.Sprintf("%s|%d|%t|%04x%04x%04x%04x", a.Hash, px, a.Round, br, bg, bb, ba)
+
+	variantsMu.Lock()
+	v, ok := variants[key]
+	if !ok {
+		if len(variants) >= maxVariants {
+			variants = map[string]*variant{}
+		}
+		v = &variant{ready: make(chan struct{})}
+		variants[key] = v
+	}
+	variantsMu.Unlock()
+
+	if ok {
+		<-v.ready
+		return v.img, v.err
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(a.Data))
+	if err == nil {
+		v.img = Portrait(src, px, a.Round, border)
+	} else {
+		v.err = fmt.Errorf("decoding portrait of %q: %s", a.Name, err)
+		// Not kept, so that it's tried again.
+		variantsMu.Lock()
+		if variants[key] == v {
+			delete(variants, key)
+		}
+		variantsMu.Unlock()
+	}
+	close(v.ready)
+	return v.img, v.err
+}
+
+// Portrait returns the middle of `src`, scaled to fill a square `px` pixels across. If `round`, it's cropped to a
+// circle. If `border` is visible, the circle is ringed, or the square framed, in it.
+func Portrait(src image.Image, px int, round bool, border color.Color) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+
+	scaled := image.NewRGBA(image.Rect(0, 0, px, px))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), src, crop, draw.Src, nil)
+
+	ring := 0.0
+	if border != nil {
+		if _, _, _, a := border.RGBA(); a > 0 {
+			ring = math.Max(2, float64(px)/16)
+		}
+	}
+
+	if !round {
+		if ring > 0 {
+			inner := scaled.Bounds().Inset(int(ring))
+			for _, r := range []image.Rectangle{
+				image.Rect(0, 0, px, inner.Min.Y), image.Rect(0, inner.Max.Y, px, px),
+				image.Rect(0, inner.Min.Y, inner.Min.X, inner.Max.Y), image.Rect(inner.Max.X, inner.Min.Y, px, inner.Max.Y),
+			} {
+				draw.Draw(scaled, r, image.NewUniform(border), image.Point{}, draw.Over)
+			}
+		}
+		return scaled
+	}
+
+	// Each pixel is covered by the circle, and by the ring, in proportion to how far inside their edges its center is;
+	// this anti-aliases both edges.
+	out := image.NewRGBA(scaled.Bounds())
+	radius := float64(px) / 2
+	for y := 0; y < px; y++ {
+		for x := 0; x < px; x++ {
+			d := math.Hypot(float64(x)+0.5-radius, float64(y)+0.5-radius)
+			disc := clamp(radius - d)
+			if disc == 0 {
+				continue
+			}
+			c := scaled.RGBAAt(x, y)
+			if ring > 0 {
+				c = over(border, clamp(d-(radius-ring)), c)
+			}
+			out.SetRGBA(x, y, scale(c, disc))
+		}
+	}
+	return out
+}
+
+// clamp limits `v` to [0,1].
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// over returns `fg` at opacity `f` composited over `bg`.
+func over(fg color.Color, f float64, bg color.RGBA) color.RGBA {
+	r, g, b, a := fg.RGBA()
+	k := 1 - f*float64(a)/0xffff
+	mix := func(top uint32, bottom uint8) uint8 {
+		return uint8(float64(top>>8)*f + float64(bottom)*k)
+	}
+	return color.RGBA{mix(r, bg.R), mix(g, bg.G), mix(b, bg.B), mix(a, bg.A)}
+}
+
+// scale returns the premultiplied `c` at opacity `f`.
+func scale(c color.RGBA, f float64) color.RGBA {
+	return color.RGBA{uint8(float64(c.R) * f), uint8(float64(c.G) * f), uint8(float64(c.B) * f), uint8(float64(c.A) * f)}
+}
@@ -0,0 +1,108 @@
+package art
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func solid(w, h int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestPortraitRound(t *testing.T) {
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	img := Portrait(solid(300, 200, blue), 64, true, red)
+
+	if img.Bounds() != image.Rect(0, 0, 64, 64) {
+		t.Fatalf("expected a 64x64 portrait, got %v", img.Bounds())
+	}
+	if c := img.RGBAAt(0, 0); c.A != 0 {
+		t.Errorf("expected the corner to be transparent, got %v", c)
+	}
+	if c := img.RGBAAt(32, 32); c != blue {
+		t.Errorf("expected the middle to be the image, got %v", c)
+	}
+	if c := img.RGBAAt(32, 1); c != red {
+		t.Errorf("expected the edge to be the ring, got %v", c)
+	}
+}
+
+func TestPortraitSquare(t *testing.T) {
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	img := Portrait(solid(100, 100, blue), 32, false, color.Transparent)
+	if c := img.RGBAAt(0, 0); c != blue {
+		t.Errorf("expected an unframed square to fill its corner, got %v", c)
+	}
+}
+
+func TestNew(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, solid(10, 10, color.White)); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(User, "U1", ":wizard:", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Round {
+		t.Errorf("expected new portraits to be round")
+	}
+
+	if _, err := New(User, "U1", ":wizard:", []byte("not an image")); err == nil {
+		t.Errorf("expected an error for data that isn't an image")
+	}
+
+	img, err := a.Image(16, color.Black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := a.Image(16, color.Black)
+	if img != again {
+		t.Errorf("expected the same variant to be reused")
+	}
+}
+
+func TestImageShared(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, solid(40, 40, color.White)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Portraits with the same data share their variants, however many renders want them at once.
+	imgs := make(chan image.Image, 8)
+	for i := 0; i < cap(imgs); i++ {
+		a, err := New(Channel, "C1", fmt.Sprintf(":goblin%d:", i), buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			img, err := a.Image(24, color.Black)
+			if err != nil {
+				t.Error(err)
+			}
+			imgs <- img
+		}()
+	}
+	first := <-imgs
+	for i := 1; i < cap(imgs); i++ {
+		if img := <-imgs; img != first {
+			t.Fatalf("expected every render to share one variant")
+		}
+	}
+
+	bad := &Art{Name: ":bad:", Data: []byte("not an image")}
+	if _, err := bad.Image(24, color.Black); err == nil {
+		t.Errorf("expected an error for data that isn't an image")
+	}
+	if _, err := bad.Image(24, color.Black); err == nil {
+		t.Errorf("expected the error again, rather than a variant")
+	}
+}
@@ -0,0 +1,14 @@
+// Package attachment models a file sent back to a user, such as an exported map; UIs deliver it however they deliver
+// files, in the same way they deliver a rendered Tabula.
+package attachment
+
+type Attachment struct {
+	// Filename is the name the file should be saved as, including its extension.
+	Filename string
+	Title    string
+	Data     []byte
+}
+
+func New(filename, title string, data []byte) *Attachment {
+	return &Attachment{Filename: filename, Title: title, Data: data}
+}
@@ -0,0 +1,399 @@
+// Package bundle packs a map and everything on it into a single zip archive, and unpacks it again, so that maps can
+// be backed up, moved between mapbot instances, or handed to another user.
+//
+// An archive holds two files: manifest.json, describing the map, and the background image bytes, exactly as they were
+// uploaded or retrieved.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/mask"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/types"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Extension is the conventional file extension for bundles.
+const Extension = ".mapbot.zip"
+
+const (
+	manifestFile   = "manifest.json"
+	backgroundFile = "background"
+	version        = 1
+)
+
+type Color struct {
+	R, G, B, A uint8
+}
+
+func colorOf(c color.Color) Color {
+	if c == nil {
+		return Color{}
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return Color{n.R, n.G, n.B, n.A}
+}
+
+func (c Color) NRGBA() color.NRGBA {
+	return color.NRGBA{R: c.R, G: c.G, B: c.B, A: c.A}
+}
+
+// facingOf returns the direction `tok` faces in degrees, or nil if it faces nowhere.
+func facingOf(tok tabula.Token) *int {
+	if !tok.HasFacing {
+		return nil
+	}
+	f := int(tok.Facing)
+	return &f
+}
+
+// withFacing returns `tok` facing `degrees`, if it isn't nil.
+func withFacing(tok tabula.Token, degrees *int) tabula.Token {
+	if degrees == nil {
+		return tok
+	}
+	return tok.WithFacing(conv.NewFacing(*degrees))
+}
+
+type Mask struct {
+	Name                     string
+	Color                    Color
+	Top, Left, Width, Height int
+}
+
+type Token struct {
+	Name                               string
+	X, Y                               int
+	Size                               int
+	Color                              Color
+	DimLight, NormalLight, BrightLight int
+	Facing                             *int   `json:",omitempty"`
+	Hidden                             bool   `json:",omitempty"`
+	Elevation                          int    `json:",omitempty"`
+	Speed                              int    `json:",omitempty"`
+	Reach                              int    `json:",omitempty"`
+	Faction                            string `json:",omitempty"`
+}
+
+type Mark struct {
+	X, Y      int
+	Direction string
+	Color     Color
+}
+
+type Light struct {
+	X, Y   float64
+	Radius int
+	Color  Color
+}
+
+// Context holds what a single context (e.g., a slack channel) has placed on the map.
+type Context struct {
+	Tokens []Token `json:",omitempty"`
+	Marks  []Mark  `json:",omitempty"`
+}
+
+type Manifest struct {
+	Version     int
+	Name        string
+	Url         string
+	OffsetX     int
+	OffsetY     int
+	Dpi         float32
+	GridColor   Color
+	GridStyle   tabula.GridStyle             `json:",omitempty"`
+	GridWidth   int                          `json:",omitempty"`
+	GridOpacity int                          `json:",omitempty"`
+	Masks       []Mask                       `json:",omitempty"`
+	Walls       []wall.Wall                  `json:",omitempty"`
+	Lights      []Light                      `json:",omitempty"`
+	Contexts    map[types.ContextId]*Context `json:",omitempty"`
+}
+
+// Bundle is an unpacked archive: a map ready to be saved, its background image, and the marks each context had
+// placed on it.
+type Bundle struct {
+	Tabula     *tabula.Tabula
+	Background []byte
+	Marks      map[types.ContextId][]mark.Mark
+}
+
+// Sniff reports whether `data` looks like a zip archive, which is the best we can do without unpacking it.
+func Sniff(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
+
+// Export packs the tabula, its background, and every context's tokens and marks on it into a zip archive.
+func Export(db anydb.AnyDb, t *tabula.Tabula) ([]byte, error) {
+	if t.Id == nil {
+		return nil, errors.New("cannot export a map that has not been saved")
+	}
+
+	bg, err := t.RawData(db)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving background: %s", err)
+	}
+
+	m := &Manifest{
+		Version:     version,
+		Name:        string(t.Name),
+		Url:         t.Url,
+		OffsetX:     t.OffsetX,
+		OffsetY:     t.OffsetY,
+		Dpi:         t.Dpi,
+		GridColor:   colorOf(t.GridColor),
+		GridStyle:   t.GridStyle,
+		GridWidth:   t.GridWidth,
+		GridOpacity: t.GridOpacity,
+		Walls:       t.Walls,
+		Contexts:    map[types.ContextId]*Context{},
+	}
+
+	masks := make([]*mask.Mask, 0, len(t.Masks))
+	for _, msk := range t.Masks {
+		masks = append(masks, msk)
+	}
+	sort.Slice(masks, func(i, j int) bool {
+		if masks[i].Order == nil || masks[j].Order == nil || *masks[i].Order == *masks[j].Order {
+			return masks[i].Name < masks[j].Name
+		}
+		return *masks[i].Order < *masks[j].Order
+	})
+	for _, msk := range masks {
+		m.Masks = append(m.Masks, Mask{msk.Name, colorOf(msk.Color), msk.Top, msk.Left, msk.Width, msk.Height})
+	}
+
+	for _, l := range t.Lights {
+		m.Lights = append(m.Lights, Light{l.X, l.Y, l.Radius, colorOf(l.Color)})
+	}
+
+	for ctxId, tokens := range t.Tokens {
+		ctx := m.context(ctxId)
+		for name, tok := range tokens {
+			ctx.Tokens = append(ctx.Tokens, Token{
+				Name:        name,
+				X:           tok.Coordinate.X,
+				Y:           tok.Coordinate.Y,
+				Size:        tok.Size,
+				Color:       colorOf(tok.Color()),
+				DimLight:    tok.DimLight,
+				NormalLight: tok.NormalLight,
+				BrightLight: tok.BrightLight,
+				Facing:      facingOf(tok),
+				Hidden:      tok.Hidden,
+				Elevation:   tok.Elevation,
+				Speed:       tok.Speed,
+				Reach:       tok.Reach,
+				Faction:     string(tok.Faction),
+			})
+		}
+		sort.Slice(ctx.Tokens, func(i, j int) bool { return ctx.Tokens[i].Name < ctx.Tokens[j].Name })
+	}
+
+	if err := m.loadMarks(db, *t.Id); err != nil {
+		return nil, err
+	}
+
+	return pack(m, bg)
+}
+
+func pack(m *Manifest, bg []byte) ([]byte, error) {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding manifest: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{manifestFile, manifest}, {backgroundFile, bg}} {
+		w, err := z.Create(f.name)
+		if err != nil {
+			return nil, fmt.Errorf("adding %s to archive: %s", f.name, err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return nil, fmt.Errorf("writing %s to archive: %s", f.name, err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, fmt.Errorf("finishing archive: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Manifest) context(id types.ContextId) *Context {
+	if m.Contexts[id] == nil {
+		m.Contexts[id] = &Context{}
+	}
+	return m.Contexts[id]
+}
+
+func (m *Manifest) loadMarks(db anydb.AnyDb, id types.TabulaId) error {
+	res, err := db.Query("SELECT context_id, square_x, square_y, direction, red, green, blue, alpha "+
+		"FROM context_marks WHERE tabula_id=$1 ORDER BY context_id, square_y, square_x, direction", int64(id))
+	if err != nil {
+		return fmt.Errorf("querying context_marks: %s", err)
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var ctxId types.ContextId
+		var mk Mark
+		var r, g, b, a uint8
+		if err := res.Scan(&ctxId, &mk.X, &mk.Y, &mk.Direction, &r, &g, &b, &a); err != nil {
+			return fmt.Errorf("retrieving mark: %s", err)
+		}
+		mk.Color = colorOf(color.RGBA{r, g, b, a})
+		ctx := m.context(ctxId)
+		ctx.Marks = append(ctx.Marks, mk)
+	}
+	return nil
+}
+
+// Import unpacks an archive produced by Export into a new, unsaved tabula called `name`.
+func Import(data []byte, name string) (*Bundle, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("opening archive: %s", err)
+	}
+
+	files := map[string][]byte{}
+	for _, f := range z.File {
+		if f.Name != manifestFile && f.Name != backgroundFile {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %s", f.Name, err)
+		}
+		files[f.Name], err = ioutil.ReadAll(io.LimitReader(r, 256<<20))
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", f.Name, err)
+		}
+	}
+
+	if files[manifestFile] == nil {
+		return nil, errors.New("archive has no manifest; is this a mapbot export?")
+	}
+	if files[backgroundFile] == nil {
+		return nil, errors.New("archive has no background image")
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(files[manifestFile], m); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %s", err)
+	}
+	if m.Version > version {
+		return nil, fmt.Errorf("archive is version %d, but this mapbot only understands up to version %d", m.Version, version)
+	}
+	if m.Dpi <= 0 {
+		return nil, fmt.Errorf("archive has invalid DPI %f", m.Dpi)
+	}
+
+	t, err := tabula.New(name, m.Url)
+	if err != nil {
+		return nil, err
+	}
+	gc := m.GridColor.NRGBA()
+	t.OffsetX, t.OffsetY, t.Dpi, t.GridColor = m.OffsetX, m.OffsetY, m.Dpi, &gc
+	t.GridStyle, t.GridWidth, t.GridOpacity = m.GridStyle, m.GridWidth, m.GridOpacity
+	t.WithWalls(m.Walls)
+
+	t.Masks = map[string]*mask.Mask{}
+	for i, msk := range m.Masks {
+		order := i
+		t.Masks[msk.Name] = &mask.Mask{
+			Name: msk.Name, Color: msk.Color.NRGBA(), Order: &order,
+			Top: msk.Top, Left: msk.Left, Width: msk.Width, Height: msk.Height,
+		}
+	}
+
+	lights := make([]tabula.Light, len(m.Lights))
+	for i, l := range m.Lights {
+		lights[i] = tabula.Light{X: l.X, Y: l.Y, Radius: l.Radius, Color: l.Color.NRGBA()}
+	}
+	t.WithLights(lights)
+
+	b := &Bundle{
+		Tabula:     t,
+		Background: files[backgroundFile],
+		Marks:      map[types.ContextId][]mark.Mark{},
+	}
+
+	t.Tokens = map[types.ContextId]map[string]tabula.Token{}
+	for ctxId, ctx := range m.Contexts {
+		for _, tok := range ctx.Tokens {
+			if t.Tokens[ctxId] == nil {
+				t.Tokens[ctxId] = map[string]tabula.Token{}
+			}
+			t.Tokens[ctxId][tok.Name] = withFacing(tabula.Token{}.
+				WithCoords(image.Pt(tok.X, tok.Y)).
+				WithSize(tok.Size).
+				WithColor(tok.Color.NRGBA()).
+				WithLight(tok.DimLight, tok.NormalLight, tok.BrightLight).
+				WithHidden(tok.Hidden).
+				WithElevation(tok.Elevation).
+				WithSpeed(tok.Speed).
+				WithReach(tok.Reach).
+				WithFaction(tabula.Faction(tok.Faction)), tok.Facing)
+		}
+		for _, mk := range ctx.Marks {
+			b.Marks[ctxId] = append(b.Marks[ctxId], mark.Mark{
+				Point:     image.Pt(mk.X, mk.Y),
+				Direction: mk.Direction,
+				Color:     mk.Color.NRGBA(),
+			})
+		}
+	}
+
+	return b, nil
+}
+
+// SaveMarksTx saves the bundle's marks against its (now saved) tabula. Marks can only belong to contexts that exist,
+// so marks for contexts this mapbot has never seen are skipped; the number skipped is returned.
+func (b *Bundle) SaveMarksTx(dialect string, tx *sql.Tx) (skipped int, err error) {
+	if b.Tabula.Id == nil {
+		return 0, errors.New("cannot save marks for tabula with nil ID")
+	}
+
+	add, err := tx.Prepare("INSERT INTO context_marks (context_id, tabula_id, square_x, square_y, direction, red, green, blue, alpha, stale) " +
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,FALSE)")
+	if err != nil {
+		return 0, fmt.Errorf("error preparing ADD: %s", err)
+	}
+	defer add.Close()
+
+	for ctxId, marks := range b.Marks {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM contexts WHERE context_id=$1", string(ctxId)).Scan(&n); err != nil {
+			return 0, fmt.Errorf("looking up context %q: %s", ctxId, err)
+		}
+		if n == 0 {
+			skipped += len(marks)
+			continue
+		}
+		for _, mk := range marks {
+			r, g, bl, a := mk.Color.RGBA()
+			if _, err := add.Exec(string(ctxId), int64(*b.Tabula.Id), mk.Point.X, mk.Point.Y, mk.Direction, r>>8, g>>8, bl>>8, a>>8); err != nil {
+				return 0, fmt.Errorf("saving mark at %v for context %q: %s", mk.Point, ctxId, err)
+			}
+		}
+	}
+	return skipped, nil
+}
@@ -0,0 +1,100 @@
+package bundle
+
+import (
+	"bytes"
+	"github.com/pdbogen/mapbot/model/types"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPackImport(t *testing.T) {
+	bg := []byte("not really a PNG")
+	m := &Manifest{
+		Version:   version,
+		Name:      "cellar",
+		Url:       "raw:abc",
+		OffsetX:   3,
+		OffsetY:   4,
+		Dpi:       62.5,
+		GridColor: Color{255, 0, 0, 255},
+		Masks:     []Mask{{"b", Color{0, 0, 0, 255}, 1, 2, 3, 4}, {"a", Color{0, 0, 0, 128}, 0, 0, 1, 1}},
+		Walls:     []wall.Wall{{A: wall.Point{X: 1, Y: 1}, B: wall.Point{X: 1, Y: 5}, Door: true}},
+		Lights:    []Light{{2.5, 2.5, 20, Color{255, 200, 100, 255}}},
+		Contexts: map[types.ContextId]*Context{
+			"T1-C1": {
+				Tokens: []Token{{Name: "bob", X: 5, Y: 6, Size: 2, Color: Color{0, 0, 255, 255}, DimLight: 30}},
+				Marks:  []Mark{{X: 1, Y: 2, Direction: "ne", Color: Color{0, 255, 0, 255}}},
+			},
+		},
+	}
+
+	data, err := pack(m, bg)
+	if err != nil {
+		t.Fatalf("unexpected error packing: %s", err)
+	}
+	if !Sniff(data) {
+		t.Fatal("packed bundle should sniff as a zip")
+	}
+
+	b, err := Import(data, "renamed")
+	if err != nil {
+		t.Fatalf("unexpected error importing: %s", err)
+	}
+
+	tab := b.Tabula
+	if tab.Name != "renamed" || tab.Url != "raw:abc" || tab.OffsetX != 3 || tab.OffsetY != 4 || tab.Dpi != 62.5 {
+		t.Errorf("grid settings did not survive: %v", tab)
+	}
+	if gc, ok := tab.GridColor.(*color.NRGBA); !ok || *gc != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("expected red grid, got %v", tab.GridColor)
+	}
+	if !bytes.Equal(b.Background, bg) {
+		t.Errorf("background bytes did not survive")
+	}
+
+	if len(tab.Masks) != 2 || *tab.Masks["b"].Order != 0 || *tab.Masks["a"].Order != 1 || tab.Masks["b"].Width != 3 {
+		t.Errorf("masks did not survive in order: %v", tab.Masks)
+	}
+	if len(tab.Walls) != 1 || tab.Walls[0] != m.Walls[0] {
+		t.Errorf("walls did not survive: %v", tab.Walls)
+	}
+	if len(tab.Lights) != 1 || tab.Lights[0].Radius != 20 || tab.Lights[0].Color != (color.NRGBA{255, 200, 100, 255}) {
+		t.Errorf("lights did not survive: %v", tab.Lights)
+	}
+
+	bob, ok := tab.Tokens["T1-C1"]["bob"]
+	if !ok {
+		t.Fatalf("token did not survive: %v", tab.Tokens)
+	}
+	if bob.Coordinate != image.Pt(5, 6) || bob.Size != 2 || bob.DimLight != 30 || colorOf(bob.Color()) != (Color{0, 0, 255, 255}) {
+		t.Errorf("token properties did not survive: %+v", bob)
+	}
+
+	marks := b.Marks["T1-C1"]
+	if len(marks) != 1 || marks[0].Point != image.Pt(1, 2) || marks[0].Direction != "ne" {
+		t.Errorf("marks did not survive: %v", marks)
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	if _, err := Import([]byte("PK\x03\x04 but not really"), "x"); err == nil {
+		t.Error("expected error for corrupt archive")
+	}
+
+	minimal, _ := pack(&Manifest{Version: version, Dpi: 50}, []byte("bg"))
+	if _, err := Import(minimal, "x"); err != nil {
+		t.Errorf("unexpected error for valid archive: %s", err)
+	}
+
+	future, _ := pack(&Manifest{Version: version + 1, Dpi: 50}, []byte("bg"))
+	if _, err := Import(future, "x"); err == nil {
+		t.Error("expected error for archive from a newer version")
+	}
+
+	noDpi, _ := pack(&Manifest{Version: version}, []byte("bg"))
+	if _, err := Import(noDpi, "x"); err == nil {
+		t.Error("expected error for archive with zero DPI")
+	}
+}
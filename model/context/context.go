@@ -1,7 +1,10 @@
 package context
 
 import (
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/output"
 	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/terrain"
 	"github.com/pdbogen/mapbot/model/types"
 	"image"
 )
@@ -23,7 +26,22 @@ type Context interface {
 	Mark(types.TabulaId, mark.Mark)
 	GetMarks(types.TabulaId) map[image.Point]map[string]mark.Mark
 	ClearMarks(types.TabulaId)
+
+	// GetTerrain returns the squares of the map that are difficult to move through, or blocked.
+	GetTerrain(types.TabulaId) terrain.Ground
+	// SetTerrain marks a square of the map as difficult, or blocked; terrain.Open clears it.
+	SetTerrain(types.TabulaId, image.Point, terrain.Kind)
+	ClearTerrain(types.TabulaId)
+
 	Save() error
 	GetLastToken(UserId types.UserId) (TokenName string)
 	SetLastToken(UserId types.UserId, TokenName string)
+
+	// GetOutput returns how maps shown in this context should be encoded.
+	GetOutput() output.Options
+	SetOutput(output.Options)
+
+	// GetCoordinates returns how squares are named in this context, and how their names are drawn on its maps.
+	GetCoordinates() conv.Options
+	SetCoordinates(conv.Options)
 }
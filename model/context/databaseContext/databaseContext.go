@@ -2,10 +2,13 @@ package databaseContext
 
 import (
 	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
 	"github.com/pdbogen/mapbot/common/db"
 	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/common/output"
 	"github.com/pdbogen/mapbot/model/context"
 	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/terrain"
 	"github.com/pdbogen/mapbot/model/types"
 	"image"
 	"image/color"
@@ -16,7 +19,10 @@ type DatabaseContext struct {
 	ActiveTabulaId         *types.TabulaId
 	MinX, MinY, MaxX, MaxY int
 	Marks                  map[types.TabulaId]map[image.Point]map[string]mark.Mark
+	Terrain                map[types.TabulaId]terrain.Ground
 	LastTokens             map[types.UserId]string
+	Output                 output.Options
+	Coordinates            conv.Options
 }
 
 func GetContext(db anydb.AnyDb) context.ContextProviderFunc {
@@ -50,19 +56,29 @@ func (dc *DatabaseContext) Save() error {
 	var query string
 	switch dia := db.Instance.Dialect(); dia {
 	case "postgresql":
-		query = "INSERT INTO contexts (context_id, active_tabula, MinX, MinY, MaxX, MaxY) VALUES ($1,$2,$3,$4,$5,$6) " +
-			"ON CONFLICT (context_id) DO UPDATE SET active_tabula=$2, MinX=$3, MinY=$4, MaxX=$5, MaxY=$6"
+		query = "INSERT INTO contexts (context_id, active_tabula, MinX, MinY, MaxX, MaxY, output_format, output_quality, output_budget, coord_style, coord_origin_x, coord_origin_y, coord_zero, coord_labels, coord_font) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15) " +
+			"ON CONFLICT (context_id) DO UPDATE SET active_tabula=$2, MinX=$3, MinY=$4, MaxX=$5, MaxY=$6, output_format=$7, output_quality=$8, output_budget=$9, coord_style=$10, coord_origin_x=$11, coord_origin_y=$12, coord_zero=$13, coord_labels=$14, coord_font=$15"
 	case "sqlite3":
-		query = "REPLACE INTO contexts (context_id, active_tabula, MinX, MinY, MaxX, MaxY) VALUES ($1,$2,$3,$4,$5,$6)"
+		query = "REPLACE INTO contexts (context_id, active_tabula, MinX, MinY, MaxX, MaxY, output_format, output_quality, output_budget, coord_style, coord_origin_x, coord_origin_y, coord_zero, coord_labels, coord_font) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)"
 	default:
 		return fmt.Errorf("no DatabaseContext.Save query for dialect %s", dia)
 	}
-	if _, err := db.Instance.Exec(query, dc.ContextId, int(*dc.ActiveTabulaId), dc.MinX, dc.MinY, dc.MaxX, dc.MaxY); err != nil {
+	// A context may have output settings before it has a map.
+	var activeTabula interface{}
+	if dc.ActiveTabulaId != nil {
+		activeTabula = int(*dc.ActiveTabulaId)
+	}
+	if _, err := db.Instance.Exec(query, dc.ContextId, activeTabula, dc.MinX, dc.MinY, dc.MaxX, dc.MaxY,
+		string(dc.Output.Format), dc.Output.Quality, dc.Output.Budget,
+		string(dc.Coordinates.Style), dc.Coordinates.Origin.X, dc.Coordinates.Origin.Y, dc.Coordinates.Zero, string(dc.Coordinates.Labels), dc.Coordinates.Font); err != nil {
 		return err
 	}
 	if err := dc.saveMarks(); err != nil {
 		return err
 	}
+	if err := dc.saveTerrain(); err != nil {
+		return err
+	}
 	return dc.saveLastTokens()
 }
 
@@ -128,6 +144,46 @@ func (dc *DatabaseContext) saveMarks() error {
 	return nil
 }
 
+func (dc *DatabaseContext) saveTerrain() error {
+	if _, err := db.Instance.Exec("DELETE FROM context_terrain WHERE context_id=$1", dc.ContextId); err != nil {
+		return fmt.Errorf("clearing DatabaseContext terrain: %s", err)
+	}
+
+	stmt, err := db.Instance.Prepare("INSERT INTO context_terrain (context_id, tabula_id, square_x, square_y, kind) VALUES ($1,$2,$3,$4,$5)")
+	if err != nil {
+		return fmt.Errorf("preparing DatabaseContext.saveTerrain query: %s", err)
+	}
+	defer stmt.Close()
+
+	for tabId, ground := range dc.Terrain {
+		for pt, kind := range ground {
+			if _, err := stmt.Exec(dc.ContextId, tabId, pt.X, pt.Y, string(kind)); err != nil {
+				return fmt.Errorf("executing DatabaseContext.saveTerrain for (%v,%v,%v,%v): %s", dc.ContextId, tabId, pt, kind, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (dc *DatabaseContext) loadTerrain() error {
+	res, err := db.Instance.Query("SELECT tabula_id, square_x, square_y, kind FROM context_terrain WHERE context_id=$1", dc.ContextId)
+	if err != nil {
+		return fmt.Errorf("querying context_terrain: %s", err)
+	}
+	defer res.Close()
+
+	var t types.TabulaId
+	var x, y int
+	var kind string
+	for res.Next() {
+		if err := res.Scan(&t, &x, &y, &kind); err != nil {
+			return fmt.Errorf("retrieving terrain: %s", err)
+		}
+		dc.SetTerrain(t, image.Point{x, y}, terrain.Kind(kind))
+	}
+	return nil
+}
+
 func (dc *DatabaseContext) loadMarks() error {
 	res, err := db.Instance.Query("SELECT tabula_id, square_x, square_y, direction, red, green, blue, alpha FROM context_marks WHERE context_id=$1", dc.ContextId)
 	if err != nil {
@@ -180,11 +236,15 @@ func (dc *DatabaseContext) Load(db anydb.AnyDb) error {
 		return err
 	}
 
+	if err := dc.loadTerrain(); err != nil {
+		return err
+	}
+
 	if err := dc.loadLastTokens(); err != nil {
 		return err
 	}
 
-	res, err := db.Query("SELECT active_tabula, MinX, MinY, MaxX, MaxY FROM contexts WHERE context_id=$1", dc.ContextId)
+	res, err := db.Query("SELECT active_tabula, MinX, MinY, MaxX, MaxY, output_format, output_quality, output_budget, coord_style, coord_origin_x, coord_origin_y, coord_zero, coord_labels, coord_font FROM contexts WHERE context_id=$1", dc.ContextId)
 	if err != nil {
 		return err
 	}
@@ -196,9 +256,14 @@ func (dc *DatabaseContext) Load(db anydb.AnyDb) error {
 
 	dc.ActiveTabulaId = new(types.TabulaId)
 
-	if err := res.Scan(&dc.ActiveTabulaId, &dc.MinX, &dc.MinY, &dc.MaxX, &dc.MaxY); err != nil {
+	var format, style, labels string
+	if err := res.Scan(&dc.ActiveTabulaId, &dc.MinX, &dc.MinY, &dc.MaxX, &dc.MaxY, &format, &dc.Output.Quality, &dc.Output.Budget,
+		&style, &dc.Coordinates.Origin.X, &dc.Coordinates.Origin.Y, &dc.Coordinates.Zero, &labels, &dc.Coordinates.Font); err != nil {
 		return fmt.Errorf("retrieving columns: %s", err)
 	}
+	dc.Output.Format = output.Format(format)
+	dc.Coordinates.Style = conv.Style(style)
+	dc.Coordinates.Labels = conv.Placement(labels)
 
 	return nil
 }
@@ -214,6 +279,22 @@ func (dc *DatabaseContext) SetZoom(MinX, MinY, MaxX, MaxY int) {
 	dc.MaxY = MaxY
 }
 
+func (dc *DatabaseContext) GetOutput() output.Options {
+	return dc.Output
+}
+
+func (dc *DatabaseContext) SetOutput(o output.Options) {
+	dc.Output = o
+}
+
+func (dc *DatabaseContext) GetCoordinates() conv.Options {
+	return dc.Coordinates
+}
+
+func (dc *DatabaseContext) SetCoordinates(o conv.Options) {
+	dc.Coordinates = o
+}
+
 func (dc *DatabaseContext) Mark(tid types.TabulaId, mk mark.Mark) {
 	if dc.Marks == nil {
 		dc.Marks = map[types.TabulaId]map[image.Point]map[string]mark.Mark{}
@@ -235,6 +316,28 @@ func (dc *DatabaseContext) ClearMarks(tid types.TabulaId) {
 	delete(dc.Marks, tid)
 }
 
+func (dc *DatabaseContext) GetTerrain(tid types.TabulaId) terrain.Ground {
+	return dc.Terrain[tid]
+}
+
+func (dc *DatabaseContext) SetTerrain(tid types.TabulaId, pt image.Point, kind terrain.Kind) {
+	if kind == terrain.Open {
+		delete(dc.Terrain[tid], pt)
+		return
+	}
+	if dc.Terrain == nil {
+		dc.Terrain = map[types.TabulaId]terrain.Ground{}
+	}
+	if _, ok := dc.Terrain[tid]; !ok {
+		dc.Terrain[tid] = terrain.Ground{}
+	}
+	dc.Terrain[tid][pt] = kind
+}
+
+func (dc *DatabaseContext) ClearTerrain(tid types.TabulaId) {
+	delete(dc.Terrain, tid)
+}
+
 func (dc *DatabaseContext) GetLastToken(UserId types.UserId) (TokenName string) {
 	return dc.LastTokens[UserId]
 }
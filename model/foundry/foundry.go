@@ -0,0 +1,459 @@
+// Package foundry exports a map, as seen from one context, as a Foundry VTT scene: a zip holding scene.json, the
+// background image, and any token portraits or emoji, laid out so that it can be unpacked into Foundry's Data directory.
+package foundry
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/model/art"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultTokenArt is the image Foundry itself uses for tokens with no art of their own.
+const DefaultTokenArt = "icons/svg/mystery-man.svg"
+
+// Foundry's CONST.WALL_SENSE_TYPES.NORMAL and CONST.WALL_MOVEMENT_TYPES.NORMAL
+const normal = 20
+
+// minGrid is the smallest grid size, in pixels, that Foundry accepts.
+const minGrid = 50
+
+type Scene struct {
+	Name       string     `json:"name"`
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	Padding    float64    `json:"padding"`
+	Background Background `json:"background"`
+	Grid       Grid       `json:"grid"`
+	Tokens     []Token    `json:"tokens"`
+	Drawings   []Drawing  `json:"drawings"`
+	Walls      []Wall     `json:"walls"`
+	Lights     []Light    `json:"lights"`
+}
+
+type Background struct {
+	Src     string  `json:"src"`
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+}
+
+type Grid struct {
+	Type     int     `json:"type"`
+	Size     int     `json:"size"`
+	Color    string  `json:"color"`
+	Alpha    float64 `json:"alpha"`
+	Distance float64 `json:"distance"`
+	Units    string  `json:"units"`
+}
+
+type Texture struct {
+	Src string `json:"src"`
+}
+
+type LightConfig struct {
+	Dim    float64 `json:"dim"`
+	Bright float64 `json:"bright"`
+	Color  string  `json:"color,omitempty"`
+	Alpha  float64 `json:"alpha,omitempty"`
+}
+
+type Token struct {
+	Name      string      `json:"name"`
+	X         float64     `json:"x"`
+	Y         float64     `json:"y"`
+	Width     float64     `json:"width"`
+	Height    float64     `json:"height"`
+	Texture   Texture     `json:"texture"`
+	Light     LightConfig `json:"light"`
+	Elevation float64     `json:"elevation,omitempty"`
+	// Disposition is -1 for a hostile token, 0 for a neutral one, and 1 for a friendly one.
+	Disposition int `json:"disposition"`
+}
+
+type Shape struct {
+	Type   string    `json:"type"`
+	Width  float64   `json:"width"`
+	Height float64   `json:"height"`
+	Points []float64 `json:"points,omitempty"`
+}
+
+type Drawing struct {
+	X           float64 `json:"x"`
+	Y           float64 `json:"y"`
+	Shape       Shape   `json:"shape"`
+	FillType    int     `json:"fillType"`
+	FillColor   string  `json:"fillColor,omitempty"`
+	FillAlpha   float64 `json:"fillAlpha"`
+	StrokeWidth int     `json:"strokeWidth"`
+	StrokeColor string  `json:"strokeColor,omitempty"`
+	StrokeAlpha float64 `json:"strokeAlpha"`
+}
+
+type Wall struct {
+	C     [4]float64 `json:"c"`
+	Move  int        `json:"move"`
+	Sight int        `json:"sight"`
+	Light int        `json:"light"`
+	Sound int        `json:"sound"`
+	Door  int        `json:"door"`
+	Ds    int        `json:"ds"`
+}
+
+type Light struct {
+	X      float64     `json:"x"`
+	Y      float64     `json:"y"`
+	Config LightConfig `json:"config"`
+}
+
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Dir returns the directory, relative to Foundry's Data directory, that an exported scene for `t` expects to be
+// unpacked into.
+func Dir(t *tabula.Tabula) string {
+	return "mapbot/" + slugRe.ReplaceAllString(strings.ToLower(string(t.Name)), "-")
+}
+
+// Export builds a zip containing a Foundry scene for `t`, with the tokens and marks placed on it in `ctx`.
+func Export(db anydb.AnyDb, t *tabula.Tabula, ctx context.Context) ([]byte, error) {
+	bg, err := t.RawData(db)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving background: %s", err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(bg))
+	if err != nil {
+		return nil, fmt.Errorf("reading background: %s", err)
+	}
+
+	files := map[string][]byte{}
+	scene := build(t, cfg, format)
+	files["background."+format] = bg
+
+	if ctx != nil {
+		var arts *art.Loader
+		if db != nil {
+			arts = art.NewLoader(db)
+		}
+		if err := scene.addTokens(t, ctx, arts, files); err != nil {
+			return nil, err
+		}
+		if t.Id != nil {
+			for _, dirMarks := range ctx.GetMarks(*t.Id) {
+				for _, m := range dirMarks {
+					scene.addMark(m)
+				}
+			}
+		}
+	}
+	for _, m := range t.Marks {
+		scene.addMark(m)
+	}
+	for _, l := range t.Lines {
+		scene.addLine(l)
+	}
+
+	js, err := json.MarshalIndent(scene, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding scene: %s", err)
+	}
+	files["scene.json"] = js
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	for _, name := range names {
+		w, err := z.Create(Dir(t) + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("adding %s to archive: %s", name, err)
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			return nil, fmt.Errorf("writing %s to archive: %s", name, err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, fmt.Errorf("finishing archive: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// build lays out the scene itself, along with the map's walls and lights.
+//
+// mapbot's DPI and offsets are relative to the background scaled to tabula.ReferenceSize on its longest side, and its DPI need not be
+// a whole number; whereas Foundry needs a whole number of pixels per square, and at least 50 of them. So we pick the
+// nearest acceptable grid size and stretch the scene (Foundry stretches the background to fit) to match it.
+func build(t *tabula.Tabula, cfg image.Config, format string) *Scene {
+	longest := cfg.Width
+	if cfg.Height > longest {
+		longest = cfg.Height
+	}
+	scale := tabula.ReferenceSize / float64(longest)
+	size := math.Round(float64(t.Dpi))
+	if size < minGrid {
+		size = minGrid
+	}
+	scale *= size / float64(t.Dpi)
+
+	s := &Scene{
+		Name:   string(t.Name),
+		Width:  int(math.Round(float64(cfg.Width) * scale)),
+		Height: int(math.Round(float64(cfg.Height) * scale)),
+		Background: Background{
+			Src:     Dir(t) + "/background." + format,
+			OffsetX: -float64(t.OffsetX) * size / float64(t.Dpi),
+			OffsetY: -float64(t.OffsetY) * size / float64(t.Dpi),
+		},
+		Grid: Grid{
+			Type:     1,
+			Size:     int(size),
+			Color:    hex(t.GridColor),
+			Alpha:    gridAlpha(t),
+			Distance: 5,
+			Units:    "ft",
+		},
+		Tokens:   []Token{},
+		Drawings: []Drawing{},
+		Walls:    []Wall{},
+		Lights:   []Light{},
+	}
+
+	for _, w := range t.Walls {
+		fw := Wall{
+			C:     [4]float64{w.A.X * size, w.A.Y * size, w.B.X * size, w.B.Y * size},
+			Move:  normal,
+			Sight: normal,
+			Light: normal,
+			Sound: normal,
+		}
+		if w.Door {
+			fw.Door = 1
+			if w.Open {
+				fw.Ds = 1
+			}
+		}
+		s.Walls = append(s.Walls, fw)
+	}
+
+	for _, l := range t.Lights {
+		s.Lights = append(s.Lights, Light{
+			X: l.X * size,
+			Y: l.Y * size,
+			Config: LightConfig{
+				Dim:    float64(l.Radius),
+				Bright: float64(l.Radius) / 2,
+				Color:  hex(l.Color),
+				Alpha:  0.5,
+			},
+		})
+	}
+
+	return s
+}
+
+func (s *Scene) grid() float64 {
+	return float64(s.Grid.Size)
+}
+
+// addTokens adds the tokens shown in `ctx`, with their portraits from `arts`, if it isn't nil; or otherwise their emoji.
+func (s *Scene) addTokens(t *tabula.Tabula, ctx context.Context, arts *art.Loader, files map[string][]byte) error {
+	tokens := t.ShownTokens(ctx)
+	names := make([]string, 0, len(tokens))
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		tok := tokens[name]
+		size := float64(tok.Size)
+		if size < 1 {
+			size = 1
+		}
+
+		texture := DefaultTokenArt
+		artName := tabula.ArtName(name)
+		var portrait *art.Art
+		if arts != nil {
+			var err error
+			if portrait, err = arts.Find(ctx.Id(), tok.Owner, artName); err != nil {
+				return fmt.Errorf("finding portrait of token %q: %s", name, err)
+			}
+		}
+		if portrait != nil {
+			if _, format, err := image.DecodeConfig(bytes.NewReader(portrait.Data)); err == nil {
+				file := fmt.Sprintf("token-%d.%s", i, format)
+				files[file] = portrait.Data
+				texture = Dir(t) + "/" + file
+			}
+		} else if ctx.IsEmoji(artName) {
+			if img, err := ctx.GetEmoji(artName); err == nil {
+				buf := &bytes.Buffer{}
+				if err := png.Encode(buf, img); err != nil {
+					return fmt.Errorf("encoding art for token %q: %s", name, err)
+				}
+				file := fmt.Sprintf("token-%d.png", i)
+				files[file] = buf.Bytes()
+				texture = Dir(t) + "/" + file
+			}
+		}
+
+		bright := tok.NormalLight
+		if tok.BrightLight > bright {
+			bright = tok.BrightLight
+		}
+		dim := tok.DimLight
+		if bright > dim {
+			dim = bright
+		}
+
+		s.Tokens = append(s.Tokens, Token{
+			Name:        name,
+			X:           float64(tok.Coordinate.X) * s.grid(),
+			Y:           float64(tok.Coordinate.Y) * s.grid(),
+			Width:       size,
+			Height:      size,
+			Texture:     Texture{Src: texture},
+			Light:       LightConfig{Dim: float64(dim), Bright: float64(bright)},
+			Elevation:   float64(tok.Elevation),
+			Disposition: disposition(tok.Faction),
+		})
+	}
+	return nil
+}
+
+// disposition returns the Foundry disposition of a token in faction `f`.
+func disposition(f tabula.Faction) int {
+	switch f {
+	case tabula.Ally:
+		return 1
+	case tabula.Enemy:
+		return -1
+	}
+	return 0
+}
+
+// markRect returns the area covered by a mark, in grid units, matching the way mapbot itself draws them.
+func markRect(m mark.Mark) (x, y, w, h float64) {
+	x, y = float64(m.Point.X), float64(m.Point.Y)
+	switch m.Direction {
+	case "n":
+		return x, y - .1, 1, .2
+	case "s":
+		return x, y + .9, 1, .2
+	case "e":
+		return x + .9, y, .2, 1
+	case "w":
+		return x - .1, y, .2, 1
+	case "ne":
+		return x + .9, y - .1, .2, .2
+	case "se":
+		return x + .9, y + .9, .2, .2
+	case "nw":
+		return x - .1, y - .1, .2, .2
+	case "sw":
+		return x - .1, y + .9, .2, .2
+	}
+	return x, y, 1, 1
+}
+
+func (s *Scene) addMark(m mark.Mark) {
+	x, y, w, h := markRect(m)
+	g := s.grid()
+	s.Drawings = append(s.Drawings, Drawing{
+		X:         x * g,
+		Y:         y * g,
+		Shape:     Shape{Type: "r", Width: w * g, Height: h * g},
+		FillType:  1,
+		FillColor: hex(m.Color),
+		FillAlpha: alpha(m.Color),
+	})
+}
+
+func corner(p image.Point, c string) (float64, float64) {
+	x, y := float64(p.X), float64(p.Y)
+	switch c {
+	case "ne":
+		x++
+	case "se":
+		x++
+		y++
+	case "sw":
+		y++
+	}
+	return x, y
+}
+
+func (s *Scene) addLine(l mark.Line) {
+	g := s.grid()
+	x1, y1 := corner(l.A, l.CA)
+	x2, y2 := corner(l.B, l.CB)
+	minX, minY := x1, y1
+	if x2 < minX {
+		minX = x2
+	}
+	if y2 < minY {
+		minY = y2
+	}
+	s.Drawings = append(s.Drawings, Drawing{
+		X: minX * g,
+		Y: minY * g,
+		Shape: Shape{
+			Type:   "p",
+			Width:  abs(x2-x1) * g,
+			Height: abs(y2-y1) * g,
+			Points: []float64{(x1 - minX) * g, (y1 - minY) * g, (x2 - minX) * g, (y2 - minY) * g},
+		},
+		StrokeWidth: 4,
+		StrokeColor: hex(l.Color),
+		StrokeAlpha: alpha(l.Color),
+	})
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+func hex(c color.Color) string {
+	if c == nil {
+		return "#000000"
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x", n.R, n.G, n.B)
+}
+
+// gridAlpha returns the opacity of the map's grid. Foundry can't dash or dot a grid, but it can hide one.
+func gridAlpha(t *tabula.Tabula) float64 {
+	if t.GridStyle == tabula.GridNone {
+		return 0
+	}
+	a := alpha(t.GridColor)
+	if t.GridOpacity > 0 && t.GridOpacity < 100 {
+		a *= float64(t.GridOpacity) / 100
+	}
+	return a
+}
+
+func alpha(c color.Color) float64 {
+	if c == nil {
+		return 1
+	}
+	return float64(color.NRGBAModel.Convert(c).(color.NRGBA).A) / 255
+}
@@ -0,0 +1,97 @@
+package foundry
+
+import (
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/types"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	tab, _ := tabula.New("Cellar Door", "raw:abc")
+	tab.Dpi = 100
+	tab.OffsetX = 10
+	tab.WithWalls([]wall.Wall{
+		{A: wall.Point{X: 0, Y: 0}, B: wall.Point{X: 2, Y: 0}},
+		{A: wall.Point{X: 2, Y: 0}, B: wall.Point{X: 3, Y: 0}, Door: true, Open: true},
+	})
+	tab.WithLights([]tabula.Light{{X: 1.5, Y: 1.5, Radius: 20, Color: color.NRGBA{255, 128, 0, 255}}})
+
+	// A 1000x500 background is scaled to 2000x1000 before mapbot draws its 100 DPI grid.
+	s := build(tab, image.Config{Width: 1000, Height: 500}, "png")
+
+	if s.Width != 2000 || s.Height != 1000 || s.Grid.Size != 100 {
+		t.Errorf("expected 2000x1000 scene with 100px grid, got %dx%d with %dpx", s.Width, s.Height, s.Grid.Size)
+	}
+	if s.Background.OffsetX != -10 || s.Background.Src != "mapbot/cellar-door/background.png" {
+		t.Errorf("unexpected background %+v", s.Background)
+	}
+
+	if len(s.Walls) != 2 {
+		t.Fatalf("expected 2 walls, got %d", len(s.Walls))
+	}
+	if s.Walls[0].C != [4]float64{0, 0, 200, 0} || s.Walls[0].Door != 0 {
+		t.Errorf("unexpected wall %+v", s.Walls[0])
+	}
+	if s.Walls[1].Door != 1 || s.Walls[1].Ds != 1 {
+		t.Errorf("expected an open door, got %+v", s.Walls[1])
+	}
+
+	if len(s.Lights) != 1 || s.Lights[0].X != 150 || s.Lights[0].Config.Dim != 20 || s.Lights[0].Config.Color != "#ff8000" {
+		t.Errorf("unexpected lights %+v", s.Lights)
+	}
+}
+
+func TestBuildSmallGrid(t *testing.T) {
+	tab, _ := tabula.New("small", "raw:abc")
+	tab.Dpi = 25
+
+	// Foundry won't accept a 25px grid, so the scene is stretched to twice the size.
+	s := build(tab, image.Config{Width: 2000, Height: 1000}, "png")
+	if s.Width != 4000 || s.Height != 2000 || s.Grid.Size != 50 {
+		t.Errorf("expected 4000x2000 scene with 50px grid, got %dx%d with %dpx", s.Width, s.Height, s.Grid.Size)
+	}
+}
+
+func TestAddMark(t *testing.T) {
+	s := &Scene{Grid: Grid{Size: 100}}
+	s.addMark(mark.Mark{Point: image.Pt(2, 3), Color: color.NRGBA{0, 255, 0, 127}})
+	s.addMark(mark.Mark{Point: image.Pt(2, 3), Direction: "e", Color: color.NRGBA{0, 0, 255, 255}})
+
+	d := s.Drawings[0]
+	if d.X != 200 || d.Y != 300 || d.Shape.Width != 100 || d.Shape.Height != 100 || d.FillColor != "#00ff00" {
+		t.Errorf("unexpected square mark %+v", d)
+	}
+	d = s.Drawings[1]
+	if d.X != 290 || d.Y != 300 || d.Shape.Width != 20 || d.Shape.Height != 100 {
+		t.Errorf("unexpected edge mark %+v", d)
+	}
+}
+
+// testContext is a context with tokens that aren't emoji; nothing else of it is used.
+type testContext struct {
+	context.Context
+}
+
+func (testContext) Id() types.ContextId      { return "test" }
+func (testContext) IsEmoji(name string) bool { return false }
+
+func TestAddTokensHidden(t *testing.T) {
+	tab, _ := tabula.New("crypt", "raw:abc")
+	tab.Tokens = map[types.ContextId]map[string]tabula.Token{"test": {
+		"elf":   {Coordinate: image.Pt(1, 1)},
+		"ghoul": {Coordinate: image.Pt(3, 3), Hidden: true},
+	}}
+
+	s := &Scene{Grid: Grid{Size: 100}}
+	if err := s.addTokens(tab, testContext{}, nil, map[string][]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tokens) != 1 || s.Tokens[0].Name != "elf" {
+		t.Errorf("expected only the elf in the channel's export, got %+v", s.Tokens)
+	}
+}
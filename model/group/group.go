@@ -0,0 +1,140 @@
+// Package group keeps the named groups of tokens, like a party of adventurers, that a context moves and changes
+// together.
+package group
+
+import (
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/model/types"
+	"image"
+	"sort"
+	"strings"
+)
+
+// Groups maps the name of each group to the names of its tokens, in the order they joined it. The first is the
+// group's leader.
+type Groups map[string][]string
+
+// Key returns the name a group is kept under; group names don't care about case.
+func Key(name string) string {
+	return strings.ToLower(name)
+}
+
+// Add puts `tokens` in the group `name`, making it if need be. Tokens already in it keep their place.
+func (g Groups) Add(name string, tokens ...string) {
+	name = Key(name)
+	for _, tok := range tokens {
+		if g.Has(name, tok) {
+			continue
+		}
+		g[name] = append(g[name], tok)
+	}
+}
+
+// Has returns whether `token` is in the group `name`.
+func (g Groups) Has(name, token string) bool {
+	for _, tok := range g[Key(name)] {
+		if tok == token {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove takes `tokens` out of the group `name`, or, if none are given, forgets the whole group. A group left empty
+// is forgotten too.
+func (g Groups) Remove(name string, tokens ...string) {
+	name = Key(name)
+	if len(tokens) == 0 {
+		delete(g, name)
+		return
+	}
+	kept := []string{}
+	for _, tok := range g[name] {
+		drop := false
+		for _, t := range tokens {
+			if tok == t {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, tok)
+		}
+	}
+	if len(kept) == 0 {
+		delete(g, name)
+		return
+	}
+	g[name] = kept
+}
+
+// Names returns the names of the groups, sorted.
+func (g Groups) Names() []string {
+	ret := make([]string, 0, len(g))
+	for name := range g {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Formation returns where each of `members` placed at `at` goes so that the first of them found in `at` lands on
+// `to`, and the rest keep where they stand relative to it. Members not in `at` are left out.
+func Formation(members []string, at map[string]image.Point, to image.Point) map[string]image.Point {
+	ret := map[string]image.Point{}
+	var shift *image.Point
+	for _, name := range members {
+		pt, ok := at[name]
+		if !ok {
+			continue
+		}
+		if shift == nil {
+			shift = new(image.Point)
+			*shift = to.Sub(pt)
+		}
+		ret[name] = pt.Add(*shift)
+	}
+	return ret
+}
+
+// Load returns the groups of context `ctxId`.
+func Load(db anydb.AnyDb, ctxId types.ContextId) (Groups, error) {
+	res, err := db.Query("SELECT name, token FROM token_groups WHERE context_id=$1 ORDER BY name, seq", ctxId)
+	if err != nil {
+		return nil, fmt.Errorf("querying groups of %s: %s", ctxId, err)
+	}
+	defer res.Close()
+
+	ret := Groups{}
+	var name, token string
+	for res.Next() {
+		if err := res.Scan(&name, &token); err != nil {
+			return nil, fmt.Errorf("scanning group of %s: %s", ctxId, err)
+		}
+		ret[name] = append(ret[name], token)
+	}
+	return ret, nil
+}
+
+// Save replaces the groups kept for context `ctxId` with `g`.
+func (g Groups) Save(db anydb.AnyDb, ctxId types.ContextId) error {
+	if _, err := db.Exec("DELETE FROM token_groups WHERE context_id=$1", ctxId); err != nil {
+		return fmt.Errorf("clearing groups of %s: %s", ctxId, err)
+	}
+
+	stmt, err := db.Prepare("INSERT INTO token_groups (context_id, name, seq, token) VALUES ($1,$2,$3,$4)")
+	if err != nil {
+		return fmt.Errorf("preparing Groups.Save query: %s", err)
+	}
+	defer stmt.Close()
+
+	for name, tokens := range g {
+		for seq, tok := range tokens {
+			if _, err := stmt.Exec(ctxId, name, seq, tok); err != nil {
+				return fmt.Errorf("saving %q in group %q of %s: %s", tok, name, ctxId, err)
+			}
+		}
+	}
+	return nil
+}
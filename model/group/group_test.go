@@ -0,0 +1,53 @@
+package group
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestAddRemove(t *testing.T) {
+	g := Groups{}
+	g.Add("Party", ":elf:", ":dwarf:")
+	g.Add("party", ":wizard:", ":elf:")
+
+	if exp := []string{":elf:", ":dwarf:", ":wizard:"}; !reflect.DeepEqual(g["party"], exp) {
+		t.Fatalf("expected %v, got %v", exp, g["party"])
+	}
+	if !g.Has("PARTY", ":dwarf:") {
+		t.Errorf("expected the party to have the dwarf")
+	}
+
+	g.Remove("party", ":elf:")
+	if exp := []string{":dwarf:", ":wizard:"}; !reflect.DeepEqual(g["party"], exp) {
+		t.Errorf("expected %v, got %v", exp, g["party"])
+	}
+
+	g.Remove("party", ":dwarf:", ":wizard:")
+	if _, ok := g["party"]; ok {
+		t.Errorf("expected an empty group to be forgotten, got %v", g["party"])
+	}
+
+	g.Add("goblins", ":goblin:")
+	g.Remove("goblins")
+	if len(g) != 0 {
+		t.Errorf("expected no groups, got %v", g)
+	}
+}
+
+func TestFormation(t *testing.T) {
+	at := map[string]image.Point{
+		":elf:":    {2, 2},
+		":dwarf:":  {3, 2},
+		":wizard:": {2, 4},
+	}
+	got := Formation([]string{":ghost:", ":elf:", ":dwarf:", ":wizard:"}, at, image.Pt(10, 7))
+	exp := map[string]image.Point{
+		":elf:":    {10, 7},
+		":dwarf:":  {11, 7},
+		":wizard:": {10, 9},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+}
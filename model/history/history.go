@@ -0,0 +1,237 @@
+// Package history records what each context has on its active map, as a frame every time its tokens or marks change,
+// so that an encounter can be replayed afterwards.
+package history
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/types"
+	"image"
+	"image/color"
+	"sort"
+	"time"
+)
+
+var log = mbLog.Log
+
+// MaxFrames is how many frames are kept for each context and map; older frames are forgotten.
+const MaxFrames = 500
+
+type Color struct {
+	R, G, B, A uint8
+}
+
+func colorOf(c color.Color) Color {
+	if c == nil {
+		return Color{}
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return Color{n.R, n.G, n.B, n.A}
+}
+
+func (c Color) NRGBA() color.NRGBA {
+	return color.NRGBA{R: c.R, G: c.G, B: c.B, A: c.A}
+}
+
+// facingOf returns the direction `tok` faces in degrees, or nil if it faces nowhere.
+func facingOf(tok tabula.Token) *int {
+	if !tok.HasFacing {
+		return nil
+	}
+	f := int(tok.Facing)
+	return &f
+}
+
+// withFacing returns `tok` facing `degrees`, if it isn't nil.
+func withFacing(tok tabula.Token, degrees *int) tabula.Token {
+	if degrees == nil {
+		return tok
+	}
+	return tok.WithFacing(conv.NewFacing(*degrees))
+}
+
+type Token struct {
+	Name                               string
+	X, Y                               int
+	Size                               int
+	Color                              Color
+	DimLight, NormalLight, BrightLight int
+	Owner                              types.UserId `json:",omitempty"`
+	Facing                             *int         `json:",omitempty"`
+	Hidden                             bool         `json:",omitempty"`
+	Elevation                          int          `json:",omitempty"`
+	Reach                              int          `json:",omitempty"`
+}
+
+type Mark struct {
+	X, Y      int
+	Direction string
+	Color     Color
+}
+
+// Frame is the tokens and marks a context had on a map at one moment.
+type Frame struct {
+	Seq    int
+	At     time.Time
+	Tokens []Token
+	Marks  []Mark
+}
+
+// NewFrame captures `tokens` and `marks`, in a consistent order so that identical frames can be recognized.
+func NewFrame(tokens map[string]tabula.Token, marks map[image.Point]map[string]mark.Mark) *Frame {
+	ret := &Frame{At: time.Now()}
+	for name, tok := range tokens {
+		ret.Tokens = append(ret.Tokens, Token{
+			Name:        name,
+			X:           tok.Coordinate.X,
+			Y:           tok.Coordinate.Y,
+			Size:        tok.Size,
+			Color:       colorOf(tok.TokenColor),
+			DimLight:    tok.DimLight,
+			NormalLight: tok.NormalLight,
+			BrightLight: tok.BrightLight,
+			Owner:       tok.Owner,
+			Facing:      facingOf(tok),
+			Hidden:      tok.Hidden,
+			Elevation:   tok.Elevation,
+			Reach:       tok.Reach,
+		})
+	}
+	sort.Slice(ret.Tokens, func(i, j int) bool { return ret.Tokens[i].Name < ret.Tokens[j].Name })
+
+	for _, dirMarks := range marks {
+		for _, m := range dirMarks {
+			ret.Marks = append(ret.Marks, Mark{X: m.Point.X, Y: m.Point.Y, Direction: m.Direction, Color: colorOf(m.Color)})
+		}
+	}
+	sort.Slice(ret.Marks, func(i, j int) bool {
+		a, b := ret.Marks[i], ret.Marks[j]
+		if a.Y != b.Y {
+			return a.Y < b.Y
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Direction < b.Direction
+	})
+	return ret
+}
+
+// TokenMap returns the frame's tokens as a tabula keeps them.
+func (f *Frame) TokenMap() map[string]tabula.Token {
+	ret := map[string]tabula.Token{}
+	for _, tok := range f.Tokens {
+		ret[tok.Name] = withFacing(tabula.Token{
+			Coordinate:  image.Pt(tok.X, tok.Y),
+			TokenColor:  tok.Color.NRGBA(),
+			Size:        tok.Size,
+			DimLight:    tok.DimLight,
+			NormalLight: tok.NormalLight,
+			BrightLight: tok.BrightLight,
+			Owner:       tok.Owner,
+			Hidden:      tok.Hidden,
+			Elevation:   tok.Elevation,
+			Reach:       tok.Reach,
+		}, tok.Facing)
+	}
+	return ret
+}
+
+// MarkMap returns the frame's marks as a context keeps them.
+func (f *Frame) MarkMap() map[image.Point]map[string]mark.Mark {
+	ret := map[image.Point]map[string]mark.Mark{}
+	for _, m := range f.Marks {
+		pt := image.Pt(m.X, m.Y)
+		if ret[pt] == nil {
+			ret[pt] = map[string]mark.Mark{}
+		}
+		ret[pt][m.Direction] = mark.Mark{Point: pt, Direction: m.Direction, Color: m.Color.NRGBA()}
+	}
+	return ret
+}
+
+// same reports whether the frames show the same thing, regardless of when they were recorded.
+func (f *Frame) same(o *Frame) bool {
+	a, _ := json.Marshal(&Frame{Tokens: f.Tokens, Marks: f.Marks})
+	b, _ := json.Marshal(&Frame{Tokens: o.Tokens, Marks: o.Marks})
+	return string(a) == string(b)
+}
+
+// Record appends `f` to the history of context `ctxId` on map `tabId`, unless it's the same as the latest frame
+// there, and forgets frames beyond MaxFrames.
+func Record(db anydb.AnyDb, ctxId types.ContextId, tabId types.TabulaId, f *Frame) error {
+	last, err := Load(db, ctxId, tabId, 1)
+	if err != nil {
+		return err
+	}
+	f.Seq = 1
+	if len(last) > 0 {
+		if last[0].same(f) {
+			return nil
+		}
+		f.Seq = last[0].Seq + 1
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encoding frame: %s", err)
+	}
+	if _, err := db.Exec("INSERT INTO context_history (context_id, tabula_id, seq, frame) VALUES ($1, $2, $3, $4)",
+		ctxId, int64(tabId), f.Seq, string(data)); err != nil {
+		return fmt.Errorf("saving frame %d of context %s on tabula %d: %s", f.Seq, ctxId, tabId, err)
+	}
+
+	if f.Seq > MaxFrames {
+		if _, err := db.Exec("DELETE FROM context_history WHERE context_id=$1 AND tabula_id=$2 AND seq <= $3",
+			ctxId, int64(tabId), f.Seq-MaxFrames); err != nil {
+			return fmt.Errorf("forgetting old frames of context %s on tabula %d: %s", ctxId, tabId, err)
+		}
+	}
+	return nil
+}
+
+// Load returns up to `limit` of the latest frames of context `ctxId` on map `tabId`, oldest first. If `limit` is zero,
+// all of them are returned.
+func Load(db anydb.AnyDb, ctxId types.ContextId, tabId types.TabulaId, limit int) ([]*Frame, error) {
+	if limit <= 0 {
+		limit = MaxFrames
+	}
+	res, err := db.Query("SELECT frame FROM context_history WHERE context_id=$1 AND tabula_id=$2 ORDER BY seq DESC LIMIT $3",
+		ctxId, int64(tabId), limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying history of context %s on tabula %d: %s", ctxId, tabId, err)
+	}
+	defer res.Close()
+
+	ret := []*Frame{}
+	for res.Next() {
+		var data sql.NullString
+		if err := res.Scan(&data); err != nil {
+			return nil, fmt.Errorf("scanning frame: %s", err)
+		}
+		f := &Frame{}
+		if err := json.Unmarshal([]byte(data.String), f); err != nil {
+			log.Warningf("skipping unreadable frame of context %s on tabula %d: %s", ctxId, tabId, err)
+			continue
+		}
+		ret = append(ret, f)
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret, nil
+}
+
+// Clear forgets the history of context `ctxId` on map `tabId`.
+func Clear(db anydb.AnyDb, ctxId types.ContextId, tabId types.TabulaId) error {
+	if _, err := db.Exec("DELETE FROM context_history WHERE context_id=$1 AND tabula_id=$2", ctxId, int64(tabId)); err != nil {
+		return fmt.Errorf("clearing history of context %s on tabula %d: %s", ctxId, tabId, err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package history
+
+import (
+	"bytes"
+	"github.com/pdbogen/mapbot/common/cache"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/output"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/terrain"
+	"github.com/pdbogen/mapbot/model/types"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"reflect"
+	"testing"
+)
+
+// testContext is just enough of a context.Context to render a map.
+type testContext struct{}
+
+func (c *testContext) Type() types.ContextType                              { return "test" }
+func (c *testContext) Id() types.ContextId                                  { return "test" }
+func (c *testContext) GetActiveTabulaId() *types.TabulaId                   { return nil }
+func (c *testContext) SetActiveTabulaId(*types.TabulaId)                    {}
+func (c *testContext) GetZoom() (int, int, int, int)                        { return 0, 0, 0, 0 }
+func (c *testContext) SetZoom(int, int, int, int)                           {}
+func (c *testContext) GetEmoji(string) (image.Image, error)                 { return nil, nil }
+func (c *testContext) IsEmoji(string) bool                                  { return false }
+func (c *testContext) Mark(types.TabulaId, mark.Mark)                       {}
+func (c *testContext) ClearMarks(types.TabulaId)                            {}
+func (c *testContext) GetTerrain(types.TabulaId) terrain.Ground             { return nil }
+func (c *testContext) SetTerrain(types.TabulaId, image.Point, terrain.Kind) {}
+func (c *testContext) ClearTerrain(types.TabulaId)                          {}
+func (c *testContext) Save() error                                          { return nil }
+func (c *testContext) GetLastToken(types.UserId) string                     { return "" }
+func (c *testContext) SetLastToken(types.UserId, string)                    {}
+func (c *testContext) GetOutput() output.Options                            { return output.Options{} }
+func (c *testContext) SetOutput(output.Options)                             {}
+func (c *testContext) GetCoordinates() conv.Options                         { return conv.Options{} }
+func (c *testContext) SetCoordinates(conv.Options)                          {}
+func (c *testContext) GetMarks(types.TabulaId) map[image.Point]map[string]mark.Mark {
+	return nil
+}
+
+var _ context.Context = &testContext{}
+
+func testFrames() []*Frame {
+	red := color.NRGBA{255, 0, 0, 255}
+	marks := map[image.Point]map[string]mark.Mark{
+		image.Pt(2, 2): {"": {Point: image.Pt(2, 2), Color: color.NRGBA{0, 0, 255, 127}}},
+	}
+	return []*Frame{
+		NewFrame(map[string]tabula.Token{"alice": {Coordinate: image.Pt(1, 1), Size: 1, TokenColor: red}}, nil),
+		NewFrame(map[string]tabula.Token{"alice": {Coordinate: image.Pt(3, 1), Size: 1, TokenColor: red}}, nil),
+		NewFrame(map[string]tabula.Token{
+			"alice": {Coordinate: image.Pt(3, 4), Size: 1, TokenColor: red},
+			"bob":   {Coordinate: image.Pt(6, 6), Size: 2},
+		}, marks),
+	}
+}
+
+func TestFrame(t *testing.T) {
+	tokens := map[string]tabula.Token{
+		"alice": {Coordinate: image.Pt(3, 4), Size: 1, TokenColor: color.NRGBA{255, 0, 0, 255}, DimLight: 30},
+		"bob":   {Coordinate: image.Pt(10, 12), Size: 2, TokenColor: color.NRGBA{}, BrightLight: 20, Facing: 90, HasFacing: true, Hidden: true, Elevation: 30},
+	}
+	marks := map[image.Point]map[string]mark.Mark{
+		image.Pt(7, 7): {
+			"":   {Point: image.Pt(7, 7), Color: color.NRGBA{0, 255, 0, 127}},
+			"ne": {Point: image.Pt(7, 7), Direction: "ne", Color: color.NRGBA{0, 0, 255, 127}},
+		},
+	}
+	f := NewFrame(tokens, marks)
+	if got := f.TokenMap(); !reflect.DeepEqual(got, tokens) {
+		t.Errorf("tokens came back as %v, not %v", got, tokens)
+	}
+	if got := f.MarkMap(); !reflect.DeepEqual(got, marks) {
+		t.Errorf("marks came back as %v, not %v", got, marks)
+	}
+	if !f.same(NewFrame(tokens, marks)) {
+		t.Errorf("identical frames were not the same")
+	}
+	if f.same(NewFrame(tokens, nil)) {
+		t.Errorf("frames with different marks were the same")
+	}
+}
+
+func TestTrails(t *testing.T) {
+	shown := shownTokens(&tabula.Tabula{}, &testContext{}, testFrames())
+	if lines := trails(shown, 0); len(lines) != 0 {
+		t.Errorf("first frame should have no trail, but had %d lines", len(lines))
+	}
+	// Alice moved twice, and each move is traced from all four corners; bob appeared, so he has no trail.
+	lines := trails(shown, 2)
+	if len(lines) != 8 {
+		t.Fatalf("expected 8 lines, got %d", len(lines))
+	}
+	if lines[0].A != image.Pt(3, 1) || lines[0].B != image.Pt(3, 4) {
+		t.Errorf("latest move should come first, but got %v", lines[0])
+	}
+	_, _, _, latest := lines[0].Color.RGBA()
+	_, _, _, older := lines[4].Color.RGBA()
+	if older >= latest {
+		t.Errorf("older trail should be fainter")
+	}
+}
+
+func TestTrailsHidden(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	frames := []*Frame{
+		NewFrame(map[string]tabula.Token{"alice": {Coordinate: image.Pt(1, 1), Size: 1, TokenColor: red, Hidden: true}}, nil),
+		NewFrame(map[string]tabula.Token{"alice": {Coordinate: image.Pt(3, 1), Size: 1, TokenColor: red, Hidden: true}}, nil),
+		NewFrame(map[string]tabula.Token{"alice": {Coordinate: image.Pt(3, 4), Size: 1, TokenColor: red}}, nil),
+	}
+
+	// Alice moved while hidden, and then was revealed where she'd moved to; neither move leaves a trail.
+	shown := shownTokens(&tabula.Tabula{}, &testContext{}, frames)
+	for i := range frames {
+		if lines := trails(shown, i); len(lines) != 0 {
+			t.Errorf("frame %d: expected no trail for a hidden token, got %v", i, lines)
+		}
+	}
+
+	// The GM sees her ghost, and so its trail.
+	shown = shownTokens(&tabula.Tabula{GM: true}, &testContext{}, frames)
+	if lines := trails(shown, 1); len(lines) != 4 {
+		t.Errorf("expected the GM to see a hidden token's trail, got %v", lines)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	*cache.CacheDir = t.TempDir()
+	cache.Instance, _ = cache.Open()
+	t.Cleanup(cache.Flush)
+
+	bg := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	draw.Draw(bg, bg.Bounds(), image.White, image.Point{}, draw.Src)
+
+	id := types.TabulaId(1)
+	tab := &tabula.Tabula{
+		Id:         &id,
+		Url:        "test:replay",
+		Background: bg,
+		Dpi:        40,
+	}
+	data, err := Replay(tab, &testContext{}, testFrames())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding replay: %s", err)
+	}
+	if len(anim.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(anim.Image))
+	}
+	if anim.Delay[2] <= anim.Delay[0] {
+		t.Errorf("last frame should linger")
+	}
+}
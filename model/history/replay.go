@@ -0,0 +1,135 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	mbDraw "github.com/pdbogen/mapbot/common/draw"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/types"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+)
+
+// MaxReplayFrames is the most frames a replay will show.
+const MaxReplayFrames = 100
+
+// replaySize is the largest width or height of a replay; GIFs are big, and chat clients shrink them anyway.
+const replaySize = 800
+
+// trailFrames is how many moves back a token's trail is drawn.
+const trailFrames = 3
+
+// frameDelay and lastFrameDelay are how long each frame is shown, in hundredths of a second; the last frame lingers so
+// that the loop's end is clear.
+const frameDelay, lastFrameDelay = 80, 300
+
+// frameContext is a context showing the marks of a recorded frame instead of its current marks.
+type frameContext struct {
+	context.Context
+	marks map[image.Point]map[string]mark.Mark
+}
+
+func (f *frameContext) GetMarks(types.TabulaId) map[image.Point]map[string]mark.Mark {
+	return f.marks
+}
+
+// Replay renders each of `frames` on `tab`, as seen from `ctx`, and animates them as a GIF. Each token that moved
+// leaves a trail, fading over its last few moves.
+func Replay(tab *tabula.Tabula, ctx context.Context, frames []*Frame) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("no frames to replay")
+	}
+
+	shown := shownTokens(tab, ctx, frames)
+	images := []image.Image{}
+	for i, f := range frames {
+		t := *tab
+		t.Tokens = map[types.ContextId]map[string]tabula.Token{ctx.Id(): f.TokenMap()}
+		t.Lines = trails(shown, i)
+		img, err := t.Render(&frameContext{ctx, f.MarkMap()}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("rendering frame %d: %s", i+1, err)
+		}
+		images = append(images, shrink(img, replaySize))
+	}
+
+	palette := mbDraw.Quantize(images, 256)
+	anim := &gif.GIF{}
+	for i, img := range images {
+		p := image.NewPaletted(img.Bounds(), palette)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), img, img.Bounds().Min)
+		anim.Image = append(anim.Image, p)
+		if i == len(images)-1 {
+			anim.Delay = append(anim.Delay, lastFrameDelay)
+		} else {
+			anim.Delay = append(anim.Delay, frameDelay)
+		}
+		if b := img.Bounds(); b.Dx() > anim.Config.Width || b.Dy() > anim.Config.Height {
+			anim.Config.Width, anim.Config.Height = b.Dx(), b.Dy()
+		}
+	}
+	anim.Config.ColorModel = palette
+
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		return nil, fmt.Errorf("encoding gif: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// shownTokens returns the tokens of each of `frames` that `tab` shows in `ctx`.
+func shownTokens(tab *tabula.Tabula, ctx context.Context, frames []*Frame) []map[string]tabula.Token {
+	ret := make([]map[string]tabula.Token, len(frames))
+	for i, f := range frames {
+		t := *tab
+		t.Tokens = map[types.ContextId]map[string]tabula.Token{ctx.Id(): f.TokenMap()}
+		ret[i] = t.ShownTokens(ctx)
+	}
+	return ret
+}
+
+// trails returns the lines tracing each token's moves up to frame `i`, brightest for the latest, given the tokens shown
+// in each frame. Tokens not shown at either end of a move leave no trail.
+func trails(shown []map[string]tabula.Token, i int) []mark.Line {
+	ret := []mark.Line{}
+	for j := i; j > 0 && j > i-trailFrames; j-- {
+		age := i - j
+		c := color.NRGBA{R: 255, A: uint8(255 - age*255/trailFrames)}
+		before, after := shown[j-1], shown[j]
+		names := []string{}
+		for name := range after {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			from, ok := before[name]
+			if !ok || from.Coordinate == after[name].Coordinate {
+				continue
+			}
+			ret = append(ret, from.MoveLines(after[name].Coordinate, c)...)
+		}
+	}
+	return ret
+}
+
+// shrink returns `img` scaled down so that neither side is longer than `size`, or `img` itself if it already fits.
+func shrink(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	longest := b.Dx()
+	if b.Dy() > longest {
+		longest = b.Dy()
+	}
+	if longest <= size {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx()*size/longest, b.Dy()*size/longest))
+	xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
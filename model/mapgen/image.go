@@ -0,0 +1,164 @@
+package mapgen
+
+import (
+	mbRand "github.com/pdbogen/mapbot/common/rand"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+)
+
+type palette struct {
+	rock, floor, ground color.RGBA
+	planks, tiles       bool
+}
+
+var palettes = map[string]palette{
+	"dungeon": {rock: color.RGBA{46, 43, 41, 255}, floor: color.RGBA{176, 168, 150, 255}, ground: color.RGBA{176, 168, 150, 255}, tiles: true},
+	"cave":    {rock: color.RGBA{58, 50, 44, 255}, floor: color.RGBA{150, 128, 98, 255}, ground: color.RGBA{150, 128, 98, 255}},
+	"tavern":  {rock: color.RGBA{92, 64, 40, 255}, floor: color.RGBA{168, 118, 70, 255}, ground: color.RGBA{96, 132, 70, 255}, planks: true},
+}
+
+var (
+	wallColor  = color.RGBA{20, 18, 16, 255}
+	doorColor  = color.RGBA{122, 78, 38, 255}
+	tableColor = color.RGBA{110, 70, 36, 255}
+	barColor   = color.RGBA{86, 52, 26, 255}
+	fireColor  = color.RGBA{226, 110, 34, 255}
+)
+
+// Image draws the layout with `px` pixels per square. The texture noise is seeded from the layout's own seed, so the
+// image is as reproducible as the layout.
+func (l *Layout) Image(px int) *image.RGBA {
+	pal, ok := palettes[l.Kind]
+	if !ok {
+		pal = palettes["dungeon"]
+	}
+	r := mbRand.Seeded(l.Seed + 1)
+
+	img := image.NewRGBA(image.Rect(0, 0, l.Width*px, l.Height*px))
+
+	for y := 0; y < l.Height; y++ {
+		for x := 0; x < l.Width; x++ {
+			sq := image.Rect(x*px, y*px, (x+1)*px, (y+1)*px)
+			switch c := l.At(x, y); c {
+			case Rock:
+				fill(img, sq, pal.rock)
+			case Ground:
+				fill(img, sq, pal.ground)
+			default:
+				fill(img, sq, pal.floor)
+				switch c {
+				case Table:
+					fill(img, sq.Inset(px/8), tableColor)
+				case Bar:
+					fill(img, sq, barColor)
+				case Hearth:
+					fill(img, sq, wallColor)
+					fill(img, sq.Inset(px/6), fireColor)
+				}
+			}
+		}
+	}
+
+	if pal.tiles {
+		l.tiles(img, px, pal)
+	}
+	if pal.planks {
+		l.planks(img, r, px)
+	}
+	noise(img, r, 10)
+
+	thick := px / 10
+	if thick < 2 {
+		thick = 2
+	}
+	for _, w := range l.Walls() {
+		if w.Door {
+			continue
+		}
+		fill(img, segment(w.A.X, w.A.Y, w.B.X, w.B.Y, px, thick), wallColor)
+	}
+	for _, d := range l.Doors {
+		outer := segment(d.A.X, d.A.Y, d.B.X, d.B.Y, px, px/5)
+		fill(img, outer, wallColor)
+		fill(img, outer.Inset(px/20+1), doorColor)
+	}
+
+	return img
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
+}
+
+// segment returns the pixel rectangle covering an axis-aligned wall from (x0,y0) to (x1,y1), in grid units,
+// `thick` pixels across.
+func segment(x0, y0, x1, y1 float64, px, thick int) image.Rectangle {
+	r := image.Rect(int(x0*float64(px)), int(y0*float64(px)), int(x1*float64(px)), int(y1*float64(px))).Canon()
+	half := thick / 2
+	if r.Dx() == 0 {
+		r.Min.X -= half
+		r.Max.X += thick - half
+	}
+	if r.Dy() == 0 {
+		r.Min.Y -= half
+		r.Max.Y += thick - half
+	}
+	return r
+}
+
+// tiles darkens the border of every open square, so dungeon floors read as flagstones.
+func (l *Layout) tiles(img *image.RGBA, px int, pal palette) {
+	line := pal.floor
+	line.R, line.G, line.B = line.R-30, line.G-30, line.B-30
+	for y := 0; y < l.Height; y++ {
+		for x := 0; x < l.Width; x++ {
+			if l.At(x, y) != Floor {
+				continue
+			}
+			fill(img, image.Rect(x*px, y*px, (x+1)*px, y*px+1), line)
+			fill(img, image.Rect(x*px, y*px, x*px+1, (y+1)*px), line)
+		}
+	}
+}
+
+// planks draws floorboards: a seam every third of a square, with staggered butt joints.
+func (l *Layout) planks(img *image.RGBA, r *rand.Rand, px int) {
+	seam := color.RGBA{120, 82, 46, 255}
+	board := px / 3
+	if board < 3 {
+		return
+	}
+	for y := 0; y < l.Height; y++ {
+		for x := 0; x < l.Width; x++ {
+			if l.At(x, y) != Floor {
+				continue
+			}
+			for row := 0; row < 3; row++ {
+				top := y*px + row*board
+				fill(img, image.Rect(x*px, top, (x+1)*px, top+1), seam)
+				if r.Intn(3) == 0 {
+					joint := x*px + r.Intn(px)
+					fill(img, image.Rect(joint, top, joint+1, top+board), seam)
+				}
+			}
+		}
+	}
+}
+
+// noise jitters each pixel's brightness by up to `amount` in either direction.
+func noise(img *image.RGBA, r *rand.Rand, amount int) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		d := r.Intn(2*amount+1) - amount
+		for c := 0; c < 3; c++ {
+			v := int(img.Pix[i+c]) + d
+			if v < 0 {
+				v = 0
+			} else if v > 255 {
+				v = 255
+			}
+			img.Pix[i+c] = uint8(v)
+		}
+	}
+}
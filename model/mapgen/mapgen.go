@@ -0,0 +1,436 @@
+// Package mapgen procedurally generates maps: a layout of squares, a background image drawn from that layout, and the
+// walls that bound it. All randomness comes from a single seed, so the same kind, seed, and size always produce the
+// same map.
+package mapgen
+
+import (
+	"fmt"
+	mbRand "github.com/pdbogen/mapbot/common/rand"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+const (
+	MinSize = 10
+	MaxSize = 100
+)
+
+type Cell uint8
+
+const (
+	Rock Cell = iota
+	Floor
+	Ground
+	Table
+	Bar
+	Hearth
+)
+
+// Open reports whether a creature could stand in the cell; walls are drawn between open and closed cells.
+func (c Cell) Open() bool {
+	return c != Rock
+}
+
+// Layout is a generated map, Width by Height squares.
+type Layout struct {
+	Kind          string
+	Seed          int64
+	Width, Height int
+	Cells         []Cell
+
+	// Doors are wall segments, in grid units, that sit across openings.
+	Doors []wall.Wall
+}
+
+type generator func(r *rand.Rand, size int) *Layout
+
+var generators = map[string]generator{
+	"dungeon": dungeon,
+	"cave":    cave,
+	"tavern":  tavern,
+}
+
+// Kinds lists the names accepted by Generate.
+func Kinds() []string {
+	ret := make([]string, 0, len(generators))
+	for k := range generators {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Generate produces a new layout of the named kind, `size` squares on a side.
+func Generate(kind string, seed int64, size int) (*Layout, error) {
+	gen, ok := generators[strings.ToLower(kind)]
+	if !ok {
+		return nil, fmt.Errorf("I don't know how to generate a %q; try one of %s", kind, strings.Join(Kinds(), ", "))
+	}
+	if size < MinSize || size > MaxSize {
+		return nil, fmt.Errorf("size must be between %d and %d squares, not %d", MinSize, MaxSize, size)
+	}
+
+	l := gen(mbRand.Seeded(seed), size)
+	l.Kind = strings.ToLower(kind)
+	l.Seed = seed
+	return l, nil
+}
+
+func newLayout(w, h int, fill Cell) *Layout {
+	l := &Layout{Width: w, Height: h, Cells: make([]Cell, w*h), Doors: []wall.Wall{}}
+	for i := range l.Cells {
+		l.Cells[i] = fill
+	}
+	return l
+}
+
+// At returns the cell at (x,y); everything outside the layout is Rock.
+func (l *Layout) At(x, y int) Cell {
+	if x < 0 || y < 0 || x >= l.Width || y >= l.Height {
+		return Rock
+	}
+	return l.Cells[y*l.Width+x]
+}
+
+func (l *Layout) Set(x, y int, c Cell) {
+	if x < 0 || y < 0 || x >= l.Width || y >= l.Height {
+		return
+	}
+	l.Cells[y*l.Width+x] = c
+}
+
+func (l *Layout) fill(r image.Rectangle, c Cell) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			l.Set(x, y, c)
+		}
+	}
+}
+
+// Walls returns every boundary between open and closed cells, with collinear neighbors merged into a single segment,
+// followed by the layout's doors.
+func (l *Layout) Walls() []wall.Wall {
+	ret := []wall.Wall{}
+
+	// Horizontal edges lie along y; the edge at (x,y) separates (x,y-1) from (x,y).
+	for y := 0; y <= l.Height; y++ {
+		start := -1
+		for x := 0; x <= l.Width; x++ {
+			edge := x < l.Width && l.At(x, y-1).Open() != l.At(x, y).Open()
+			if edge && start < 0 {
+				start = x
+			}
+			if !edge && start >= 0 {
+				ret = append(ret, wall.Wall{A: wall.Point{X: float64(start), Y: float64(y)}, B: wall.Point{X: float64(x), Y: float64(y)}})
+				start = -1
+			}
+		}
+	}
+
+	// Vertical edges lie along x; the edge at (x,y) separates (x-1,y) from (x,y).
+	for x := 0; x <= l.Width; x++ {
+		start := -1
+		for y := 0; y <= l.Height; y++ {
+			edge := y < l.Height && l.At(x-1, y).Open() != l.At(x, y).Open()
+			if edge && start < 0 {
+				start = y
+			}
+			if !edge && start >= 0 {
+				ret = append(ret, wall.Wall{A: wall.Point{X: float64(x), Y: float64(start)}, B: wall.Point{X: float64(x), Y: float64(y)}})
+				start = -1
+			}
+		}
+	}
+
+	return append(ret, l.Doors...)
+}
+
+// door records a closed door along the edge on the given side of square (x,y).
+func (l *Layout) door(x, y int, side string) {
+	fx, fy := float64(x), float64(y)
+	var d wall.Wall
+	switch side {
+	case "n":
+		d = wall.Wall{A: wall.Point{X: fx, Y: fy}, B: wall.Point{X: fx + 1, Y: fy}}
+	case "s":
+		d = wall.Wall{A: wall.Point{X: fx, Y: fy + 1}, B: wall.Point{X: fx + 1, Y: fy + 1}}
+	case "w":
+		d = wall.Wall{A: wall.Point{X: fx, Y: fy}, B: wall.Point{X: fx, Y: fy + 1}}
+	case "e":
+		d = wall.Wall{A: wall.Point{X: fx + 1, Y: fy}, B: wall.Point{X: fx + 1, Y: fy + 1}}
+	}
+	d.Door = true
+	l.Doors = append(l.Doors, d)
+}
+
+func center(r image.Rectangle) image.Point {
+	return image.Pt((r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2)
+}
+
+// dungeon scatters non-overlapping rectangular rooms and joins each to the next with an L-shaped corridor. Corridors
+// that enter a room through a one-square gap may get a door.
+func dungeon(r *rand.Rand, size int) *Layout {
+	l := newLayout(size, size, Rock)
+
+	maxRoom := size / 4
+	if maxRoom < 4 {
+		maxRoom = 4
+	}
+
+	rooms := []image.Rectangle{}
+place:
+	for attempt := 0; attempt < size*size/8; attempt++ {
+		w := 3 + r.Intn(maxRoom-2)
+		h := 3 + r.Intn(maxRoom-2)
+		if w > size-2 || h > size-2 {
+			continue
+		}
+		x := 1 + r.Intn(size-w-1)
+		y := 1 + r.Intn(size-h-1)
+		room := image.Rect(x, y, x+w, y+h)
+		for _, other := range rooms {
+			if room.Inset(-2).Overlaps(other) {
+				continue place
+			}
+		}
+		rooms = append(rooms, room)
+	}
+
+	for _, room := range rooms {
+		l.fill(room, Floor)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		ci, cj := center(rooms[i]), center(rooms[j])
+		return ci.X+ci.Y < cj.X+cj.Y
+	})
+
+	for i := 1; i < len(rooms); i++ {
+		a, b := center(rooms[i-1]), center(rooms[i])
+		if r.Intn(2) == 0 {
+			l.hline(a.X, b.X, a.Y)
+			l.vline(a.Y, b.Y, b.X)
+		} else {
+			l.vline(a.Y, b.Y, a.X)
+			l.hline(a.X, b.X, b.Y)
+		}
+	}
+
+	for _, room := range rooms {
+		l.doorsAround(r, room, rooms)
+	}
+
+	return l
+}
+
+func (l *Layout) hline(x0, x1, y int) {
+	if x0 > x1 {
+		x0, x1 = x1, x0
+	}
+	for x := x0; x <= x1; x++ {
+		l.Set(x, y, Floor)
+	}
+}
+
+func (l *Layout) vline(y0, y1, x int) {
+	if y0 > y1 {
+		y0, y1 = y1, y0
+	}
+	for y := y0; y <= y1; y++ {
+		l.Set(x, y, Floor)
+	}
+}
+
+// doorsAround looks at the ring of squares just outside `room`; a corridor square flanked by rock on both sides is a
+// one-square opening, and gets a door half the time.
+func (l *Layout) doorsAround(r *rand.Rand, room image.Rectangle, rooms []image.Rectangle) {
+	inRoom := func(x, y int) bool {
+		for _, other := range rooms {
+			if image.Pt(x, y).In(other) {
+				return true
+			}
+		}
+		return false
+	}
+
+	candidate := func(x, y, fx, fy int) bool {
+		return l.At(x, y) == Floor && !inRoom(x, y) &&
+			!l.At(x-fx, y-fy).Open() && !l.At(x+fx, y+fy).Open()
+	}
+
+	for x := room.Min.X; x < room.Max.X; x++ {
+		if candidate(x, room.Min.Y-1, 1, 0) && r.Intn(2) == 0 {
+			l.door(x, room.Min.Y, "n")
+		}
+		if candidate(x, room.Max.Y, 1, 0) && r.Intn(2) == 0 {
+			l.door(x, room.Max.Y-1, "s")
+		}
+	}
+	for y := room.Min.Y; y < room.Max.Y; y++ {
+		if candidate(room.Min.X-1, y, 0, 1) && r.Intn(2) == 0 {
+			l.door(room.Min.X, y, "w")
+		}
+		if candidate(room.Max.X, y, 0, 1) && r.Intn(2) == 0 {
+			l.door(room.Max.X-1, y, "e")
+		}
+	}
+}
+
+// cave fills the map with noise and smooths it with a cellular automaton: a square becomes rock when five or more of
+// the nine squares around it (itself included) are rock. Only the largest connected open area is kept.
+func cave(r *rand.Rand, size int) *Layout {
+	l := newLayout(size, size, Rock)
+	for y := 1; y < size-1; y++ {
+		for x := 1; x < size-1; x++ {
+			if r.Float64() >= 0.45 {
+				l.Set(x, y, Floor)
+			}
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		next := newLayout(size, size, Rock)
+		for y := 1; y < size-1; y++ {
+			for x := 1; x < size-1; x++ {
+				rock := 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						if !l.At(x+dx, y+dy).Open() {
+							rock++
+						}
+					}
+				}
+				if rock < 5 {
+					next.Set(x, y, Floor)
+				}
+			}
+		}
+		l = next
+	}
+
+	l.keepLargestRegion()
+	return l
+}
+
+// keepLargestRegion turns every open square that is not connected to the largest open region into rock. If nothing
+// is open at all, a small chamber is carved in the middle so there is somewhere to stand.
+func (l *Layout) keepLargestRegion() {
+	region := make([]int, len(l.Cells))
+	sizes := []int{0}
+	for start := range l.Cells {
+		if region[start] != 0 || !l.Cells[start].Open() {
+			continue
+		}
+		id := len(sizes)
+		sizes = append(sizes, 0)
+		stack := []int{start}
+		region[start] = id
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			sizes[id]++
+			x, y := i%l.Width, i/l.Width
+			for _, d := range []image.Point{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+				nx, ny := x+d.X, y+d.Y
+				if !l.At(nx, ny).Open() {
+					continue
+				}
+				n := ny*l.Width + nx
+				if region[n] == 0 {
+					region[n] = id
+					stack = append(stack, n)
+				}
+			}
+		}
+	}
+
+	largest := 0
+	for id, n := range sizes {
+		if n > sizes[largest] {
+			largest = id
+		}
+	}
+
+	if largest == 0 {
+		c := l.Width / 2
+		l.fill(image.Rect(c-2, c-2, c+2, c+2), Floor)
+		return
+	}
+
+	for i := range l.Cells {
+		if l.Cells[i].Open() && region[i] != largest {
+			l.Cells[i] = Rock
+		}
+	}
+}
+
+// tavern builds a single hall with a kitchen behind a partition, a bar along the partition, a hearth on the west
+// wall, tables scattered across the common room, and a front door facing south onto open ground.
+func tavern(r *rand.Rand, size int) *Layout {
+	l := newLayout(size, size, Ground)
+
+	margin := 1 + r.Intn(size/10+1)
+	building := image.Rect(margin, margin, size-margin, size-margin)
+	l.fill(building, Rock)
+	hall := building.Inset(1)
+	l.fill(hall, Floor)
+
+	// Kitchen along the east side, behind a partition with a single doorway.
+	partition := hall.Max.X - hall.Dx()/4 - 1
+	for y := hall.Min.Y; y < hall.Max.Y; y++ {
+		l.Set(partition, y, Rock)
+	}
+	kitchenDoor := hall.Min.Y + hall.Dy()/2 + r.Intn(hall.Dy()/4+1)
+	if kitchenDoor >= hall.Max.Y {
+		kitchenDoor = hall.Max.Y - 1
+	}
+	l.Set(partition, kitchenDoor, Floor)
+	l.door(partition, kitchenDoor, "w")
+
+	// The bar runs along the front of the partition, leaving the kitchen doorway clear.
+	for y := hall.Min.Y + 1; y < kitchenDoor-1; y++ {
+		l.Set(partition-2, y, Bar)
+	}
+
+	// Hearth on the west wall.
+	hearth := hall.Min.Y + r.Intn(hall.Dy()/2+1)
+	l.Set(hall.Min.X, hearth, Hearth)
+	l.Set(hall.Min.X, hearth+1, Hearth)
+
+	// Front door in the south wall of the common room.
+	lo, hi := hall.Min.X+1, partition-1
+	if hi <= lo {
+		hi = lo + 1
+	}
+	front := lo + r.Intn(hi-lo)
+	l.Set(front, building.Max.Y-1, Floor)
+	l.door(front, building.Max.Y-1, "s")
+
+	// Tables, each with a clear square all the way around.
+	common := image.Rect(hall.Min.X+2, hall.Min.Y+1, partition-3, hall.Max.Y-2)
+	for attempt := 0; attempt < size*2; attempt++ {
+		if common.Dx() < 2 || common.Dy() < 2 {
+			break
+		}
+		w := 1 + r.Intn(2)
+		x := common.Min.X + r.Intn(common.Dx()-w+1)
+		y := common.Min.Y + r.Intn(common.Dy())
+		table := image.Rect(x, y, x+w, y+1)
+		clear := true
+		for cy := table.Min.Y - 1; cy <= table.Max.Y; cy++ {
+			for cx := table.Min.X - 1; cx <= table.Max.X; cx++ {
+				if l.At(cx, cy) != Floor || (cx == front && cy >= building.Max.Y-2) {
+					clear = false
+				}
+			}
+		}
+		if clear {
+			l.fill(table, Table)
+		}
+	}
+
+	return l
+}
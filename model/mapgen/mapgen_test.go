@@ -0,0 +1,105 @@
+package mapgen
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestGenerateReproducible(t *testing.T) {
+	for _, kind := range Kinds() {
+		a, err := Generate(kind, 42, 30)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", kind, err)
+		}
+		b, err := Generate(kind, 42, 30)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", kind, err)
+		}
+		if !bytes.Equal(cellBytes(a), cellBytes(b)) {
+			t.Fatalf("%s: two layouts from seed 42 differed", kind)
+		}
+		if !bytes.Equal(a.Image(8).Pix, b.Image(8).Pix) {
+			t.Fatalf("%s: two images from seed 42 differed", kind)
+		}
+
+		c, _ := Generate(kind, 43, 30)
+		if bytes.Equal(cellBytes(a), cellBytes(c)) {
+			t.Fatalf("%s: layouts from seeds 42 and 43 were identical", kind)
+		}
+	}
+}
+
+func TestGenerateRejects(t *testing.T) {
+	if _, err := Generate("castle", 1, 30); err == nil {
+		t.Fatal("expected error for unknown kind")
+	}
+	if _, err := Generate("cave", 1, MinSize-1); err == nil {
+		t.Fatal("expected error for undersized map")
+	}
+	if _, err := Generate("cave", 1, MaxSize+1); err == nil {
+		t.Fatal("expected error for oversized map")
+	}
+}
+
+func TestCaveConnected(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		l, _ := Generate("cave", seed, 40)
+		regions := 0
+		seen := map[image.Point]bool{}
+		for y := 0; y < l.Height; y++ {
+			for x := 0; x < l.Width; x++ {
+				if !l.At(x, y).Open() || seen[image.Pt(x, y)] {
+					continue
+				}
+				regions++
+				stack := []image.Point{{x, y}}
+				seen[image.Pt(x, y)] = true
+				for len(stack) > 0 {
+					p := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					for _, d := range []image.Point{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+						n := p.Add(d)
+						if l.At(n.X, n.Y).Open() && !seen[n] {
+							seen[n] = true
+							stack = append(stack, n)
+						}
+					}
+				}
+			}
+		}
+		if regions != 1 {
+			t.Fatalf("seed %d: expected one open region, found %d", seed, regions)
+		}
+	}
+}
+
+func TestWalls(t *testing.T) {
+	l := newLayout(4, 4, Rock)
+	l.fill(image.Rect(1, 1, 3, 3), Floor)
+	l.door(1, 1, "n")
+
+	walls := l.Walls()
+	if len(walls) != 5 {
+		t.Fatalf("expected four walls around a 2x2 room plus one door, got %d: %v", len(walls), walls)
+	}
+	for _, w := range walls[:4] {
+		if w.Length() != 2 {
+			t.Fatalf("expected merged walls of length 2, got %v-%v", w.A, w.B)
+		}
+		if w.Door {
+			t.Fatalf("wall %v-%v should not be a door", w.A, w.B)
+		}
+	}
+	if !walls[4].Door || walls[4].Length() != 1 {
+		t.Fatalf("expected a door of length 1 last, got %+v", walls[4])
+	}
+}
+
+func cellBytes(l *Layout) []byte {
+	ret := make([]byte, len(l.Cells))
+	for i, c := range l.Cells {
+		ret[i] = byte(c)
+	}
+	return ret
+}
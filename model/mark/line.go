@@ -16,3 +16,28 @@ func (l Line) WithColor(c color.Color) Line {
 	ret.Color = c
 	return ret
 }
+
+// Corners are the corners of a square, clockwise from the north-east.
+var Corners = []string{"ne", "se", "sw", "nw"}
+
+// CornerLines returns a line from corner `ca` of the square `a` to corner `cb` of the square `b`. An empty corner
+// stands for all of the square's corners, so that `a` and `b` alone give every line from a corner of one to a corner
+// of the other.
+func CornerLines(a image.Point, ca string, b image.Point, cb string) []Line {
+	cornersA := []string{ca}
+	if ca == "" {
+		cornersA = Corners
+	}
+	cornersB := []string{cb}
+	if cb == "" {
+		cornersB = Corners
+	}
+
+	out := []Line{}
+	for _, cA := range cornersA {
+		for _, cB := range cornersB {
+			out = append(out, Line{A: a, CA: cA, B: b, CB: cB})
+		}
+	}
+	return out
+}
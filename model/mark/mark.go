@@ -22,11 +22,11 @@ func (m Mark) WithColor(c color.Color) (ret Mark) {
 	return ret
 }
 
-func Circle(args []string) (out []Mark, err error) {
+func Circle(n conv.Notation, args []string) (out []Mark, err error) {
 	if len(args) != 2 {
 		return nil, fmt.Errorf("`circle()` expects two comma-separated arguments")
 	}
-	center, dir, err := conv.RCToPoint(args[0], true)
+	center, dir, err := n.Parse(args[0], true)
 	if err != nil {
 		return nil, fmt.Errorf("looked like a circle, but could not parse coordinate `%s`: %s", args[0], err)
 	}
@@ -2,6 +2,7 @@ package mark
 
 import (
 	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
 	"image"
 	"strings"
 	"testing"
@@ -80,7 +81,7 @@ func TestCircle(t *testing.T) {
 
 	for _, test := range tests {
 		args := strings.Split(strings.TrimRight(strings.Split(test.input, "(")[1], ")"), ",")
-		res, err := Circle(args)
+		res, err := Circle(conv.Notation{}, args)
 		if err != nil {
 			t.Fatalf("%q: expected non-nil err, produced %q", test.input, err)
 		}
@@ -107,3 +108,19 @@ func TestCircle(t *testing.T) {
 		fmt.Printf("%q: correctly produced the expected %d marks\n", test.input, len(res))
 	}
 }
+
+func TestCornerLines(t *testing.T) {
+	a, b := image.Pt(0, 0), image.Pt(3, 1)
+	if lines := CornerLines(a, "", b, ""); len(lines) != 16 {
+		t.Errorf("expected 16 lines between every corner of two squares, got %d", len(lines))
+	}
+	lines := CornerLines(a, "se", b, "")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines from one corner, got %d", len(lines))
+	}
+	for i, l := range lines {
+		if l.A != a || l.CA != "se" || l.B != b || l.CB != Corners[i] {
+			t.Errorf("line %d: expected from %v se to %v %s, got %+v", i, a, b, Corners[i], l)
+		}
+	}
+}
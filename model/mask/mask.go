@@ -49,7 +49,7 @@ func (m *Mask) Save(db anydb.AnyDb, id int64) error {
 
 	if err != nil && tx != nil {
 		if rbErr := tx.Rollback(); rbErr != nil {
-			err = fmt.Errorf("%v and during rollback: %v", rbErr)
+			err = fmt.Errorf("%v and during rollback: %v", err, rbErr)
 		}
 	}
 
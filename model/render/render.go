@@ -0,0 +1,173 @@
+// Package render schedules map renders, so that a burst of changes in one context produces one image rather than one
+// image per change.
+package render
+
+import (
+	"flag"
+	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/types"
+	"image"
+	"sync"
+	"time"
+)
+
+var log = mbLog.Log
+
+var Window = flag.Duration("render-window", 250*time.Millisecond, "how long to wait for further changes to a map before rendering it")
+
+// maxCancels is the number of times in a row a context's render may be cancelled in favor of a newer one; after that,
+// the running render is allowed to finish, so that a steady stream of changes can't prevent any image at all.
+const maxCancels = 3
+
+// Default is the scheduler used by the UIs.
+var Default = &Scheduler{}
+
+// Scheduler coalesces renders by context. Requests that arrive within a short window are rendered once, with the
+// newest map state, and the result is shared between them. A request that arrives while a render for its context is
+// already running cancels that render, and its requesters wait for the new one instead.
+type Scheduler struct {
+	// Window is how long to wait for more requests before starting a render; if zero, the -render-window flag is used.
+	Window time.Duration
+
+	mu       sync.Mutex
+	contexts map[types.ContextId]*contextState
+
+	// renderFn is what actually renders; if nil, Tabula.RenderCancellable.
+	renderFn func(t *tabula.Tabula, ctx context.Context, status func(string), cancel <-chan struct{}) (image.Image, error)
+}
+
+type contextState struct {
+	seq     uint64
+	pending *job
+	running *job
+}
+
+type job struct {
+	tab    *tabula.Tabula
+	ctx    context.Context
+	status func(string)
+
+	// last is the sequence number of the newest request to join this job that will post its image, or zero if none has.
+	last uint64
+
+	// next is the job for the requests that arrived while this one was running.
+	next *job
+
+	// cancels counts how many renders in a row, ending with this one's predecessor, were cancelled in favor of their
+	// successor.
+	cancels int
+	cancel  chan struct{}
+
+	done chan struct{}
+	img  image.Image
+	err  error
+}
+
+// Render renders `t` as seen in `ctx`, coalescing with other requests for the same context. If `superseded` is true,
+// a newer request for the context arrived before the image was ready, and the image returned may be the one made for
+// that request; a caller that posts the image somewhere can leave that to the newer request.
+func (s *Scheduler) Render(ctx context.Context, t *tabula.Tabula, status func(string)) (img image.Image, superseded bool, err error) {
+	return s.render(ctx, t, status, true)
+}
+
+// Share is Render for a caller that only hands the image back to whoever asked for it, like the web UI. It coalesces
+// with other requests just the same, but never counts as a newer request, so it can't leave a poster without an image
+// to post.
+func (s *Scheduler) Share(ctx context.Context, t *tabula.Tabula, status func(string)) (image.Image, error) {
+	img, _, err := s.render(ctx, t, status, false)
+	return img, err
+}
+
+func (s *Scheduler) render(ctx context.Context, t *tabula.Tabula, status func(string), posts bool) (img image.Image, superseded bool, err error) {
+	s.mu.Lock()
+	if s.contexts == nil {
+		s.contexts = map[types.ContextId]*contextState{}
+	}
+	id := ctx.Id()
+	st, ok := s.contexts[id]
+	if !ok {
+		st = &contextState{}
+		s.contexts[id] = st
+	}
+	st.seq++
+	mine := st.seq
+
+	j := st.pending
+	if j == nil {
+		j = &job{cancel: make(chan struct{}), done: make(chan struct{})}
+		st.pending = j
+		if r := st.running; r != nil && r.next == nil {
+			r.next = j
+			if r.cancels < maxCancels {
+				log.Debugf("context %s: cancelling superseded render", id)
+				j.cancels = r.cancels + 1
+				close(r.cancel)
+			}
+		}
+		go s.run(id, j)
+	}
+	j.tab, j.ctx, j.status = t, ctx, status
+	if posts {
+		j.last = mine
+	}
+	s.mu.Unlock()
+
+	for {
+		<-j.done
+		s.mu.Lock()
+		next := j.next
+		if j.err == tabula.ErrCancelled && next != nil {
+			s.mu.Unlock()
+			j = next
+			continue
+		}
+		superseded = j.last > mine
+		for ; next != nil && !superseded; next = next.next {
+			superseded = next.last > mine
+		}
+		s.mu.Unlock()
+		return j.img, superseded, j.err
+	}
+}
+
+func (s *Scheduler) window() time.Duration {
+	if s.Window != 0 {
+		return s.Window
+	}
+	return *Window
+}
+
+func (s *Scheduler) run(id types.ContextId, j *job) {
+	time.Sleep(s.window())
+
+	// Renders for a context run one at a time; by now, a running render has usually noticed it was cancelled.
+	s.mu.Lock()
+	st := s.contexts[id]
+	for st.running != nil {
+		prev := st.running
+		s.mu.Unlock()
+		<-prev.done
+		s.mu.Lock()
+	}
+	st.pending = nil
+	st.running = j
+	t, ctx, status := j.tab, j.ctx, j.status
+	s.mu.Unlock()
+
+	renderFn := s.renderFn
+	if renderFn == nil {
+		renderFn = (*tabula.Tabula).RenderCancellable
+	}
+	img, err := renderFn(t, ctx, status, j.cancel)
+
+	s.mu.Lock()
+	j.img, j.err = img, err
+	st.running = nil
+	if st.pending == nil {
+		delete(s.contexts, id)
+	}
+	close(j.done)
+	s.mu.Unlock()
+}
@@ -0,0 +1,166 @@
+package render
+
+import (
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/context/databaseContext"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/types"
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRenderer "renders" a map as an image whose width is the map's DPI, taking `delay` to do it.
+type fakeRenderer struct {
+	delay time.Duration
+
+	mu        sync.Mutex
+	rendered  []float32
+	cancelled int
+}
+
+func (f *fakeRenderer) render(t *tabula.Tabula, ctx context.Context, status func(string), cancel <-chan struct{}) (image.Image, error) {
+	select {
+	case <-time.After(f.delay):
+	case <-cancel:
+		f.mu.Lock()
+		f.cancelled++
+		f.mu.Unlock()
+		return nil, tabula.ErrCancelled
+	}
+	f.mu.Lock()
+	f.rendered = append(f.rendered, t.Dpi)
+	f.mu.Unlock()
+	return image.NewRGBA(image.Rect(0, 0, int(t.Dpi), 1)), nil
+}
+
+type result struct {
+	width      int
+	superseded bool
+	err        error
+}
+
+// request starts a render of a map with the given DPI, returning a channel for its result.
+func request(s *Scheduler, ctx context.Context, dpi float32) <-chan result {
+	ret := make(chan result, 1)
+	go func() {
+		img, superseded, err := s.Render(ctx, &tabula.Tabula{Dpi: dpi}, nil)
+		r := result{superseded: superseded, err: err}
+		if img != nil {
+			r.width = img.Bounds().Dx()
+		}
+		ret <- r
+	}()
+	return ret
+}
+
+// share is request, for a caller that doesn't post the image.
+func share(s *Scheduler, ctx context.Context, dpi float32) <-chan result {
+	ret := make(chan result, 1)
+	go func() {
+		img, err := s.Share(ctx, &tabula.Tabula{Dpi: dpi}, nil)
+		r := result{err: err}
+		if img != nil {
+			r.width = img.Bounds().Dx()
+		}
+		ret <- r
+	}()
+	return ret
+}
+
+func ctx(id string) context.Context {
+	return &databaseContext.DatabaseContext{ContextId: types.ContextId(id)}
+}
+
+func TestCoalesce(t *testing.T) {
+	f := &fakeRenderer{}
+	s := &Scheduler{Window: 50 * time.Millisecond, renderFn: f.render}
+
+	first := request(s, ctx("a"), 1)
+	time.Sleep(10 * time.Millisecond)
+	second := request(s, ctx("a"), 2)
+	other := request(s, ctx("b"), 3)
+
+	r1, r2, r3 := <-first, <-second, <-other
+	if r1.width != 2 || !r1.superseded {
+		t.Errorf("expected first request to share the newer image and be superseded, got %+v", r1)
+	}
+	if r2.width != 2 || r2.superseded {
+		t.Errorf("expected second request to get its image, got %+v", r2)
+	}
+	if r3.width != 3 || r3.superseded {
+		t.Errorf("expected other context to render separately, got %+v", r3)
+	}
+	if len(f.rendered) != 2 {
+		t.Errorf("expected two renders, got %v", f.rendered)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	f := &fakeRenderer{delay: 200 * time.Millisecond}
+	s := &Scheduler{Window: 10 * time.Millisecond, renderFn: f.render}
+
+	first := request(s, ctx("a"), 1)
+	time.Sleep(50 * time.Millisecond)
+	second := request(s, ctx("a"), 2)
+
+	r1, r2 := <-first, <-second
+	if r1.width != 2 || !r1.superseded || r1.err != nil {
+		t.Errorf("expected cancelled request to receive newer image, got %+v", r1)
+	}
+	if r2.width != 2 || r2.superseded || r2.err != nil {
+		t.Errorf("expected newer request to get its image, got %+v", r2)
+	}
+	if f.cancelled != 1 || len(f.rendered) != 1 {
+		t.Errorf("expected one cancelled and one finished render, got %d and %v", f.cancelled, f.rendered)
+	}
+}
+
+func TestShare(t *testing.T) {
+	f := &fakeRenderer{delay: 100 * time.Millisecond}
+	s := &Scheduler{Window: 30 * time.Millisecond, renderFn: f.render}
+
+	// Joining the poster's pending render, and cancelling its running render, both leave the poster to post the image.
+	poster := request(s, ctx("a"), 1)
+	time.Sleep(10 * time.Millisecond)
+	joined := share(s, ctx("a"), 2)
+	time.Sleep(60 * time.Millisecond)
+	newer := share(s, ctx("a"), 3)
+
+	r, j, n := <-poster, <-joined, <-newer
+	if r.width != 3 || r.superseded || r.err != nil {
+		t.Errorf("expected poster to get the newest image and not be superseded, got %+v", r)
+	}
+	if j.width != 3 || n.width != 3 {
+		t.Errorf("expected shared requests to get the newest image, got %+v and %+v", j, n)
+	}
+
+	// A poster that joins after a sharer still supersedes an earlier poster.
+	first := request(s, ctx("a"), 4)
+	time.Sleep(10 * time.Millisecond)
+	share(s, ctx("a"), 5)
+	second := request(s, ctx("a"), 6)
+	if r1, r2 := <-first, <-second; !r1.superseded || r2.superseded {
+		t.Errorf("expected only the earlier poster to be superseded, got %+v and %+v", r1, r2)
+	}
+}
+
+func TestCancelLimit(t *testing.T) {
+	f := &fakeRenderer{delay: 100 * time.Millisecond}
+	s := &Scheduler{Window: time.Millisecond, renderFn: f.render}
+
+	results := []<-chan result{}
+	for i := 1; i <= maxCancels+2; i++ {
+		results = append(results, request(s, ctx("a"), float32(i)))
+		time.Sleep(30 * time.Millisecond)
+	}
+	for _, r := range results {
+		<-r
+	}
+
+	// The first maxCancels renders are cancelled; the next is allowed to finish; and then the last.
+	if f.cancelled != maxCancels || len(f.rendered) != 2 {
+		t.Errorf("expected %d cancelled and 2 finished renders, got %d and %v", maxCancels, f.cancelled, f.rendered)
+	}
+}
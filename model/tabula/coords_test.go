@@ -0,0 +1,54 @@
+package tabula
+
+import (
+	"github.com/pdbogen/mapbot/common/conv"
+	"image"
+	"testing"
+)
+
+func TestCoordinateLabels(t *testing.T) {
+	labels := coordinateLabels(conv.Notation{Style: conv.Numeric}, 2, 0, 2, 2)
+	want := []string{"3", "4", "1", "2"}
+	if len(labels) != len(want) {
+		t.Fatalf("expected %d labels, got %d", len(want), len(labels))
+	}
+	for i, l := range labels {
+		if l.text != want[i] {
+			t.Errorf("label %d was %q, not %q", i, l.text, want[i])
+		}
+	}
+
+	edges := edgeLabels(conv.Notation{}, 0, 0, 3, 2, 3, 2, 0.5)
+	if len(edges) != 2*3+2*2 {
+		t.Fatalf("expected labels on all four edges, got %d", len(edges))
+	}
+	for _, l := range edges {
+		inside := l.x >= 0 && l.x+l.width <= 3 && l.y >= 0 && l.y+l.height <= 2
+		if inside {
+			t.Errorf("edge label %q at (%g,%g) covers the map", l.text, l.x, l.y)
+		}
+	}
+}
+
+func TestAddCoordinates(t *testing.T) {
+	tab := &Tabula{Dpi: 50}
+	img := image.NewRGBA(image.Rect(0, 0, 500, 300))
+
+	if out := tab.addCoordinates(img, conv.Options{Labels: conv.Hidden}, 0, 0, image.Point{}); out.Bounds() != img.Bounds() {
+		t.Errorf("hidden labels changed the bounds to %v", out.Bounds())
+	}
+	for _, px := range img.Pix {
+		if px != 0 {
+			t.Fatal("hidden labels drew on the map")
+		}
+	}
+
+	out := tab.addCoordinates(img, conv.Options{Labels: conv.Edges, Font: "mono"}, 0, 0, image.Point{})
+	if want := image.Rect(0, 0, 550, 350); out.Bounds() != want {
+		t.Errorf("expected edge labels to add a margin, for %v, but got %v", want, out.Bounds())
+	}
+	// The map itself is untouched, inside the margin.
+	if _, _, _, a := out.At(25+100, 25+100).RGBA(); a != 0 {
+		t.Errorf("expected the map to be copied into the margin untouched")
+	}
+}
@@ -0,0 +1,131 @@
+package tabula
+
+import (
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+)
+
+// Cover is how well hidden a target is from an attacker, behind walls and other tokens.
+type Cover int
+
+const (
+	NoCover Cover = iota
+	PartialCover
+	FullCover
+	TotalCover
+)
+
+func (c Cover) String() string {
+	switch c {
+	case PartialCover:
+		return "partial"
+	case FullCover:
+		return "cover"
+	case TotalCover:
+		return "total"
+	}
+	return "none"
+}
+
+// CoverLine is one of the lines tested for cover, and whether something is in its way.
+type CoverLine struct {
+	mark.Line
+	Blocked bool
+}
+
+// CoverFrom works out the cover `target` has from `attacker` by the corner-to-corner rule. From each corner of the
+// attacker's squares, a line is drawn to each corner of the target's space; a line is blocked if it crosses or runs
+// along one of `walls`, or passes through a square of one of `others`. The corner with the fewest lines blocked is the
+// attacker's best, and its lines are returned. If none are blocked, the target has no cover; if fewer than half are,
+// partial cover; if all of them are, total cover; and otherwise, cover.
+func CoverFrom(attacker, target Token, others []Token, walls []wall.Wall) (Cover, []CoverLine) {
+	size := target.Size
+	if size < 1 {
+		size = 1
+	}
+	far := size - 1
+	targetCorners := []struct {
+		square image.Point
+		corner string
+	}{
+		{target.Coordinate.Add(image.Pt(far, 0)), "ne"},
+		{target.Coordinate.Add(image.Pt(far, far)), "se"},
+		{target.Coordinate.Add(image.Pt(0, far)), "sw"},
+		{target.Coordinate, "nw"},
+	}
+
+	var best []CoverLine
+	bestBlocked := -1
+	seen := map[image.Point]bool{}
+	for _, sq := range attacker.squares() {
+		for _, c := range mark.Corners {
+			from, _ := lineEnds(mark.Line{A: sq, CA: c})
+			if seen[from] {
+				continue
+			}
+			seen[from] = true
+
+			lines := []CoverLine{}
+			blocked := 0
+			for _, tc := range targetCorners {
+				for _, l := range mark.CornerLines(sq, c, tc.square, tc.corner) {
+					cl := CoverLine{Line: l, Blocked: lineBlocked(l, others, walls)}
+					if cl.Blocked {
+						blocked++
+					}
+					lines = append(lines, cl)
+				}
+			}
+			if bestBlocked < 0 || blocked < bestBlocked {
+				best, bestBlocked = lines, blocked
+			}
+		}
+	}
+
+	switch {
+	case bestBlocked == 0:
+		return NoCover, best
+	case bestBlocked == len(best):
+		return TotalCover, best
+	case 2*bestBlocked < len(best):
+		return PartialCover, best
+	}
+	return FullCover, best
+}
+
+// lineBlocked reports whether the line `l` crosses or runs along one of `walls`, not counting its ends, or passes
+// through a square of one of `tokens`, rather than just along its edge or past its corner.
+func lineBlocked(l mark.Line, tokens []Token, walls []wall.Wall) bool {
+	from, to := lineEnds(l)
+	a := [2]float64{float64(from.X), float64(from.Y)}
+	b := [2]float64{float64(to.X), float64(to.Y)}
+
+	// A wall the line only starts or ends on, like one the target stands against, isn't in the way.
+	const trim = 1e-6
+	at := func(f float64) wall.Point {
+		return wall.Point{X: a[0] + f*(b[0]-a[0]), Y: a[1] + f*(b[1]-a[1])}
+	}
+	for _, w := range walls {
+		if w.Blocks() && w.Crosses(at(trim), at(1-trim)) {
+			return true
+		}
+	}
+
+	for _, tok := range tokens {
+		for _, sq := range tok.squares() {
+			min := [2]float64{float64(sq.X), float64(sq.Y)}
+			max := [2]float64{min[0] + 1, min[1] + 1}
+			in, out, ok := clip(a, b, min, max)
+			if !ok {
+				continue
+			}
+			// A line through the square has the middle of the part of it inside the square off the square's edges.
+			mid := snap([2]float64{(in[0] + out[0]) / 2, (in[1] + out[1]) / 2}, min, max)
+			if mid[0] > min[0] && mid[0] < max[0] && mid[1] > min[1] && mid[1] < max[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package tabula
+
+import (
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"testing"
+)
+
+func TestCoverFrom(t *testing.T) {
+	archer := Token{Coordinate: image.Pt(0, 0)}
+	goblin := Token{Coordinate: image.Pt(4, 0)}
+	type test struct {
+		name   string
+		others []Token
+		walls  []wall.Wall
+		cover  Cover
+	}
+	tests := []test{
+		{"in the open", nil, nil, NoCover},
+		{"behind a wall", nil, []wall.Wall{{A: wall.Point{X: 2, Y: -10}, B: wall.Point{X: 2, Y: 10}}}, TotalCover},
+		{"behind an open door", nil, []wall.Wall{{A: wall.Point{X: 2, Y: -10}, B: wall.Point{X: 2, Y: 10}, Door: true, Open: true}}, NoCover},
+		// Lines along the top or bottom of the orc's square pass it by; the others go through it.
+		{"behind an orc", []Token{{Coordinate: image.Pt(2, 0)}}, nil, FullCover},
+		// Only the line from the archer's north-east corner to the goblin's south-west corner clips the wall's end.
+		{"past the end of a wall", nil, []wall.Wall{{A: wall.Point{X: 3, Y: 0.6}, B: wall.Point{X: 3, Y: 2}}}, PartialCover},
+		// The goblin's back is to the wall; lines that end on it aren't blocked.
+		{"against a wall", nil, []wall.Wall{{A: wall.Point{X: 5, Y: -10}, B: wall.Point{X: 5, Y: 10}}}, NoCover},
+	}
+	for _, test := range tests {
+		cover, lines := CoverFrom(archer, goblin, test.others, test.walls)
+		if cover != test.cover {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.cover, cover, lines)
+		}
+		if len(lines) != 4 {
+			t.Errorf("%s: expected a line to each of the goblin's corners, got %v", test.name, lines)
+		}
+	}
+}
+
+func TestCoverFromLarge(t *testing.T) {
+	// The ogre's best corner is its south-east one, below the orc, whose square only the line to the goblin's
+	// north-west corner passes through.
+	ogre := Token{Coordinate: image.Pt(0, 0), Size: 2}
+	goblin := Token{Coordinate: image.Pt(5, 0)}
+	orc := Token{Coordinate: image.Pt(3, 0)}
+	cover, lines := CoverFrom(ogre, goblin, []Token{orc}, nil)
+	if cover != PartialCover {
+		t.Errorf("expected the goblin to have partial cover from the ogre, got %s: %v", cover, lines)
+	}
+	if from, _ := lineEnds(lines[0].Line); from != image.Pt(2, 2) {
+		t.Errorf("expected the lines to leave the ogre's south-east corner, got %v", from)
+	}
+
+	// Lines go to the corners of the ogre's whole space.
+	ends := map[image.Point]bool{}
+	_, lines = CoverFrom(goblin, ogre, []Token{orc}, nil)
+	for _, l := range lines {
+		_, to := lineEnds(l.Line)
+		ends[to] = true
+	}
+	for _, pt := range []image.Point{{0, 0}, {2, 0}, {2, 2}, {0, 2}} {
+		if !ends[pt] {
+			t.Errorf("expected a line to the ogre's corner %v, got %v", pt, lines)
+		}
+	}
+}
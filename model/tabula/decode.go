@@ -0,0 +1,328 @@
+package tabula
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/draw"
+	"io"
+)
+
+var MaxBackgroundSize = flag.Int("max-background-size", 6000, "largest width or height, in pixels, that background images are kept at; larger ones are scaled down as they're decoded")
+
+// errNotStreamable is returned by streamPNG for images it can't decode a row at a time, which are decoded whole
+// instead.
+var errNotStreamable = errors.New("not a PNG that can be streamed")
+
+// shrinkFactor returns the whole number that the sides of a `w` by `h` image are divided by so that neither is more
+// than MaxBackgroundSize.
+func shrinkFactor(w, h int) int {
+	longest := w
+	if h > longest {
+		longest = h
+	}
+	if *MaxBackgroundSize <= 0 || longest <= *MaxBackgroundSize {
+		return 1
+	}
+	return (longest + *MaxBackgroundSize - 1) / *MaxBackgroundSize
+}
+
+// decodeBackground decodes the image in `data`, no larger than MaxBackgroundSize; no render draws more detail than
+// that. PNGs that need shrinking are decoded a row at a time, averaging each block of pixels into one as it goes, so
+// that however large they are only the shrunk image is ever held. Other images are decoded whole, and so are refused
+// if they're larger than MaxSourcePixels, and then shrunk.
+func decodeBackground(data []byte) (image.Image, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, badImage(data, err)
+	}
+	f := shrinkFactor(cfg.Width, cfg.Height)
+
+	if f > 1 && format == "png" {
+		img, err := streamPNG(data, f)
+		if err != errNotStreamable {
+			return img, err
+		}
+	}
+
+	if cfg.Width*cfg.Height > *MaxSourcePixels {
+		return nil, fmt.Errorf("image is %dx%d, which is more than the %d megapixels this mapbot will load",
+			cfg.Width, cfg.Height, *MaxSourcePixels/1000000)
+	}
+
+	// The image is kept in whatever form it decoded to, if it needn't be shrunk; e.g., JPEGs stay YCbCr, which is much
+	// smaller than RGBA.
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, badImage(data, err)
+	}
+	if f == 1 {
+		return img, nil
+	}
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, (b.Dx()+f-1)/f, (b.Dy()+f-1)/f))
+	xdraw.ApproxBiLinear.Scale(out, out.Bounds(), img, b, draw.Src, nil)
+	return out, nil
+}
+
+// badImage describes the error `err` decoding `data`, with the start of the data, which is often enough to tell what
+// was received instead of an image.
+func badImage(data []byte, err error) error {
+	n := 16
+	if len(data) < 16 {
+		n = len(data)
+	}
+	return fmt.Errorf("received image data (%q…), but: %s", data[0:n], err)
+}
+
+// pngHeader is the part of a PNG's IHDR and other chunks needed to decode its pixels.
+type pngHeader struct {
+	width, height         int
+	depth, colorType      int
+	palette               [][4]uint32
+	key                   [3]uint32
+	hasKey                bool
+	idat                  []io.Reader
+	channels, bytesPerPix int
+}
+
+// readPNG reads the chunks of the PNG in `data`, keeping its image data in place.
+func readPNG(data []byte) (*pngHeader, error) {
+	if len(data) < 8 || string(data[:8]) != "\x89PNG\r\n\x1a\n" {
+		return nil, errors.New("not a PNG")
+	}
+	h := &pngHeader{}
+	var trns []byte
+	for p := 8; p+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[p:]))
+		kind := string(data[p+4 : p+8])
+		if n < 0 || p+12+n > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", kind)
+		}
+		chunk := data[p+8 : p+8+n]
+		p += 12 + n
+
+		switch kind {
+		case "IHDR":
+			if n != 13 {
+				return nil, errors.New("bad IHDR")
+			}
+			h.width = int(binary.BigEndian.Uint32(chunk))
+			h.height = int(binary.BigEndian.Uint32(chunk[4:]))
+			h.depth, h.colorType = int(chunk[8]), int(chunk[9])
+			if chunk[12] != 0 {
+				return nil, errNotStreamable
+			}
+		case "PLTE":
+			for i := 0; i+3 <= len(chunk); i += 3 {
+				h.palette = append(h.palette, [4]uint32{
+					uint32(chunk[i]) * 0x101, uint32(chunk[i+1]) * 0x101, uint32(chunk[i+2]) * 0x101, 0xffff,
+				})
+			}
+		case "tRNS":
+			trns = chunk
+		case "IDAT":
+			h.idat = append(h.idat, bytes.NewReader(chunk))
+		case "IEND":
+			p = len(data)
+		}
+	}
+
+	switch h.colorType {
+	case 0:
+		h.channels = 1
+	case 2:
+		h.channels = 3
+	case 3:
+		h.channels = 1
+		for i := 0; i < len(trns) && i < len(h.palette); i++ {
+			h.palette[i][3] = uint32(trns[i]) * 0x101
+		}
+	case 4:
+		h.channels = 2
+	case 6:
+		h.channels = 4
+	default:
+		return nil, errNotStreamable
+	}
+	if (h.colorType == 0 || h.colorType == 2) && len(trns) >= 2*h.channels {
+		h.hasKey = true
+		for c := 0; c < h.channels; c++ {
+			h.key[c] = uint32(binary.BigEndian.Uint16(trns[2*c:]))
+		}
+	}
+	if h.depth != 1 && h.depth != 2 && h.depth != 4 && h.depth != 8 && h.depth != 16 {
+		return nil, errNotStreamable
+	}
+	h.bytesPerPix = (h.channels*h.depth + 7) / 8
+	return h, nil
+}
+
+// streamPNG decodes the PNG in `data` a row at a time, averaging each `f` by `f` block of its pixels into one pixel of
+// the image returned.
+func streamPNG(data []byte, f int) (image.Image, error) {
+	h, err := readPNG(data)
+	if err != nil {
+		return nil, err
+	}
+	z, err := zlib.NewReader(io.MultiReader(h.idat...))
+	if err != nil {
+		return nil, fmt.Errorf("reading PNG data: %s", err)
+	}
+	defer z.Close()
+
+	out := image.NewRGBA(image.Rect(0, 0, (h.width+f-1)/f, (h.height+f-1)/f))
+	sums := make([]uint64, 4*out.Rect.Dx())
+	rowLen := (h.width*h.channels*h.depth + 7) / 8
+	prev, cur := make([]byte, rowLen), make([]byte, rowLen)
+	filter := []byte{0}
+
+	for y := 0; y < h.height; y++ {
+		if _, err := io.ReadFull(z, filter); err != nil {
+			return nil, fmt.Errorf("reading PNG row %d: %s", y, err)
+		}
+		if _, err := io.ReadFull(z, cur); err != nil {
+			return nil, fmt.Errorf("reading PNG row %d: %s", y, err)
+		}
+		if err := unfilter(filter[0], cur, prev, h.bytesPerPix); err != nil {
+			return nil, fmt.Errorf("PNG row %d: %s", y, err)
+		}
+
+		for x := 0; x < h.width; x++ {
+			r, g, b, a := h.pixel(cur, x)
+			s := sums[4*(x/f):]
+			s[0] += uint64(r)
+			s[1] += uint64(g)
+			s[2] += uint64(b)
+			s[3] += uint64(a)
+		}
+
+		// The last block of each row and column may be short.
+		if y%f == f-1 || y == h.height-1 {
+			rows := y%f + 1
+			oy := y / f
+			for ox := 0; ox < out.Rect.Dx(); ox++ {
+				cols := f
+				if rest := h.width - ox*f; rest < f {
+					cols = rest
+				}
+				n := uint64(rows * cols)
+				s := sums[4*ox:]
+				i := out.PixOffset(ox, oy)
+				for c := 0; c < 4; c++ {
+					out.Pix[i+c] = uint8(s[c] / n >> 8)
+					s[c] = 0
+				}
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return out, nil
+}
+
+// pixel returns the colour of pixel `x` of the unfiltered `row`, alpha-premultiplied with 16 bits per channel.
+func (h *pngHeader) pixel(row []byte, x int) (r, g, b, a uint32) {
+	sample := func(i int) uint32 {
+		switch h.depth {
+		case 16:
+			return uint32(row[2*i])<<8 | uint32(row[2*i+1])
+		case 8:
+			return uint32(row[i])
+		}
+		bit := i * h.depth
+		return uint32(row[bit/8]>>(8-h.depth-bit%8)) & (1<<h.depth - 1)
+	}
+	// Samples of fewer than 16 bits are stretched to fill 16.
+	scale := func(v uint32) uint32 {
+		return v * 0xffff / (1<<h.depth - 1)
+	}
+
+	a = 0xffff
+	switch h.colorType {
+	case 0:
+		v := sample(x)
+		if h.hasKey && v == h.key[0] {
+			a = 0
+		}
+		r = scale(v)
+		g, b = r, r
+	case 2:
+		vr, vg, vb := sample(3*x), sample(3*x+1), sample(3*x+2)
+		if h.hasKey && vr == h.key[0] && vg == h.key[1] && vb == h.key[2] {
+			a = 0
+		}
+		r, g, b = scale(vr), scale(vg), scale(vb)
+	case 3:
+		i := int(sample(x))
+		if i >= len(h.palette) {
+			return 0, 0, 0, 0
+		}
+		p := h.palette[i]
+		r, g, b, a = p[0], p[1], p[2], p[3]
+	case 4:
+		r, a = scale(sample(2*x)), scale(sample(2*x+1))
+		g, b = r, r
+	case 6:
+		r, g, b, a = scale(sample(4*x)), scale(sample(4*x+1)), scale(sample(4*x+2)), scale(sample(4*x+3))
+	}
+	return r * a / 0xffff, g * a / 0xffff, b * a / 0xffff, a
+}
+
+// unfilter undoes the PNG filter `kind` on `cur`, in place, given the unfiltered previous row `prev` and `bpp` bytes per
+// pixel.
+func unfilter(kind byte, cur, prev []byte, bpp int) error {
+	switch kind {
+	case 0:
+	case 1:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3:
+		for i := range cur {
+			left := 0
+			if i >= bpp {
+				left = int(cur[i-bpp])
+			}
+			cur[i] += byte((left + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range cur {
+			var a, c int
+			if i >= bpp {
+				a, c = int(cur[i-bpp]), int(prev[i-bpp])
+			}
+			cur[i] += paeth(a, int(prev[i]), c)
+		}
+	default:
+		return fmt.Errorf("unknown filter %d", kind)
+	}
+	return nil
+}
+
+func paeth(a, b, c int) byte {
+	p := a + b - c
+	pa, pb, pc := abs(p-a), abs(p-b), abs(p-c)
+	switch {
+	case pa <= pb && pa <= pc:
+		return byte(a)
+	case pb <= pc:
+		return byte(b)
+	}
+	return byte(c)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,130 @@
+package tabula
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// boxAverage shrinks `img` the way streamPNG does, from the fully decoded image.
+func boxAverage(img image.Image, f int) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, (b.Dx()+f-1)/f, (b.Dy()+f-1)/f))
+	for oy := 0; oy < out.Rect.Dy(); oy++ {
+		for ox := 0; ox < out.Rect.Dx(); ox++ {
+			var sum [4]uint64
+			n := uint64(0)
+			for y := oy * f; y < (oy+1)*f && y < b.Dy(); y++ {
+				for x := ox * f; x < (ox+1)*f && x < b.Dx(); x++ {
+					r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					sum[0] += uint64(r)
+					sum[1] += uint64(g)
+					sum[2] += uint64(bl)
+					sum[3] += uint64(a)
+					n++
+				}
+			}
+			out.SetRGBA(ox, oy, color.RGBA{
+				uint8(sum[0] / n >> 8), uint8(sum[1] / n >> 8), uint8(sum[2] / n >> 8), uint8(sum[3] / n >> 8),
+			})
+		}
+	}
+	return out
+}
+
+func TestStreamPNG(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, 53, 31)
+	images := map[string]image.Image{
+		"nrgba":   image.NewNRGBA(r),
+		"rgba64":  image.NewNRGBA64(r),
+		"gray":    image.NewGray(r),
+		"gray16":  image.NewGray16(r),
+		"palette": image.NewPaletted(r, palette.WebSafe),
+		"bilevel": image.NewPaletted(r, color.Palette{color.Black, color.NRGBA{255, 0, 0, 128}}),
+		"rgb":     image.NewRGBA(r),
+	}
+	for name, img := range images {
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				c := color.NRGBA64{uint16(rnd.Intn(0x10000)), uint16(rnd.Intn(0x10000)), uint16(rnd.Intn(0x10000)), uint16(rnd.Intn(0x10000))}
+				// Runs of colour, so that the encoder uses every filter.
+				if x%7 < 4 {
+					c = color.NRGBA64{uint16(y * 2000), uint16(x * 1000), 0x8000, 0xffff}
+				}
+				if name == "rgb" {
+					c.A = 0xffff
+				}
+				img.(interface{ Set(int, int, color.Color) }).Set(x, y, c)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, img); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		for _, f := range []int{1, 4, 10} {
+			got, err := streamPNG(buf.Bytes(), f)
+			if err != nil {
+				t.Fatalf("%s shrunk %dx: %s", name, f, err)
+			}
+			exp := boxAverage(decoded, f)
+			if got.Bounds() != exp.Bounds() {
+				t.Fatalf("%s shrunk %dx: expected %v, got %v", name, f, exp.Bounds(), got.Bounds())
+			}
+			if !bytes.Equal(got.(*image.RGBA).Pix, exp.Pix) {
+				t.Errorf("%s shrunk %dx: pixels differ from the decoded image's", name, f)
+			}
+		}
+	}
+}
+
+func TestDecodeBackground(t *testing.T) {
+	defer func(size, pixels int) { *MaxBackgroundSize, *MaxSourcePixels = size, pixels }(*MaxBackgroundSize, *MaxSourcePixels)
+	*MaxBackgroundSize, *MaxSourcePixels = 100, 10000
+
+	img := image.NewNRGBA(image.Rect(0, 0, 250, 120))
+	pngBuf, jpegBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	png.Encode(pngBuf, img)
+	jpeg.Encode(jpegBuf, img, nil)
+
+	// A PNG is streamed, so it may be larger than MaxSourcePixels.
+	bg, err := decodeBackground(pngBuf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bg.Bounds() != image.Rect(0, 0, 84, 40) {
+		t.Errorf("expected the PNG shrunk by 3 to 84x40, got %v", bg.Bounds())
+	}
+
+	// A JPEG is decoded whole, so it may not.
+	if _, err := decodeBackground(jpegBuf.Bytes()); err == nil || !strings.Contains(err.Error(), "megapixels") {
+		t.Errorf("expected the JPEG to be refused, got %v", err)
+	}
+	*MaxSourcePixels = 100000
+	if bg, err := decodeBackground(jpegBuf.Bytes()); err != nil || bg.Bounds() != image.Rect(0, 0, 84, 40) {
+		t.Errorf("expected the JPEG shrunk by 3 to 84x40, got %v, %v", bg, err)
+	}
+
+	// Small images are left as they are.
+	small := &bytes.Buffer{}
+	jpeg.Encode(small, image.NewGray(image.Rect(0, 0, 50, 50)), nil)
+	if bg, err := decodeBackground(small.Bytes()); err != nil || bg.Bounds().Dx() != 50 {
+		t.Errorf("expected a 50px image unchanged, got %v, %v", bg, err)
+	}
+
+	if _, err := decodeBackground([]byte("<html>")); err == nil || !strings.Contains(err.Error(), "<html>") {
+		t.Errorf("expected an error quoting the data, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package tabula
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// badgeColor is the background of the badge showing a token's elevation.
+var badgeColor = color.NRGBA{0x20, 0x20, 0x20, 0xc0}
+
+// ElevationLabel returns how a token `feet` above the ground, or below it if negative, is labelled.
+func ElevationLabel(feet int) string {
+	if feet < 0 {
+		return fmt.Sprintf("↓%d", -feet)
+	}
+	return fmt.Sprintf("↑%d", feet)
+}
+
+// badge returns where the elevation badge of a token drawn in `box` goes: across the top right of it.
+func badge(box tokenBox) (x, y, width, height float32) {
+	width, height = box.size*0.6, box.size*0.3
+	return box.x + box.size - width, box.y, width, height
+}
+
+// addElevation draws the badge showing how high `token`, drawn in `box`, is.
+func (t *Tabula) addElevation(i draw.Image, token Token, box tokenBox, offset image.Point) {
+	x, y, w, h := badge(box)
+	t.squareAtFloat(i, x, y, x+w, y+h, 0, badgeColor, offset)
+	t.printAt(i, ElevationLabel(token.Elevation), x, y, w, h, Middle, Center, offset)
+}
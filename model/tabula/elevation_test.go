@@ -0,0 +1,72 @@
+package tabula
+
+import (
+	"image"
+	"testing"
+)
+
+func TestDistanceTo(t *testing.T) {
+	goblin := Token{Coordinate: image.Pt(3, 3), Size: 1}
+	tests := []struct {
+		other Token
+		feet  int
+	}{
+		{Token{Coordinate: image.Pt(4, 3), Size: 1}, 5},
+		{Token{Coordinate: image.Pt(3, 3), Size: 1, Elevation: 5}, 5},
+		{Token{Coordinate: image.Pt(3, 3), Size: 1, Elevation: 30}, 30},
+		{Token{Coordinate: image.Pt(9, 3), Size: 1, Elevation: 20}, 40},
+		{Token{Coordinate: image.Pt(3, 3), Size: 1, Elevation: -10}, 10},
+		// An ogre is as tall as it is wide, so one standing in a 10ft pit beside the goblin is 5ft from it.
+		{Token{Coordinate: image.Pt(1, 1), Size: 2, Elevation: -10}, 5},
+	}
+	for i, test := range tests {
+		if d := goblin.DistanceTo(test.other); d != test.feet {
+			t.Errorf("test %d: expected %dft, got %dft", i, test.feet, d)
+		}
+		if d := test.other.DistanceTo(goblin); d != test.feet {
+			t.Errorf("test %d reversed: expected %dft, got %dft", i, test.feet, d)
+		}
+	}
+}
+
+func TestTokenBoxes(t *testing.T) {
+	boxes := tokenBoxes(map[string]Token{
+		"goblin": {Coordinate: image.Pt(3, 3), Size: 1},
+		"bat":    {Coordinate: image.Pt(3, 3), Size: 1, Elevation: 20},
+		"orc":    {Coordinate: image.Pt(5, 5), Size: 1},
+	})
+
+	if b := boxes["orc"]; b != (tokenBox{5, 5, 1}) {
+		t.Errorf("expected a lone token to fill its square, got %+v", b)
+	}
+	goblin, bat := boxes["goblin"], boxes["bat"]
+	if goblin.size != stackScale || bat.size != stackScale {
+		t.Errorf("expected stacked tokens to be drawn smaller, got %+v and %+v", goblin, bat)
+	}
+	if !(bat.x > goblin.x && bat.y < goblin.y) {
+		t.Errorf("expected the bat above and right of the goblin, got %+v and %+v", bat, goblin)
+	}
+	for _, b := range []tokenBox{goblin, bat} {
+		if b.x < 3 || b.y < 3 || b.x+b.size > 4.0001 || b.y+b.size > 4.0001 {
+			t.Errorf("expected stacked tokens to stay in their square, got %+v", b)
+		}
+	}
+
+	order := tokenOrder(map[string]Token{
+		"goblin": {Coordinate: image.Pt(3, 3), Size: 1},
+		"bat":    {Coordinate: image.Pt(3, 3), Size: 1, Elevation: 20},
+		"ogre":   {Coordinate: image.Pt(3, 3), Size: 2},
+	})
+	if order[len(order)-1] != "bat" {
+		t.Errorf("expected the bat to be drawn last, got %v", order)
+	}
+}
+
+func TestElevationLabel(t *testing.T) {
+	if l := ElevationLabel(30); l != "↑30" {
+		t.Errorf("expected ↑30, got %s", l)
+	}
+	if l := ElevationLabel(-10); l != "↓10" {
+		t.Errorf("expected ↓10, got %s", l)
+	}
+}
@@ -0,0 +1,58 @@
+package tabula
+
+import (
+	mbDraw "github.com/pdbogen/mapbot/common/draw"
+	"golang.org/x/image/vector"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// wedge returns the corners of the wedge showing which way `token`, drawn in `box`, faces, in tabula coordinates: a
+// triangle pointing out of the token's edge, its tip on the circle the box encloses.
+func wedge(token Token, box tokenBox) [3][2]float64 {
+	r := float64(box.size) / 2
+	cx, cy := float64(box.x)+r, float64(box.y)+r
+	at := func(radians, dist float64) [2]float64 {
+		return [2]float64{cx + math.Sin(radians)*dist, cy - math.Cos(radians)*dist}
+	}
+	a := token.Facing.Radians()
+	return [3][2]float64{at(a, r), at(a-0.35, 0.62*r), at(a+0.35, 0.62*r)}
+}
+
+// wedgeColor is the token's own color, made opaque so the wedge stands out over its art; or black, for a token with
+// no color.
+func wedgeColor(token Token) color.Color {
+	c := color.NRGBAModel.Convert(token.Color()).(color.NRGBA)
+	if c.A == 0 {
+		return color.Black
+	}
+	c.A = 0xff
+	return c
+}
+
+// addFacing draws the wedge showing which way `token`, drawn in `box`, faces.
+func (t *Tabula) addFacing(i draw.Image, token Token, box tokenBox, offset image.Point) {
+	pts := wedge(token, box)
+	bounds := box.pixels(t.Dpi, offset)
+	if bounds.Empty() {
+		return
+	}
+
+	z := vector.NewRasterizer(bounds.Dx(), bounds.Dy())
+	for n, pt := range pts {
+		x := float32(pt[0])*t.Dpi + float32(offset.X-bounds.Min.X)
+		y := float32(pt[1])*t.Dpi + float32(offset.Y-bounds.Min.Y)
+		if n == 0 {
+			z.MoveTo(x, y)
+		} else {
+			z.LineTo(x, y)
+		}
+	}
+	z.ClosePath()
+
+	mask := image.NewAlpha(bounds)
+	z.Draw(mask, bounds, image.Opaque, image.Point{})
+	mbDraw.BlendMask(i, mask, wedgeColor(token), 0xff)
+}
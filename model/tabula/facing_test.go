@@ -0,0 +1,24 @@
+package tabula
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAddFacing(t *testing.T) {
+	tab := &Tabula{Dpi: 40}
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	token := Token{Coordinate: image.Pt(1, 1), Size: 2, TokenColor: color.NRGBA{0, 0, 255, 127}}.WithFacing(90)
+	tab.addFacing(img, token, tokenBox{1, 1, 2}, image.Pt(10, 10))
+
+	// The token's middle is at (90,90); facing east, the wedge reaches its right edge, at 130.
+	if c := img.RGBAAt(124, 90); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("expected an opaque blue wedge at the token's east edge, got %v", c)
+	}
+	for _, pt := range []image.Point{{90, 55}, {55, 90}, {90, 124}, {90, 90}} {
+		if c := img.RGBAAt(pt.X, pt.Y); c.A != 0 {
+			t.Errorf("expected nothing drawn at %v, got %v", pt, c)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package tabula
+
+import (
+	"fmt"
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// DefaultFont is the font that text is drawn in unless a context chooses another for its coordinate labels.
+const DefaultFont = "serif"
+
+// labelFont is a font that coordinate labels can be drawn in, along with the font-family an SVG should ask for.
+type labelFont struct {
+	font   *truetype.Font
+	family string
+}
+
+var font *truetype.Font
+
+var fonts = map[string]labelFont{}
+
+func init() {
+	path := "fonts/DejaVuSerif.ttf"
+	fontData, err := ioutil.ReadFile(path)
+	if err != nil {
+		fontData, err = ioutil.ReadFile("../../" + path)
+		if err != nil {
+			panic(fmt.Sprintf("reading %s: %s", path, err))
+		}
+	}
+
+	font, err = freetype.ParseFont(fontData)
+	if err != nil {
+		panic(fmt.Sprintf("parsing %s: %s", path, err))
+	}
+	fonts[DefaultFont] = labelFont{font, "DejaVu Serif, serif"}
+
+	for name, f := range map[string]struct {
+		ttf    []byte
+		family string
+	}{
+		"sans": {goregular.TTF, "Go, sans-serif"},
+		"mono": {gomono.TTF, "Go Mono, monospace"},
+	} {
+		parsed, err := freetype.ParseFont(f.ttf)
+		if err != nil {
+			panic(fmt.Sprintf("parsing %s font: %s", name, err))
+		}
+		fonts[name] = labelFont{parsed, f.family}
+	}
+}
+
+// FontNames returns the names of the fonts that coordinate labels can be drawn in.
+func FontNames() []string {
+	ret := []string{}
+	for name := range fonts {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ParseFont returns the name of the font called `s`, or an error if there's no such font.
+func ParseFont(s string) (string, error) {
+	if _, ok := fonts[strings.ToLower(s)]; !ok {
+		return "", fmt.Errorf("unknown font %q; try %s", s, strings.Join(FontNames(), ", "))
+	}
+	return strings.ToLower(s), nil
+}
+
+// fontNamed returns the font called `name`, or the default font if there's no such font.
+func fontNamed(name string) labelFont {
+	if f, ok := fonts[name]; ok {
+		return f
+	}
+	return fonts[DefaultFont]
+}
@@ -0,0 +1,92 @@
+package tabula
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type GridStyle string
+
+const (
+	GridSolid  GridStyle = "solid"
+	GridDashed GridStyle = "dashed"
+	GridDotted GridStyle = "dotted"
+	GridNone   GridStyle = "none"
+)
+
+var GridStyles = []GridStyle{GridSolid, GridDashed, GridDotted, GridNone}
+
+func ParseGridStyle(s string) (GridStyle, error) {
+	for _, style := range GridStyles {
+		if GridStyle(strings.ToLower(s)) == style {
+			return style, nil
+		}
+	}
+	names := []string{}
+	for _, style := range GridStyles {
+		names = append(names, string(style))
+	}
+	return "", fmt.Errorf("unknown grid style %q; try %s", s, strings.Join(names, ", "))
+}
+
+// MaxGridWidth is the thickest grid line, in pixels.
+const MaxGridWidth = 10
+
+// gridStyle returns the grid's style; the zero value is solid.
+func (t *Tabula) gridStyle() GridStyle {
+	if t.GridStyle == "" {
+		return GridSolid
+	}
+	return t.GridStyle
+}
+
+// gridWidth returns the width of grid lines, in output pixels; the zero value is 1.
+func (t *Tabula) gridWidth() int {
+	if t.GridWidth <= 0 {
+		return 1
+	}
+	return t.GridWidth
+}
+
+// gridAlpha returns the grid's opacity as an alpha value; the zero value is opaque.
+func (t *Tabula) gridAlpha() uint8 {
+	if t.GridOpacity <= 0 || t.GridOpacity >= 100 {
+		return 255
+	}
+	return uint8(t.GridOpacity * 255 / 100)
+}
+
+// gridPattern returns the length of each dash or dot, and the distance from the start of one to the next, in pixels.
+// Both are zero for solid lines. Dashes and dots are spaced by fractions of a square, so that every square's edge looks
+// the same.
+func (t *Tabula) gridPattern() (on, period float64) {
+	switch t.gridStyle() {
+	case GridDashed:
+		period = math.Max(4, float64(t.Dpi)/4)
+		return period / 2, period
+	case GridDotted:
+		on = float64(t.gridWidth())
+		return on, math.Max(3*on, float64(t.Dpi)/8)
+	}
+	return 0, 0
+}
+
+// gridDashes returns the stretches, as [start, end) pairs along a grid line `length` pixels long, that are drawn in the
+// grid's style.
+func (t *Tabula) gridDashes(length int) [][2]int {
+	on, period := t.gridPattern()
+	if period == 0 {
+		return [][2]int{{0, length}}
+	}
+
+	ret := [][2]int{}
+	for start := 0.0; int(start) < length; start += period {
+		end := int(math.Round(start + on))
+		if end > length {
+			end = length
+		}
+		ret = append(ret, [2]int{int(math.Round(start)), end})
+	}
+	return ret
+}
@@ -0,0 +1,97 @@
+package tabula
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func gray() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 101, 101))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	return img
+}
+
+func TestGridStyles(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	at := func(tab *Tabula, x, y int) color.RGBA {
+		img := gray()
+		tab.addGrid(img)
+		return img.RGBAAt(x, y)
+	}
+	bg := color.RGBA{0x80, 0x80, 0x80, 0x80}
+	solidRed := color.RGBA{255, 0, 0, 255}
+
+	if c := at(&Tabula{Dpi: 50, GridColor: red}, 50, 10); c != solidRed {
+		t.Errorf("solid grid line was %v", c)
+	}
+	if c := at(&Tabula{Dpi: 50, GridColor: red}, 51, 10); c != bg {
+		t.Errorf("1px grid line spilled over: %v", c)
+	}
+	if c := at(&Tabula{Dpi: 50, GridColor: red, GridWidth: 3}, 51, 10); c != solidRed {
+		t.Errorf("3px grid line didn't cover its neighbour: %v", c)
+	}
+	if c := at(&Tabula{Dpi: 50, GridColor: red, GridStyle: GridNone}, 50, 10); c != bg {
+		t.Errorf("hidden grid was drawn: %v", c)
+	}
+	if c := at(&Tabula{Dpi: 50, GridColor: red, GridOpacity: 50}, 50, 10); c.R <= bg.R || c.R == 255 {
+		t.Errorf("half-opaque grid line was %v", c)
+	}
+
+	// Dashes along the 12.5px period: on for the first half, off for the second.
+	dashed := &Tabula{Dpi: 50, GridColor: red, GridStyle: GridDashed}
+	if c := at(dashed, 50, 2); c != solidRed {
+		t.Errorf("dash was %v", c)
+	}
+	if c := at(dashed, 50, 9); c != bg {
+		t.Errorf("gap between dashes was %v", c)
+	}
+
+	dotted := &Tabula{Dpi: 50, GridColor: red, GridStyle: GridDotted}
+	if c := at(dotted, 50, 0); c != solidRed {
+		t.Errorf("dot was %v", c)
+	}
+	if c := at(dotted, 50, 3); c != bg {
+		t.Errorf("gap between dots was %v", c)
+	}
+}
+
+func TestGridDashes(t *testing.T) {
+	tab := &Tabula{Dpi: 40, GridStyle: GridDashed}
+	dashes := tab.gridDashes(40)
+	if len(dashes) != 4 || dashes[0] != [2]int{0, 5} || dashes[3] != [2]int{30, 35} {
+		t.Errorf("unexpected dashes %v", dashes)
+	}
+	tab.GridStyle = GridSolid
+	if dashes := tab.gridDashes(40); len(dashes) != 1 || dashes[0] != [2]int{0, 40} {
+		t.Errorf("unexpected solid line %v", dashes)
+	}
+}
+
+func TestParseGridStyle(t *testing.T) {
+	if s, err := ParseGridStyle("Dotted"); err != nil || s != GridDotted {
+		t.Errorf("parsed Dotted as %q, %v", s, err)
+	}
+	if _, err := ParseGridStyle("wavy"); err == nil {
+		t.Errorf("parsed wavy without error")
+	}
+}
+
+func TestRenderKeyGridStyle(t *testing.T) {
+	a := &Tabula{Url: "x", Dpi: 50}
+	b := &Tabula{Url: "x", Dpi: 50, GridStyle: GridDashed}
+	c := &Tabula{Url: "x", Dpi: 50, GridWidth: 2}
+	d := &Tabula{Url: "x", Dpi: 50, GridOpacity: 40}
+	keys := map[string]bool{}
+	for _, tab := range []*Tabula{a, b, c, d} {
+		keys[tab.renderKey(0, 0, 0, 0)] = true
+	}
+	if len(keys) != 4 {
+		t.Errorf("grid styles should have distinct render keys")
+	}
+	if a.renderKey(0, 0, 0, 0) != (&Tabula{Url: "x", Dpi: 50, GridStyle: GridSolid, GridWidth: 1, GridOpacity: 100}).renderKey(0, 0, 0, 0) {
+		t.Errorf("defaults should share a render key with their explicit equivalents")
+	}
+}
@@ -0,0 +1,94 @@
+package tabula
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/model/mark"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Light is a light source that belongs to the map itself, like a sconce or a campfire, rather than being carried by a
+// token. X and Y are in grid units, like walls; Radius is in pathfinder feet, like token lights.
+type Light struct {
+	X, Y   float64
+	Radius int
+	Color  color.NRGBA
+}
+
+// Square returns the map square containing the light.
+func (l Light) Square() image.Point {
+	return image.Pt(int(math.Floor(l.X)), int(math.Floor(l.Y)))
+}
+
+func (t *Tabula) WithLights(lights []Light) *Tabula {
+	t.Lights = make([]Light, len(lights))
+	copy(t.Lights, lights)
+	return t
+}
+
+// mapLightMarks returns marks for every map light, tinted with the light's own color.
+func (t *Tabula) mapLightMarks() ([]mark.Mark, error) {
+	ret := []mark.Mark{}
+	for _, l := range t.Lights {
+		c := l.Color
+		c.A = 63
+		marks, err := light(t, nil, l.Radius, l.Square(), c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, marks...)
+	}
+	return ret, nil
+}
+
+func (t *Tabula) loadLights(db anydb.AnyDb) error {
+	if t.Id == nil {
+		return errors.New("cannot load lights for tabula with nil ID")
+	}
+
+	res, err := db.Query("SELECT x, y, radius, r, g, b FROM tabula_lights WHERE tabula_id=$1 ORDER BY idx", t.Id)
+	if err != nil {
+		return fmt.Errorf("querying tabula_lights: %s", err)
+	}
+	defer res.Close()
+
+	t.Lights = []Light{}
+	for res.Next() {
+		l := Light{Color: color.NRGBA{A: 255}}
+		if err := res.Scan(&l.X, &l.Y, &l.Radius, &l.Color.R, &l.Color.G, &l.Color.B); err != nil {
+			return fmt.Errorf("retrieving light: %s", err)
+		}
+		t.Lights = append(t.Lights, l)
+	}
+	return nil
+}
+
+// saveLightsTx replaces all of the tabula's saved lights with those currently in t.Lights.
+func (t *Tabula) saveLightsTx(dialect string, tx *sql.Tx) error {
+	if t.Id == nil {
+		return errors.New("cannot save lights for tabula with nil ID")
+	}
+
+	if _, err := tx.Exec("DELETE FROM tabula_lights WHERE tabula_id=$1", t.Id); err != nil {
+		return fmt.Errorf("clearing old lights: %s", err)
+	}
+
+	add, err := tx.Prepare("INSERT INTO tabula_lights (tabula_id, idx, x, y, radius, r, g, b) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
+	if err != nil {
+		return fmt.Errorf("error preparing ADD: %s", err)
+	}
+	defer add.Close()
+
+	for i, l := range t.Lights {
+		if _, err := add.Exec(t.Id, i, l.X, l.Y, l.Radius, l.Color.R, l.Color.G, l.Color.B); err != nil {
+			return fmt.Errorf("saving light %d at (%.2f,%.2f) on tabula %d: %s", i, l.X, l.Y, t.Id, err)
+		}
+	}
+
+	return nil
+}
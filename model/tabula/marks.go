@@ -4,7 +4,9 @@ import (
 	"errors"
 	"github.com/pdbogen/mapbot/model/context"
 	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/terrain"
 	"image"
+	"image/color"
 	"image/draw"
 )
 
@@ -16,49 +18,55 @@ func (t *Tabula) addLines(in image.Image, ctx context.Context, offset image.Poin
 
 	for _, l := range t.Lines {
 		log.Debugf("adding line %v", l)
-		from := l.A
-		switch l.CA {
-		case "nw":
-		case "ne":
-			from.X++
-		case "se":
-			from.X++
-			from.Y++
-		case "sw":
-			from.Y++
-		}
+		from, to := lineEnds(l)
+		log.Debugf("post-cornering it's %v -> %v", from, to)
+		t.line(drawable, float32(from.X), float32(from.Y), float32(to.X), float32(to.Y), l.Color, offset)
+	}
+	return nil
+}
 
-		to := l.B
-		switch l.CB {
-		case "nw":
+// lineEnds returns the grid points a line runs between, after moving each end to the corner of its square it names.
+func lineEnds(l mark.Line) (from, to image.Point) {
+	corner := func(p image.Point, c string) image.Point {
+		switch c {
 		case "ne":
-			to.X++
+			p.X++
 		case "se":
-			to.X++
-			to.Y++
+			p.X++
+			p.Y++
 		case "sw":
-			to.Y++
+			p.Y++
 		}
-
-		log.Debugf("post-cornering it's %v -> %v", from, to)
-		t.line(drawable, float32(from.X), float32(from.Y), float32(to.X), float32(to.Y), l.Color, offset)
+		return p
 	}
-	return nil
+	return corner(l.A, l.CA), corner(l.B, l.CB)
 }
 
 func (t *Tabula) addMarks(in image.Image, ctx context.Context, offset image.Point) error {
-	dirMarkSlice := []mark.Mark{}
+	return t.addMarkSlice(in, t.allMarks(ctx), offset)
+}
+
+// terrainColors shade the squares of each kind of terrain.
+var terrainColors = map[terrain.Kind]color.Color{
+	terrain.Difficult: color.NRGBA{R: 0x8b, G: 0x5a, B: 0x2b, A: 0x60},
+	terrain.Blocked:   color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xb0},
+}
+
+// allMarks returns the terrain marked in `ctx`, then the marks made in it, followed by those belonging to the tabula
+// itself.
+func (t *Tabula) allMarks(ctx context.Context) []mark.Mark {
+	ret := []mark.Mark{}
+	for pt, kind := range ctx.GetTerrain(*t.Id) {
+		if c, ok := terrainColors[kind]; ok {
+			ret = append(ret, mark.Mark{Point: pt, Color: c})
+		}
+	}
 	for _, dirMarks := range ctx.GetMarks(*t.Id) {
 		for _, mark := range dirMarks {
-			dirMarkSlice = append(dirMarkSlice, mark)
+			ret = append(ret, mark)
 		}
 	}
-
-	if err := t.addMarkSlice(in, dirMarkSlice, offset); err != nil {
-		return err
-	}
-
-	return t.addMarkSlice(in, t.Marks, offset)
+	return append(ret, t.Marks...)
 }
 
 func (t *Tabula) addMarkSlice(in image.Image, marks []mark.Mark, offset image.Point) error {
@@ -68,31 +76,38 @@ func (t *Tabula) addMarkSlice(in image.Image, marks []mark.Mark, offset image.Po
 	}
 
 	for _, mark := range marks {
-		switch mark.Direction {
-		case "n":
-			t.squareAtFloat(drawable, float32(mark.Point.X), float32(mark.Point.Y)-.1, float32(mark.Point.X)+1, float32(mark.Point.Y)+.1, 0, mark.Color, offset)
-		case "s":
-			t.squareAtFloat(drawable, float32(mark.Point.X), float32(mark.Point.Y)+.9, float32(mark.Point.X)+1, float32(mark.Point.Y)+1.1, 0, mark.Color, offset)
-		case "e":
-			t.squareAtFloat(drawable, float32(mark.Point.X)+.9, float32(mark.Point.Y), float32(mark.Point.X)+1.1, float32(mark.Point.Y)+1, 0, mark.Color, offset)
-		case "w":
-			t.squareAtFloat(drawable, float32(mark.Point.X)-.1, float32(mark.Point.Y), float32(mark.Point.X)+.1, float32(mark.Point.Y)+1, 0, mark.Color, offset)
-		case "ne":
-			t.squareAtFloat(drawable, float32(mark.Point.X)+.9, float32(mark.Point.Y)-.1, float32(mark.Point.X)+1.1, float32(mark.Point.Y)+.1, 0, mark.Color, offset)
-		case "se":
-			t.squareAtFloat(drawable, float32(mark.Point.X)+.9, float32(mark.Point.Y)+.9, float32(mark.Point.X)+1.1, float32(mark.Point.Y)+1.1, 0, mark.Color, offset)
-		case "nw":
-			t.squareAtFloat(drawable, float32(mark.Point.X)-.1, float32(mark.Point.Y)-.1, float32(mark.Point.X)+.1, float32(mark.Point.Y)+.1, 0, mark.Color, offset)
-		case "sw":
-			t.squareAtFloat(drawable, float32(mark.Point.X)-.1, float32(mark.Point.Y)+.9, float32(mark.Point.X)+.1, float32(mark.Point.Y)+1.1, 0, mark.Color, offset)
-		default:
-			t.squareAt(drawable, image.Rect(mark.Point.X, mark.Point.Y, mark.Point.X+1, mark.Point.Y+1), 1, mark.Color, offset)
-		}
+		minX, minY, maxX, maxY, inset := markBounds(mark)
+		t.squareAtFloat(drawable, minX, minY, maxX, maxY, inset, mark.Color, offset)
 	}
 
 	return nil
 }
 
+// markBounds returns the rectangle, in squares, that a mark covers, and the number of pixels it is inset by; marks on
+// a square fill it, and marks on an edge or corner straddle it.
+func markBounds(m mark.Mark) (minX, minY, maxX, maxY float32, inset int) {
+	x, y := float32(m.Point.X), float32(m.Point.Y)
+	switch m.Direction {
+	case "n":
+		return x, y - .1, x + 1, y + .1, 0
+	case "s":
+		return x, y + .9, x + 1, y + 1.1, 0
+	case "e":
+		return x + .9, y, x + 1.1, y + 1, 0
+	case "w":
+		return x - .1, y, x + .1, y + 1, 0
+	case "ne":
+		return x + .9, y - .1, x + 1.1, y + .1, 0
+	case "se":
+		return x + .9, y + .9, x + 1.1, y + 1.1, 0
+	case "nw":
+		return x - .1, y - .1, x + .1, y + .1, 0
+	case "sw":
+		return x - .1, y + .9, x + .1, y + 1.1, 0
+	}
+	return x, y, x + 1, y + 1, 1
+}
+
 func (t *Tabula) WithMarks(marks []mark.Mark) *Tabula {
 	t.Marks = make([]mark.Mark, len(marks))
 	for i, m := range marks {
@@ -113,3 +128,11 @@ func (t *Tabula) WithNote(note string) *Tabula {
 	t.Note = note
 	return t
 }
+
+// GMView returns a copy of the map that renders hidden tokens, for the GM. It's a copy, rather than the map itself, so
+// that renders of the map for everyone else still leave them out.
+func (t *Tabula) GMView() *Tabula {
+	ret := *t
+	ret.GM = true
+	return &ret
+}
@@ -0,0 +1,188 @@
+package tabula
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/common/pdf"
+	"github.com/pdbogen/mapbot/model/context"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Paper is a sheet size that maps can be printed on, in inches.
+type Paper struct {
+	Name          string
+	Width, Height float64
+}
+
+var Papers = map[string]Paper{
+	"letter": {"letter", 8.5, 11},
+	"a4":     {"a4", 8.27, 11.69},
+}
+
+func PaperNames() []string {
+	ret := []string{}
+	for name := range Papers {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// printMargin is the border left around the grid on each side of a page, in inches; coordinates, overlap markers, and
+// page numbers are printed there. Most printers can't print right to the edge, anyway.
+const printMargin = 0.5
+
+// minPrintResolution and maxPrintResolution bound the pixels per square, and so per inch, that maps are printed at.
+// Within them, maps print at the background's own resolution.
+const minPrintResolution, maxPrintResolution = 72, 200
+
+// printQuality is the JPEG quality of the map images on each page.
+const printQuality = 90
+
+// Print renders the whole map, with the tokens and marks visible in `ctx`, as a PDF in which every square is one inch.
+// The map is tiled across as many pages of `paper` as it takes, in whichever orientation takes fewer; neighbouring
+// pages overlap by one square, marked with dashed lines, so that they can be lined up and taped together.
+func (t *Tabula) Print(ctx context.Context, paper Paper) ([]byte, error) {
+	if ctx == nil {
+		return nil, fmt.Errorf("print of tabula %d received nil context", t.Id)
+	}
+	if t.Dpi == 0 {
+		return nil, errors.New("cannot render tabula with zero DPI")
+	}
+
+	src, err := t.Source(db.Instance, nil)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving background: %s", err)
+	}
+	k := sourceScale(src)
+	maxx, maxy, _ := t.region(src, 0, 0, 0, 0)
+	squares := image.Rect(0, 0, maxx+1, maxy+1)
+
+	cols, rows := printableSquares(paper.Width), printableSquares(paper.Height)
+	if cols < 2 || rows < 2 {
+		return nil, fmt.Errorf("%s paper is too small to print on", paper.Name)
+	}
+	tiles := printLayout(squares, cols, rows)
+	if landscape := printLayout(squares, rows, cols); len(landscape) < len(tiles) {
+		tiles = landscape
+		paper.Width, paper.Height = paper.Height, paper.Width
+	}
+
+	// The scale, in output pixels per reference pixel, at which each square is the chosen number of pixels.
+	resolution := math.Max(minPrintResolution, math.Min(maxPrintResolution, float64(t.Dpi)*k))
+	scale := resolution / float64(t.Dpi)
+	view := t.scaled(scale)
+
+	doc := pdf.New()
+	for i, tile := range tiles {
+		log.Debugf("printing squares %v on page %d of %d", tile, i+1, len(tiles))
+		r := image.Rect(
+			int(float32(tile.Min.X)*t.Dpi)+t.OffsetX,
+			int(float32(tile.Min.Y)*t.Dpi)+t.OffsetY,
+			int(float32(tile.Max.X)*t.Dpi)+t.OffsetX+1,
+			int(float32(tile.Max.Y)*t.Dpi)+t.OffsetY+1,
+		)
+		img := view.addGrid(scaleRegion(src, r, k, scale))
+		offset := image.Point{
+			int(float32(tile.Min.X)*view.Dpi) * -1,
+			int(float32(tile.Min.Y)*view.Dpi) * -1,
+		}
+		if err := view.addOverlays(img, ctx, offset, nil); err != nil {
+			return nil, err
+		}
+
+		page := doc.AddPage(paper.Width*pdf.PointsPerInch, paper.Height*pdf.PointsPerInch)
+		perPixel := pdf.PointsPerInch / float64(view.Dpi)
+		if err := page.Image(img, printMargin*pdf.PointsPerInch, printMargin*pdf.PointsPerInch,
+			float64(img.Bounds().Dx())*perPixel, float64(img.Bounds().Dy())*perPixel, printQuality); err != nil {
+			return nil, fmt.Errorf("adding page %d: %s", i+1, err)
+		}
+		printMarkings(page, tiles, i, string(t.Name), ctx.GetCoordinates())
+	}
+	return doc.Bytes()
+}
+
+// printableSquares returns how many one-inch squares fit across `inches` of paper, inside the margins.
+func printableSquares(inches float64) int {
+	return int(math.Floor(inches - 2*printMargin + 1e-9))
+}
+
+// printLayout tiles the squares in `squares` with pages of `cols` by `rows` squares, overlapping neighbours by one
+// square. Pages are in reading order: left to right, then top to bottom.
+func printLayout(squares image.Rectangle, cols, rows int) []image.Rectangle {
+	xs := printSpans(squares.Min.X, squares.Max.X, cols)
+	ys := printSpans(squares.Min.Y, squares.Max.Y, rows)
+	ret := []image.Rectangle{}
+	for _, y := range ys {
+		for _, x := range xs {
+			ret = append(ret, image.Rect(x[0], y[0], x[1], y[1]))
+		}
+	}
+	return ret
+}
+
+// printSpans divides [min,max) into spans at most `n` long, each starting on the last square of the one before.
+func printSpans(min, max, n int) [][2]int {
+	ret := [][2]int{}
+	for start := min; ; start += n - 1 {
+		end := start + n
+		if end >= max {
+			return append(ret, [2]int{start, max})
+		}
+		ret = append(ret, [2]int{start, end})
+	}
+}
+
+// printMarkings adds the coordinates, unless `coords` hides them, overlap markers, and page label to page `i` of those
+// laid out in `tiles`.
+func printMarkings(page *pdf.Page, tiles []image.Rectangle, i int, name string, coords conv.Options) {
+	tile := tiles[i]
+	margin := printMargin * pdf.PointsPerInch
+	x := func(col int) float64 { return margin + float64(col-tile.Min.X)*pdf.PointsPerInch }
+	y := func(row int) float64 { return margin + float64(row-tile.Min.Y)*pdf.PointsPerInch }
+	left, top, right, bottom := x(tile.Min.X), y(tile.Min.Y), x(tile.Max.X), y(tile.Max.Y)
+
+	if coords.Placement() != conv.Hidden {
+		for col := tile.Min.X; col < tile.Max.X; col++ {
+			page.TextCentered(x(col)+pdf.PointsPerInch/2, top-10, 10, coords.Column(col))
+		}
+		for row := tile.Min.Y; row < tile.Max.Y; row++ {
+			label := coords.Row(row)
+			page.Text(left-6-pdf.TextWidth(label, 10), y(row)+pdf.PointsPerInch/2+3.5, 10, label)
+		}
+	}
+
+	// Where a neighbouring page shares squares with this one, dash the edge of the shared squares and name the page.
+	for j, other := range tiles {
+		if j == i {
+			continue
+		}
+		shared := other.Intersect(tile)
+		if shared.Empty() {
+			continue
+		}
+		label := fmt.Sprintf("p. %d", j+1)
+		switch {
+		case other.Min.Y == tile.Min.Y && other.Min.X > tile.Min.X:
+			page.Line(x(shared.Min.X), top, x(shared.Min.X), bottom, 0.5, 0, 4)
+			page.Text(right+4, (top+bottom)/2, 8, label)
+		case other.Min.Y == tile.Min.Y && other.Min.X < tile.Min.X:
+			page.Line(x(shared.Max.X), top, x(shared.Max.X), bottom, 0.5, 0, 4)
+			page.Text(4, (top+bottom)/2, 8, label)
+		case other.Min.X == tile.Min.X && other.Min.Y > tile.Min.Y:
+			page.Line(left, y(shared.Min.Y), right, y(shared.Min.Y), 0.5, 0, 4)
+			page.TextCentered((left+right)/2, bottom+10, 8, label)
+		case other.Min.X == tile.Min.X && other.Min.Y < tile.Min.Y:
+			page.Line(left, y(shared.Max.Y), right, y(shared.Max.Y), 0.5, 0, 4)
+			page.TextCentered((left+right)/2, 8, 8, label)
+		}
+	}
+
+	footer := []string{name, fmt.Sprintf("page %d of %d", i+1, len(tiles)), "print at 100% (actual size); 1 square = 1 inch"}
+	page.Text(margin, page.Height-margin/3, 8, strings.Join(footer, " - "))
+}
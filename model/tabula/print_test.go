@@ -0,0 +1,63 @@
+package tabula
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestPrintLayout(t *testing.T) {
+	tiles := printLayout(image.Rect(0, 0, 20, 10), 7, 10)
+	want := []image.Rectangle{image.Rect(0, 0, 7, 10), image.Rect(6, 0, 13, 10), image.Rect(12, 0, 19, 10), image.Rect(18, 0, 20, 10)}
+	if len(tiles) != len(want) {
+		t.Fatalf("got %d pages, not %d: %v", len(tiles), len(want), tiles)
+	}
+	for i := range want {
+		if tiles[i] != want[i] {
+			t.Errorf("page %d was %v, not %v", i+1, tiles[i], want[i])
+		}
+	}
+
+	// Every square should be printed on some page.
+	squares := image.Rect(-3, 2, 31, 41)
+	tiles = printLayout(squares, 7, 10)
+	for y := squares.Min.Y; y < squares.Max.Y; y++ {
+		for x := squares.Min.X; x < squares.Max.X; x++ {
+			found := false
+			for _, tile := range tiles {
+				if image.Pt(x, y).In(tile) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("square (%d,%d) is not on any page", x, y)
+			}
+		}
+	}
+
+	if n := printableSquares(Papers["letter"].Width); n != 7 {
+		t.Errorf("expected 7 squares across letter paper, got %d", n)
+	}
+	if n := printableSquares(Papers["a4"].Height); n != 10 {
+		t.Errorf("expected 10 squares down a4 paper, got %d", n)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	tab, ctx := testTabula()
+	data, err := tab.Print(ctx, Papers["letter"])
+	if err != nil {
+		t.Fatalf("unexpected error printing: %s", err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		t.Fatalf("print is not a PDF")
+	}
+
+	// The map is 41x31 squares, which fits on 5x5 landscape letter pages of 10x7 squares, but would take 7x4 portrait.
+	if n := bytes.Count(data, []byte("/Type /Page ")); n != 25 {
+		t.Fatalf("expected 25 pages, got %d", n)
+	}
+	if !bytes.Contains(data, []byte("/MediaBox [0 0 792 612]")) {
+		t.Fatalf("expected landscape pages")
+	}
+}
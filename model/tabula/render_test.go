@@ -0,0 +1,243 @@
+package tabula
+
+import (
+	"github.com/pdbogen/mapbot/common/cache"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/output"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/terrain"
+	"github.com/pdbogen/mapbot/model/types"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// testContext is just enough of a context.Context to render a map.
+type testContext struct {
+	marks  map[image.Point]map[string]mark.Mark
+	coords conv.Options
+}
+
+func (c *testContext) Type() types.ContextType                              { return "test" }
+func (c *testContext) Id() types.ContextId                                  { return "test" }
+func (c *testContext) GetActiveTabulaId() *types.TabulaId                   { return nil }
+func (c *testContext) SetActiveTabulaId(*types.TabulaId)                    {}
+func (c *testContext) GetZoom() (int, int, int, int)                        { return 0, 0, 0, 0 }
+func (c *testContext) SetZoom(int, int, int, int)                           {}
+func (c *testContext) GetEmoji(string) (image.Image, error)                 { return nil, nil }
+func (c *testContext) IsEmoji(string) bool                                  { return false }
+func (c *testContext) Mark(types.TabulaId, mark.Mark)                       {}
+func (c *testContext) ClearMarks(types.TabulaId)                            {}
+func (c *testContext) GetTerrain(types.TabulaId) terrain.Ground             { return nil }
+func (c *testContext) SetTerrain(types.TabulaId, image.Point, terrain.Kind) {}
+func (c *testContext) ClearTerrain(types.TabulaId)                          {}
+func (c *testContext) Save() error                                          { return nil }
+func (c *testContext) GetLastToken(types.UserId) string                     { return "" }
+func (c *testContext) SetLastToken(types.UserId, string)                    {}
+func (c *testContext) GetOutput() output.Options                            { return output.Options{} }
+func (c *testContext) SetOutput(output.Options)                             {}
+func (c *testContext) GetCoordinates() conv.Options                         { return c.coords }
+func (c *testContext) SetCoordinates(conv.Options)                          {}
+func (c *testContext) GetMarks(types.TabulaId) map[image.Point]map[string]mark.Mark {
+	return c.marks
+}
+
+var _ context.Context = &testContext{}
+
+// testTabula returns a 2000x1500 map at 50 DPI, with a few tokens, lights, marks, and lines on it.
+func testTabula() (*Tabula, context.Context) {
+	bg := image.NewRGBA(image.Rect(0, 0, 2000, 1500))
+	for y := 0; y < 1500; y++ {
+		for x := 0; x < 2000; x++ {
+			bg.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+
+	id := types.TabulaId(1)
+	t := &Tabula{
+		Id:         &id,
+		Url:        "test:render",
+		Background: bg,
+		Dpi:        50,
+		Tokens: map[types.ContextId]map[string]Token{"test": {
+			"alice": {Coordinate: image.Pt(3, 4), Size: 1, TokenColor: color.RGBA{255, 0, 0, 255}, DimLight: 30},
+			"bob":   {Coordinate: image.Pt(10, 12), Size: 2, BrightLight: 20},
+		}},
+		Lights: []Light{{X: 20, Y: 20, Radius: 40, Color: color.NRGBA{255, 255, 255, 255}}},
+		Lines:  []mark.Line{{A: image.Pt(0, 0), B: image.Pt(39, 29), Color: color.Black}},
+	}
+	for x := 0; x < 20; x++ {
+		t.Marks = append(t.Marks, mark.Mark{Point: image.Pt(x, 5), Color: color.NRGBA{0, 0, 255, 127}})
+	}
+	return t, &testContext{marks: map[image.Point]map[string]mark.Mark{
+		image.Pt(7, 7): {"": {Point: image.Pt(7, 7), Color: color.NRGBA{0, 255, 0, 127}}},
+	}}
+}
+
+func TestRender(t *testing.T) {
+	*cache.CacheDir = t.TempDir()
+	cache.Instance, _ = cache.Open()
+	tab, ctx := testTabula()
+
+	img, err := tab.Render(ctx, nil)
+	cache.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error rendering: %s", err)
+	}
+	if img.Bounds().Dx() < 2000 || img.Bounds().Dy() < 1500 {
+		t.Errorf("expected at least 2000x1500 render, got %v", img.Bounds())
+	}
+
+	// Inside a blue mark in row 6, well away from grid lines, coordinates, and lights.
+	r, g, b, _ := img.At(15*50+25, 5*50+25).RGBA()
+	if b>>8 < 100 || r>>8 > 200 || g>>8 > 200 {
+		t.Errorf("expected blue mark to be drawn, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestUnderlay(t *testing.T) {
+	r := image.Rect(0, 0, 7, 5)
+	rgba, nrgba := image.NewRGBA(r), image.NewNRGBA(r)
+	layer := image.NewRGBA(r)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			c := color.NRGBA{uint8(x * 40), uint8(y * 60), 200, uint8(x * y * 10)}
+			rgba.Set(x, y, c)
+			nrgba.Set(x, y, c)
+			layer.Set(x, y, color.NRGBA{255, 0, uint8(x * 30), []uint8{0, 100, 255}[(x+y)%3]})
+		}
+	}
+
+	for name, base := range map[string]image.Image{"rgba": rgba, "nrgba": nrgba, "gray": image.NewGray(r)} {
+		exp := image.NewRGBA(r)
+		draw.Draw(exp, r, base, r.Min, draw.Src)
+		draw.Draw(exp, r, layer, r.Min, draw.Over)
+
+		got := image.NewRGBA(r)
+		copy(got.Pix, layer.Pix)
+		underlay(got, base)
+		// An NRGBA base is premultiplied on the way, which may round differently.
+		for i := range exp.Pix {
+			if d := int(got.Pix[i]) - int(exp.Pix[i]); d < -1 || d > 1 {
+				t.Fatalf("%s: expected layer drawn over base, got %v at byte %d, not %v", name, got.Pix[i], i, exp.Pix[i])
+			}
+		}
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	*cache.CacheDir = b.TempDir()
+	cache.Instance, _ = cache.Open()
+	tab, ctx := testTabula()
+	if _, err := tab.Render(ctx, nil); err != nil {
+		b.Fatal(err)
+	}
+	cache.Flush()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tab.Render(ctx, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBackground(b *testing.B) {
+	tab, _ := testTabula()
+	r := image.Rect(0, 0, 2001, 1501)
+	for i := 0; i < b.N; i++ {
+		tab.addGrid(scaleRegion(tab.Background, r, 1, 1))
+	}
+}
+
+func BenchmarkOverlays(b *testing.B) {
+	tab, ctx := testTabula()
+	bg := tab.addGrid(scaleRegion(tab.Background, image.Rect(0, 0, 2001, 1501), 1, 1))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		img := image.NewRGBA(bg.Bounds())
+		tab.addMarks(img, ctx, image.Point{})
+		tab.addTokenLights(img, ctx, image.Point{})
+		tab.addTokens(img, ctx, image.Point{})
+		tab.addLines(img, ctx, image.Point{})
+		underlay(img, bg)
+		tab.addCoordinates(img, conv.Options{}, 0, 0, image.Point{})
+	}
+}
+
+func BenchmarkUnderlay(b *testing.B) {
+	tab, _ := testTabula()
+	layer := image.NewRGBA(tab.Background.Bounds())
+	for i := 0; i < b.N; i++ {
+		underlay(layer, tab.Background)
+	}
+}
+
+func BenchmarkScaleRegion(b *testing.B) {
+	src := image.NewYCbCr(image.Rect(0, 0, 8000, 6000), image.YCbCrSubsampleRatio420)
+	for i := 0; i < b.N; i++ {
+		scaleRegion(src, image.Rect(0, 0, 2000, 1500), 4, 1)
+	}
+}
+
+func TestRenderKey(t *testing.T) {
+	tab, _ := testTabula()
+	base := tab.renderKey(0, 0, 0, 0)
+
+	changes := map[string]func(*Tabula){
+		"url":        func(t *Tabula) { t.Url = "test:other" },
+		"dpi":        func(t *Tabula) { t.Dpi = 51 },
+		"offset":     func(t *Tabula) { t.OffsetX = 1 },
+		"grid color": func(t *Tabula) { t.GridColor = color.White },
+	}
+	for name, change := range changes {
+		changed := *tab
+		change(&changed)
+		if changed.renderKey(0, 0, 0, 0) == base {
+			t.Errorf("changing %s should change the render key", name)
+		}
+	}
+	if tab.renderKey(0, 0, 5, 5) == base {
+		t.Error("changing the zoom should change the render key")
+	}
+}
+
+func TestHiddenTokens(t *testing.T) {
+	tab, ctx := testTabula()
+	tab.Tokens["test"]["alice"] = tab.Tokens["test"]["alice"].WithHidden(true)
+
+	if _, ok := tab.ShownTokens(ctx)["alice"]; ok {
+		t.Errorf("expected hidden alice to be left out of the channel's tokens")
+	}
+	if _, ok := tab.GMView().ShownTokens(ctx)["alice"]; !ok {
+		t.Errorf("expected hidden alice to be in the GM's tokens")
+	}
+	if tab.GM {
+		t.Errorf("expected GMView to leave the map itself alone")
+	}
+	if alice := tab.Tokens["test"]["alice"]; tab.Shows(alice) || !tab.GMView().Shows(alice) {
+		t.Errorf("expected hidden alice to be shown only in the GM view")
+	}
+
+	// Alice is a red square at (3,4), 50 pixels across.
+	at := image.Pt(3*50+4, 4*50+4)
+
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 1000))
+	if err := tab.addTokens(img, ctx, image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	if c := img.RGBAAt(at.X, at.Y); c.A != 0 {
+		t.Errorf("expected nothing drawn for hidden alice, got %v", c)
+	}
+
+	img = image.NewRGBA(image.Rect(0, 0, 1000, 1000))
+	if err := tab.GMView().addTokens(img, ctx, image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	if c := img.RGBAAt(at.X, at.Y); c.R == 0 || c.A == 0 || c.A == 0xff {
+		t.Errorf("expected hidden alice to be ghosted in the GM view, got %v", c)
+	}
+}
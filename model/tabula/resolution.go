@@ -0,0 +1,108 @@
+package tabula
+
+import (
+	"flag"
+	xdraw "golang.org/x/image/draw"
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// ReferenceSize is the length, in pixels, of the longest side of the background in the coordinate space that the DPI
+// and offsets are measured in. The background is not actually drawn at this size; see Tabula.Render.
+const ReferenceSize = 2000
+
+// minSquareSize is the smallest number of output pixels a grid square may be drawn with, so that tokens and
+// coordinates remain legible on small background images.
+const minSquareSize = 20
+
+var MaxRenderSize = flag.Int("max-render-size", 2000, "largest width or height, in pixels, of a rendered map")
+var MaxSourcePixels = flag.Int("max-source-pixels", 100000000, "largest background image, in total pixels, that will be decoded whole; PNGs are scaled down as they're decoded, and may be larger")
+
+// sourceScale returns the number of source pixels per reference pixel.
+func sourceScale(src image.Image) float64 {
+	longest := src.Bounds().Dx()
+	if dy := src.Bounds().Dy(); dy > longest {
+		longest = dy
+	}
+	return float64(longest) / ReferenceSize
+}
+
+// outputScale picks the number of output pixels per reference pixel for drawing the reference-space region `r`, from
+// a source with `k` source pixels per reference pixel. Images are drawn at their native resolution where possible; so
+// small images are not blown up (unless their squares would be illegibly small), and zooming into a large image shows
+// its detail; but the output never exceeds MaxRenderSize.
+func (t *Tabula) outputScale(k float64, r image.Rectangle) float64 {
+	scale := k
+	if min := minSquareSize / float64(t.Dpi); scale < min {
+		scale = min
+	}
+
+	longest := r.Dx()
+	if r.Dy() > longest {
+		longest = r.Dy()
+	}
+	if max := float64(*MaxRenderSize) / float64(longest); longest > 0 && scale > max {
+		scale = max
+	}
+	return scale
+}
+
+// scaled returns a shallow copy of the tabula with its DPI and offsets multiplied by `scale`, suitable for drawing in
+// output pixels.
+func (t *Tabula) scaled(scale float64) *Tabula {
+	if scale <= 0 {
+		scale = 1
+	}
+	ret := *t
+	ret.Dpi = float32(float64(t.Dpi) * scale)
+	ret.OffsetX = int(math.Round(float64(t.OffsetX) * scale))
+	ret.OffsetY = int(math.Round(float64(t.OffsetY) * scale))
+	return &ret
+}
+
+// scaleRegion returns a new image of the reference-space region `r`, drawn at `scale` output pixels per reference
+// pixel, from `src` which has `k` source pixels per reference pixel. Only the part of the source inside the region is
+// resampled; any part of the region outside the source is left transparent.
+func scaleRegion(src image.Image, r image.Rectangle, k, scale float64) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0,
+		int(math.Ceil(float64(r.Dx())*scale)),
+		int(math.Ceil(float64(r.Dy())*scale)),
+	))
+
+	// The region, in source pixels, clipped to the source.
+	sr := image.Rect(
+		int(math.Floor(float64(r.Min.X)*k)), int(math.Floor(float64(r.Min.Y)*k)),
+		int(math.Ceil(float64(r.Max.X)*k)), int(math.Ceil(float64(r.Max.Y)*k)),
+	).Intersect(src.Bounds())
+	if sr.Empty() {
+		return out
+	}
+
+	// The clipped region, mapped back to output pixels.
+	toOut := scale / k
+	dr := image.Rect(
+		int(math.Round((float64(sr.Min.X)-float64(r.Min.X)*k)*toOut)),
+		int(math.Round((float64(sr.Min.Y)-float64(r.Min.Y)*k)*toOut)),
+		int(math.Round((float64(sr.Max.X)-float64(r.Min.X)*k)*toOut)),
+		int(math.Round((float64(sr.Max.Y)-float64(r.Min.Y)*k)*toOut)),
+	)
+
+	// Scale clips to the bounds of its destination while still mapping all of `dr` onto `sr`, so horizontal bands of
+	// the output can be resampled independently.
+	bands := runtime.GOMAXPROCS(0)
+	height := (out.Rect.Dy() + bands - 1) / bands
+	wg := sync.WaitGroup{}
+	for y := 0; y < out.Rect.Dy(); y += height {
+		band := out.SubImage(image.Rect(0, y, out.Rect.Dx(), y+height)).(draw.Image)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			xdraw.ApproxBiLinear.Scale(band, dr, src, sr, draw.Src, nil)
+		}()
+	}
+	wg.Wait()
+	return out
+}
@@ -0,0 +1,78 @@
+package tabula
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOutputScale(t *testing.T) {
+	tab := &Tabula{Dpi: 50}
+	whole := image.Rect(0, 0, 2000, 1000)
+
+	// A small image is drawn at native resolution rather than blown up.
+	if s := tab.outputScale(0.5, whole); s != 0.5 {
+		t.Errorf("expected native scale 0.5, got %f", s)
+	}
+
+	// ...unless its squares would be too small to read.
+	if s := tab.outputScale(0.1, whole); s != 0.4 {
+		t.Errorf("expected minimum square scale 0.4, got %f", s)
+	}
+
+	// A huge image is capped to MaxRenderSize.
+	if s := tab.outputScale(8, whole); s != float64(*MaxRenderSize)/2000 {
+		t.Errorf("expected capped scale %f, got %f", float64(*MaxRenderSize)/2000, s)
+	}
+
+	// But zooming in on a huge image shows more of its detail.
+	if s := tab.outputScale(8, image.Rect(0, 0, 250, 250)); s != float64(*MaxRenderSize)/250 {
+		t.Errorf("expected zoomed scale %f, got %f", float64(*MaxRenderSize)/250, s)
+	}
+}
+
+func TestScaled(t *testing.T) {
+	tab := &Tabula{Dpi: 50, OffsetX: 3, OffsetY: -5}
+	s := tab.scaled(2)
+	if s.Dpi != 100 || s.OffsetX != 6 || s.OffsetY != -10 {
+		t.Errorf("expected 100dpi at (6,-10), got %.1fdpi at (%d,%d)", s.Dpi, s.OffsetX, s.OffsetY)
+	}
+	if tab.Dpi != 50 || tab.OffsetX != 3 {
+		t.Error("scaled modified the original")
+	}
+}
+
+func TestScaleRegion(t *testing.T) {
+	// A 4000x2000 source, so k=2; the left half red and the right half blue.
+	src := image.NewNRGBA(image.Rect(0, 0, 4000, 2000))
+	for y := 0; y < 2000; y++ {
+		for x := 0; x < 4000; x++ {
+			if x < 2000 {
+				src.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+			} else {
+				src.SetNRGBA(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	// The reference region straddling the middle, drawn at one output pixel per source pixel.
+	out := scaleRegion(src, image.Rect(900, 0, 1100, 100), 2, 2)
+	if out.Bounds() != image.Rect(0, 0, 400, 200) {
+		t.Fatalf("expected 400x200 output, got %v", out.Bounds())
+	}
+	if c := color.NRGBAModel.Convert(out.At(10, 10)).(color.NRGBA); c.R != 255 || c.B != 0 {
+		t.Errorf("expected red on the left, got %v", c)
+	}
+	if c := color.NRGBAModel.Convert(out.At(390, 10)).(color.NRGBA); c.B != 255 || c.R != 0 {
+		t.Errorf("expected blue on the right, got %v", c)
+	}
+
+	// A region hanging off the top-left of the source is transparent there.
+	out = scaleRegion(src, image.Rect(-100, -100, 100, 100), 2, 1)
+	if c := color.NRGBAModel.Convert(out.At(50, 50)).(color.NRGBA); c.A != 0 {
+		t.Errorf("expected transparent padding, got %v", c)
+	}
+	if c := color.NRGBAModel.Convert(out.At(150, 150)).(color.NRGBA); c.R != 255 || c.A != 255 {
+		t.Errorf("expected red image, got %v", c)
+	}
+}
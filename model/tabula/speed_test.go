@@ -0,0 +1,64 @@
+package tabula
+
+import (
+	"github.com/pdbogen/mapbot/model/terrain"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"testing"
+)
+
+func TestRemaining(t *testing.T) {
+	elf := Token{Speed: 30, Moved: 20}
+	if r := elf.Remaining(); r != 10 {
+		t.Errorf("expected 10ft left, got %dft", r)
+	}
+	if r := elf.WithMoved(45).Remaining(); r != 0 {
+		t.Errorf("expected nothing left after moving too far, got %dft", r)
+	}
+}
+
+func TestReachable(t *testing.T) {
+	elf := Token{Coordinate: image.Pt(5, 5), Size: 1}
+	squares := map[image.Point]bool{}
+	for _, pt := range elf.Reachable(10, nil, nil) {
+		squares[pt] = true
+	}
+	// Two squares straight, or one diagonal and one straight, but not two diagonals (15ft).
+	for _, pt := range []image.Point{{5, 5}, {7, 5}, {5, 3}, {6, 7}, {4, 4}} {
+		if !squares[pt] {
+			t.Errorf("expected %v to be reachable in 10ft", pt)
+		}
+	}
+	for _, pt := range []image.Point{{7, 7}, {8, 5}, {3, 3}} {
+		if squares[pt] {
+			t.Errorf("expected %v to be out of reach in 10ft", pt)
+		}
+	}
+	if len(squares) != 21 {
+		t.Errorf("expected 21 squares in reach, got %d", len(squares))
+	}
+
+	// A large token covers the squares beside where it could go, too.
+	ogre := Token{Coordinate: image.Pt(0, 0), Size: 2}
+	if n := len(ogre.Reachable(0, nil, nil)); n != 4 {
+		t.Errorf("expected a standing ogre to cover 4 squares, got %d", n)
+	}
+
+	// A wall to the east and difficult ground to the west keep the elf close on both sides.
+	ground := terrain.Ground{image.Pt(4, 5): terrain.Difficult}
+	walls := []wall.Wall{{A: wall.Point{X: 6, Y: 0}, B: wall.Point{X: 6, Y: 10}}}
+	squares = map[image.Point]bool{}
+	for _, pt := range elf.Reachable(10, ground, walls) {
+		squares[pt] = true
+	}
+	for _, pt := range []image.Point{{4, 5}, {5, 3}, {3, 4}} {
+		if !squares[pt] {
+			t.Errorf("expected %v to be reachable in 10ft", pt)
+		}
+	}
+	for _, pt := range []image.Point{{6, 5}, {7, 5}, {3, 5}} {
+		if squares[pt] {
+			t.Errorf("expected %v to be out of reach past the wall or difficult ground", pt)
+		}
+	}
+}
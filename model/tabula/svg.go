@@ -0,0 +1,287 @@
+package tabula
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/db"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"unicode/utf8"
+)
+
+// SVG renders the map as seen in `ctx` as an SVG document. Rather than being rasterized, the grid, marks, lights,
+// tokens, lines, and coordinates are drawn as shapes and text over the background, which is referenced by `href`; if
+// `href` is empty, the background's original image data is embedded instead, so that the document stands alone.
+//
+// The document's units are the reference pixels that DPI and offsets are measured in; inside it, everything but the
+// background is drawn in a group scaled so that one unit is one square.
+func (t *Tabula) SVG(ctx context.Context, href string) ([]byte, error) {
+	if ctx == nil {
+		return nil, fmt.Errorf("svg of tabula %d received nil context", t.Id)
+	}
+	if t.Dpi == 0 {
+		return nil, errors.New("cannot render tabula with zero DPI")
+	}
+
+	src, err := t.Source(db.Instance, nil)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving background: %s", err)
+	}
+	if href == "" {
+		raw, err := t.RawData(db.Instance)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving background: %s", err)
+		}
+		href = "data:" + http.DetectContentType(raw) + ";base64," + base64.StdEncoding.EncodeToString(raw)
+	}
+
+	minx, miny, maxx, maxy := ctx.GetZoom()
+	maxx, maxy, r := t.region(src, minx, miny, maxx, maxy)
+	k := sourceScale(src)
+
+	// Labels at the edges are drawn in a margin around the squares shown.
+	coords := ctx.GetCoordinates()
+	view := r
+	if coords.Placement() == conv.Edges {
+		view = r.Inset(-int(t.Dpi * labelMargin))
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" `+
+		`width="%d" height="%d" viewBox="%d %d %d %d">`+"\n", view.Dx(), view.Dy(), view.Min.X, view.Min.Y, view.Dx(), view.Dy())
+	if view != r {
+		c, _ := svgColor(edgeBackground)
+		fmt.Fprintf(buf, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`+"\n",
+			view.Min.X, view.Min.Y, view.Dx(), view.Dy(), c)
+	}
+	fmt.Fprintf(buf, `<image x="0" y="0" width="%g" height="%g" preserveAspectRatio="none" xlink:href="%s"/>`+"\n",
+		float64(src.Bounds().Dx())/k, float64(src.Bounds().Dy())/k, html.EscapeString(href))
+	fmt.Fprintf(buf, `<g transform="translate(%d %d) scale(%g)">`+"\n", t.OffsetX, t.OffsetY, t.Dpi)
+
+	t.svgGrid(buf, minx, miny, maxx, maxy)
+
+	buf.WriteString(`<g id="marks">` + "\n")
+	for _, m := range t.allMarks(ctx) {
+		t.svgMark(buf, m)
+	}
+	buf.WriteString("</g>\n")
+
+	lights, err := t.lightMarks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(`<g id="lighting">` + "\n")
+	for _, m := range lights {
+		t.svgMark(buf, m)
+	}
+	buf.WriteString("</g>\n")
+
+	if edges := t.threatOutlines(ctx); len(edges) > 0 {
+		path := &bytes.Buffer{}
+		for _, e := range edges {
+			fmt.Fprintf(path, "M%d %dL%d %d", e[0].X, e[0].Y, e[1].X, e[1].Y)
+		}
+		c, a := svgColor(threatColor)
+		fmt.Fprintf(buf, `<path id="threats" d="%s" fill="none" stroke="%s" stroke-opacity="%g" stroke-width="2" `+
+			`vector-effect="non-scaling-stroke"/>`+"\n", path, c, a)
+	}
+
+	buf.WriteString(`<g id="tokens">` + "\n")
+	if err := t.svgTokens(buf, ctx); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</g>\n")
+
+	buf.WriteString(`<g id="lines">` + "\n")
+	for _, l := range t.Lines {
+		from, to := lineEnds(l)
+		c, a := svgColor(l.Color)
+		fmt.Fprintf(buf, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s" stroke-opacity="%g" stroke-width="1" `+
+			`vector-effect="non-scaling-stroke"/>`+"\n", from.X, from.Y, to.X, to.Y, c, a)
+	}
+	buf.WriteString("</g>\n")
+
+	buf.WriteString(`<g id="coordinates">` + "\n")
+	family := fontNamed(coords.Font).family
+	cols, rows := maxx-minx+1, maxy-miny+1
+	switch coords.Placement() {
+	case conv.Inside:
+		for _, l := range coordinateLabels(coords.Notation, minx, miny, cols, rows) {
+			svgText(buf, l, family)
+		}
+	case conv.Edges:
+		for _, l := range edgeLabels(coords.Notation, minx, miny, cols, rows,
+			float32(r.Dx())/t.Dpi, float32(r.Dy())/t.Dpi, labelMargin) {
+			svgText(buf, l, family)
+		}
+	}
+	buf.WriteString("</g>\n")
+
+	buf.WriteString("</g>\n</svg>\n")
+	return buf.Bytes(), nil
+}
+
+// svgGrid draws the grid lines around the squares from (minx,miny) to (maxx,maxy), in the grid's style. As in addGrid,
+// a black grid gets a white line down the middle, so that it can be seen on dark maps.
+func (t *Tabula) svgGrid(w io.Writer, minx, miny, maxx, maxy int) {
+	if t.gridStyle() == GridNone {
+		return
+	}
+
+	var col color.Color = t.GridColor
+	if col == nil {
+		col = color.Black
+	}
+	c, _ := svgColor(col)
+
+	path := &bytes.Buffer{}
+	for x := minx; x <= maxx+1; x++ {
+		fmt.Fprintf(path, "M%d %dV%d", x, miny, maxy+1)
+	}
+	for y := miny; y <= maxy+1; y++ {
+		fmt.Fprintf(path, "M%d %dH%d", minx, y, maxx+1)
+	}
+
+	// Widths and dashes are in pixels, and so are divided by the DPI to be in squares, like everything else here.
+	dpi := float64(t.Dpi)
+	dashes := ""
+	if on, period := t.gridPattern(); period > 0 {
+		dashes = fmt.Sprintf(` stroke-dasharray="%g %g"`, on/dpi, (period-on)/dpi)
+	}
+	width := float64(t.gridWidth())
+
+	fmt.Fprintf(w, `<g id="grid" fill="none" opacity="%g">`+"\n", float64(t.gridAlpha())/255)
+	if r, g, b, _ := col.RGBA(); r == 0 && g == 0 && b == 0 {
+		fmt.Fprintf(w, `<path d="%s" stroke="%s" stroke-width="%g"%s/>`+"\n", path, c, (width+2)/dpi, dashes)
+		fmt.Fprintf(w, `<path d="%s" stroke="#ffffff" stroke-width="%g"%s/>`+"\n", path, width/dpi, dashes)
+	} else {
+		fmt.Fprintf(w, `<path d="%s" stroke="%s" stroke-width="%g"%s/>`+"\n", path, c, width/dpi, dashes)
+	}
+	fmt.Fprintf(w, "</g>\n")
+}
+
+func (t *Tabula) svgMark(w io.Writer, m mark.Mark) {
+	minX, minY, maxX, maxY, inset := markBounds(m)
+	t.svgRect(w, minX, minY, maxX, maxY, inset, m.Color)
+}
+
+// svgRect draws a rectangle in squares, inset by `inset` reference pixels on each side.
+func (t *Tabula) svgRect(w io.Writer, minX, minY, maxX, maxY float32, inset int, col color.Color) {
+	in := float32(inset) / t.Dpi
+	c, a := svgColor(col)
+	fmt.Fprintf(w, `<rect x="%g" y="%g" width="%g" height="%g" fill="%s" fill-opacity="%g"/>`+"\n",
+		minX+in, minY+in, maxX-minX-2*in, maxY-minY-2*in, c, a)
+}
+
+func (t *Tabula) svgTokens(w io.Writer, ctx context.Context) error {
+	tokens := t.ShownTokens(ctx)
+	boxes := tokenBoxes(tokens)
+	for _, tokenName := range tokenOrder(tokens) {
+		token, box := tokens[tokenName], boxes[tokenName]
+		x, y, size := box.x, box.y, box.size
+		name, label := splitTokenName(tokenName)
+
+		ghost := ""
+		if token.Hidden {
+			ghost = fmt.Sprintf(` opacity="%.2f"`, float64(ghostAlpha)/0xff)
+		}
+		fmt.Fprintf(w, `<g class="token" data-name="%s"%s>`+"\n", html.EscapeString(tokenName), ghost)
+		if _, _, _, a := token.Color().RGBA(); a > 0 {
+			t.svgRect(w, x, y, x+size, y+size, 1, token.Color())
+		}
+
+		drawn := false
+		if ctx.IsEmoji(name) {
+			if emoji, err := ctx.GetEmoji(name); err != nil {
+				log.Warningf("error obtaining emoji %q: %s", name, err)
+			} else if uri, err := dataUri(emoji); err != nil {
+				log.Warningf("error encoding emoji %q: %s", name, err)
+			} else {
+				in := 2 / t.Dpi
+				fmt.Fprintf(w, `<image x="%g" y="%g" width="%g" height="%g" xlink:href="%s"/>`+"\n",
+					x+in, y+in, size-2*in, size-2*in, uri)
+				if label != "" {
+					svgText(w, labelAt(label, x, y+size/2, size, size/2, Bottom, Center), fonts[DefaultFont].family)
+				}
+				drawn = true
+			}
+		}
+		if !drawn {
+			svgText(w, labelAt(name, x, y, size, size, Middle, Center), fonts[DefaultFont].family)
+		}
+		if token.HasFacing {
+			pts := wedge(token, box)
+			c, a := svgColor(wedgeColor(token))
+			fmt.Fprintf(w, `<polygon class="facing" points="%g,%g %g,%g %g,%g" fill="%s" fill-opacity="%g"/>`+"\n",
+				pts[0][0], pts[0][1], pts[1][0], pts[1][1], pts[2][0], pts[2][1], c, a)
+		}
+		if token.Elevation != 0 {
+			bx, by, bw, bh := badge(box)
+			t.svgRect(w, bx, by, bx+bw, by+bh, 0, badgeColor)
+			svgText(w, labelAt(ElevationLabel(token.Elevation), bx, by, bw, bh, Middle, Center), fonts[DefaultFont].family)
+		}
+		fmt.Fprintf(w, "</g>\n")
+	}
+	return nil
+}
+
+func labelAt(text string, x, y, width, height float32, valign VerticalAlignment, halign HorizontalAlignment) label {
+	return label{text, x, y, width, height, valign, halign}
+}
+
+// svgText draws a label in the style of glyph: white, outlined in black, and as large as fits in its rectangle. The
+// text's width is estimated, since the viewer will choose the actual font from `family`.
+func svgText(w io.Writer, l label, family string) {
+	size := l.height * 0.9
+	if n := utf8.RuneCountInString(l.text); n > 0 {
+		if fit := l.width / (0.6 * float32(n)); fit < size {
+			size = fit
+		}
+	}
+
+	x, anchor := l.x, "start"
+	switch l.halign {
+	case Center:
+		x, anchor = l.x+l.width/2, "middle"
+	case Right:
+		x, anchor = l.x+l.width, "end"
+	}
+	y := l.y + l.height/2
+	switch l.valign {
+	case Top:
+		y = l.y + size/2
+	case Bottom:
+		y = l.y + l.height - size/2
+	}
+
+	fmt.Fprintf(w, `<text x="%g" y="%g" font-size="%g" text-anchor="%s" dominant-baseline="central" `+
+		`font-family="%s" fill="#ffffff" stroke="#000000" stroke-width="%g" paint-order="stroke">%s</text>`+"\n",
+		x, y, size, anchor, html.EscapeString(family), size*0.15, html.EscapeString(l.text))
+}
+
+// svgColor returns the color as #rrggbb, and its opacity.
+func svgColor(c color.Color) (string, float64) {
+	if c == nil {
+		return "#000000", 0
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x", n.R, n.G, n.B), float64(n.A) / 255
+}
+
+func dataUri(img image.Image) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,69 @@
+package tabula
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+func TestSVG(t *testing.T) {
+	tab, ctx := testTabula()
+
+	doc, err := tab.SVG(ctx, "bg.png")
+	if err != nil {
+		t.Fatalf("unexpected error rendering svg: %s", err)
+	}
+
+	counts := map[string]int{}
+	texts := map[string]bool{}
+	var href string
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	inText := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("svg is not well-formed: %s", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			counts[el.Name.Local]++
+			inText = el.Name.Local == "text"
+			if el.Name.Local == "image" && href == "" {
+				for _, a := range el.Attr {
+					if a.Name.Local == "href" {
+						href = a.Value
+					}
+				}
+			}
+		case xml.CharData:
+			if inText {
+				texts[string(el)] = true
+			}
+		case xml.EndElement:
+			inText = false
+		}
+	}
+
+	if href != "bg.png" {
+		t.Errorf("background href was %q, not bg.png", href)
+	}
+	if counts["svg"] != 1 {
+		t.Errorf("expected one svg element, got %d", counts["svg"])
+	}
+	// 20 marks on the map, one in the context, two tokens, and some amount of light.
+	if counts["rect"] < 23 {
+		t.Errorf("expected at least 23 rects, got %d", counts["rect"])
+	}
+	if counts["line"] != 1 {
+		t.Errorf("expected one line, got %d", counts["line"])
+	}
+	for _, want := range []string{"alice", "bob", "A", "BN", "1", "30"} {
+		if !texts[want] {
+			t.Errorf("expected text %q in svg", want)
+		}
+	}
+}
@@ -21,17 +21,19 @@ import (
 	"github.com/pdbogen/mapbot/model/mark"
 	"github.com/pdbogen/mapbot/model/mask"
 	"github.com/pdbogen/mapbot/model/types"
+	"github.com/pdbogen/mapbot/model/wall"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
 	"image"
 	"image/color"
 	"image/draw"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"strconv"
+	"runtime"
+	"sync"
 	"time"
 )
 
@@ -40,24 +42,34 @@ var log = mbLog.Log
 type TabulaName string
 
 type Tabula struct {
-	Id         *types.TabulaId
-	Name       TabulaName
-	Url        string
-	Background *image.RGBA
-	OffsetX    int
-	OffsetY    int
-	Dpi        float32
-	GridColor  color.Color
-	Masks      map[string]*mask.Mask
-	Note       string // Not saved to database; just used when rendering.
-	Tokens     map[types.ContextId]map[string]Token
-	Version    int
+	Id          *types.TabulaId
+	Name        TabulaName
+	Url         string
+	Background  image.Image
+	OffsetX     int
+	OffsetY     int
+	Dpi         float32
+	GridColor   color.Color
+	GridStyle   GridStyle
+	GridWidth   int // in pixels; if zero, 1
+	GridOpacity int // percent; if zero, 100
+	Masks       map[string]*mask.Mask
+	Note        string // Not saved to database; just used when rendering.
+	GM          bool   // Not saved to database; renders hidden tokens, ghosted, for the GM's eyes only.
+	Tokens      map[types.ContextId]map[string]Token
+	Version     int
 
 	// A list of marks appended to marks obtained from the context during rendering.
 	Marks []mark.Mark
 
 	// A list of lines appended to lines obtained from the context during rendering.
 	Lines []mark.Line
+
+	// Walls and doors belonging to the map itself, in grid units.
+	Walls []wall.Wall
+
+	// Light sources belonging to the map itself; drawn beneath token lights.
+	Lights []Light
 }
 
 func (t *Tabula) String() string {
@@ -71,7 +83,7 @@ func Load(db anydb.AnyDb, id types.TabulaId) (*Tabula, error) {
 		return t, nil
 	}
 
-	res, err := db.Query("SELECT name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, version FROM tabulas WHERE id=$1", int64(id))
+	res, err := db.Query("SELECT name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, grid_style, grid_width, grid_opacity, version FROM tabulas WHERE id=$1", int64(id))
 	if err != nil {
 		return nil, err
 	}
@@ -92,6 +104,7 @@ func Load(db anydb.AnyDb, id types.TabulaId) (*Tabula, error) {
 	if err := res.Scan(
 		&(ret.Name), &(ret.Url), &(ret.OffsetX), &(ret.OffsetY), &(ret.Dpi),
 		&r, &g, &b, &a,
+		&(ret.GridStyle), &(ret.GridWidth), &(ret.GridOpacity),
 		&(ret.Version),
 	); err != nil {
 		return nil, fmt.Errorf("retrieving columns: %s", err)
@@ -112,6 +125,14 @@ func Load(db anydb.AnyDb, id types.TabulaId) (*Tabula, error) {
 		return nil, fmt.Errorf("loading tokens: %s", err)
 	}
 
+	if err := ret.loadWalls(db); err != nil {
+		return nil, fmt.Errorf("loading walls: %s", err)
+	}
+
+	if err := ret.loadLights(db); err != nil {
+		return nil, fmt.Errorf("loading lights: %s", err)
+	}
+
 	return ret, nil
 }
 
@@ -172,7 +193,7 @@ func (t *Tabula) Save(db anydb.AnyDb) error {
 			log.Trace("attempting rollback")
 			if rbErr := tx.Rollback(); rbErr != nil {
 				log.WithError(rbErr).Error("rollback failed")
-				err = fmt.Errorf("%v and during rollback: %v", rbErr)
+				err = fmt.Errorf("%v and during rollback: %v", err, rbErr)
 			}
 		}
 	}
@@ -191,19 +212,19 @@ func (t *Tabula) SaveTx(dialect string, tx *sql.Tx) error {
 		var q string
 		switch dialect {
 		case "sqlite3":
-			q = "INSERT INTO tabulas (name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, version) " +
-				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) " +
+			q = "INSERT INTO tabulas (name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, grid_style, grid_width, grid_opacity, version) " +
+				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) " +
 				"; SELECT last_insert_rowid()"
 		case "postgresql":
-			q = "INSERT INTO tabulas (name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, version) " +
-				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) " +
+			q = "INSERT INTO tabulas (name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, grid_style, grid_width, grid_opacity, version) " +
+				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) " +
 				"RETURNING id"
 		default:
 			return fmt.Errorf("no Tabula.Save (update) query for SQL dialect %s", dialect)
 		}
 
 		result, err := tx.Query(q,
-			string(t.Name), t.Url, t.OffsetX, t.OffsetY, t.Dpi, r, g, b, a, t.Version,
+			string(t.Name), t.Url, t.OffsetX, t.OffsetY, t.Dpi, r, g, b, a, string(t.GridStyle), t.GridWidth, t.GridOpacity, t.Version,
 		)
 
 		if err != nil {
@@ -226,19 +247,20 @@ func (t *Tabula) SaveTx(dialect string, tx *sql.Tx) error {
 		var query string
 		switch dialect {
 		case "postgresql":
-			query = "INSERT INTO tabulas (id, name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a) " +
-				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) " +
+			query = "INSERT INTO tabulas (id, name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, grid_style, grid_width, grid_opacity) " +
+				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) " +
 				"ON CONFLICT (id) DO UPDATE SET name=$2, url=$3, offset_x=$4, offset_y=$5, dpi=$6, " +
-				"grid_r=$7, grid_g=$8, grid_b=$9, grid_a=$10"
+				"grid_r=$7, grid_g=$8, grid_b=$9, grid_a=$10, grid_style=$11, grid_width=$12, grid_opacity=$13"
 		case "sqlite3":
-			query = "REPLACE INTO tabula (id, name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a) " +
-				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+			query = "REPLACE INTO tabula (id, name, url, offset_x, offset_y, dpi, grid_r, grid_g, grid_b, grid_a, grid_style, grid_width, grid_opacity) " +
+				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)"
 		default:
 			return fmt.Errorf("no Tabula.Save query for SQL dialect %s", dialect)
 		}
 
 		_, err := tx.Exec(query,
 			int64(*t.Id), string(t.Name), t.Url, t.OffsetX, t.OffsetY, t.Dpi, r, g, b, a,
+			string(t.GridStyle), t.GridWidth, t.GridOpacity,
 		)
 		if err != nil {
 			return err
@@ -259,6 +281,18 @@ func (t *Tabula) SaveTx(dialect string, tx *sql.Tx) error {
 		}
 	}
 
+	if t.Walls != nil {
+		if err := t.saveWallsTx(dialect, tx); err != nil {
+			return err
+		}
+	}
+
+	if t.Lights != nil {
+		if err := t.saveLightsTx(dialect, tx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -276,6 +310,23 @@ func (t *Tabula) Hydrate(db anydb.AnyDb) error {
 		return nil
 	}
 
+	imgData, err := t.RawData(db)
+	if err != nil {
+		return err
+	}
+
+	img, err := decodeBackground(imgData)
+	if err != nil {
+		return err
+	}
+
+	t.Background = img
+	return nil
+}
+
+// RawData returns the undecoded background image: the copy saved in the database if there is one, or else whatever is
+// at the tabula's URL.
+func (t *Tabula) RawData(db anydb.AnyDb) ([]byte, error) {
 	c := http.Client{
 		Timeout: 30 * time.Second,
 	}
@@ -300,42 +351,19 @@ func (t *Tabula) Hydrate(db anydb.AnyDb) error {
 	if imgData == nil {
 		res, err := c.Get(t.Url)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer res.Body.Close()
 
 		imgBuf := &bytes.Buffer{}
 		if _, err := io.Copy(imgBuf, res.Body); err != nil {
-			return fmt.Errorf("error reading from HTTP response: %s", err)
+			return nil, fmt.Errorf("error reading from HTTP response: %s", err)
 		}
 
 		imgData = imgBuf.Bytes()
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(imgData))
-	if err != nil {
-		n := 16
-		if len(imgData) < 16 {
-			n = len(imgData)
-		}
-		return fmt.Errorf("received image data (%q…), but: %s", imgData[0:n], err)
-	}
-
-	var ret *image.RGBA
-	switch i := img.(type) {
-	case (*image.RGBA):
-		ret = i
-	default:
-		ret = image.NewRGBA(img.Bounds())
-		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
-			for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
-				ret.Set(x, y, img.At(x, y))
-			}
-		}
-	}
-
-	t.Background = ret
-	return nil
+	return imgData, nil
 }
 
 func (t *Tabula) addGrid(i draw.Image) draw.Image {
@@ -344,19 +372,12 @@ func (t *Tabula) addGrid(i draw.Image) draw.Image {
 
 	log.Debugf("adding grid to image with bounds %v at spacing %.02f", i.Bounds(), t.Dpi)
 
-	//xOff := float32(t.OffsetX)
-	//for xOff > 0 {
-	//	xOff -= t.Dpi
-	//}
-	//
-	//yOff := float32(t.OffsetY)
-	//for yOff > 0 {
-	//	yOff -= t.Dpi
-	//}
-
-	xOff := float32(0)
-	yOff := float32(0)
+	if t.gridStyle() == GridNone {
+		return gridded
+	}
 
+	// A black grid is drawn a pixel wider on each side, with a white line down the middle, so that it shows up on
+	// dark maps too.
 	blackOnWhite := false
 	var col color.Color = t.GridColor
 	if col == nil {
@@ -368,50 +389,48 @@ func (t *Tabula) addGrid(i draw.Image) draw.Image {
 		blackOnWhite = true
 	}
 
-	for x := xOff; x < float32(bounds.Max.X); x += t.Dpi {
-		if blackOnWhite {
-			mbDraw.Line(gridded, image.Pt(int(x-1), 0), image.Pt(int(x-1), bounds.Max.Y), col)
-			mbDraw.Line(gridded, image.Pt(int(x+1), 0), image.Pt(int(x+1), bounds.Max.Y), col)
-		}
-		mbDraw.Line(gridded, image.Pt(int(x), 0), image.Pt(int(x), bounds.Max.Y), col)
-	}
-
-	// Horizontal lines; Y at DPI intervals, all X
-	for y := yOff; y < float32(bounds.Max.Y); y += t.Dpi {
-		if blackOnWhite {
-			mbDraw.Line(gridded, image.Pt(0, int(y-1)), image.Pt(bounds.Max.X, int(y-1)), col)
-			mbDraw.Line(gridded, image.Pt(0, int(y+1)), image.Pt(bounds.Max.X, int(y+1)), col)
-		}
-		mbDraw.Line(gridded, image.Pt(0, int(y)), image.Pt(bounds.Max.X, int(y)), col)
-	}
-
+	// The lines are drawn into masks and then blended onto the image once, so that translucent grids aren't darker
+	// where lines cross.
+	width := t.gridWidth()
 	if blackOnWhite {
-		for x := xOff; x < float32(bounds.Max.X); x += t.Dpi {
-			mbDraw.Line(gridded, image.Pt(int(x), 0), image.Pt(int(x), bounds.Max.Y), color.White)
-		}
-		for y := yOff; y < float32(bounds.Max.Y); y += t.Dpi {
-			mbDraw.Line(gridded, image.Pt(0, int(y)), image.Pt(bounds.Max.X, int(y)), color.White)
-		}
+		outline := t.gridMask(bounds, width+2)
+		mbDraw.BlendMask(gridded, outline, col, t.gridAlpha())
+		mbDraw.BlendMask(gridded, t.gridMask(bounds, width), color.White, t.gridAlpha())
+	} else {
+		mbDraw.BlendMask(gridded, t.gridMask(bounds, width), col, t.gridAlpha())
 	}
 
 	return gridded
 }
 
-var font *truetype.Font
+// gridMask returns a mask of the grid lines, `width` pixels wide, over an image with the given bounds.
+func (t *Tabula) gridMask(bounds image.Rectangle, width int) *image.Alpha {
+	mask := image.NewAlpha(bounds)
+	before := (width - 1) / 2
 
-func init() {
-	path := "fonts/DejaVuSerif.ttf"
-	fontData, err := ioutil.ReadFile(path)
-	if err != nil {
-		fontData, err = ioutil.ReadFile("../../" + path)
-		if err != nil {
-			panic(fmt.Sprintf("reading %s: %s", path, err))
+	// Vertical lines; X at DPI intervals, all Y
+	for x := float32(0); x < float32(bounds.Max.X); x += t.Dpi {
+		for _, dash := range t.gridDashes(bounds.Max.Y) {
+			fillAlpha(mask, image.Rect(int(x)-before, dash[0], int(x)-before+width, dash[1]))
 		}
 	}
 
-	font, err = freetype.ParseFont(fontData)
-	if err != nil {
-		panic(fmt.Sprintf("parsing %s: %s", path, err))
+	// Horizontal lines; Y at DPI intervals, all X
+	for y := float32(0); y < float32(bounds.Max.Y); y += t.Dpi {
+		for _, dash := range t.gridDashes(bounds.Max.X) {
+			fillAlpha(mask, image.Rect(dash[0], int(y)-before, dash[1], int(y)-before+width))
+		}
+	}
+	return mask
+}
+
+func fillAlpha(mask *image.Alpha, r image.Rectangle) {
+	r = r.Intersect(mask.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := mask.Pix[mask.PixOffset(r.Min.X, y):mask.PixOffset(r.Max.X, y)]
+		for i := range row {
+			row[i] = 255
+		}
 	}
 }
 
@@ -419,9 +438,11 @@ type dimension struct {
 	w, h   float32
 	valign VerticalAlignment
 	halign HorizontalAlignment
+	font   *truetype.Font
 }
 
 var coordCache map[dimension]map[string]*image.RGBA
+var coordCacheMu sync.Mutex
 
 type VerticalAlignment int
 
@@ -439,9 +460,12 @@ const (
 	Right
 )
 
-// glyph renders the string given by `s` so that it fits horizontally in the rectangle given by (width,height)
-func glyph(s string, width float32, height float32, valign VerticalAlignment, halign HorizontalAlignment) *image.RGBA {
-	dim := dimension{width, height, valign, halign}
+// glyph renders the string given by `s` in font `f` so that it fits horizontally in the rectangle given by
+// (width,height)
+func glyph(f *truetype.Font, s string, width float32, height float32, valign VerticalAlignment, halign HorizontalAlignment) *image.RGBA {
+	dim := dimension{width, height, valign, halign, f}
+	coordCacheMu.Lock()
+	defer coordCacheMu.Unlock()
 	if coordCache == nil {
 		coordCache = map[dimension]map[string]*image.RGBA{}
 	}
@@ -462,7 +486,7 @@ func glyph(s string, width float32, height float32, valign VerticalAlignment, ha
 	ctx := freetype.NewContext()
 	ctx.SetClip(img.Bounds())
 	ctx.SetDst(img)
-	ctx.SetFont(font)
+	ctx.SetFont(f)
 	ctx.SetDPI(72.0)
 	ctx.SetFontSize(float64(height))
 	ctx.SetSrc(image.Black)
@@ -513,11 +537,7 @@ func align(i image.Image, width int, height int, halign HorizontalAlignment, val
 	}
 
 	result := image.NewRGBA(image.Rect(0, 0, width, height))
-	for x := i.Bounds().Min.X; x < i.Bounds().Max.X; x++ {
-		for y := i.Bounds().Min.Y; y < i.Bounds().Max.Y; y++ {
-			result.Set(x+offsetX, y+offsetY, i.At(x, y))
-		}
-	}
+	draw.Draw(result, i.Bounds().Add(image.Pt(offsetX, offsetY)), i, i.Bounds().Min, draw.Src)
 	return result
 }
 
@@ -527,11 +547,20 @@ func autocrop(i image.Image) *image.RGBA {
 	max_x := i.Bounds().Max.X
 	max_y := i.Bounds().Max.Y
 
+	opaque := func(x, y int) bool {
+		_, _, _, a := i.At(x, y).RGBA()
+		return a > 0
+	}
+	if rgba, ok := i.(*image.RGBA); ok {
+		opaque = func(x, y int) bool {
+			return (image.Point{x, y}).In(rgba.Rect) && rgba.Pix[rgba.PixOffset(x, y)+3] > 0
+		}
+	}
+
 min_y:
 	for y := min_y; y < max_y; y++ {
 		for x := min_x; x < max_x; x++ {
-			_, _, _, a := i.At(x, y).RGBA()
-			if a > 0 {
+			if opaque(x, y) {
 				min_y = y
 				break min_y
 			}
@@ -541,8 +570,7 @@ min_y:
 max_y:
 	for y := max_y; y > min_y; y-- {
 		for x := min_x; x < max_x; x++ {
-			_, _, _, a := i.At(x, y).RGBA()
-			if a > 0 {
+			if opaque(x, y) {
 				max_y = y
 				break max_y
 			}
@@ -552,8 +580,7 @@ max_y:
 min_x:
 	for x := min_x; x < max_x; x++ {
 		for y := min_y; y < max_y; y++ {
-			_, _, _, a := i.At(x, y).RGBA()
-			if a > 0 {
+			if opaque(x, y) {
 				min_x = x
 				break min_x
 			}
@@ -563,8 +590,7 @@ min_x:
 max_x:
 	for x := max_x; x > min_x; x-- {
 		for y := min_y; y < max_y; y++ {
-			_, _, _, a := i.At(x, y).RGBA()
-			if a > 0 {
+			if opaque(x, y) {
 				max_x = x
 				break max_x
 			}
@@ -589,19 +615,7 @@ func Crop(i image.Image, min_x, min_y, max_x, max_y int) *image.RGBA {
 	}
 
 	result := image.NewRGBA(image.Rect(0, 0, max_x-min_x, max_y-min_y))
-	for x := min_x; x < max_x; x++ {
-		srcX := x - offset_x
-		if srcX < 0 || srcX > i.Bounds().Max.X {
-			continue
-		}
-		for y := min_y; y < max_y; y++ {
-			srcY := y - offset_y
-			if srcY < 0 || srcY > i.Bounds().Max.Y {
-				continue
-			}
-			result.Set(x-min_x, y-min_y, i.At(srcX, srcY))
-		}
-	}
+	draw.Draw(result, result.Bounds(), i, image.Pt(min_x-offset_x, min_y-offset_y), draw.Src)
 	return result
 }
 
@@ -615,17 +629,10 @@ func (t *Tabula) line(i draw.Image, fromX, fromY, toX, toY float32, col color.Co
 }
 
 func (t *Tabula) squareAtFloat(i draw.Image, minX, minY, maxX, maxY float32, inset int, col color.Color, offset image.Point) {
-	for x := int(minX*t.Dpi) + offset.X + inset; x < int(maxX*t.Dpi)+offset.X-inset; x++ {
-		if x < 0 {
-			continue
-		}
-		for y := int(minY*t.Dpi) + offset.Y + inset; y < int(maxY*t.Dpi)+offset.Y-inset; y++ {
-			if y < 0 {
-				continue
-			}
-			mbDraw.BlendAt(i, x, y, col)
-		}
-	}
+	mbDraw.BlendRect(i, image.Rect(
+		int(minX*t.Dpi)+offset.X+inset, int(minY*t.Dpi)+offset.Y+inset,
+		int(maxX*t.Dpi)+offset.X-inset, int(maxY*t.Dpi)+offset.Y-inset,
+	), col)
 }
 
 func (t *Tabula) squareAt(i draw.Image, bounds image.Rectangle, inset int, col color.Color, offset image.Point) {
@@ -635,7 +642,12 @@ func (t *Tabula) squareAt(i draw.Image, bounds image.Rectangle, inset int, col c
 // drawAt *modifies* the image given by `i` so that the string given by `what` is printed in the square at tabula
 // coordinates x,y (not image coordinates), scaled so that the string occupies a rectangle described by (width,height) tabula squares
 func (t *Tabula) printAt(i draw.Image, what string, x float32, y float32, width float32, height float32, valign VerticalAlignment, halign HorizontalAlignment, offset image.Point) {
-	g := glyph(what, t.Dpi*width, t.Dpi*height, valign, halign)
+	t.printIn(i, font, what, x, y, width, height, valign, halign, offset)
+}
+
+// printIn is printAt, but in the font `f`.
+func (t *Tabula) printIn(i draw.Image, f *truetype.Font, what string, x float32, y float32, width float32, height float32, valign VerticalAlignment, halign HorizontalAlignment, offset image.Point) {
+	g := glyph(f, what, t.Dpi*width, t.Dpi*height, valign, halign)
 	draw.Draw(
 		i,
 		image.Rect(
@@ -648,34 +660,101 @@ func (t *Tabula) printAt(i draw.Image, what string, x float32, y float32, width
 	)
 }
 
-func (t *Tabula) addCoordinates(i draw.Image, first_x, first_y int, offset image.Point) draw.Image {
-	result := i //copyImage(i)
+// label is text to be drawn in the rectangle of (width,height) squares whose upper left is at square (x,y).
+type label struct {
+	text          string
+	x, y          float32
+	width, height float32
+	valign        VerticalAlignment
+	halign        HorizontalAlignment
+}
 
-	rows := int(float32(i.Bounds().Max.Y)/t.Dpi + 0.2)
-	cols := int(float32(i.Bounds().Max.X)/t.Dpi + 0.2)
+// coordinateLabels returns the column names along the top, and row names down the left, of `cols` by `rows` squares
+// starting with (first_x,first_y), in notation `n`.
+func coordinateLabels(n conv.Notation, first_x, first_y, cols, rows int) []label {
+	ret := []label{}
 	// 0 1 2 3 4 ... 25 26 27 28
 	// A B C D E ... Y  Z  BA BB
 	for x := first_x; x < first_x+cols; x++ {
-		t.printAt(result, conv.ToLetter(x), float32(x), float32(first_y), 1, 0.5, Middle, Left, offset)
+		ret = append(ret, label{n.Column(x), float32(x), float32(first_y), 1, 0.5, Middle, Left})
 	}
 
 	for y := first_y; y < first_y+rows; y++ {
-		if y < 0 {
-			t.printAt(result, strconv.Itoa(y), float32(first_x), float32(y)+0.5, 1, 0.5, Middle, Right, offset)
-		} else {
-			t.printAt(result, strconv.Itoa(y+1), float32(first_x), float32(y)+0.5, 1, 0.5, Middle, Right, offset)
+		ret = append(ret, label{n.Row(y), float32(first_x), float32(y) + 0.5, 1, 0.5, Middle, Right})
+	}
+	return ret
+}
+
+// edgeLabels returns the column names above and below, and the row names left and right, of `cols` by `rows` squares
+// starting with (first_x,first_y), in notation `n`. The labels are `depth` squares deep, outside the squares, which
+// extend `width` by `height` squares.
+func edgeLabels(n conv.Notation, first_x, first_y, cols, rows int, width, height, depth float32) []label {
+	ret := []label{}
+	top, bottom := float32(first_y)-depth, float32(first_y)+height
+	for x := first_x; x < first_x+cols; x++ {
+		ret = append(ret,
+			label{n.Column(x), float32(x), top, 1, depth, Middle, Center},
+			label{n.Column(x), float32(x), bottom, 1, depth, Middle, Center},
+		)
+	}
+
+	left, right := float32(first_x)-depth, float32(first_x)+width
+	for y := first_y; y < first_y+rows; y++ {
+		mid := float32(y) + (1-depth)/2
+		ret = append(ret,
+			label{n.Row(y), left, mid, depth, depth, Middle, Center},
+			label{n.Row(y), right, mid, depth, depth, Middle, Center},
+		)
+	}
+	return ret
+}
+
+// labelMargin is how deep, in squares, the margin holding labels at the edges of a map is.
+const labelMargin = 0.5
+
+// edgeBackground is the color of the margin holding labels at the edges of a map.
+var edgeBackground = color.Gray{Y: 0x33}
+
+// addCoordinates labels the squares of `i`, the first of which is (first_x,first_y), as `opts` prescribe. Labels at the
+// edges are drawn in a margin added around `i`, so the returned image is larger.
+func (t *Tabula) addCoordinates(i draw.Image, opts conv.Options, first_x, first_y int, offset image.Point) draw.Image {
+	f := fontNamed(opts.Font).font
+	rows := int(float32(i.Bounds().Max.Y)/t.Dpi + 0.2)
+	cols := int(float32(i.Bounds().Max.X)/t.Dpi + 0.2)
+
+	switch opts.Placement() {
+	case conv.Hidden:
+		return i
+	case conv.Edges:
+		margin := int(t.Dpi * labelMargin)
+		b := i.Bounds()
+		result := image.NewRGBA(image.Rect(0, 0, b.Dx()+2*margin, b.Dy()+2*margin))
+		draw.Draw(result, result.Bounds(), image.NewUniform(edgeBackground), image.Point{}, draw.Src)
+		draw.Draw(result, b.Sub(b.Min).Add(image.Pt(margin, margin)), i, b.Min, draw.Src)
+		offset = offset.Add(image.Pt(margin, margin))
+		for _, l := range edgeLabels(opts.Notation, first_x, first_y, cols, rows,
+			float32(b.Dx())/t.Dpi, float32(b.Dy())/t.Dpi, float32(margin)/t.Dpi) {
+			t.printIn(result, f, l.text, l.x, l.y, l.width, l.height, l.valign, l.halign, offset)
 		}
+		return result
 	}
 
-	return result
+	for _, l := range coordinateLabels(opts.Notation, first_x, first_y, cols, rows) {
+		t.printIn(i, f, l.text, l.x, l.y, l.width, l.height, l.valign, l.halign, offset)
+	}
+	return i
 }
 
-// Returns the tabula BackgroundImage, scaled so that its largest dimension is 2000px.
-func (t *Tabula) BackgroundImage(db anydb.AnyDb, sendStatusMessage func(string)) (image.Image, error) {
+// Source returns the tabula's background image at its original resolution, or scaled down to MaxBackgroundSize if it's
+// larger.
+func (t *Tabula) Source(db anydb.AnyDb, sendStatusMessage func(string)) (image.Image, error) {
+	// The key includes the size the background is kept at, since the cache may be shared by several mapbots with
+	// different settings.
+	key := fmt.Sprintf("%s|max%d", t.Url, *MaxBackgroundSize)
 	if t.Background == nil {
-		bg, ok := cache.Get(t.Url)
+		bg, ok := cache.Get(key)
 		if ok && bg.Version == t.Version {
-			t.Background = copyImage(bg.Image)
+			t.Background = bg.Image
 		} else {
 			if sendStatusMessage != nil {
 				sendStatusMessage("I have to retrieve the background image; this could take a moment.")
@@ -683,31 +762,108 @@ func (t *Tabula) BackgroundImage(db anydb.AnyDb, sendStatusMessage func(string))
 			if err := t.Hydrate(db); err != nil {
 				return nil, fmt.Errorf("retrieving background: %v", err)
 			}
-			cache.Put(t.Url, &cache.CacheEntry{t.Version, copyImage(t.Background)})
+			cache.Put(key, &cache.CacheEntry{Version: t.Version, Image: t.Background, Scale: 1})
 		}
 	}
+	return t.Background, nil
+}
 
-	dx := t.Background.Rect.Dx()
-	dy := t.Background.Rect.Dy()
-	var resized image.Image = t.Background
-	if dx > 2000 || dy > 2000 {
-		if dx > dy {
-			resized = resize.Resize(2000, 0, t.Background, resize.Bilinear)
-		} else {
-			resized = resize.Resize(0, 2000, t.Background, resize.Bilinear)
-		}
+// BackgroundImage returns the tabula's background scaled so that its largest dimension is ReferenceSize pixels; i.e.,
+// the image that the DPI and offsets describe.
+func (t *Tabula) BackgroundImage(db anydb.AnyDb, sendStatusMessage func(string)) (image.Image, error) {
+	src, err := t.Source(db, sendStatusMessage)
+	if err != nil {
+		return nil, err
 	}
-	if dx < 2000 && dy < 2000 {
-		if dx > dy {
-			resized = resize.Resize(2000, 0, t.Background, resize.Bilinear)
-		} else {
-			resized = resize.Resize(0, 2000, t.Background, resize.Bilinear)
+
+	dx := src.Bounds().Dx()
+	dy := src.Bounds().Dy()
+	if dx > dy {
+		return resize.Resize(ReferenceSize, 0, src, resize.Bilinear), nil
+	}
+	return resize.Resize(0, ReferenceSize, src, resize.Bilinear), nil
+}
+
+// renderKey returns the cache key for the gridded background of the given region of the map. It must include
+// everything that affects that image, since the cache may be shared by several mapbots with different settings.
+func (t *Tabula) renderKey(minx, miny, maxx, maxy int) string {
+	grid := "default"
+	if t.GridColor != nil {
+		r, g, b, a := t.GridColor.RGBA()
+		grid = fmt.Sprintf("%04x%04x%04x%04x", r, g, b, a)
+	}
+	grid += fmt.Sprintf(",%s,%dpx,%d", t.gridStyle(), t.gridWidth(), t.gridAlpha())
+	return fmt.Sprintf("%s|%fdpi|offset%d,%d|grid:%s|%dx%d-%dx%d|max%d",
+		t.Url, t.Dpi, t.OffsetX, t.OffsetY, grid, minx, miny, maxx, maxy, *MaxRenderSize)
+}
+
+// addOverlays draws the marks, lighting, threatened squares, tokens, and lines visible in `ctx` onto `img`, in that
+// order.
+func (t *Tabula) addOverlays(img image.Image, ctx context.Context, offset image.Point, cancel <-chan struct{}) error {
+	overlays := []struct {
+		name string
+		add  func(image.Image, context.Context, image.Point) error
+	}{
+		{"marks", t.addMarks},
+		{"lighting", t.addTokenLights},
+		{"threats", t.addThreats},
+		{"tokens", t.addTokens},
+		{"lines", t.addLines},
+	}
+	for _, overlay := range overlays {
+		if isCancelled(cancel) {
+			return ErrCancelled
+		}
+		log.Debugf("adding %s...", overlay.name)
+		if err := overlay.add(img, ctx, offset); err != nil {
+			return err
 		}
 	}
-	return resized, nil
+	return nil
+}
+
+// region returns the reference-space rectangle covering the squares from (minx,miny) to (maxx,maxy) of a map with the
+// background `src`. If the zoom is unset in either direction, the region extends to the edge of the background, and
+// the last square in that direction is returned in place of the given max.
+func (t *Tabula) region(src image.Image, minx, miny, maxx, maxy int) (int, int, image.Rectangle) {
+	k := sourceScale(src)
+	refW := float32(src.Bounds().Dx()) / float32(k)
+	refH := float32(src.Bounds().Dy()) / float32(k)
+
+	if minx == maxx {
+		maxx = int((refW + float32(t.OffsetX)) / t.Dpi)
+	}
+
+	if miny == maxy {
+		maxy = int((refH + float32(t.OffsetY)) / t.Dpi)
+	}
+
+	return maxx, maxy, image.Rect(
+		int(float32(minx)*t.Dpi)+t.OffsetX,
+		int(float32(miny)*t.Dpi)+t.OffsetY,
+		int(float32(maxx+1)*t.Dpi)+t.OffsetX+1,
+		int(float32(maxy+1)*t.Dpi)+t.OffsetY+1,
+	)
+}
+
+// ErrCancelled is returned by RenderCancellable when its render is cancelled.
+var ErrCancelled = errors.New("render cancelled")
+
+func isCancelled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
 }
 
 func (t *Tabula) Render(ctx context.Context, sendStatusMessage func(string)) (image.Image, error) {
+	return t.RenderCancellable(ctx, sendStatusMessage, nil)
+}
+
+// RenderCancellable is Render, but gives up with ErrCancelled between steps once `cancel` is closed.
+func (t *Tabula) RenderCancellable(ctx context.Context, sendStatusMessage func(string), cancel <-chan struct{}) (image.Image, error) {
 	if sendStatusMessage == nil {
 		sendStatusMessage = func(string) {}
 	}
@@ -723,94 +879,108 @@ func (t *Tabula) Render(ctx context.Context, sendStatusMessage func(string)) (im
 
 	log.Debugf("map with bounds from (%d,%d) to (%d,%d)", minx, miny, maxx, maxy)
 
-	imgOffset := image.Point{
-		int(float32(minx)*t.Dpi) + t.OffsetX,
-		int(float32(miny)*t.Dpi) + t.OffsetY,
-	}
-
-	log.Debugf("calculated image offset %v", imgOffset)
-
-	tokenOffset := image.Point{
-		int(float32(minx)*t.Dpi) * -1,
-		int(float32(miny)*t.Dpi) * -1,
-	}
-	log.Debugf("token offset %v", tokenOffset)
-
-	cacheKey := fmt.Sprintf("%s|%fdpi+%dx%d-%dx%d", t.Url, t.Dpi, minx, miny, maxx, maxy)
+	cacheKey := t.renderKey(minx, miny, maxx, maxy)
 
-	var gridded image.Image
+	// `view` is the tabula as it will be drawn: its DPI and offsets are in output pixels rather than reference pixels.
+	// `base` is the background with its grid, which is cached, and so is never drawn on.
+	var view *Tabula
+	var base image.Image
 	if cached, ok := cache.Get(cacheKey); ok && cached.Version == t.Version {
-		gridded = copyImage(cached.Image)
+		view = t.scaled(cached.Scale)
+		base = cached.Image
 	} else {
 		log.Infof("Cache miss: %s", cacheKey)
-		resized, err := t.BackgroundImage(db.Instance, sendStatusMessage)
+		src, err := t.Source(db.Instance, sendStatusMessage)
 		if err != nil {
 			return nil, fmt.Errorf("retrieving background: %s", err)
 		}
 
-		drawable, ok := resized.(draw.Image)
-		if !ok {
-			panic("resize didn't return a drawable image?!")
-		}
-
-		if minx == maxx {
-			maxx = int(float32(drawable.Bounds().Dx()+t.OffsetX) / t.Dpi)
-		}
+		// k is the number of source pixels per reference pixel.
+		k := sourceScale(src)
+		var r image.Rectangle
+		maxx, maxy, r = t.region(src, minx, miny, maxx, maxy)
+		scale := t.outputScale(k, r)
+		log.Debugf("rendering reference region %v at %.3f output pixels per reference pixel", r, scale)
 
-		if miny == maxy {
-			maxy = int(float32(drawable.Bounds().Dy()+t.OffsetY) / t.Dpi)
+		if isCancelled(cancel) {
+			return nil, ErrCancelled
 		}
-
-		r := image.Rect(
-			imgOffset.X,
-			imgOffset.Y,
-			int(float32(maxx+1)*t.Dpi)+t.OffsetX+1,
-			int(float32(maxy+1)*t.Dpi)+t.OffsetY+1,
-		)
-		log.Debugf("padding out to %v", r)
-		padded := mbDraw.Pad(drawable, r)
-		gridded = t.addGrid(padded)
-		cache.Put(cacheKey, &cache.CacheEntry{t.Version, copyImage(gridded)})
+		view = t.scaled(scale)
+		base = view.addGrid(scaleRegion(src, r, k, scale))
+		cache.Put(cacheKey, &cache.CacheEntry{Version: t.Version, Image: base, Scale: scale})
 	}
 
-	log.Debugf("adding marks...")
-	if err := t.addMarks(gridded, ctx, tokenOffset); err != nil {
-		return nil, err
-	}
-
-	log.Debugf("adding lighting...")
-	if err := t.addTokenLights(gridded, ctx, tokenOffset); err != nil {
-		return nil, err
-	}
-
-	log.Debugf("adding tokens...")
-	if err := t.addTokens(gridded, ctx, tokenOffset); err != nil {
-		return nil, err
+	tokenOffset := image.Point{
+		int(float32(minx)*view.Dpi) * -1,
+		int(float32(miny)*view.Dpi) * -1,
 	}
+	log.Debugf("token offset %v", tokenOffset)
 
-	log.Debugf("adding lines...")
-	if err := t.addLines(gridded, ctx, tokenOffset); err != nil {
+	layer := image.NewRGBA(base.Bounds())
+	if err := view.addOverlays(layer, ctx, tokenOffset, cancel); err != nil {
 		return nil, err
 	}
 
-	var coord image.Image
-	if drawable, ok := gridded.(draw.Image); ok {
-		coord = t.addCoordinates(drawable, minx, miny, tokenOffset)
-	} else {
-		panic("resize didn't return a drawable image?!")
+	if isCancelled(cancel) {
+		return nil, ErrCancelled
 	}
-
-	return coord, nil
+	underlay(layer, base)
+	return view.addCoordinates(layer, ctx.GetCoordinates(), minx, miny, tokenOffset), nil
 }
 
-func copyImage(in image.Image) *image.RGBA {
-	out := image.NewRGBA(in.Bounds())
-	for x := 0; x < in.Bounds().Max.X; x++ {
-		for y := 0; y < in.Bounds().Max.Y; y++ {
-			out.Set(x, y, in.At(x, y))
-		}
+// underlay draws `base` beneath the overlays already drawn on `layer`, in place: the same as drawing `layer` over a
+// copy of `base`, but in one pass. Every overlay is drawn over what's beneath it, so they can be drawn on a clear layer
+// of their own, leaving the cached base as it is.
+func underlay(layer *image.RGBA, base image.Image) {
+	var premultiplied bool
+	var pix []uint8
+	var stride int
+	switch b := base.(type) {
+	case *image.RGBA:
+		premultiplied, pix, stride = true, b.Pix[b.PixOffset(layer.Rect.Min.X, layer.Rect.Min.Y):], b.Stride
+	case *image.NRGBA:
+		// As a cached image is, once it's been read back from a PNG.
+		pix, stride = b.Pix[b.PixOffset(layer.Rect.Min.X, layer.Rect.Min.Y):], b.Stride
+	default:
+		rgba := image.NewRGBA(base.Bounds())
+		draw.Draw(rgba, rgba.Rect, base, base.Bounds().Min, draw.Src)
+		underlay(layer, rgba)
+		return
+	}
+
+	w, h := layer.Rect.Dx(), layer.Rect.Dy()
+	bands := runtime.GOMAXPROCS(0)
+	height := (h + bands - 1) / bands
+	wg := sync.WaitGroup{}
+	for y0 := 0; y0 < h; y0 += height {
+		wg.Add(1)
+		go func(y0 int) {
+			defer wg.Done()
+			for y := y0; y < y0+height && y < h; y++ {
+				dst, src := layer.Pix[y*layer.Stride:y*layer.Stride+4*w], pix[y*stride:y*stride+4*w]
+				for i := 0; i < len(dst); i += 4 {
+					// As draw.Draw does, with 16 bits per channel.
+					inv := (255 - uint32(dst[i+3])) * 0x101
+					if inv == 0 {
+						continue
+					}
+					if inv == 0xffff && premultiplied {
+						copy(dst[i:i+4], src[i:i+4])
+						continue
+					}
+					a := uint32(src[i+3]) * 0x101
+					for c := 0; c < 4; c++ {
+						v := uint32(src[i+c]) * 0x101
+						if !premultiplied && c < 3 {
+							v = v * a / 0xffff
+						}
+						dst[i+c] = uint8((uint32(dst[i+c])*0x101 + v*inv/0xffff) >> 8)
+					}
+				}
+			}
+		}(y0)
 	}
-	return out
+	wg.Wait()
 }
 
 func (t Tabula) PointToPixel(pt image.Point, dir string) image.Point {
@@ -0,0 +1,261 @@
+package tabula
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/mark"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"strings"
+)
+
+// Faction is whose side a token is on. Allies and enemies threaten one another; neutral tokens threaten no one in
+// particular.
+type Faction string
+
+const (
+	Neutral Faction = ""
+	Ally    Faction = "ally"
+	Enemy   Faction = "enemy"
+)
+
+// ParseFaction parses `ally`, `enemy`, or `neutral`.
+func ParseFaction(s string) (Faction, error) {
+	switch strings.ToLower(s) {
+	case "ally":
+		return Ally, nil
+	case "enemy":
+		return Enemy, nil
+	case "neutral":
+		return Neutral, nil
+	}
+	return Neutral, fmt.Errorf("unknown faction %q; try ally, enemy, or neutral", s)
+}
+
+func (f Faction) String() string {
+	if f == Neutral {
+		return "neutral"
+	}
+	return string(f)
+}
+
+// Opposes reports whether `f` and `o` are on opposite sides.
+func (f Faction) Opposes(o Faction) bool {
+	return f == Ally && o == Enemy || f == Enemy && o == Ally
+}
+
+// DefaultReach is how far a token with no reach of its own reaches, in feet.
+const DefaultReach = 5
+
+// MaxReach is the furthest a token may reach, in feet; further than any creature does, but near enough that outlining
+// it stays quick.
+const MaxReach = 100
+
+// threatColor outlines the squares a token with a reach threatens.
+var threatColor = color.NRGBA{R: 0xff, G: 0x40, B: 0x40, A: 0x90}
+
+func (t Token) WithReach(feet int) (ret Token) {
+	ret = t
+	ret.Reach = feet
+	return
+}
+
+func (t Token) WithFaction(f Faction) (ret Token) {
+	ret = t
+	ret.Faction = f
+	return
+}
+
+// ReachOrDefault returns how many feet the token reaches: its reach, up to MaxReach, or DefaultReach if it has none.
+func (t Token) ReachOrDefault() int {
+	switch {
+	case t.Reach > MaxReach:
+		return MaxReach
+	case t.Reach > 0:
+		return t.Reach
+	}
+	return DefaultReach
+}
+
+// squares returns the squares the token covers.
+func (t Token) squares() []image.Point {
+	size := t.Size
+	if size < 1 {
+		size = 1
+	}
+	ret := make([]image.Point, 0, size*size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			ret = append(ret, t.Coordinate.Add(image.Pt(x, y)))
+		}
+	}
+	return ret
+}
+
+// Threatened returns the squares within the token's reach of any square it covers, not counting its own, from top to
+// bottom and left to right.
+func (t Token) Threatened() []image.Point {
+	own := map[image.Point]bool{}
+	for _, sq := range t.squares() {
+		own[sq] = true
+	}
+	seen := map[image.Point]bool{}
+	ret := []image.Point{}
+	for _, sq := range t.squares() {
+		// A circle centred on a square never fails.
+		marks, _ := mark.CirclePoint(sq, "", t.ReachOrDefault())
+		for _, m := range marks {
+			if !own[m.Point] && !seen[m.Point] {
+				seen[m.Point] = true
+				ret = append(ret, m.Point)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Y != ret[j].Y {
+			return ret[i].Y < ret[j].Y
+		}
+		return ret[i].X < ret[j].X
+	})
+	return ret
+}
+
+// Threatens reports whether `o` is within the token's reach. On the ground, that's when `o` covers one of the squares
+// Threatened returns; a token flying high enough is out of reach.
+func (t Token) Threatens(o Token) bool {
+	return t.DistanceTo(o) <= t.ReachOrDefault()
+}
+
+// Flanks reports whether the token and `ally` flank `target`: both threaten it, and the line between their centres
+// passes through opposite sides, or opposite corners, of its space.
+func (t Token) Flanks(ally, target Token) bool {
+	if !t.Threatens(target) || !ally.Threatens(target) {
+		return false
+	}
+	a, b := t.centre(), ally.centre()
+	size := float64(target.Size)
+	if size < 1 {
+		size = 1
+	}
+	min := [2]float64{float64(target.Coordinate.X), float64(target.Coordinate.Y)}
+	max := [2]float64{min[0] + size, min[1] + size}
+
+	in, out, ok := clip(a, b, min, max)
+	if !ok {
+		return false
+	}
+	for axis := 0; axis < 2; axis++ {
+		if in[axis] == min[axis] && out[axis] == max[axis] || in[axis] == max[axis] && out[axis] == min[axis] {
+			return true
+		}
+	}
+	return false
+}
+
+// centre returns the middle of the token, in squares.
+func (t Token) centre() [2]float64 {
+	size := float64(t.Size)
+	if size < 1 {
+		size = 1
+	}
+	return [2]float64{float64(t.Coordinate.X) + size/2, float64(t.Coordinate.Y) + size/2}
+}
+
+// clip returns where the line from `a` to `b` enters and leaves the rectangle from `min` to `max`, touching its edges
+// and corners included, or false if it misses.
+func clip(a, b, min, max [2]float64) (in, out [2]float64, ok bool) {
+	t0, t1 := 0.0, 1.0
+	for axis := 0; axis < 2; axis++ {
+		d := b[axis] - a[axis]
+		for _, pq := range [][2]float64{{-d, a[axis] - min[axis]}, {d, max[axis] - a[axis]}} {
+			p, q := pq[0], pq[1]
+			if p == 0 {
+				if q < 0 {
+					return in, out, false
+				}
+				continue
+			}
+			r := q / p
+			if p < 0 && r > t0 {
+				t0 = r
+			} else if p > 0 && r < t1 {
+				t1 = r
+			}
+		}
+	}
+	if t0 > t1 {
+		return in, out, false
+	}
+	for axis := 0; axis < 2; axis++ {
+		in[axis] = a[axis] + t0*(b[axis]-a[axis])
+		out[axis] = a[axis] + t1*(b[axis]-a[axis])
+	}
+	// Rounding can leave a point a hair off the edge it's on; all of the edges are whole squares.
+	return snap(in, min, max), snap(out, min, max), true
+}
+
+func snap(pt, min, max [2]float64) [2]float64 {
+	const epsilon = 1e-9
+	for axis := 0; axis < 2; axis++ {
+		for _, edge := range []float64{min[axis], max[axis]} {
+			if pt[axis]-edge < epsilon && edge-pt[axis] < epsilon {
+				pt[axis] = edge
+			}
+		}
+	}
+	return pt
+}
+
+// ThreatOutline returns the edges around the squares the token threatens and the squares it covers, so that its reach
+// can be drawn as a ring around it. Each edge is a pair of grid corners, from top left to bottom right.
+func (t Token) ThreatOutline() [][2]image.Point {
+	covered := append(t.squares(), t.Threatened()...)
+	in := map[image.Point]bool{}
+	for _, sq := range covered {
+		in[sq] = true
+	}
+	ret := [][2]image.Point{}
+	for _, sq := range covered {
+		if !in[sq.Add(image.Pt(0, -1))] {
+			ret = append(ret, [2]image.Point{sq, sq.Add(image.Pt(1, 0))})
+		}
+		if !in[sq.Add(image.Pt(1, 0))] {
+			ret = append(ret, [2]image.Point{sq.Add(image.Pt(1, 0)), sq.Add(image.Pt(1, 1))})
+		}
+		if !in[sq.Add(image.Pt(0, 1))] {
+			ret = append(ret, [2]image.Point{sq.Add(image.Pt(0, 1)), sq.Add(image.Pt(1, 1))})
+		}
+		if !in[sq.Add(image.Pt(-1, 0))] {
+			ret = append(ret, [2]image.Point{sq, sq.Add(image.Pt(0, 1))})
+		}
+	}
+	return ret
+}
+
+// threatOutlines returns the outlines of the reaches of the tokens shown in `ctx` that have a reach of their own.
+func (t *Tabula) threatOutlines(ctx context.Context) [][2]image.Point {
+	tokens := t.ShownTokens(ctx)
+	ret := [][2]image.Point{}
+	for _, name := range tokenOrder(tokens) {
+		if tok := tokens[name]; tok.Reach > 0 {
+			ret = append(ret, tok.ThreatOutline()...)
+		}
+	}
+	return ret
+}
+
+// addThreats faintly outlines the squares threatened by each token with a reach of its own.
+func (t *Tabula) addThreats(in image.Image, ctx context.Context, offset image.Point) error {
+	drawable, ok := in.(draw.Image)
+	if !ok {
+		return errors.New("image provided could not be used as a draw.Image")
+	}
+	// Each edge is drawn as a rectangle a pixel either side of it, rather than as a line, so that it's blended in.
+	for _, edge := range t.threatOutlines(ctx) {
+		t.squareAtFloat(drawable, float32(edge[0].X), float32(edge[0].Y), float32(edge[1].X), float32(edge[1].Y), -1, threatColor, offset)
+	}
+	return nil
+}
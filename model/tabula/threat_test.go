@@ -0,0 +1,106 @@
+package tabula
+
+import (
+	"image"
+	"testing"
+)
+
+func TestThreatened(t *testing.T) {
+	ogre := Token{Coordinate: image.Pt(5, 5), Size: 2}
+	squares := map[image.Point]bool{}
+	for _, pt := range ogre.Threatened() {
+		squares[pt] = true
+	}
+	// Every square touching it, but none of its own.
+	if len(squares) != 12 {
+		t.Errorf("expected a large token to threaten 12 squares, got %d: %v", len(squares), ogre.Threatened())
+	}
+	for _, pt := range []image.Point{{5, 5}, {6, 6}, {7, 8}, {8, 5}} {
+		if squares[pt] {
+			t.Errorf("expected %v not to be threatened", pt)
+		}
+	}
+
+	squares = map[image.Point]bool{}
+	for _, pt := range ogre.WithReach(10).Threatened() {
+		squares[pt] = true
+	}
+	// Two squares straight out, or one diagonal and one straight, but not two diagonals.
+	for _, pt := range []image.Point{{8, 5}, {3, 6}, {8, 4}, {5, 3}} {
+		if !squares[pt] {
+			t.Errorf("expected %v to be threatened with 10ft reach", pt)
+		}
+	}
+	if squares[image.Pt(8, 3)] {
+		t.Errorf("expected %v not to be threatened with 10ft reach", image.Pt(8, 3))
+	}
+
+	// A reach saved before there was a limit is held to it.
+	if far, max := len(ogre.WithReach(1<<30).Threatened()), len(ogre.WithReach(MaxReach).Threatened()); far != max {
+		t.Errorf("expected a huge reach to threaten as much as %dft, %d squares, but got %d", MaxReach, max, far)
+	}
+}
+
+func TestThreatens(t *testing.T) {
+	ogre := Token{Coordinate: image.Pt(0, 0), Size: 2, Reach: 10}
+	if !ogre.Threatens(Token{Coordinate: image.Pt(3, 0)}) {
+		t.Error("expected the ogre to threaten a token two squares away")
+	}
+	if ogre.Threatens(Token{Coordinate: image.Pt(4, 0)}) {
+		t.Error("expected the ogre not to threaten a token three squares away")
+	}
+	if ogre.Threatens(Token{Coordinate: image.Pt(2, 0), Elevation: 30}) {
+		t.Error("expected the ogre not to threaten a token flying 30ft up")
+	}
+}
+
+func TestFlanks(t *testing.T) {
+	orc := Token{Coordinate: image.Pt(5, 5)}
+	type test struct {
+		rogue, ally image.Point
+		flanks      bool
+	}
+	tests := []test{
+		// Opposite sides, and opposite corners.
+		{image.Pt(4, 5), image.Pt(6, 5), true},
+		{image.Pt(5, 4), image.Pt(5, 6), true},
+		{image.Pt(4, 4), image.Pt(6, 6), true},
+		// The line goes in one side and out the top, or only clips a corner.
+		{image.Pt(4, 5), image.Pt(6, 4), false},
+		{image.Pt(4, 5), image.Pt(5, 4), false},
+		// Side by side, and too far away to threaten.
+		{image.Pt(4, 5), image.Pt(4, 6), false},
+		{image.Pt(4, 5), image.Pt(7, 5), false},
+	}
+	for i, test := range tests {
+		rogue, ally := Token{Coordinate: test.rogue}, Token{Coordinate: test.ally}
+		if flanks := rogue.Flanks(ally, orc); flanks != test.flanks {
+			t.Errorf("test %d: rogue at %v and ally at %v: expected flanking %v, got %v", i, test.rogue, test.ally, test.flanks, flanks)
+		}
+	}
+
+	// A large target is flanked across its whole space, and a long reach flanks from further away.
+	ogre := Token{Coordinate: image.Pt(5, 5), Size: 2}
+	if !(Token{Coordinate: image.Pt(4, 5)}).Flanks(Token{Coordinate: image.Pt(7, 6)}, ogre) {
+		t.Error("expected tokens either side of the ogre to flank it")
+	}
+	pike := Token{Coordinate: image.Pt(3, 6), Reach: 10}
+	if !pike.Flanks(Token{Coordinate: image.Pt(7, 6)}, ogre) {
+		t.Error("expected a pike reaching 10ft to flank the ogre")
+	}
+}
+
+func TestParseFaction(t *testing.T) {
+	if f, err := ParseFaction("Enemy"); err != nil || f != Enemy {
+		t.Errorf("expected enemy, got %q, %v", f, err)
+	}
+	if f, err := ParseFaction("neutral"); err != nil || f != Neutral {
+		t.Errorf("expected neutral, got %q, %v", f, err)
+	}
+	if _, err := ParseFaction("orcs"); err == nil {
+		t.Error("expected an error for orcs")
+	}
+	if !Ally.Opposes(Enemy) || Ally.Opposes(Neutral) || Enemy.Opposes(Enemy) {
+		t.Error("expected only allies and enemies to oppose one another")
+	}
+}
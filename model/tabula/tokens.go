@@ -5,10 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/nfnt/resize"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/common/db"
 	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/model/art"
 	"github.com/pdbogen/mapbot/model/context"
 	"github.com/pdbogen/mapbot/model/mark"
+	"github.com/pdbogen/mapbot/model/terrain"
 	"github.com/pdbogen/mapbot/model/types"
+	"github.com/pdbogen/mapbot/model/wall"
 	"image"
 	"image/color"
 	"image/draw"
@@ -21,6 +26,29 @@ type Token struct {
 	TokenColor                         color.Color
 	Size                               int
 	DimLight, NormalLight, BrightLight int
+
+	// Owner is the user who first placed the token; their portrait for it is drawn, if the channel has none.
+	Owner types.UserId
+
+	// Facing is the direction the token faces, if HasFacing; it's drawn as a wedge on the token's edge.
+	Facing    conv.Facing
+	HasFacing bool
+
+	// Hidden tokens are left out of the maps shown to a channel; only GM views show them, ghosted.
+	Hidden bool
+
+	// Elevation is how many feet above the ground the token is, or below it if negative.
+	Elevation int
+
+	// Speed is how many feet the token may move in a turn, or 0 if its movement isn't counted. Moved is how many feet it
+	// has moved since its turn began.
+	Speed, Moved int
+
+	// Reach is how many feet away the token threatens, or 0 for DefaultReach; only a reach set for the token is drawn.
+	Reach int
+
+	// Faction is whose side the token is on, for working out who threatens and flanks whom.
+	Faction Faction
 }
 
 func (t Token) Color() color.Color {
@@ -50,18 +78,152 @@ func (t Token) WithCoords(p image.Point) (ret Token) {
 	return
 }
 
+// MovedTo returns the token moved to `p`, turned to face the way it went.
+func (t Token) MovedTo(p image.Point) (ret Token) {
+	ret = t.WithCoords(p)
+	if facing, ok := conv.FacingBetween(t.Coordinate, p); ok {
+		ret = ret.WithFacing(facing)
+	}
+	return
+}
+
+func (t Token) WithFacing(f conv.Facing) (ret Token) {
+	ret = t
+	ret.Facing = f
+	ret.HasFacing = true
+	return
+}
+
+func (t Token) WithoutFacing() (ret Token) {
+	ret = t
+	ret.Facing = 0
+	ret.HasFacing = false
+	return
+}
+
+func (t Token) WithHidden(hidden bool) (ret Token) {
+	ret = t
+	ret.Hidden = hidden
+	return
+}
+
+func (t Token) WithElevation(feet int) (ret Token) {
+	ret = t
+	ret.Elevation = feet
+	return
+}
+
+func (t Token) WithSpeed(feet int) (ret Token) {
+	ret = t
+	ret.Speed = feet
+	return
+}
+
+func (t Token) WithMoved(feet int) (ret Token) {
+	ret = t
+	ret.Moved = feet
+	return
+}
+
+// Remaining returns how many more feet the token may move this turn; it's never less than 0.
+func (t Token) Remaining() int {
+	if t.Moved >= t.Speed {
+		return 0
+	}
+	return t.Speed - t.Moved
+}
+
+// Reachable returns the squares the token could cover after moving `feet` feet from where it is over `ground`, going
+// around blocked squares and `walls` and paying extra for difficult squares, as a move would.
+func (t Token) Reachable(feet int, ground terrain.Ground, walls []wall.Wall) []image.Point {
+	size := t.Size
+	if size < 1 {
+		size = 1
+	}
+	seen := map[image.Point]bool{}
+	ret := []image.Point{}
+	for _, to := range ground.Reachable(t.Coordinate, size, feet, walls) {
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				pt := to.Add(image.Pt(x, y))
+				if !seen[pt] {
+					seen[pt] = true
+					ret = append(ret, pt)
+				}
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Y != ret[j].Y {
+			return ret[i].Y < ret[j].Y
+		}
+		return ret[i].X < ret[j].X
+	})
+	return ret
+}
+
 func (t Token) WithSize(s int) (ret Token) {
 	ret = t
 	ret.Size = s
 	return
 }
 
+// DistanceTo returns how many feet apart the nearest squares of `t` and `o` are, counting how far apart they are in
+// height as well as across the map. A token is as tall as it is wide, so a bat flying 5ft up is right next to a
+// goblin beneath it.
+func (t Token) DistanceTo(o Token) int {
+	size := func(tok Token) int {
+		if tok.Size < 1 {
+			return 1
+		}
+		return tok.Size
+	}
+	flat := conv.Distance(image.Point{}, image.Pt(
+		gap(t.Coordinate.X, size(t), o.Coordinate.X, size(o)),
+		gap(t.Coordinate.Y, size(t), o.Coordinate.Y, size(o)),
+	))
+	rise := 5 * gap(floorDiv(t.Elevation, 5), size(t), floorDiv(o.Elevation, 5), size(o))
+	return conv.Distance3D(flat, rise)
+}
+
+// gap returns how many squares apart the nearest of the `na` squares starting at `a` and the `nb` starting at `b` are.
+func gap(a, na, b, nb int) int {
+	if d := b - (a + na - 1); d > 0 {
+		return d
+	}
+	if d := a - (b + nb - 1); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// floorDiv returns a/b rounded down, rather than towards zero.
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// MoveLines returns a line from each corner of the token to the same corner of it moved to `to`, outlining the path it
+// takes.
+func (t Token) MoveLines(to image.Point, c color.Color) []mark.Line {
+	far := t.Size - 1
+	return []mark.Line{
+		{A: t.Coordinate, B: to, CA: "nw", CB: "nw", Color: c},
+		{A: t.Coordinate.Add(image.Pt(far, 0)), B: to.Add(image.Pt(far, 0)), CA: "ne", CB: "ne", Color: c},
+		{A: t.Coordinate.Add(image.Pt(far, far)), B: to.Add(image.Pt(far, far)), CA: "se", CB: "se", Color: c},
+		{A: t.Coordinate.Add(image.Pt(0, far)), B: to.Add(image.Pt(0, far)), CA: "sw", CB: "sw", Color: c},
+	}
+}
+
 func (t *Tabula) loadTokens(db anydb.AnyDb) error {
 	if t.Id == nil {
 		return errors.New("cannot load tokens for tabula with nil ID")
 	}
 	// Read list of existing tokens
-	res, err := db.Query("SELECT context_id, name, size, x, y, r, g, b, a, light_dim, light_normal, light_bright FROM tabula_tokens WHERE tabula_id=$1", t.Id)
+	res, err := db.Query("SELECT context_id, name, size, x, y, r, g, b, a, light_dim, light_normal, light_bright, owner, facing, hidden, elevation, speed, moved, reach, faction FROM tabula_tokens WHERE tabula_id=$1", t.Id)
 	if err != nil {
 		return fmt.Errorf("retrieving list to sync: %s", err)
 	}
@@ -74,7 +236,12 @@ func (t *Tabula) loadTokens(db anydb.AnyDb) error {
 		var x, y, size int
 		var r, g, b, a uint8
 		var dim, normal, bright int
-		if err := res.Scan(&ctxId, &name, &size, &x, &y, &r, &g, &b, &a, &dim, &normal, &bright); err != nil {
+		var owner types.UserId
+		var facing int
+		var hidden bool
+		var elevation, speed, moved, reach int
+		var faction string
+		if err := res.Scan(&ctxId, &name, &size, &x, &y, &r, &g, &b, &a, &dim, &normal, &bright, &owner, &facing, &hidden, &elevation, &speed, &moved, &reach, &faction); err != nil {
 			log.Warningf("scanning row: %s", err)
 			continue
 		}
@@ -90,6 +257,15 @@ func (t *Tabula) loadTokens(db anydb.AnyDb) error {
 			DimLight:    dim,
 			NormalLight: normal,
 			BrightLight: bright,
+			Owner:       owner,
+			Facing:      conv.NewFacing(facing),
+			HasFacing:   facing >= 0,
+			Hidden:      hidden,
+			Elevation:   elevation,
+			Speed:       speed,
+			Moved:       moved,
+			Reach:       reach,
+			Faction:     Faction(faction),
 		}
 	}
 
@@ -171,12 +347,12 @@ func (t *Tabula) saveTokensTx(dialect string, tx *sql.Tx) error {
 	var query string
 	switch dialect {
 	case "postgresql":
-		query = "INSERT INTO tabula_tokens (name, context_id, tabula_id, size, x, y, r, g, b, a, light_dim, light_normal, light_bright) " +
-			"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10, $11, $12, $13) " +
-			"ON CONFLICT (name, context_id, tabula_id) DO UPDATE SET size=$4, x=$5, y=$6, r=$7, g=$8, b=$9, a=$10, light_dim = $11, light_normal=$12, light_bright=$13"
+		query = "INSERT INTO tabula_tokens (name, context_id, tabula_id, size, x, y, r, g, b, a, light_dim, light_normal, light_bright, owner, facing, hidden, elevation, speed, moved, reach, faction) " +
+			"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21) " +
+			"ON CONFLICT (name, context_id, tabula_id) DO UPDATE SET size=$4, x=$5, y=$6, r=$7, g=$8, b=$9, a=$10, light_dim = $11, light_normal=$12, light_bright=$13, owner=$14, facing=$15, hidden=$16, elevation=$17, speed=$18, moved=$19, reach=$20, faction=$21"
 	case "sqlite3":
-		query = "REPLACE INTO tabula_tokens (name, context_id, tabula_id, size, x, y, r, g, b, a, light_dim, light_normal, light_bright) " +
-			"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10, $11, $12, $13)"
+		query = "REPLACE INTO tabula_tokens (name, context_id, tabula_id, size, x, y, r, g, b, a, light_dim, light_normal, light_bright, owner, facing, hidden, elevation, speed, moved, reach, faction) " +
+			"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)"
 	default:
 		return fmt.Errorf("no Tabula.saveTokens query for SQL dialect %s", dialect)
 	}
@@ -189,7 +365,12 @@ func (t *Tabula) saveTokensTx(dialect string, tx *sql.Tx) error {
 		for name, token := range ctxTokens {
 			pos := token.Coordinate
 			r, g, b, a := token.Color().RGBA()
-			if _, err := add.Exec(name, ctxId, t.Id, token.Size, pos.X, pos.Y, r>>8, g>>8, b>>8, a>>8, token.DimLight, token.NormalLight, token.BrightLight); err != nil {
+			// A token that faces nowhere is saved as facing -1.
+			facing := -1
+			if token.HasFacing {
+				facing = int(token.Facing)
+			}
+			if _, err := add.Exec(name, ctxId, t.Id, token.Size, pos.X, pos.Y, r>>8, g>>8, b>>8, a>>8, token.DimLight, token.NormalLight, token.BrightLight, token.Owner, facing, token.Hidden, token.Elevation, token.Speed, token.Moved, token.Reach, string(token.Faction)); err != nil {
 				log.Warningf("error saving token %q at pos (%d,%d) on tabula %d, context ID %q: %s", name, pos.X, pos.Y, t.Id, ctxId, err)
 			}
 		}
@@ -260,6 +441,42 @@ func (t *Tabula) drawAtAlign(i draw.Image, obj image.Image, x float32, y float32
 
 var emojiRe = regexp.MustCompile(`^(:[^:]+:)(.*)$`)
 
+// splitTokenName splits a token name like `:wolf:2` into the emoji and its label; names that don't start with an
+// emoji have no label.
+// ArtName returns the name that the art of the token `tokenName`, its portrait or emoji, goes by: the name without any
+// label.
+func ArtName(tokenName string) string {
+	name, _ := splitTokenName(tokenName)
+	return name
+}
+
+func splitTokenName(tokenName string) (name, label string) {
+	comps := emojiRe.FindStringSubmatch(tokenName)
+	if comps == nil {
+		return tokenName, ""
+	}
+	return comps[1], comps[2]
+}
+
+// tokenOrder returns the names of `tokens` in the order they should be drawn: lowest first, so that flying tokens are
+// seen over those beneath them; and then largest first, so that smaller tokens sharing their squares remain visible.
+func tokenOrder(tokens map[string]Token) []string {
+	names := make([]string, 0, len(tokens))
+	for name := range tokens {
+		names = append(names, name)
+	}
+
+	// note reversal of i and j in args; to cause a reverse sort
+	sort.Slice(names, func(j, i int) bool {
+		if tokens[names[i]].Elevation != tokens[names[j]].Elevation {
+			return tokens[names[i]].Elevation > tokens[names[j]].Elevation
+		}
+		return tokens[names[i]].Size < tokens[names[j]].Size ||
+			(tokens[names[i]].Size == tokens[names[j]].Size && names[i] < names[j])
+	})
+	return names
+}
+
 func light(t *Tabula, in image.Image, radius int, coord image.Point, col color.Color) ([]mark.Mark, error) {
 	if radius <= 0 {
 		return []mark.Mark{}, nil
@@ -275,17 +492,34 @@ func light(t *Tabula, in image.Image, radius int, coord image.Point, col color.C
 }
 
 func (t *Tabula) addTokenLights(in image.Image, ctx context.Context, offset image.Point) error {
-	// Map out light levels; brightest lights win.
+	marks, err := t.lightMarks(ctx)
+	if err != nil {
+		return err
+	}
+	return t.addMarkSlice(in, marks, offset)
+}
+
+// lightMarks returns the marks that show the light cast by the map's lights and by the tokens in `ctx`.
+func (t *Tabula) lightMarks(ctx context.Context) ([]mark.Mark, error) {
+	// Map out light levels; brightest lights win, and any token light outshines the map's own lights.
 	lighting := map[image.Point]mark.Mark{}
-	for tokenName, token := range t.Tokens[ctx.Id()] {
+	mapLights, err := t.mapLightMarks()
+	if err != nil {
+		return nil, fmt.Errorf("drawing map lights: %s", err)
+	}
+	for _, m := range mapLights {
+		lighting[m.Point] = m
+	}
+
+	for tokenName, token := range t.ShownTokens(ctx) {
 		if token.DimLight == 0 {
 			continue
 		}
 		log.Debugf("adding dim lighting %dft for token %q at %v", token.DimLight, tokenName, token.Coordinate)
 		// Add "dim lighting" marks
-		marks, err := light(t, in, token.DimLight, token.Coordinate, color.NRGBA{231, 114, 0, 63})
+		marks, err := light(t, nil, token.DimLight, token.Coordinate, color.NRGBA{231, 114, 0, 63})
 		if err != nil {
-			return fmt.Errorf("drawing lights: %s", err)
+			return nil, fmt.Errorf("drawing lights: %s", err)
 		}
 
 		for _, m := range marks {
@@ -293,15 +527,15 @@ func (t *Tabula) addTokenLights(in image.Image, ctx context.Context, offset imag
 		}
 	}
 
-	for tokenName, token := range t.Tokens[ctx.Id()] {
+	for tokenName, token := range t.ShownTokens(ctx) {
 		if token.NormalLight == 0 {
 			continue
 		}
 		log.Debugf("adding normal lighting %dft for token %q at %v", token.NormalLight, tokenName, token.Coordinate)
 		// Add "normal lighting" marks
-		marks, err := light(t, in, token.NormalLight, token.Coordinate, color.NRGBA{250, 250, 55, 63})
+		marks, err := light(t, nil, token.NormalLight, token.Coordinate, color.NRGBA{250, 250, 55, 63})
 		if err != nil {
-			return fmt.Errorf("drawing lights: %s", err)
+			return nil, fmt.Errorf("drawing lights: %s", err)
 		}
 
 		for _, m := range marks {
@@ -309,15 +543,15 @@ func (t *Tabula) addTokenLights(in image.Image, ctx context.Context, offset imag
 		}
 	}
 
-	for tokenName, token := range t.Tokens[ctx.Id()] {
+	for tokenName, token := range t.ShownTokens(ctx) {
 		if token.BrightLight == 0 {
 			continue
 		}
 		log.Debugf("adding bright lighting %dft for token %q at %v", token.BrightLight, tokenName, token.Coordinate)
 		// Add "bright lighting" marks
-		marks, err := light(t, in, token.BrightLight, token.Coordinate, color.NRGBA{149, 224, 232, 63})
+		marks, err := light(t, nil, token.BrightLight, token.Coordinate, color.NRGBA{149, 224, 232, 63})
 		if err != nil {
-			return fmt.Errorf("drawing lights: %s", err)
+			return nil, fmt.Errorf("drawing lights: %s", err)
 		}
 
 		for _, m := range marks {
@@ -325,12 +559,11 @@ func (t *Tabula) addTokenLights(in image.Image, ctx context.Context, offset imag
 		}
 	}
 
-	// Render all marks
 	marks := []mark.Mark{}
 	for _, m := range lighting {
 		marks = append(marks, m)
 	}
-	return t.addMarkSlice(in, marks, offset)
+	return marks, nil
 }
 
 func (t *Tabula) addTokens(in image.Image, ctx context.Context, offset image.Point) error {
@@ -339,55 +572,172 @@ func (t *Tabula) addTokens(in image.Image, ctx context.Context, offset image.Poi
 		return errors.New("image provided could not be used as a draw.Image")
 	}
 
-	tokens := t.Tokens[ctx.Id()]
-	names := make([]string, len(tokens))
-	n := 0
-	for name := range tokens {
-		names[n] = name
-		n++
+	var arts *art.Loader
+	if db.Instance != nil {
+		arts = art.NewLoader(db.Instance)
 	}
 
-	// note reversal of i and j in args; to cause a reverse sort
-	sort.Slice(names, func(j, i int) bool {
-		return tokens[names[i]].Size < tokens[names[j]].Size ||
-			(tokens[names[i]].Size == tokens[names[j]].Size && names[i] < names[j])
-	})
-
-	for _, tokenName := range names {
+	tokens := t.ShownTokens(ctx)
+	boxes := tokenBoxes(tokens)
+	for _, tokenName := range tokenOrder(tokens) {
 		token := tokens[tokenName]
-		coord := token.Coordinate
-		r, g, b, a := token.Color().RGBA()
+		if token.Hidden {
+			t.addGhost(drawable, ctx, arts, tokenName, token, boxes[tokenName], offset)
+			continue
+		}
+		t.addToken(drawable, ctx, arts, tokenName, token, boxes[tokenName], offset)
+	}
 
-		var name, label string
+	// Facings and elevations go on top of everything, so that no token's art hides them.
+	for _, tokenName := range tokenOrder(tokens) {
+		if token := tokens[tokenName]; !token.Hidden {
+			t.addTokenMarkings(drawable, token, boxes[tokenName], offset)
+		}
+	}
+	return nil
+}
 
-		comps := emojiRe.FindStringSubmatch(tokenName)
-		if comps == nil {
-			name = tokenName
-		} else {
-			name = comps[1]
-			label = comps[2]
+// tokenBox is where a token is drawn: the `size`-square square whose top left is at square (x,y).
+type tokenBox struct {
+	x, y, size float32
+}
+
+func (b tokenBox) pixels(dpi float32, offset image.Point) image.Rectangle {
+	return image.Rect(int(b.x*dpi), int(b.y*dpi), int((b.x+b.size)*dpi), int((b.y+b.size)*dpi)).Add(offset)
+}
+
+// stackScale is the size, relative to the square they share, that stacked tokens are drawn.
+const stackScale = 0.7
+
+// tokenBoxes returns where each token is drawn. Most fill their own squares; tokens that share a square, as a bat
+// flying over a goblin does, are drawn smaller and stacked from the lowest, at the bottom left, to the highest, at the
+// top right.
+func tokenBoxes(tokens map[string]Token) map[string]tokenBox {
+	type spot struct {
+		at   image.Point
+		size int
+	}
+	stacks := map[spot][]string{}
+	for _, name := range tokenOrder(tokens) {
+		tok := tokens[name]
+		stacks[spot{tok.Coordinate, tok.Size}] = append(stacks[spot{tok.Coordinate, tok.Size}], name)
+	}
+
+	ret := map[string]tokenBox{}
+	for sp, names := range stacks {
+		x, y, size := float32(sp.at.X), float32(sp.at.Y), float32(sp.size)
+		if len(names) == 1 {
+			ret[names[0]] = tokenBox{x, y, size}
+			continue
+		}
+		step := size * (1 - stackScale) / float32(len(names)-1)
+		for i, name := range names {
+			ret[name] = tokenBox{x + float32(i)*step, y + size*(1-stackScale) - float32(i)*step, size * stackScale}
 		}
+	}
+	return ret
+}
+
+func (t *Tabula) addToken(drawable draw.Image, ctx context.Context, arts *art.Loader, tokenName string, token Token, box tokenBox, offset image.Point) {
+	r, g, b, a := token.Color().RGBA()
+	name, label := splitTokenName(tokenName)
 
-		log.Debugf("Adding token (name=%q) (label=%q) (color:%d,%d,%d,%d) at (%d,%d)", name, label, r, g, b, a, coord.X, coord.Y)
+	log.Debugf("Adding token (name=%q) (label=%q) (color:%d,%d,%d,%d) at (%.2f,%.2f)", name, label, r, g, b, a, box.x, box.y)
 
-		if a > 0 {
-			t.squareAt(drawable, image.Rect(coord.X, coord.Y, coord.X+token.Size, coord.Y+token.Size), 1, token.Color(), offset)
+	if a > 0 {
+		t.squareAtFloat(drawable, box.x, box.y, box.x+box.size, box.y+box.size, 1, token.Color(), offset)
+	}
+
+	if portrait := t.portrait(ctx, arts, name, token, int(box.size*t.Dpi)); portrait != nil {
+		t.drawAtAlign(drawable, portrait, box.x, box.y, box.size, 0, Middle, Center, offset)
+		if label != "" {
+			t.printAt(drawable, label, box.x, box.y+box.size/2, box.size, box.size/2, Bottom, Center, offset)
 		}
+		return
+	}
 
-		if ctx.IsEmoji(name) {
-			emoji, err := ctx.GetEmoji(name)
-			if err != nil {
-				log.Warningf("error obtaining emoji %q: %s", name, err)
-				// no return here, we'll fall through to rendering token name
-			} else {
-				t.drawAtAlign(drawable, emoji, float32(coord.X), float32(coord.Y), float32(token.Size), 2, Middle, Center, offset)
-				if label != "" {
-					t.printAt(drawable, label, float32(coord.X), float32(coord.Y)+float32(token.Size)/2, float32(token.Size), float32(token.Size)/2, Bottom, Center, offset)
-				}
-				continue
+	if ctx.IsEmoji(name) {
+		emoji, err := ctx.GetEmoji(name)
+		if err != nil {
+			log.Warningf("error obtaining emoji %q: %s", name, err)
+			// no return here, we'll fall through to rendering token name
+		} else {
+			t.drawAtAlign(drawable, emoji, box.x, box.y, box.size, 2, Middle, Center, offset)
+			if label != "" {
+				t.printAt(drawable, label, box.x, box.y+box.size/2, box.size, box.size/2, Bottom, Center, offset)
 			}
+			return
 		}
-		t.printAt(drawable, name, float32(coord.X), float32(coord.Y), float32(token.Size), float32(token.Size), Middle, Center, offset)
 	}
-	return nil
+	t.printAt(drawable, name, box.x, box.y, box.size, box.size, Middle, Center, offset)
+}
+
+// addTokenMarkings draws the wedge showing which way a token faces, and the badge showing its elevation.
+func (t *Tabula) addTokenMarkings(drawable draw.Image, token Token, box tokenBox, offset image.Point) {
+	if token.HasFacing {
+		t.addFacing(drawable, token, box, offset)
+	}
+	if token.Elevation != 0 {
+		t.addElevation(drawable, token, box, offset)
+	}
+}
+
+// ghostAlpha is the opacity hidden tokens are drawn at in GM views.
+const ghostAlpha = 0x70
+
+// addGhost draws a hidden token, and its markings, faintly.
+func (t *Tabula) addGhost(drawable draw.Image, ctx context.Context, arts *art.Loader, tokenName string, token Token, box tokenBox, offset image.Point) {
+	bounds := box.pixels(t.Dpi, offset).Intersect(drawable.Bounds())
+	if bounds.Empty() {
+		return
+	}
+
+	layer := image.NewRGBA(bounds)
+	t.addToken(layer, ctx, arts, tokenName, token, box, offset)
+	t.addTokenMarkings(layer, token, box, offset)
+	draw.DrawMask(drawable, bounds, layer, bounds.Min, image.NewUniform(color.Alpha{A: ghostAlpha}), image.Point{}, draw.Over)
+}
+
+// Shows reports whether `token` is shown: always in a GM view, and otherwise only if it isn't hidden. Whatever the
+// channel is told about the map goes by this, not just what's drawn; measurements, paths, cover, and so on leave out
+// tokens it doesn't show, lest their being there be given away.
+func (t *Tabula) Shows(token Token) bool {
+	return t.GM || !token.Hidden
+}
+
+// ShownTokens returns the tokens of `ctx` that are shown; see Shows.
+func (t *Tabula) ShownTokens(ctx context.Context) map[string]Token {
+	tokens := t.Tokens[ctx.Id()]
+	if t.GM {
+		return tokens
+	}
+	ret := map[string]Token{}
+	for name, token := range tokens {
+		if t.Shows(token) {
+			ret[name] = token
+		}
+	}
+	return ret
+}
+
+// portrait returns the portrait that the token `name` is drawn with in `ctx`, `px` pixels across, or nil if it has
+// none; or if there are no portraits to be had, as when `arts` is nil.
+func (t *Tabula) portrait(ctx context.Context, arts *art.Loader, name string, token Token, px int) image.Image {
+	if arts == nil {
+		return nil
+	}
+	a, err := arts.Find(ctx.Id(), token.Owner, name)
+	if err != nil {
+		log.Warningf("finding portrait of token %q: %s", name, err)
+		return nil
+	}
+	if a == nil {
+		return nil
+	}
+	img, err := a.Image(px, token.Color())
+	if err != nil {
+		log.Warningf("drawing portrait of token %q: %s", name, err)
+		return nil
+	}
+	return img
 }
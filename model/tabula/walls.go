@@ -0,0 +1,63 @@
+package tabula
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/model/wall"
+)
+
+func (t *Tabula) WithWalls(walls []wall.Wall) *Tabula {
+	t.Walls = make([]wall.Wall, len(walls))
+	copy(t.Walls, walls)
+	return t
+}
+
+func (t *Tabula) loadWalls(db anydb.AnyDb) error {
+	if t.Id == nil {
+		return errors.New("cannot load walls for tabula with nil ID")
+	}
+
+	res, err := db.Query("SELECT x1, y1, x2, y2, door, open FROM tabula_walls WHERE tabula_id=$1 ORDER BY idx", t.Id)
+	if err != nil {
+		return fmt.Errorf("querying tabula_walls: %s", err)
+	}
+	defer res.Close()
+
+	t.Walls = []wall.Wall{}
+	for res.Next() {
+		var w wall.Wall
+		if err := res.Scan(&w.A.X, &w.A.Y, &w.B.X, &w.B.Y, &w.Door, &w.Open); err != nil {
+			return fmt.Errorf("retrieving wall: %s", err)
+		}
+		t.Walls = append(t.Walls, w)
+	}
+	return nil
+}
+
+// saveWallsTx replaces all of the tabula's saved walls with those currently in t.Walls.
+func (t *Tabula) saveWallsTx(dialect string, tx *sql.Tx) error {
+	if t.Id == nil {
+		return errors.New("cannot save walls for tabula with nil ID")
+	}
+
+	if _, err := tx.Exec("DELETE FROM tabula_walls WHERE tabula_id=$1", t.Id); err != nil {
+		return fmt.Errorf("clearing old walls: %s", err)
+	}
+
+	add, err := tx.Prepare("INSERT INTO tabula_walls (tabula_id, idx, x1, y1, x2, y2, door, open) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
+	if err != nil {
+		return fmt.Errorf("error preparing ADD: %s", err)
+	}
+	defer add.Close()
+
+	for i, w := range t.Walls {
+		if _, err := add.Exec(t.Id, i, w.A.X, w.A.Y, w.B.X, w.B.Y, w.Door, w.Open); err != nil {
+			return fmt.Errorf("saving wall %d (%v-%v) on tabula %d: %s", i, w.A, w.B, t.Id, err)
+		}
+	}
+
+	return nil
+}
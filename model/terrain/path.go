@@ -0,0 +1,192 @@
+package terrain
+
+import (
+	"container/heap"
+	"github.com/pdbogen/mapbot/common/conv"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+)
+
+// margin is how many squares beyond the start and end a path may stray, looking for a way around.
+const margin = 20
+
+// maxReach is how many squares from where it starts Reachable looks for where a token could be, however far it may go.
+const maxReach = 100
+
+// state is where a path has got to: its square, and whether it has taken an odd number of diagonals.
+type state struct {
+	pt  image.Point
+	odd bool
+}
+
+type entry struct {
+	state
+	cost, estimate int
+	index          int
+}
+
+// queue holds the paths still to follow, cheapest estimate first.
+type queue []*entry
+
+func (q queue) Len() int { return len(q) }
+func (q queue) Less(i, j int) bool {
+	if q[i].estimate != q[j].estimate {
+		return q[i].estimate < q[j].estimate
+	}
+	return q[i].cost > q[j].cost
+}
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *queue) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+func (q *queue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+var steps = []image.Point{
+	{0, -1}, {1, -1}, {1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1},
+}
+
+// centre returns the middle of the square at `pt`, in grid units.
+func centre(pt image.Point) wall.Point {
+	return wall.Point{X: float64(pt.X) + 0.5, Y: float64(pt.Y) + 0.5}
+}
+
+// canStep reports whether a token `size` squares big can step from `from` to the adjacent `to`: none of the squares it
+// would cover are blocked, none of its squares cross a wall to get there, and a diagonal step doesn't cut the corner
+// of a blocked square.
+func (g Ground) canStep(from, to image.Point, size int, walls []wall.Wall) bool {
+	for _, sq := range footprint(to, size) {
+		if g[sq] == Blocked {
+			return false
+		}
+	}
+	d := to.Sub(from)
+	if d.X != 0 && d.Y != 0 {
+		for _, sq := range append(footprint(from.Add(image.Pt(d.X, 0)), size), footprint(from.Add(image.Pt(0, d.Y)), size)...) {
+			if g[sq] == Blocked {
+				return false
+			}
+		}
+	}
+	for _, sq := range footprint(from, size) {
+		a, b := centre(sq), centre(sq.Add(d))
+		for _, w := range walls {
+			if w.Blocks() && w.Crosses(a, b) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Path returns the cheapest way for a token `size` squares big to go from `from` to `to` without entering blocked
+// squares or crossing walls, as every square it steps through after `from`, and what the way costs, in feet. It returns
+// false if there's no way there.
+func (g Ground) Path(from, to image.Point, size int, walls []wall.Wall) ([]image.Point, int, bool) {
+	if size < 1 {
+		size = 1
+	}
+	if from == to {
+		return []image.Point{}, 0, true
+	}
+
+	bounds := image.Rectangle{Min: from, Max: from.Add(image.Pt(1, 1))}.
+		Union(image.Rectangle{Min: to, Max: to.Add(image.Pt(1, 1))}).
+		Inset(-margin)
+
+	start := state{pt: from}
+	came := map[state]state{}
+	best := map[state]int{start: 0}
+	q := &queue{{state: start, estimate: conv.Distance(from, to)}}
+
+	for q.Len() > 0 {
+		cur := heap.Pop(q).(*entry)
+		if cur.cost > best[cur.state] {
+			continue
+		}
+		if cur.pt == to {
+			path := []image.Point{}
+			for s := cur.state; s != start; s = came[s] {
+				path = append([]image.Point{s.pt}, path...)
+			}
+			return path, cur.cost, true
+		}
+
+		for _, d := range steps {
+			next := cur.pt.Add(d)
+			if !next.In(bounds) || !g.canStep(cur.pt, next, size, walls) {
+				continue
+			}
+			cost, odd := g.stepCost(cur.pt, next, size, cur.odd)
+			ns := state{pt: next, odd: odd}
+			if prev, ok := best[ns]; ok && prev <= cur.cost+cost {
+				continue
+			}
+			best[ns] = cur.cost + cost
+			came[ns] = cur.state
+			heap.Push(q, &entry{state: ns, cost: cur.cost + cost, estimate: cur.cost + cost + conv.Distance(next, to)})
+		}
+	}
+	return nil, 0, false
+}
+
+// Reachable returns where a token `size` squares big at `from` could be, as its top-left square, after moving no more
+// than `feet` feet without entering blocked squares or crossing walls, paying for difficult squares as Path does. It
+// looks no further than `maxReach` squares away.
+func (g Ground) Reachable(from image.Point, size, feet int, walls []wall.Wall) []image.Point {
+	if size < 1 {
+		size = 1
+	}
+
+	// Every step costs at least 5ft, so nothing further than feet/5 squares away can be reached.
+	squares := feet / 5
+	if squares > maxReach {
+		squares = maxReach
+	}
+	bounds := image.Rectangle{Min: from, Max: from.Add(image.Pt(1, 1))}.Inset(-squares)
+
+	start := state{pt: from}
+	best := map[state]int{start: 0}
+	reached := map[image.Point]bool{from: true}
+	ret := []image.Point{from}
+	q := &queue{{state: start}}
+
+	for q.Len() > 0 {
+		cur := heap.Pop(q).(*entry)
+		if cur.cost > best[cur.state] {
+			continue
+		}
+		if !reached[cur.pt] {
+			reached[cur.pt] = true
+			ret = append(ret, cur.pt)
+		}
+
+		for _, d := range steps {
+			next := cur.pt.Add(d)
+			if !next.In(bounds) || !g.canStep(cur.pt, next, size, walls) {
+				continue
+			}
+			cost, odd := g.stepCost(cur.pt, next, size, cur.odd)
+			if cur.cost+cost > feet {
+				continue
+			}
+			ns := state{pt: next, odd: odd}
+			if prev, ok := best[ns]; ok && prev <= cur.cost+cost {
+				continue
+			}
+			best[ns] = cur.cost + cost
+			heap.Push(q, &entry{state: ns, cost: cur.cost + cost, estimate: cur.cost + cost})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,105 @@
+// Package terrain models squares that are hard to move through, or impossible, and finds the way around them.
+package terrain
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Kind is how hard a square is to move through.
+type Kind string
+
+const (
+	// Open squares cost nothing extra; it's the same as no terrain at all.
+	Open Kind = ""
+	// Difficult squares, like rubble or undergrowth, cost double to enter.
+	Difficult Kind = "difficult"
+	// Blocked squares can't be entered at all.
+	Blocked Kind = "blocked"
+)
+
+var Kinds = []Kind{Difficult, Blocked}
+
+// ParseKind parses the name of a kind of terrain; `open` names no terrain at all.
+func ParseKind(s string) (Kind, error) {
+	s = strings.ToLower(s)
+	if s == "open" {
+		return Open, nil
+	}
+	for _, k := range Kinds {
+		if Kind(s) == k {
+			return k, nil
+		}
+	}
+	return Open, fmt.Errorf("unknown terrain %q; try difficult, blocked, or open", s)
+}
+
+// Ground is the terrain of each square of a map that has any.
+type Ground map[image.Point]Kind
+
+// footprint returns the squares covered by a token `size` squares big with its top-left square at `pt`.
+func footprint(pt image.Point, size int) []image.Point {
+	ret := make([]image.Point, 0, size*size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			ret = append(ret, pt.Add(image.Pt(x, y)))
+		}
+	}
+	return ret
+}
+
+// stepCost returns what it costs a token `size` squares big to step from `from` to the adjacent `to`, by the
+// Pathfinder rule that every other diagonal costs double; `odd` is whether an odd number of diagonals have been taken
+// so far. Entering any difficult square doubles the cost. It returns whether the next step starts with an odd number
+// of diagonals behind it.
+func (g Ground) stepCost(from, to image.Point, size int, odd bool) (int, bool) {
+	cost := 5
+	if from.X != to.X && from.Y != to.Y {
+		if odd {
+			cost = 10
+		}
+		odd = !odd
+	}
+
+	was := map[image.Point]bool{}
+	for _, sq := range footprint(from, size) {
+		was[sq] = true
+	}
+	for _, sq := range footprint(to, size) {
+		if !was[sq] && g[sq] == Difficult {
+			return cost * 2, odd
+		}
+	}
+	return cost, odd
+}
+
+// Cost returns what it costs a token `size` squares big to move through the squares `path`, in order. Where two of
+// them aren't next to one another, the token is taken to go diagonally first, then straight.
+func (g Ground) Cost(path []image.Point, size int) int {
+	if size < 1 {
+		size = 1
+	}
+	total := 0
+	odd := false
+	for i := 1; i < len(path); i++ {
+		for at := path[i-1]; at != path[i]; {
+			next := at.Add(image.Pt(sign(path[i].X-at.X), sign(path[i].Y-at.Y)))
+			var cost int
+			cost, odd = g.stepCost(at, next, size, odd)
+			total += cost
+			at = next
+		}
+	}
+	return total
+}
+
+func sign(v int) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return 0
+}
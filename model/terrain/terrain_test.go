@@ -0,0 +1,137 @@
+package terrain
+
+import (
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"testing"
+)
+
+func TestCost(t *testing.T) {
+	g := Ground{image.Pt(2, 0): Difficult}
+	type test struct {
+		path []image.Point
+		size int
+		feet int
+	}
+	tests := []test{
+		{[]image.Point{{0, 0}, {0, 3}}, 1, 15},
+		{[]image.Point{{0, 0}, {2, 2}}, 1, 15},
+		// The second square costs double.
+		{[]image.Point{{0, 0}, {3, 0}}, 1, 20},
+		// Diagonals alternate along the whole path, and double into difficult terrain.
+		{[]image.Point{{1, 1}, {2, 0}}, 1, 10},
+		{[]image.Point{{0, 2}, {1, 1}, {2, 0}}, 1, 25},
+		// A big token pays for difficult terrain under any of the squares it moves onto.
+		{[]image.Point{{0, 1}, {0, 0}}, 3, 10},
+	}
+	for i, test := range tests {
+		if feet := g.Cost(test.path, test.size); feet != test.feet {
+			t.Errorf("test %d: expected %v to cost %dft, got %dft", i, test.path, test.feet, feet)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	// A wall runs down the east side of column 3, ending at row 5, with a way round at the bottom.
+	walls := []wall.Wall{{A: wall.Point{X: 4, Y: -50}, B: wall.Point{X: 4, Y: 5}}}
+	g := Ground{}
+
+	path, feet, ok := g.Path(image.Pt(3, 0), image.Pt(4, 0), 1, walls)
+	if !ok {
+		t.Fatal("expected a way around the wall")
+	}
+	if path[len(path)-1] != image.Pt(4, 0) {
+		t.Errorf("expected the path to end at the goal, got %v", path)
+	}
+	for i, pt := range path {
+		prev := image.Pt(3, 0)
+		if i > 0 {
+			prev = path[i-1]
+		}
+		for _, w := range walls {
+			if w.Crosses(centre(prev), centre(pt)) {
+				t.Errorf("step %v -> %v crosses the wall", prev, pt)
+			}
+		}
+	}
+	if exp := g.Cost(append([]image.Point{{3, 0}}, path...), 1); feet != exp {
+		t.Errorf("expected the path to cost what it costs to walk, %dft, got %dft", exp, feet)
+	}
+	// Down five, across one, and up five; diagonals can't cut the wall's end.
+	if feet != 55 {
+		t.Errorf("expected the way around to be 55ft, got %dft: %v", feet, path)
+	}
+}
+
+func TestPathTerrain(t *testing.T) {
+	// A band of difficult terrain across the way, and a blocked square beyond it.
+	g := Ground{}
+	for x := -3; x <= 3; x++ {
+		g[image.Pt(x, 2)] = Difficult
+	}
+	g[image.Pt(0, 4)] = Blocked
+
+	path, feet, ok := g.Path(image.Pt(0, 0), image.Pt(0, 5), 1, nil)
+	if !ok {
+		t.Fatal("expected a path")
+	}
+	for _, pt := range path {
+		if g[pt] == Blocked {
+			t.Errorf("path %v enters blocked square %v", path, pt)
+		}
+	}
+	// Straight through the band costs 5 extra; going round it costs more.
+	if feet != 35 {
+		t.Errorf("expected 35ft, got %dft: %v", feet, path)
+	}
+
+	for x := -30; x <= 30; x++ {
+		g[image.Pt(x, 4)] = Blocked
+	}
+	if _, _, ok := g.Path(image.Pt(0, 0), image.Pt(0, 5), 1, nil); ok {
+		t.Error("expected no way through a wall of blocked squares")
+	}
+}
+
+func TestReachable(t *testing.T) {
+	// Blocked squares all round but for a gap to the north.
+	g := Ground{}
+	for _, d := range steps {
+		if d != image.Pt(0, -1) {
+			g[d] = Blocked
+		}
+	}
+	reached := map[image.Point]bool{}
+	for _, pt := range g.Reachable(image.Pt(0, 0), 1, 15, nil) {
+		reached[pt] = true
+	}
+	// North two, and then one more diagonally, but no further round than that.
+	for _, pt := range []image.Point{{0, 0}, {0, -1}, {0, -2}, {0, -3}, {1, -3}, {-1, -2}} {
+		if !reached[pt] {
+			t.Errorf("expected %v to be reachable", pt)
+		}
+	}
+	for _, pt := range []image.Point{{1, 0}, {2, -1}, {0, -4}, {2, -3}} {
+		if reached[pt] {
+			t.Errorf("expected %v to be out of reach", pt)
+		}
+	}
+
+	// However far a token may go, the search stops maxReach squares away.
+	side := 2*maxReach + 1
+	if n := len(Ground{}.Reachable(image.Pt(0, 0), 1, 1<<30, nil)); n != side*side {
+		t.Errorf("expected %d squares within %d of the start, got %d", side*side, maxReach, n)
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	if k, err := ParseKind("Difficult"); err != nil || k != Difficult {
+		t.Errorf("expected difficult, got %q, %v", k, err)
+	}
+	if k, err := ParseKind("open"); err != nil || k != Open {
+		t.Errorf("expected open, got %q, %v", k, err)
+	}
+	if _, err := ParseKind("lava"); err == nil {
+		t.Error("expected an error for lava")
+	}
+}
@@ -184,6 +184,19 @@ func Get(db anydb.AnyDb, id types.UserId) (*User, error) {
 	return user, nil
 }
 
+// Owns returns true if the map `id` is one of the user's own.
+func (u *User) Owns(id types.TabulaId) bool {
+	if u == nil {
+		return false
+	}
+	for _, t := range u.Tabulas {
+		if t.Id != nil && *t.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *User) TabulaByName(name tabula.TabulaName) (*tabula.Tabula, bool) {
 	if u == nil || u.Tabulas == nil {
 		return nil, false
@@ -0,0 +1,206 @@
+// Package uvtt reads the Universal VTT format (.dd2vtt, .df2vtt, .uvtt) exported by Dungeondraft, DungeonFog, and
+// similar tools: a JSON document carrying the map image along with its grid, walls, doors, and lights.
+package uvtt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/mapbot/model/tabula"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Extensions lists the file extensions commonly used for Universal VTT files.
+var Extensions = []string{".dd2vtt", ".df2vtt", ".uvtt"}
+
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type Resolution struct {
+	MapOrigin     Point   `json:"map_origin"`
+	MapSize       Point   `json:"map_size"`
+	PixelsPerGrid float64 `json:"pixels_per_grid"`
+}
+
+type Portal struct {
+	Position     Point   `json:"position"`
+	Bounds       []Point `json:"bounds"`
+	Rotation     float64 `json:"rotation"`
+	Closed       bool    `json:"closed"`
+	Freestanding bool    `json:"freestanding"`
+}
+
+type Light struct {
+	Position  Point   `json:"position"`
+	Range     float64 `json:"range"`
+	Intensity float64 `json:"intensity"`
+	Color     string  `json:"color"`
+	Shadows   bool    `json:"shadows"`
+}
+
+// File is a parsed Universal VTT document. All positions are in grid units.
+type File struct {
+	Format             float64    `json:"format"`
+	Resolution         Resolution `json:"resolution"`
+	LineOfSight        [][]Point  `json:"line_of_sight"`
+	ObjectsLineOfSight [][]Point  `json:"objects_line_of_sight"`
+	Portals            []Portal   `json:"portals"`
+	Lights             []Light    `json:"lights"`
+	Image              string     `json:"image"`
+}
+
+// Sniff reports whether `data` looks like a Universal VTT document rather than, say, an image.
+func Sniff(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{' && bytes.Contains(data, []byte(`"pixels_per_grid"`))
+}
+
+// HasExtension reports whether `name` ends in one of the usual Universal VTT extensions.
+func HasExtension(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range Extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func Parse(data []byte) (*File, error) {
+	f := &File{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("parsing universal VTT JSON: %s", err)
+	}
+	if f.Resolution.PixelsPerGrid <= 0 {
+		return nil, fmt.Errorf("pixels_per_grid must be positive, not %g", f.Resolution.PixelsPerGrid)
+	}
+	if f.Image == "" {
+		return nil, errors.New("file contains no image")
+	}
+	return f, nil
+}
+
+// ImageData returns the raw bytes of the embedded image, which is usually PNG or WebP.
+func (f *File) ImageData() ([]byte, error) {
+	enc := f.Image
+	// Some exporters produce a data URI rather than bare base64.
+	if i := strings.Index(enc, ";base64,"); i >= 0 && strings.HasPrefix(enc, "data:") {
+		enc = enc[i+len(";base64,"):]
+	}
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("decoding embedded image: %s", err)
+	}
+	return data, nil
+}
+
+// Walls returns every line-of-sight segment and portal, relative to the map origin. Portals become doors.
+func (f *File) Walls() []wall.Wall {
+	ret := []wall.Wall{}
+	for _, lines := range [][][]Point{f.LineOfSight, f.ObjectsLineOfSight} {
+		for _, poly := range lines {
+			for i := 1; i < len(poly); i++ {
+				a, b := f.point(poly[i-1]), f.point(poly[i])
+				if a == b {
+					continue
+				}
+				ret = append(ret, wall.Wall{A: a, B: b})
+			}
+		}
+	}
+	for _, p := range f.Portals {
+		if len(p.Bounds) < 2 {
+			continue
+		}
+		ret = append(ret, wall.Wall{
+			A:    f.point(p.Bounds[0]),
+			B:    f.point(p.Bounds[1]),
+			Door: true,
+			Open: !p.Closed,
+		})
+	}
+	return ret
+}
+
+// MapLights returns the map's light sources. Ranges are converted from squares to pathfinder feet.
+func (f *File) MapLights() []tabula.Light {
+	ret := []tabula.Light{}
+	for _, l := range f.Lights {
+		if l.Range <= 0 {
+			continue
+		}
+		p := f.point(l.Position)
+		ret = append(ret, tabula.Light{
+			X:      p.X,
+			Y:      p.Y,
+			Radius: int(math.Round(l.Range * 5)),
+			Color:  parseColor(l.Color),
+		})
+	}
+	return ret
+}
+
+// Tabula builds a new map from the file, with the grid already aligned, and returns it along with the image data that
+// should be stored as its background.
+func (f *File) Tabula(name, url string) (*tabula.Tabula, []byte, error) {
+	data, err := f.ImageData()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading embedded image: %s", err)
+	}
+	longest := cfg.Width
+	if cfg.Height > longest {
+		longest = cfg.Height
+	}
+	if longest == 0 {
+		return nil, nil, errors.New("embedded image is empty")
+	}
+
+	t, err := tabula.New(name, url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// DPI is measured against the background scaled so its longest side is tabula.ReferenceSize, and the image starts
+	// exactly at the map origin, so no offset is needed.
+	t.Dpi = float32(f.Resolution.PixelsPerGrid * tabula.ReferenceSize / float64(longest))
+	t.OffsetX = 0
+	t.OffsetY = 0
+	t.WithWalls(f.Walls())
+	t.WithLights(f.MapLights())
+	return t, data, nil
+}
+
+func (f *File) point(p Point) wall.Point {
+	return wall.Point{X: p.X - f.Resolution.MapOrigin.X, Y: p.Y - f.Resolution.MapOrigin.Y}
+}
+
+// parseColor reads the hex colors found in universal VTT files, which are either RRGGBB or AARRGGBB. Anything else is
+// treated as white.
+func parseColor(s string) color.NRGBA {
+	s = strings.TrimPrefix(s, "#")
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{255, 255, 255, 255}
+	}
+	switch len(s) {
+	case 6:
+		return color.NRGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 255}
+	case 8:
+		return color.NRGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), uint8(n >> 24)}
+	}
+	return color.NRGBA{255, 255, 255, 255}
+}
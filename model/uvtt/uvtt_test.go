@@ -0,0 +1,94 @@
+package uvtt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/pdbogen/mapbot/model/wall"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testFile(t *testing.T, w, h int) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return []byte(fmt.Sprintf(`{
+		"format": 0.3,
+		"resolution": {"map_origin": {"x": 1, "y": 2}, "map_size": {"x": 10, "y": 5}, "pixels_per_grid": 100},
+		"line_of_sight": [[{"x": 1, "y": 2}, {"x": 4, "y": 2}, {"x": 4, "y": 4}]],
+		"objects_line_of_sight": [],
+		"portals": [{"position": {"x": 5, "y": 2}, "bounds": [{"x": 4.5, "y": 2}, {"x": 5.5, "y": 2}], "closed": false}],
+		"lights": [{"position": {"x": 3.5, "y": 3.5}, "range": 4, "intensity": 1, "color": "80ff8000"}],
+		"image": %q
+	}`, base64.StdEncoding.EncodeToString(buf.Bytes())))
+}
+
+func TestSniff(t *testing.T) {
+	if !Sniff(testFile(t, 1000, 500)) {
+		t.Fatal("expected test file to sniff as universal VTT")
+	}
+	if Sniff([]byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatal("PNG header should not sniff as universal VTT")
+	}
+}
+
+func TestTabula(t *testing.T) {
+	f, err := Parse(testFile(t, 1000, 500))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tab, img, err := f.Tabula("test", "raw:test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(img) == 0 {
+		t.Fatal("expected image data")
+	}
+
+	// 100 pixels per grid, in a 1000px wide image scaled up to 2000px.
+	if tab.Dpi != 200 {
+		t.Errorf("expected 200 DPI, got %f", tab.Dpi)
+	}
+
+	walls := []wall.Wall{
+		{A: wall.Point{X: 0, Y: 0}, B: wall.Point{X: 3, Y: 0}},
+		{A: wall.Point{X: 3, Y: 0}, B: wall.Point{X: 3, Y: 2}},
+		{A: wall.Point{X: 3.5, Y: 0}, B: wall.Point{X: 4.5, Y: 0}, Door: true, Open: true},
+	}
+	if len(tab.Walls) != len(walls) {
+		t.Fatalf("expected %d walls, got %d: %v", len(walls), len(tab.Walls), tab.Walls)
+	}
+	for i, w := range walls {
+		if tab.Walls[i] != w {
+			t.Errorf("wall %d: expected %+v, got %+v", i, w, tab.Walls[i])
+		}
+	}
+
+	if len(tab.Lights) != 1 {
+		t.Fatalf("expected one light, got %d", len(tab.Lights))
+	}
+	l := tab.Lights[0]
+	if l.X != 2.5 || l.Y != 1.5 || l.Radius != 20 || l.Color != (color.NRGBA{255, 128, 0, 128}) {
+		t.Errorf("unexpected light %+v", l)
+	}
+	if sq := l.Square(); sq != image.Pt(2, 1) {
+		t.Errorf("expected light in square (2,1), got %v", sq)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"resolution": {"pixels_per_grid": 0}, "image": "AAAA"}`,
+		`{"resolution": {"pixels_per_grid": 50}}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expected error parsing %q", data)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Package wall models line-of-sight barriers placed on a map. Unlike marks, walls are not tied to a context; they
+// belong to the map itself, like its grid.
+package wall
+
+import (
+	"fmt"
+	"math"
+)
+
+// Point is a position in grid units. (0,0) is the north-west corner of the square A1, and (1,1) is its south-east
+// corner.
+type Point struct {
+	X, Y float64
+}
+
+func (p Point) String() string {
+	return fmt.Sprintf("(%.2f,%.2f)", p.X, p.Y)
+}
+
+// Wall is a single straight segment between A and B. A door is a wall that may be opened; open doors block nothing.
+type Wall struct {
+	A, B Point
+	Door bool
+	Open bool
+}
+
+// Blocks reports whether the wall currently blocks movement and sight.
+func (w Wall) Blocks() bool {
+	return !w.Door || !w.Open
+}
+
+// Length returns the length of the wall in grid units.
+func (w Wall) Length() float64 {
+	return math.Hypot(w.B.X-w.A.X, w.B.Y-w.A.Y)
+}
+
+// Crosses reports whether the segment from `a` to `b` crosses the wall, or touches it.
+func (w Wall) Crosses(a, b Point) bool {
+	o1, o2 := orientation(w.A, w.B, a), orientation(w.A, w.B, b)
+	o3, o4 := orientation(a, b, w.A), orientation(a, b, w.B)
+	if o1*o2 < 0 && o3*o4 < 0 {
+		return true
+	}
+	return o1 == 0 && within(w.A, w.B, a) || o2 == 0 && within(w.A, w.B, b) ||
+		o3 == 0 && within(a, b, w.A) || o4 == 0 && within(a, b, w.B)
+}
+
+// orientation returns 1 if `c` is clockwise of the line from `a` to `b`, -1 if it's anticlockwise, and 0 if it's on it.
+func orientation(a, b, c Point) int {
+	v := (b.X-a.X)*(c.Y-a.Y) - (b.Y-a.Y)*(c.X-a.X)
+	switch {
+	case v > 1e-9:
+		return 1
+	case v < -1e-9:
+		return -1
+	}
+	return 0
+}
+
+// within reports whether `c`, which is on the line through `a` and `b`, is between them.
+func within(a, b, c Point) bool {
+	return math.Min(a.X, b.X)-1e-9 <= c.X && c.X <= math.Max(a.X, b.X)+1e-9 &&
+		math.Min(a.Y, b.Y)-1e-9 <= c.Y && c.Y <= math.Max(a.Y, b.Y)+1e-9
+}
@@ -4,15 +4,17 @@ import (
 	"embed"
 	"errors"
 	"fmt"
-	"image/png"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pdbogen/mapbot/common/db/anydb"
 	mbLog "github.com/pdbogen/mapbot/common/log"
+	"github.com/pdbogen/mapbot/common/output"
 	"github.com/pdbogen/mapbot/hub"
 	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/render"
 	"github.com/pdbogen/mapbot/model/tabula"
 	"github.com/pdbogen/mapbot/model/webSession"
 )
@@ -43,6 +45,8 @@ func New(db anydb.AnyDb, hub *hub.Hub, prov *context.ContextProvider, prefix str
 	mux := http.NewServeMux()
 	mux.Handle("/", http.FileServer(http.FS(assets)))
 	mux.HandleFunc("/map", ret.GetMap)
+	mux.HandleFunc("/map.svg", ret.GetMapSVG)
+	mux.HandleFunc("/background", ret.GetBackground)
 	mux.HandleFunc("/ws", ret.WebSocket)
 	ret.mux = mux
 	return ret
@@ -144,37 +148,89 @@ func (h *Http) sendMapUpdate(ctx context.Context, conn *websocket.Conn) error {
 	return conn.WriteJSON(map[string]string{"cmd": "update"})
 }
 
-func (h *Http) GetMap(rw http.ResponseWriter, req *http.Request) {
+// activeMap returns the context of the session in `req`, and the map active in it. If either can't be found, it writes
+// a response and returns false.
+func (h *Http) activeMap(rw http.ResponseWriter, req *http.Request) (context.Context, *tabula.Tabula, bool) {
 	sess, ok := h.GetSession(rw, req)
 	if !ok {
-		return
+		return nil, nil, false
 	}
 	ctx, err := sess.GetContext(h.prov)
 	if err != nil {
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		log.Errorf("retrieving context for session %v: %v", sess, err)
-		return
+		return nil, nil, false
 	}
 
 	tabId := ctx.GetActiveTabulaId()
 	if tabId == nil {
 		fmt.Fprintln(rw, "No active map.")
-		return
+		return nil, nil, false
 	}
 
 	tab, err := tabula.Load(h.db, *tabId)
 	if err != nil {
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		log.Errorf("loading tabula with id %q: %v", *tabId, err)
+		return nil, nil, false
+	}
+	return ctx, tab, true
+}
+
+func (h *Http) GetMap(rw http.ResponseWriter, req *http.Request) {
+	ctx, tab, ok := h.activeMap(rw, req)
+	if !ok {
 		return
 	}
+	tabId := tab.Id
 
-	img, err := tab.Render(ctx, nil)
+	img, err := render.Default.Share(ctx, tab, nil)
 	if err != nil {
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		log.Errorf("loading tabula bg with id %q: %v", *tabId, err)
 		return
 	}
 
-	png.Encode(rw, img)
+	enc, err := output.Encode(img, ctx.GetOutput())
+	if err != nil {
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		log.Errorf("encoding map %q: %v", *tabId, err)
+		return
+	}
+	rw.Header().Set("Content-Type", enc.Format.ContentType())
+	rw.Write(enc.Data)
+}
+
+// GetMapSVG serves the map as an SVG overlay, over a background served separately by GetBackground.
+func (h *Http) GetMapSVG(rw http.ResponseWriter, req *http.Request) {
+	ctx, tab, ok := h.activeMap(rw, req)
+	if !ok {
+		return
+	}
+
+	doc, err := tab.SVG(ctx, "background?id="+url.QueryEscape(req.FormValue("id")))
+	if err != nil {
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		log.Errorf("rendering svg of tabula %q: %v", *tab.Id, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "image/svg+xml")
+	rw.Write(doc)
+}
+
+// GetBackground serves the active map's background image, as it was originally uploaded.
+func (h *Http) GetBackground(rw http.ResponseWriter, req *http.Request) {
+	_, tab, ok := h.activeMap(rw, req)
+	if !ok {
+		return
+	}
+
+	data, err := tab.RawData(h.db)
+	if err != nil {
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		log.Errorf("retrieving background of tabula %q: %v", *tab.Id, err)
+		return
+	}
+	rw.Header().Set("Content-Type", http.DetectContentType(data))
+	rw.Write(data)
 }
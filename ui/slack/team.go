@@ -1,26 +1,29 @@
 package slack
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/pdbogen/mapbot/common/db"
 	"github.com/pdbogen/mapbot/common/db/anydb"
+	"github.com/pdbogen/mapbot/common/output"
 	"github.com/pdbogen/mapbot/hub"
+	"github.com/pdbogen/mapbot/model/attachment"
+	"github.com/pdbogen/mapbot/model/bundle"
 	"github.com/pdbogen/mapbot/model/context"
+	"github.com/pdbogen/mapbot/model/render"
 	"github.com/pdbogen/mapbot/model/tabula"
 	"github.com/pdbogen/mapbot/model/types"
 	"github.com/pdbogen/mapbot/model/user"
+	"github.com/pdbogen/mapbot/model/uvtt"
 	"github.com/pdbogen/mapbot/model/workflow"
 	slackContext "github.com/pdbogen/mapbot/ui/slack/context"
 	"github.com/slack-go/slack"
 	"image"
-	"image/png"
 	"io/ioutil"
 	"math/rand"
-	"mime"
 	"net/http"
-	"os"
 	"reflect"
 	"regexp"
 	"strings"
@@ -124,7 +127,7 @@ func (t *Team) updateEmoji() {
 		return
 	}
 	if t.EmojiCache == nil {
-		log.Debugf("initializing emoji cache for team %s", t)
+		log.Debugf("initializing emoji cache for team %s", t.Info.ID)
 		t.EmojiCache = map[string]image.Image{}
 	} else {
 		for name := range t.EmojiCache {
@@ -255,9 +258,9 @@ func (t *Team) handleMessage(event slack.RTMEvent) {
 		return
 	}
 
-	// Accept maps uploaded via DM
+	// Accept maps, and token portraits, uploaded via DM
 	if msg.Upload && len(msg.Files) > 0 && msg.Channel[0] == 'D' {
-		t.handleUpload(u, msg)
+		t.handleUpload(u, msg, argv)
 		return
 	}
 
@@ -315,15 +318,31 @@ func (t *Team) Send(h *hub.Hub, c *hub.Command) {
 		if err != nil {
 			log.Errorf("%s: error posting message %q to channel %q: %s", t.Info.ID, msg, comps[4], err)
 		}
+	case *hub.Private:
+		if len(comps) < 6 {
+			log.Errorf("%s: received private message via %s, but it names no user", t.Info.ID, c.Type)
+			return
+		}
+		t.sendPrivate(h, c, channel, comps[5], msg.Payload)
 	case *workflow.WorkflowMessage:
 		log.Debugf("got a workflow message via %s, but can deal..", c.Type)
 		t.sendWorkflowMessage(h, c, msg)
+	case *attachment.Attachment:
+		if err := t.uploadFile(msg, []string{channel}); err != nil {
+			log.Errorf("%s: error uploading %q: %s", t.Info.ID, msg.Filename, err)
+			t.Send(h, c.WithPayload(fmt.Sprintf("error uploading %s: %s", msg.Filename, err)))
+		}
 	case *tabula.Tabula:
 		repErr := func(ctx string, err error) {
 			log.Errorf("%s: error %s image %q: %s", t.Info.ID, ctx, msg.Name, err)
 			t.Send(h, c.WithPayload(fmt.Sprintf("error %s map %q: %s", ctx, msg.Name, err)))
 		}
-		img, err := msg.Render(t.Context(channel), func(msg string) { t.Send(h, c.WithPayload(msg)) })
+		ctx := t.Context(channel)
+		img, superseded, err := render.Default.Render(ctx, msg, func(msg string) { t.Send(h, c.WithPayload(msg)) })
+		if superseded {
+			log.Debugf("%s: not uploading map %q, since a newer render was requested", t.Info.ID, msg.Name)
+			return
+		}
 		if err != nil {
 			repErr("rendering", err)
 			return
@@ -336,34 +355,63 @@ func (t *Team) Send(h *hub.Hub, c *hub.Command) {
 			return
 		}
 
-		if _, err := t.uploadImage(msg.Note, img, []string{channel}); err != nil {
+		if _, err := t.uploadImage(msg.Note, img, ctx.GetOutput(), []string{channel}); err != nil {
 			repErr("uploading", err)
 			return
 		}
 	}
 }
 
-func (t *Team) uploadImage(title string, img image.Image, channels []string) (string, error) {
-	repErr := func(s string, e error) error { return fmt.Errorf("%s: %s", s, e) }
-	buf, err := ioutil.TempFile("", "")
+// sendPrivate sends `payload` to `userId` in a direct message. Maps are rendered as they're seen in `channel`.
+func (t *Team) sendPrivate(h *hub.Hub, c *hub.Command, channel, userId string, payload interface{}) {
+	im, _, _, err := t.botClient.OpenConversation(&slack.OpenConversationParameters{Users: []string{userId}})
 	if err != nil {
-		return "", repErr("opening tmpfile for", err)
+		log.Errorf("%s: error opening direct message with %s: %s", t.Info.ID, userId, err)
+		t.Send(h, c.WithPayload(fmt.Sprintf("I couldn't send you a direct message: %s", err)))
+		return
+	}
+	dm := c.WithType(hub.CommandType(fmt.Sprintf("internal:send:slack:%s:%s:%s", t.Info.ID, im.ID, userId)))
+
+	tab, ok := payload.(*tabula.Tabula)
+	if !ok {
+		t.Send(h, dm.WithPayload(payload))
+		return
 	}
 
-	err = png.Encode(buf, img)
-	buf.Close()
+	// This is rendered here, rather than by the scheduler, so that it's never mixed up with the channel's own renders.
+	ctx := t.Context(channel)
+	img, err := tab.Render(ctx, func(msg string) { t.Send(h, dm.WithPayload(msg)) })
+	if err != nil {
+		log.Errorf("%s: error rendering image %q: %s", t.Info.ID, tab.Name, err)
+		t.Send(h, dm.WithPayload(fmt.Sprintf("error rendering map %q: %s", tab.Name, err)))
+		return
+	}
+	if _, err := t.uploadImage(tab.Note, img, ctx.GetOutput(), []string{im.ID}); err != nil {
+		log.Errorf("%s: error uploading image %q: %s", t.Info.ID, tab.Name, err)
+		t.Send(h, dm.WithPayload(fmt.Sprintf("error uploading map %q: %s", tab.Name, err)))
+	}
+}
+
+func (t *Team) uploadImage(title string, img image.Image, opts output.Options, channels []string) (string, error) {
+	repErr := func(s string, e error) error { return fmt.Errorf("%s: %s", s, e) }
+
+	enc, err := output.Encode(img, opts)
 	if err != nil {
 		return "", repErr("encoding", err)
 	}
+	if opts.Budget > 0 {
+		log.Debugf("%s: map %q sent as %s at %.0f%% scale, %s of a %s budget", t.Info.ID, title, enc.Format,
+			enc.Scale*100, output.FormatSize(len(enc.Data)), output.FormatSize(opts.Budget))
+	}
 
 	upload, err := t.botClient.UploadFile(
 		slack.FileUploadParameters{
 			Title:    title,
-			Filetype: mime.TypeByExtension(".png"),
+			Filename: "map" + enc.Format.Extension(),
+			Filetype: "auto",
+			Reader:   bytes.NewReader(enc.Data),
 			Channels: channels,
-			File:     buf.Name(),
 		})
-	os.Remove(buf.Name())
 	if err != nil {
 		return "", repErr("uploading", err)
 	}
@@ -371,6 +419,18 @@ func (t *Team) uploadImage(title string, img image.Image, channels []string) (st
 	return upload.URLPrivate, nil
 }
 
+func (t *Team) uploadFile(a *attachment.Attachment, channels []string) error {
+	_, err := t.botClient.UploadFile(
+		slack.FileUploadParameters{
+			Title:    a.Title,
+			Filename: a.Filename,
+			Filetype: "auto",
+			Reader:   bytes.NewReader(a.Data),
+			Channels: channels,
+		})
+	return err
+}
+
 func (t *Team) Context(ChannelId string) context.Context {
 	ret := &slackContext.SlackContext{
 		Emoji:      t.Emoji,
@@ -384,7 +444,9 @@ func (t *Team) Context(ChannelId string) context.Context {
 	return ret
 }
 
-func (t *Team) handleUpload(user *user.User, msg *slack.MessageEvent) {
+// handleUpload adds an uploaded map; or, if the upload's comment is `token art <name> ...`, makes the upload the
+// uploader's portrait for that token.
+func (t *Team) handleUpload(user *user.User, msg *slack.MessageEvent, argv []string) {
 	file := msg.Files[0]
 
 	req, err := http.NewRequest("GET", file.URLPrivateDownload, nil)
@@ -407,13 +469,44 @@ func (t *Team) handleUpload(user *user.User, msg *slack.MessageEvent) {
 		return
 	}
 
+	if len(argv) >= 3 && strings.ToLower(argv[0]) == "token" && strings.ToLower(argv[1]) == "art" {
+		args := argv[1:]
+		mine := false
+		for _, arg := range args {
+			mine = mine || strings.ToLower(arg) == "mine"
+		}
+		// A DM isn't a channel anyone plays in, so portraits uploaded there are the user's own.
+		if !mine {
+			args = append(args, "mine")
+		}
+		t.hub.Publish(&hub.Command{
+			From:    fmt.Sprintf("internal:send:slack:%s:%s:%s", t.Info.ID, msg.Channel, user.Id),
+			Type:    "user:token",
+			Payload: args,
+			User:    user,
+			Context: t.Context(msg.Channel),
+			Data:    data,
+		})
+		return
+	}
+
+	// Mapbot exports and universal VTT files carry their own grid (and more), so they're imported rather than added as
+	// images.
+	subcommand := "add"
+	if uvtt.HasExtension(file.Name) || uvtt.Sniff(data) || bundle.Sniff(data) {
+		subcommand = "import"
+		for _, ext := range append([]string{bundle.Extension}, uvtt.Extensions...) {
+			file.Name = strings.TrimSuffix(strings.ToLower(file.Name), ext)
+		}
+	}
+
 	sum := sha256.Sum256(data)
 	nonalnum := regexp.MustCompile(`[^a-z0-9]`)
 	file.Name = nonalnum.ReplaceAllString(strings.ToLower(file.Name), "-")
 	t.hub.Publish(&hub.Command{
 		From:    fmt.Sprintf("internal:send:slack:%s:%s:%s", t.Info.ID, msg.Channel, user.Id),
 		Type:    "user:map",
-		Payload: []string{"add", "@" + file.Name, "raw:" + hex.EncodeToString(sum[:])},
+		Payload: []string{subcommand, "@" + file.Name, "raw:" + hex.EncodeToString(sum[:])},
 		User:    user,
 		Context: t.Context("@mapbot"),
 		Data:    data,